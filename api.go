@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error(err)
+	}
+}
+
+// rebalancesHandler reports per room how many receivers rebalances renegotiated or skipped
+func rebalancesHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, rooms.RebalanceStats())
+	}
+}
+
+// statsHandler lists the live statistics of the tracks and of the legs
+// sending them to receivers
+func statsHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, rooms.Stats())
+	}
+}
+
+func receiversHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, rooms.Receivers())
+	}
+}
+
+// pinReceiverHandler forces a track or the tracks of a publisher onto a
+// receiver of the room, whatever the distribution
+func pinReceiverHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		receiverID, err := uuid.Parse(chi.URLParam(r, "receiverID"))
+		if err != nil {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown receiver")
+			return
+		}
+		pin := hub.Pin{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&pin); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Expected a JSON object with a track or a publisher")
+			return
+		}
+		if err := b.Pin(receiverID, pin); err != nil {
+			writeReceiverProblem(w, r, err)
+			return
+		}
+		logger.Infow("Receiver pinned", "receiverID", receiverID, "track", pin.Track, "publisher", pin.Publisher)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// unpinReceiverHandler removes the pins of a receiver of the room
+func unpinReceiverHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		receiverID, err := uuid.Parse(chi.URLParam(r, "receiverID"))
+		if err != nil {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown receiver")
+			return
+		}
+		if err := b.Unpin(receiverID); err != nil {
+			writeReceiverProblem(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type trackRequest struct {
+	// Track is the stream ID followed by the track ID
+	Track string `json:"track"`
+}
+
+// pauseTrackHandler pauses or resumes forwarding a track to a receiver of the room
+func pauseTrackHandler(rooms *Rooms, pause bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		receiverID, err := uuid.Parse(chi.URLParam(r, "receiverID"))
+		if err != nil {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown receiver")
+			return
+		}
+		request := trackRequest{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&request); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Expected a JSON object with a track")
+			return
+		}
+		if pause {
+			err = b.PauseTrack(receiverID, request.Track)
+		} else {
+			err = b.ResumeTrack(receiverID, request.Track)
+		}
+		if err != nil {
+			writeReceiverProblem(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type trackPriorityRequest struct {
+	// Track is the stream ID followed by the track ID
+	Track string `json:"track"`
+	High  bool   `json:"high"`
+}
+
+// trackPriorityHandler marks a video track of the room as high-priority, for
+// the receivers that negotiated FlexFEC to get it with forward error
+// correction
+func trackPriorityHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		request := trackPriorityRequest{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&request); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Expected a JSON object with a track and high")
+			return
+		}
+		if err := b.SetTrackPriority(request.Track, request.High); err != nil {
+			if errors.Is(err, hub.ErrUnknownTrack) {
+				writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown track")
+				return
+			}
+			writeProblem(w, r, http.StatusServiceUnavailable, ProblemInternal, err.Error())
+			return
+		}
+		logger.Infow("Track priority changed", "track", request.Track, "high", request.High)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// programHandler reports the program of the room in program mode
+func programHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		state, ok := b.ProgramState()
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Program mode is not enabled")
+			return
+		}
+		writeJSON(w, r, state)
+	}
+}
+
+// switchProgramHandler puts another track on air, receivers see it from its
+// next keyframe
+func switchProgramHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		request := hub.ProgramState{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&request); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Expected a JSON object with the source track")
+			return
+		}
+		if err := b.SwitchProgram(request.Source); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, err.Error())
+			return
+		}
+		logger.Infow("Program switched", "source", request.Source)
+		state, _ := b.ProgramState()
+		writeJSON(w, r, state)
+	}
+}
+
+// roomEventsHandler streams the events of the room as server-sent events,
+// the event query parameters restrict which are sent
+func roomEventsHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		filter := make(map[string]bool)
+		for _, event := range r.URL.Query()["event"] {
+			filter[event] = true
+		}
+		serveEventStream(w, r, b.Events(), filter)
+	}
+}
+
+func writeReceiverProblem(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, hub.ErrUnknownReceiver) {
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown receiver")
+		return
+	}
+	writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, err.Error())
+}
+
+type distributionState struct {
+	Name      string   `json:"name"`
+	Available []string `json:"available,omitempty"`
+}
+
+// distributionHandler reports the distribution of the room and the ones it can switch to
+func distributionHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		writeJSON(w, r, distributionState{Name: b.DistributionName(), Available: hub.DistributionNames()})
+	}
+}
+
+// setDistributionHandler switches the distribution of the room, its
+// receivers are rebalanced right away
+func setDistributionHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		state := distributionState{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&state); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Expected a JSON object with the distribution name")
+			return
+		}
+		if err := b.UseDistribution(state.Name); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, err.Error())
+			return
+		}
+		logger.Infow("Distribution changed", "distribution", state.Name)
+		writeJSON(w, r, distributionState{Name: b.DistributionName(), Available: hub.DistributionNames()})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// ScopeCompliance grants access to decrypted media of designated streams
+	ScopeCompliance = "compliance"
+	// ScopeAdmin grants access to the hub inspection and control API
+	ScopeAdmin = "admin"
+	// ScopePublish grants publishing with the RTMP and SRT ingests
+	ScopePublish = "publish"
+)
+
+// authorizeScope tells whether token grants scope, for the ingests that
+// carry it outside of an Authorization header
+func authorizeScope(tokens tokenScopesFlag, scope string) func(token string) bool {
+	return func(token string) bool {
+		return token != "" && tokens[token][scope]
+	}
+}
+
+func RequireScope(tokens tokenScopesFlag, scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" || token == r.Header.Get("Authorization") {
+				w.Header().Add("WWW-Authenticate", "Bearer")
+				writeProblem(w, r, http.StatusUnauthorized, ProblemUnauthorized, "Missing bearer token")
+				return
+			}
+			scopes, ok := tokens[token]
+			if !ok {
+				logger.Warnw("Rejected unknown API token", "scope", scope)
+				writeProblem(w, r, http.StatusUnauthorized, ProblemUnauthorized, "Unknown bearer token")
+				return
+			}
+			if !scopes[scope] {
+				logger.Warnw("API token lacks required scope", "scope", scope)
+				writeProblem(w, r, http.StatusForbidden, ProblemForbidden, "Token lacks the "+scope+" scope")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const capabilitiesRel = "urn:webrtc-hub:ext:capabilities"
+
+// Capabilities are the optional hub features advertised to WHIP/WHEP
+// clients so they can shape their offers instead of guessing.
+type Capabilities struct {
+	Audio         bool
+	Simulcast     bool
+	Recording     bool
+	Replay        bool
+	ServerTrickle bool
+	Codecs        []string
+}
+
+// WriteHeaders advertises the capabilities as structured field headers
+// (RFC 8941), the Link header points clients at their meaning
+func (c Capabilities) WriteHeaders(w http.ResponseWriter) {
+	w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"%s\"", capabilitiesRel, capabilitiesRel))
+	w.Header().Set("X-Hub-Capabilities", strings.Join([]string{
+		"audio=" + sfBool(c.Audio),
+		"simulcast=" + sfBool(c.Simulcast),
+		"recording=" + sfBool(c.Recording),
+		"replay=" + sfBool(c.Replay),
+		"server-trickle=" + sfBool(c.ServerTrickle),
+	}, ", "))
+	codecs := make([]string, 0, len(c.Codecs))
+	for _, codec := range c.Codecs {
+		codecs = append(codecs, fmt.Sprintf("%q", codec))
+	}
+	w.Header().Set("X-Hub-Codecs", strings.Join(codecs, ", "))
+}
+
+func sfBool(b bool) string {
+	if b {
+		return "?1"
+	}
+	return "?0"
+}
+
+// optionsHandler answers WHIP/WHEP OPTIONS requests with the capabilities
+func optionsHandler(capabilities Capabilities) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", "OPTIONS, POST")
+		w.Header().Set("Accept-Post", "application/sdp")
+		capabilities.WriteHeaders(w)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxChatNameLength bounds the display name of chat messages
+	maxChatNameLength = 64
+	// signalingErrorRateLimited is the code of the error events of senders
+	// chatting too fast
+	signalingErrorRateLimited = "rate-limited"
+)
+
+// chatOptions configure the chat relayed over the signaling, a nil Limiter
+// disables it
+type chatOptions struct {
+	Limiter   *ipRateLimiter
+	MaxLength int
+}
+
+// chatRequest is the data of the chat events sent by receivers and by the
+// publishers over their chat data channel
+type chatRequest struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+// message validates a chat request of sender and rate limits it, problems
+// are returned as *signalingError
+func (o chatOptions) message(sender uuid.UUID, data []byte) (hub.ChatMessage, error) {
+	if o.Limiter == nil {
+		return hub.ChatMessage{}, &signalingError{Event: "chat", Code: signalingErrorUnknownEvent, Detail: "chat is disabled"}
+	}
+	request := chatRequest{}
+	if err := json.Unmarshal(data, &request); err != nil {
+		return hub.ChatMessage{}, invalidMessage("chat", "data is not a valid JSON document for the event")
+	}
+	request.Text = strings.TrimSpace(request.Text)
+	switch {
+	case request.Text == "":
+		return hub.ChatMessage{}, invalidMessage("chat", "text is missing")
+	case len(request.Text) > o.MaxLength:
+		return hub.ChatMessage{}, invalidMessage("chat", "text too long")
+	case len(request.Name) > maxChatNameLength:
+		return hub.ChatMessage{}, invalidMessage("chat", "name too long")
+	case !utf8.ValidString(request.Text) || !utf8.ValidString(request.Name):
+		return hub.ChatMessage{}, invalidMessage("chat", "text and name must be UTF-8")
+	}
+	if ok, _ := o.Limiter.allow(sender.String()); !ok {
+		return hub.ChatMessage{}, &signalingError{Event: "chat", Code: signalingErrorRateLimited, Detail: "too many chat messages"}
+	}
+	if request.Name == "" {
+		request.Name = "anonymous"
+	}
+	return hub.ChatMessage{From: request.Name, Text: request.Text, Time: time.Now()}, nil
+}
+
+// onPublisherChat relays the messages of the chat data channel a publisher
+// opened and gets the room chat over it
+func (o chatOptions) onPublisherChat(b *hub.Broadcaster, publisher uuid.UUID, channel *webrtc.DataChannel, logger *zap.SugaredLogger) {
+	if o.Limiter == nil || !b.AttachPublisherChat(publisher, channel) {
+		return
+	}
+	channel.OnMessage(func(raw webrtc.DataChannelMessage) {
+		message, err := o.message(publisher, raw.Data)
+		if err != nil {
+			logger.Infow("Rejected publisher chat message", "publisherID", publisher, "error", err)
+			return
+		}
+		b.Chat(message)
+	})
+}
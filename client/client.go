@@ -0,0 +1,381 @@
+// Package client joins a webrtc-hub as a receiver over its websocket
+// signaling protocol, so bots, recorders and monitoring agents do not have
+// to reimplement the offer/answer/candidate handling of index.html.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"nhooyr.io/websocket"
+)
+
+// Subprotocol is the version of the hub signaling protocol the client speaks
+const Subprotocol = "webRTCBroadcast.v1"
+
+// Message is a signaling message, Data holds a JSON document encoded as a string
+type Message struct {
+	Event string `json:"event"`
+	Data  string `json:"data"`
+}
+
+type ReconnectBackoff struct {
+	Initial    float64 `json:"initial"`
+	Max        float64 `json:"max"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+// ReconnectHint is sent by the hub right before it drops the receiver
+type ReconnectHint struct {
+	Reason     string           `json:"reason"`
+	RetryAfter float64          `json:"retryAfter"`
+	Backoff    ReconnectBackoff `json:"backoff"`
+	Alternates []string         `json:"alternates,omitempty"`
+}
+
+// ReconnectError is returned by Run when the hub asked the client to reconnect
+type ReconnectError struct {
+	Hint ReconnectHint
+}
+
+func (e *ReconnectError) Error() string {
+	return fmt.Sprintf("hub asked to reconnect: %s", e.Hint.Reason)
+}
+
+// RetryAfter is how long to wait before reconnecting
+func (e *ReconnectError) RetryAfter() time.Duration {
+	return time.Duration(e.Hint.RetryAfter * float64(time.Second))
+}
+
+type Options struct {
+	// Header is sent with the websocket handshake, e.g. for authentication
+	Header http.Header
+	// Configuration of the receiving PeerConnection
+	Configuration webrtc.Configuration
+	// API used to create the PeerConnection, the default one when nil
+	API *webrtc.API
+	// OnTrack is called for every track the hub sends
+	OnTrack func(*webrtc.TrackRemote, *webrtc.RTPReceiver)
+	// StatsInterval is how often the reception stats are reported to the
+	// hub, they are not when zero
+	StatsInterval time.Duration
+}
+
+// telemetryMessage is exchanged over the ping data channel
+type telemetryMessage struct {
+	Type      string          `json:"type"`
+	Timestamp int64           `json:"ts,omitempty"`
+	Stats     *telemetryStats `json:"stats,omitempty"`
+}
+
+type telemetryStats struct {
+	Jitter          float64 `json:"jitter"`
+	PacketsLost     int64   `json:"packetsLost"`
+	PacketsReceived int64   `json:"packetsReceived"`
+}
+
+// Client is a receiver connected to a hub
+type Client struct {
+	conn          *websocket.Conn
+	peer          *webrtc.PeerConnection
+	statsInterval time.Duration
+
+	writeLock sync.Mutex
+	// negotiationLock keeps the answers to offers of both signalings apart
+	negotiationLock sync.Mutex
+
+	lock      sync.Mutex
+	signaling *webrtc.DataChannel
+	hint      *ReconnectHint
+}
+
+// Dial connects to the hub websocket endpoint, e.g. ws://localhost:8080/websocket
+func Dial(ctx context.Context, url string, opts Options) (*Client, error) {
+	conn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPHeader:   opts.Header,
+		Subprotocols: []string{Subprotocol},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	api := opts.API
+	if api == nil {
+		m := &webrtc.MediaEngine{}
+		if err := m.RegisterDefaultCodecs(); err != nil {
+			conn.Close(websocket.StatusInternalError, "")
+			return nil, err
+		}
+		api = webrtc.NewAPI(webrtc.WithMediaEngine(m))
+	}
+	peer, err := api.NewPeerConnection(opts.Configuration)
+	if err != nil {
+		conn.Close(websocket.StatusInternalError, "")
+		return nil, err
+	}
+
+	c := &Client{conn: conn, peer: peer, statsInterval: opts.StatsInterval}
+	if opts.OnTrack != nil {
+		peer.OnTrack(opts.OnTrack)
+	}
+	peer.OnDataChannel(c.onDataChannel)
+	peer.OnICECandidate(func(i *webrtc.ICECandidate) {
+		if i == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// Errors surface on the next read, nothing more to do here
+		_ = c.send(ctx, "candidate", i.ToJSON())
+	})
+	return c, nil
+}
+
+// PeerConnection gives access to the underlying connection, e.g. for stats
+func (c *Client) PeerConnection() *webrtc.PeerConnection {
+	return c.peer
+}
+
+// Run handles the signaling until ctx is done or the hub closes the
+// connection. It returns a *ReconnectError when the hub sent a reconnect hint.
+func (c *Client) Run(ctx context.Context) error {
+	for {
+		_, raw, err := c.conn.Read(ctx)
+		if err != nil {
+			if hint := c.reconnectHint(); hint != nil {
+				return &ReconnectError{Hint: *hint}
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		message := Message{}
+		if err := json.Unmarshal(raw, &message); err != nil {
+			return err
+		}
+		if err := c.handle(ctx, message); err != nil {
+			return err
+		}
+	}
+}
+
+// handle applies a message received over the websocket or the signaling
+// data channel
+func (c *Client) handle(ctx context.Context, message Message) error {
+	switch message.Event {
+	case "offer":
+		offer := webrtc.SessionDescription{}
+		if err := json.Unmarshal([]byte(message.Data), &offer); err != nil {
+			return err
+		}
+		return c.answer(ctx, offer)
+	case "candidate":
+		candidate := webrtc.ICECandidateInit{}
+		if err := json.Unmarshal([]byte(message.Data), &candidate); err != nil {
+			return err
+		}
+		return c.peer.AddICECandidate(candidate)
+	case "reconnect":
+		hint := &ReconnectHint{}
+		if err := json.Unmarshal([]byte(message.Data), hint); err != nil {
+			return err
+		}
+		c.lock.Lock()
+		c.hint = hint
+		c.lock.Unlock()
+	case "ping":
+		// The hub drops receivers that stay silent on the websocket
+		return c.writeWebSocket(ctx, Message{Event: "pong"})
+	}
+	return nil
+}
+
+// onDataChannel takes over the signaling data channel the hub opens once
+// connected, renegotiations then go over it
+func (c *Client) onDataChannel(channel *webrtc.DataChannel) {
+	if channel.Label() == "ping" {
+		c.serveTelemetry(channel)
+		return
+	}
+	if channel.Label() != "signaling" {
+		return
+	}
+	channel.OnMessage(func(raw webrtc.DataChannelMessage) {
+		message := Message{}
+		if err := json.Unmarshal(raw.Data, &message); err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// The websocket is still there to report failures
+		_ = c.handle(ctx, message)
+	})
+	c.lock.Lock()
+	c.signaling = channel
+	c.lock.Unlock()
+}
+
+// serveTelemetry echoes the pings of the hub, so it can measure the RTT, and
+// reports the reception stats every statsInterval
+func (c *Client) serveTelemetry(channel *webrtc.DataChannel) {
+	channel.OnMessage(func(raw webrtc.DataChannelMessage) {
+		message := telemetryMessage{}
+		if err := json.Unmarshal(raw.Data, &message); err != nil || message.Type != "ping" {
+			return
+		}
+		_ = sendTelemetry(channel, telemetryMessage{Type: "pong", Timestamp: message.Timestamp})
+	})
+	if c.statsInterval <= 0 {
+		return
+	}
+	channel.OnOpen(func() {
+		ticker := time.NewTicker(c.statsInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := sendTelemetry(channel, telemetryMessage{Type: "stats", Stats: c.receptionStats()}); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// receptionStats sums up the inbound RTP streams
+func (c *Client) receptionStats() *telemetryStats {
+	summary := &telemetryStats{}
+	for _, s := range c.peer.GetStats() {
+		inbound, ok := s.(webrtc.InboundRTPStreamStats)
+		if !ok {
+			continue
+		}
+		if inbound.Jitter > summary.Jitter {
+			summary.Jitter = inbound.Jitter
+		}
+		if inbound.PacketsLost > 0 {
+			summary.PacketsLost += int64(inbound.PacketsLost)
+		}
+		summary.PacketsReceived += int64(inbound.PacketsReceived)
+	}
+	return summary
+}
+
+func sendTelemetry(channel *webrtc.DataChannel, message telemetryMessage) error {
+	raw, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return channel.SendText(string(raw))
+}
+
+func (c *Client) reconnectHint() *ReconnectHint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.hint
+}
+
+func (c *Client) answer(ctx context.Context, offer webrtc.SessionDescription) error {
+	c.negotiationLock.Lock()
+	defer c.negotiationLock.Unlock()
+	if err := c.peer.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	answer, err := c.peer.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := c.peer.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	return c.send(ctx, "answer", answer)
+}
+
+// Replay asks the hub to send streamID delayed by delay alongside the live tracks
+func (c *Client) Replay(ctx context.Context, streamID string, delay time.Duration) error {
+	return c.send(ctx, "replay", map[string]interface{}{
+		"streamID": streamID,
+		"delay":    delay.Seconds(),
+	})
+}
+
+// Live stops a replay started with Replay
+func (c *Client) Live(ctx context.Context, streamID string) error {
+	return c.sendRaw(ctx, "live", streamID)
+}
+
+// Subscribe asks the hub for streamID, once subscribed the client only gets
+// the streams it subscribed to
+func (c *Client) Subscribe(ctx context.Context, streamID string) error {
+	return c.sendRaw(ctx, "subscribe", streamID)
+}
+
+// SubscribeLayer subscribes to streamID and pins its simulcast layer to rid,
+// an empty rid lets the hub pick the layer from the available bandwidth
+func (c *Client) SubscribeLayer(ctx context.Context, streamID string, rid string) error {
+	return c.send(ctx, "subscribe", map[string]string{
+		"streamID": streamID,
+		"rid":      rid,
+	})
+}
+
+// Unsubscribe stops a subscription started with Subscribe
+func (c *Client) Unsubscribe(ctx context.Context, streamID string) error {
+	return c.sendRaw(ctx, "unsubscribe", streamID)
+}
+
+// Pause asks the hub to stop sending a track without renegotiating, the
+// track is named by its stream ID and ID
+func (c *Client) Pause(ctx context.Context, streamID string, trackID string) error {
+	return c.sendRaw(ctx, "pause", streamID+trackID)
+}
+
+// Resume restarts a track paused with Pause
+func (c *Client) Resume(ctx context.Context, streamID string, trackID string) error {
+	return c.sendRaw(ctx, "resume", streamID+trackID)
+}
+
+// send encodes data as JSON and sends it as event
+func (c *Client) send(ctx context.Context, event string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return c.sendRaw(ctx, event, string(encoded))
+}
+
+// sendRaw sends over the signaling data channel once open, over the
+// websocket otherwise
+func (c *Client) sendRaw(ctx context.Context, event string, data string) error {
+	message := Message{Event: event, Data: data}
+	c.lock.Lock()
+	channel := c.signaling
+	c.lock.Unlock()
+	if channel == nil || channel.ReadyState() != webrtc.DataChannelStateOpen {
+		return c.writeWebSocket(ctx, message)
+	}
+	raw, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return channel.SendText(string(raw))
+}
+
+func (c *Client) writeWebSocket(ctx context.Context, message Message) error {
+	raw, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.conn.Write(ctx, websocket.MessageText, raw)
+}
+
+// Close leaves the hub
+func (c *Client) Close() error {
+	c.conn.Close(websocket.StatusNormalClosure, "")
+	return c.peer.Close()
+}
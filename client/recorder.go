@@ -0,0 +1,169 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"github.com/pion/webrtc/v4/pkg/media/rtpdump"
+)
+
+// mediaWriter is implemented by the pion media writers
+type mediaWriter interface {
+	WriteRTP(*rtp.Packet) error
+	Close() error
+}
+
+// Recorder writes every received track to its own file in Dir, using a
+// container matching the codec and falling back to rtpdump otherwise
+type Recorder struct {
+	Dir string
+
+	lock    sync.Mutex
+	writers map[string]mediaWriter
+	// OnError is called when a track stops being recorded because of an error
+	OnError func(track *webrtc.TrackRemote, err error)
+}
+
+func NewRecorder(dir string) *Recorder {
+	return &Recorder{
+		Dir:     dir,
+		writers: make(map[string]mediaWriter),
+	}
+}
+
+// OnTrack records the track until it ends, it fits Options.OnTrack
+func (r *Recorder) OnTrack(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	writer, err := r.open(track)
+	if err != nil {
+		r.fail(track, err)
+		return
+	}
+	key := track.StreamID() + track.ID()
+	defer func() {
+		r.lock.Lock()
+		_, open := r.writers[key]
+		delete(r.writers, key)
+		r.lock.Unlock()
+		// Close already finalized the file otherwise
+		if open {
+			writer.Close()
+		}
+	}()
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if err := writer.WriteRTP(packet); err != nil {
+			r.fail(track, err)
+			return
+		}
+	}
+}
+
+func (r *Recorder) open(track *webrtc.TrackRemote) (mediaWriter, error) {
+	codec := track.Codec()
+	base := filepath.Join(r.Dir, fmt.Sprintf("%s-%s-%d", sanitize(track.StreamID()), sanitize(track.ID()), track.SSRC()))
+
+	var writer mediaWriter
+	var err error
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		writer, err = ivfwriter.New(base+".ivf", ivfwriter.WithCodec(webrtc.MimeTypeVP8))
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		writer, err = ivfwriter.New(base+".ivf", ivfwriter.WithCodec(webrtc.MimeTypeAV1))
+	case strings.ToLower(webrtc.MimeTypeH264):
+		writer, err = h264writer.New(base + ".h264")
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		writer, err = oggwriter.New(base+".ogg", codec.ClockRate, codec.Channels)
+	default:
+		writer, err = newRTPDumpWriter(base + ".rtpdump")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	r.writers[track.StreamID()+track.ID()] = writer
+	r.lock.Unlock()
+	return writer, nil
+}
+
+func (r *Recorder) fail(track *webrtc.TrackRemote, err error) {
+	if r.OnError != nil {
+		r.OnError(track, err)
+	}
+}
+
+// Close finalizes the files of the tracks still being recorded
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var err error
+	for key, writer := range r.writers {
+		if closeErr := writer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(r.writers, key)
+	}
+	return err
+}
+
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// rtpDumpWriter keeps the raw packets of codecs without a matching container
+type rtpDumpWriter struct {
+	file   *os.File
+	writer *rtpdump.Writer
+	start  time.Time
+}
+
+func newRTPDumpWriter(fileName string) (*rtpDumpWriter, error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	writer, err := rtpdump.NewWriter(f, rtpdump.Header{
+		Start:  start,
+		Source: net.IPv4zero,
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rtpDumpWriter{file: f, writer: writer, start: start}, nil
+}
+
+func (w *rtpDumpWriter) WriteRTP(packet *rtp.Packet) error {
+	payload, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	return w.writer.WritePacket(rtpdump.Packet{
+		Offset:  time.Since(w.start),
+		Payload: payload,
+	})
+}
+
+func (w *rtpDumpWriter) Close() error {
+	return w.file.Close()
+}
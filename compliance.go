@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pion/webrtc/v4/pkg/media/rtpdump"
+	"go.uber.org/zap"
+)
+
+// complianceTap is a hub.TrackSink that hands decrypted RTP packets over to an
+// authorized compliance recorder. The hub terminates SRTP so the tap gives
+// recorders the plaintext media without having to export keying material.
+type complianceTap struct {
+	packets chan []byte
+	done    chan struct{}
+	once    sync.Once
+	dropped atomic.Uint64
+}
+
+func newComplianceTap() *complianceTap {
+	return &complianceTap{
+		packets: make(chan []byte, 512),
+		done:    make(chan struct{}),
+	}
+}
+
+func (t *complianceTap) WriteRTP(packet []byte) error {
+	select {
+	case <-t.done:
+		return errors.New("tap closed")
+	default:
+	}
+	p := make([]byte, len(packet))
+	copy(p, packet)
+	select {
+	case t.packets <- p:
+	default:
+		// Never block the forwarding loop on a slow recorder
+		t.dropped.Add(1)
+	}
+	return nil
+}
+
+func (t *complianceTap) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+// complianceTapHandler streams every track of a designated stream in rtpdump
+// format until the publisher goes away or the recorder disconnects.
+func complianceTapHandler(rooms *Rooms, designated stringListFlag) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		streamID := chi.URLParam(r, "streamID")
+		if !designated.Contains(streamID) {
+			writeProblem(w, r, http.StatusForbidden, ProblemForbidden, "Stream not designated for compliance recording")
+			return
+		}
+		tracks := b.StreamTracks(streamID)
+		if len(tracks) == 0 {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Stream has no published track")
+			return
+		}
+
+		tap := newComplianceTap()
+		attached := 0
+		for _, track := range tracks {
+			if b.AddSink(track, tap) {
+				attached++
+			}
+		}
+		defer func() {
+			for _, track := range tracks {
+				b.RemoveSink(track, tap)
+			}
+			tap.Close()
+			logger.Infow("Compliance tap ended", "streamID", streamID, "dropped", tap.dropped.Load())
+		}()
+		if attached == 0 {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Stream has no published track")
+			return
+		}
+
+		start := time.Now()
+		w.Header().Add("content-type", "application/x-rtpdump")
+		w.WriteHeader(http.StatusOK)
+		dump, err := rtpdump.NewWriter(w, rtpdump.Header{
+			Start:  start,
+			Source: net.IPv4zero,
+		})
+		if err != nil {
+			logger.Error(err)
+			return
+		}
+		flusher, _ := w.(http.Flusher)
+		logger.Infow("Compliance tap started", "streamID", streamID, "tracks", attached)
+
+		// Each track closes the tap when it goes away, stop as soon as any of
+		// them ends so the recorder notices the publisher change.
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-tap.done:
+				return
+			case packet := <-tap.packets:
+				if err := dump.WritePacket(rtpdump.Packet{
+					Offset:  time.Since(start),
+					Payload: packet,
+				}); err != nil {
+					logger.Error(err)
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+	}
+}
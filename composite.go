@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// ffmpegVideoCodec decodes the tracks for the composite and the previews
+// and encodes the composite with an ffmpeg process each, streaming raw
+// pictures through their pipes
+type ffmpegVideoCodec struct {
+	path string
+}
+
+func (c ffmpegVideoCodec) NewDecoder(mimeType string, width, height int) (hub.VideoDecoder, error) {
+	format, fourCC := "", ""
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		format = "h264"
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		format, fourCC = "ivf", "VP80"
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		format, fourCC = "ivf", "VP90"
+	default:
+		return nil, fmt.Errorf("%s cannot be decoded", mimeType)
+	}
+	size := fmt.Sprintf("%d:%d", width, height)
+	d := &ffmpegVideoDecoder{fourCC: fourCC, width: width, height: height}
+	d.process = exec.Command(c.path, "-hide_banner", "-loglevel", "error", "-fflags", "nobuffer", "-flags", "low_delay",
+		"-f", format, "-i", "pipe:0",
+		"-vf", "scale="+size+":force_original_aspect_ratio=decrease,pad="+size+":(ow-iw)/2:(oh-ih)/2",
+		"-f", "rawvideo", "-pix_fmt", "rgba", "pipe:1")
+	if err := d.start(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (c ffmpegVideoCodec) NewEncoder(options hub.CompositorOptions, output func(accessUnit []byte)) (hub.VideoEncoder, error) {
+	frameRate := strconv.Itoa(options.FrameRate)
+	bitrate := strconv.Itoa(options.Bitrate)
+	e := &ffmpegVideoEncoder{output: output}
+	e.process = exec.Command(c.path, "-hide_banner", "-loglevel", "error",
+		"-f", "rawvideo", "-pix_fmt", "rgba", "-s", fmt.Sprintf("%dx%d", options.Width, options.Height), "-r", frameRate, "-i", "pipe:0",
+		"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-profile:v", "baseline", "-pix_fmt", "yuv420p",
+		"-g", frameRate, "-b:v", bitrate, "-maxrate", bitrate, "-bufsize", bitrate,
+		// Every access unit starts with a delimiter, every keyframe with
+		// the parameter sets for the receivers joining
+		"-x264-params", "aud=1:repeat-headers=1",
+		"-f", "h264", "pipe:1")
+	if err := e.start(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ffmpegProcess is a filter process written to and read from through its
+// pipes, its error output logged
+type ffmpegProcess struct {
+	process *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  io.ReadCloser
+	once    sync.Once
+}
+
+func (p *ffmpegProcess) startProcess(read func(stdout io.Reader)) error {
+	var err error
+	if p.stdin, err = p.process.StdinPipe(); err != nil {
+		return err
+	}
+	if p.stdout, err = p.process.StdoutPipe(); err != nil {
+		return err
+	}
+	stderr := &bytes.Buffer{}
+	p.process.Stderr = stderr
+	if err := p.process.Start(); err != nil {
+		return err
+	}
+	go func() {
+		read(p.stdout)
+		if err := p.process.Wait(); err != nil {
+			zap.S().Infow("ffmpeg exited", "error", err, "output", strings.TrimSpace(stderr.String()))
+		}
+	}()
+	return nil
+}
+
+// Close ends the input, the process exits once it processed it
+func (p *ffmpegProcess) Close() error {
+	p.once.Do(func() {
+		p.stdin.Close()
+	})
+	return nil
+}
+
+// ffmpegVideoDecoder writes the frames as H264 in Annex B or in IVF and
+// reads back the pictures as RGBA
+type ffmpegVideoDecoder struct {
+	ffmpegProcess
+	fourCC        string
+	width, height int
+	frames        uint64
+
+	lock    sync.Mutex
+	picture *image.RGBA
+}
+
+func (d *ffmpegVideoDecoder) start() error {
+	return d.startProcess(func(stdout io.Reader) {
+		for {
+			// Every picture is new, those returned are never written again
+			picture := image.NewRGBA(image.Rect(0, 0, d.width, d.height))
+			if _, err := io.ReadFull(stdout, picture.Pix); err != nil {
+				return
+			}
+			d.lock.Lock()
+			d.picture = picture
+			d.lock.Unlock()
+		}
+	})
+}
+
+func (d *ffmpegVideoDecoder) Decode(frame []byte) error {
+	var data []byte
+	if d.fourCC != "" {
+		if d.frames == 0 {
+			data = ivfHeader(d.fourCC)
+		}
+		data = append(ivfFrameHeader(data, frame, d.frames), frame...)
+	} else {
+		data = frame
+	}
+	d.frames++
+	_, err := d.stdin.Write(data)
+	return err
+}
+
+func (d *ffmpegVideoDecoder) Picture() image.Image {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.picture == nil {
+		return nil
+	}
+	return d.picture
+}
+
+// ffmpegVideoEncoder writes the pictures as RGBA and reads back the H264
+// stream, cut into access units on their delimiters
+type ffmpegVideoEncoder struct {
+	ffmpegProcess
+	output func(accessUnit []byte)
+}
+
+func (e *ffmpegVideoEncoder) start() error {
+	return e.startProcess(func(stdout io.Reader) {
+		chunk := make([]byte, 1<<16)
+		stream := []byte{}
+		for {
+			n, err := stdout.Read(chunk)
+			stream = append(stream, chunk[:n]...)
+			// The delimiter of the access unit starts the stream, the next
+			// one ends it
+			for {
+				next := nextAccessUnitDelimiter(stream, 4)
+				if next < 0 {
+					break
+				}
+				e.output(stream[:next])
+				stream = append([]byte(nil), stream[next:]...)
+			}
+			if err != nil {
+				if len(stream) > 0 {
+					e.output(stream)
+				}
+				return
+			}
+		}
+	})
+}
+
+func (e *ffmpegVideoEncoder) Encode(picture *image.RGBA) error {
+	_, err := e.stdin.Write(picture.Pix)
+	return err
+}
+
+// nextAccessUnitDelimiter finds the start code of the next access unit
+// delimiter NAL unit of stream from offset, -1 when there is none yet
+func nextAccessUnitDelimiter(stream []byte, offset int) int {
+	for i := offset; i+3 < len(stream); i++ {
+		if stream[i] != 0 || stream[i+1] != 0 || stream[i+2] != 1 || stream[i+3]&0x1f != 9 {
+			continue
+		}
+		// The start code may be on 4 bytes
+		if stream[i-1] == 0 {
+			return i - 1
+		}
+		return i
+	}
+	return -1
+}
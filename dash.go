@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// dashManifestHandler serves the DASH manifest of a stream of the room,
+// waiting up to wait for its first segment. The players of any origin may
+// load it.
+func dashManifestHandler(rooms *Rooms, wait time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		// The files are in the same room as the manifest
+		query := ""
+		if room := r.URL.Query().Get("room"); room != "" {
+			query = url.Values{"room": {room}}.Encode()
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		manifest, err := b.DASHManifest(ctx, chi.URLParam(r, "streamID"), query)
+		if err != nil {
+			writeHLSProblem(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(manifest)
+	}
+}
+
+// dashFileHandler serves the init and media segments listed by the DASH
+// manifest of a stream of the room
+func dashFileHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		data, err := b.DASHFile(chi.URLParam(r, "streamID"), chi.URLParam(r, "file"))
+		if err != nil {
+			writeHLSProblem(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(data)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// egressConnectTimeout bounds the connection to the destination of an
+// egress, its handshake included
+const egressConnectTimeout = 10 * time.Second
+
+type egressRequest struct {
+	// StreamID is the stream pushed out, program in program mode
+	StreamID string `json:"streamID"`
+	// URL is the destination, RTMP or RTMPS ending with the stream key, or
+	// SRT with its mode, latency and streamid
+	URL string `json:"url"`
+}
+
+type pipeEgressRequest struct {
+	StreamID string `json:"streamID"`
+	// Pipeline is the name of a pipeline of -pipe-egress
+	Pipeline string `json:"pipeline"`
+}
+
+// egressesHandler lists the streams pushed out of the hub
+func egressesHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, rooms.Egresses())
+	}
+}
+
+// egressStartHandler pushes a stream of the room out with start, to the
+// ingest of a streaming platform over RTMP or to a broadcast workflow over
+// SRT, until it is stopped or the stream goes away
+func egressStartHandler(rooms *Rooms, start func(b *hub.Broadcaster, ctx context.Context, streamID string, url string) (hub.EgressInfo, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		request := egressRequest{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&request); err != nil || request.StreamID == "" || request.URL == "" {
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Expected a JSON object with a streamID and an url")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), egressConnectTimeout)
+		defer cancel()
+		info, err := start(b, ctx, request.StreamID, request.URL)
+		if err != nil {
+			writeEgressProblem(w, r, err)
+			return
+		}
+		logger.Infow("Egress started", "id", info.ID, "streamID", info.StreamID, "url", info.URL)
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, r, info)
+	}
+}
+
+// pipeEgressHandler pushes a stream of the room to one of the configured
+// pipelines, an ffmpeg or GStreamer process the hub runs, until it is
+// stopped or the stream goes away
+func pipeEgressHandler(rooms *Rooms, pipelines map[string]hub.PipeEgress) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		request := pipeEgressRequest{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&request); err != nil || request.StreamID == "" || request.Pipeline == "" {
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Expected a JSON object with a streamID and a pipeline")
+			return
+		}
+		pipeline, ok := pipelines[request.Pipeline]
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown pipeline, set it with -pipe-egress")
+			return
+		}
+		info, err := b.StartPipeEgress(request.StreamID, pipeline)
+		if err != nil {
+			writeEgressProblem(w, r, err)
+			return
+		}
+		logger.Infow("Egress started", "id", info.ID, "streamID", info.StreamID, "pipeline", pipeline.Name)
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, r, info)
+	}
+}
+
+// stopEgressHandler stops pushing out a stream
+func stopEgressHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		info, err := rooms.StopEgress(chi.URLParam(r, "egressID"))
+		if err != nil {
+			writeEgressProblem(w, r, err)
+			return
+		}
+		logger.Infow("Egress stopped", "id", info.ID, "streamID", info.StreamID)
+		writeJSON(w, r, info)
+	}
+}
+
+func writeEgressProblem(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, hub.ErrUnknownStream):
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Stream has no published track")
+	case errors.Is(err, hub.ErrUnknownEgress):
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown egress")
+	case errors.Is(err, hub.ErrEgressURL):
+		writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, err.Error())
+	case errors.Is(err, hub.ErrEgressUnreachable):
+		writeProblem(w, r, http.StatusBadGateway, ProblemUpstream, err.Error())
+	default:
+		writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, err.Error())
+	}
+}
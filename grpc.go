@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"go.uber.org/zap"
+)
+
+// grpcSignalPath is the Signal method of the Signaling service of
+// pkg/hub/signaling.proto
+const grpcSignalPath = "/webrtchub.signaling.Signaling/Signal"
+
+// The gRPC status codes returned by the Signal method
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+)
+
+// grpcSignalHandler serves the receiver signaling as a bidirectional
+// streaming gRPC call exchanging the messages of signaling.proto, for native
+// clients. The room, maxTracks, capacity and resume parameters of the
+// websocket are passed as the room, max-tracks, capacity and resume-token
+// metadata. gRPC needs HTTP/2, which the listeners only speak over TLS.
+func grpcSignalHandler(rooms *Rooms, receivers receiverOptions) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			writeProblem(w, r, http.StatusUnsupportedMediaType, ProblemUnsupportedContentType, "Signal is a gRPC method, it needs HTTP/2 and application/grpc")
+			return
+		}
+		if encoding := r.Header.Get("Grpc-Encoding"); encoding != "" && encoding != "identity" {
+			writeGRPCStatus(w, grpcUnimplemented, "compression is not supported")
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeGRPCStatus(w, grpcInternal, "streaming unsupported")
+			return
+		}
+
+		name := r.Header.Get("Room")
+		if name == "" {
+			name = DefaultRoom
+		}
+		if !roomNamePattern.MatchString(name) {
+			writeGRPCStatus(w, grpcInvalidArgument, "invalid room name")
+			return
+		}
+		options := receivers
+		preferences, err := parseReceiverPreferences(r.Header.Get("Max-Tracks"), r.Header.Get("Capacity"))
+		if err != nil {
+			writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+		options.Preferences = preferences
+		options.ResumeToken = r.Header.Get("Resume-Token")
+		b := rooms.Get(name)
+
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		signaler := hub.NewGRPCSignaler(r.Body, w, flusher.Flush, r.Body.Close, maxSignalingMessageSize)
+		if b.Draining() {
+			hub.SendReconnectHint(signaler, b.ReconnectPolicy(), "draining")
+			setGRPCStatus(w, grpcUnavailable, "hub is draining")
+			return
+		}
+
+		err = serveReceiver(r.Context(), b, signaler, options, logger)
+		code, message := grpcStatusOf(err)
+		if code != grpcOK {
+			logger.Infow("gRPC signaling ended", "error", err)
+		}
+		setGRPCStatus(w, code, message)
+	}
+}
+
+// grpcStatusOf maps the end of a signaling session to a gRPC status
+func grpcStatusOf(err error) (int, string) {
+	switch {
+	case err == nil, errors.Is(err, io.EOF), errors.Is(err, hub.ErrSignalingClosed):
+		return grpcOK, ""
+	case errors.Is(err, errSignalingTimeout):
+		return grpcDeadlineExceeded, err.Error()
+	case errors.Is(err, errTooManyInvalidMessages), errors.Is(err, hub.ErrFrameTooLarge):
+		return grpcInvalidArgument, err.Error()
+	case errors.Is(err, hub.ErrUnknownReceiver):
+		return grpcFailedPrecondition, err.Error()
+	}
+	return grpcInternal, "signaling failed"
+}
+
+// writeGRPCStatus answers with a status alone, before any message
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	setGRPCStatus(w, code, message)
+	w.WriteHeader(http.StatusOK)
+}
+
+// setGRPCStatus sets the status trailers, or headers when nothing was
+// written yet
+func setGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", grpcEncodeMessage(message))
+	}
+}
+
+// grpcEncodeMessage percent-encodes message as required by grpc-message
+func grpcEncodeMessage(message string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c >= 0x20 && c <= 0x7E && c != '%' {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
@@ -0,0 +1,148 @@
+//go:build unix
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"go.uber.org/zap"
+)
+
+// maxHandoffListeners bounds the file descriptors passed in one handoff
+const maxHandoffListeners = 16
+
+// handoffState is sent to the next process along with the listening sockets
+type handoffState struct {
+	// Listeners are the addresses of the passed sockets, in order
+	Listeners []string `json:"listeners"`
+	// Sessions still served by the previous process until they end
+	Sessions []hub.SessionDescriptor `json:"sessions"`
+}
+
+// inheritListeners takes over the listening sockets of the hub process
+// serving the handoff socket, it returns no listener when there is none
+func inheritListeners(socketPath string) (map[string]net.Listener, *handoffState, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	unixConn := conn.(*net.UnixConn)
+	unixConn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	buf := make([]byte, 1<<20)
+	oob := make([]byte, syscall.CmsgSpace(4*maxHandoffListeners))
+	n, oobn, _, _, err := unixConn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+	state := &handoffState{}
+	if err := json.Unmarshal(buf[:n], state); err != nil {
+		return nil, nil, err
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(messages) != 1 {
+		return nil, nil, fmt.Errorf("expected one control message, got %d", len(messages))
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(fds) != len(state.Listeners) {
+		return nil, nil, fmt.Errorf("got %d sockets for %d listeners", len(fds), len(state.Listeners))
+	}
+
+	listeners := make(map[string]net.Listener, len(fds))
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), state.Listeners[i])
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		listeners[state.Listeners[i]] = listener
+	}
+	// Tell the previous process it can stop accepting
+	if _, err := conn.Write([]byte("ok")); err != nil {
+		return nil, nil, err
+	}
+	return listeners, state, nil
+}
+
+// serveHandoff waits for the next hub process on socketPath, passes it the
+// listening sockets and the session descriptors, then calls handedOff
+func serveHandoff(socketPath string, addrs []string, listeners []net.Listener, rooms *Rooms, handedOff func()) error {
+	if len(listeners) > maxHandoffListeners {
+		return fmt.Errorf("at most %d listeners can be handed off", maxHandoffListeners)
+	}
+	// The previous process, if any, is done with the socket
+	os.Remove(socketPath)
+	socket, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer socket.Close()
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				zap.S().Errorw("Handoff socket failed", "error", err)
+				return
+			}
+			if err := handOff(conn.(*net.UnixConn), addrs, listeners, rooms); err != nil {
+				zap.S().Errorw("Handoff failed", "error", err)
+				conn.Close()
+				continue
+			}
+			conn.Close()
+			handedOff()
+			return
+		}
+	}()
+	return nil
+}
+
+func handOff(conn *net.UnixConn, addrs []string, listeners []net.Listener, rooms *Rooms) error {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fds := make([]int, 0, len(listeners))
+	for _, listener := range listeners {
+		tcpListener, ok := listener.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("cannot hand off %T", listener)
+		}
+		// File duplicates the socket, closing it leaves the listener alone
+		f, err := tcpListener.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fds = append(fds, int(f.Fd()))
+	}
+	payload, err := json.Marshal(handoffState{
+		Listeners: addrs,
+		Sessions:  rooms.SessionDescriptors(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, _, err := conn.WriteMsgUnix(payload, syscall.UnixRights(fds...), nil); err != nil {
+		return err
+	}
+	ack := make([]byte, 2)
+	if _, err := conn.Read(ack); err != nil {
+		return err
+	}
+	return nil
+}
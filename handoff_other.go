@@ -0,0 +1,23 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+)
+
+type handoffState struct {
+	Listeners []string
+	Sessions  []hub.SessionDescriptor
+}
+
+func inheritListeners(socketPath string) (map[string]net.Listener, *handoffState, error) {
+	return nil, nil, errors.New("handoff needs unix domain sockets")
+}
+
+func serveHandoff(socketPath string, addrs []string, listeners []net.Listener, rooms *Rooms, handedOff func()) error {
+	return errors.New("handoff needs unix domain sockets")
+}
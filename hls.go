@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/go-chi/chi/v5"
+)
+
+// hlsPlaylistHandler serves the media playlist of a stream of the room,
+// waiting up to wait for its first segment or for the segment or part of a
+// blocking reload. The players of any origin may load it.
+func hlsPlaylistHandler(rooms *Rooms, wait time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		// The files are in the same room as the playlist
+		query := ""
+		if room := r.URL.Query().Get("room"); room != "" {
+			query = url.Values{"room": {room}}.Encode()
+		}
+		msn, part := int64(-1), -1
+		if value := r.URL.Query().Get("_HLS_msn"); value != "" {
+			var err error
+			if msn, err = strconv.ParseInt(value, 10, 64); err != nil || msn < 0 {
+				writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Invalid _HLS_msn")
+				return
+			}
+		}
+		if value := r.URL.Query().Get("_HLS_part"); value != "" {
+			var err error
+			if part, err = strconv.Atoi(value); err != nil || part < 0 || msn < 0 {
+				writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Invalid _HLS_part, it goes with _HLS_msn")
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		playlist, err := b.HLSPlaylist(ctx, chi.URLParam(r, "streamID"), query, msn, part)
+		if err != nil {
+			writeHLSProblem(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(playlist)
+	}
+}
+
+// hlsFileHandler serves the init segments, the media segments and their
+// parts listed by the playlist of a stream of the room, waiting up to wait
+// for those of the preload hints
+func hlsFileHandler(rooms *Rooms, wait time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		name := chi.URLParam(r, "file")
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		data, err := b.HLSFile(ctx, chi.URLParam(r, "streamID"), name)
+		if err != nil {
+			writeHLSProblem(w, r, err)
+			return
+		}
+		if strings.HasSuffix(name, ".mp4") {
+			w.Header().Set("Content-Type", "video/mp4")
+		} else {
+			w.Header().Set("Content-Type", "video/iso.segment")
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(data)
+	}
+}
+
+func writeHLSProblem(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, hub.ErrUnknownStream):
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Stream is not packaged")
+	case errors.Is(err, hub.ErrFutureSegment):
+		writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Segment too far in the future")
+	case errors.Is(err, hub.ErrSegmentNotFound):
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Segment not available")
+	default:
+		writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, err.Error())
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ListenerRole selects the routes served by a listener
+type ListenerRole string
+
+const (
+	// RolePublic serves the player page, the websocket signaling and WHEP
+	RolePublic ListenerRole = "public"
+	// RoleContribution serves WHIP ingest
+	RoleContribution ListenerRole = "contribution"
+	// RoleAdmin serves the /api endpoints
+	RoleAdmin ListenerRole = "admin"
+)
+
+var listenerRoles = []ListenerRole{RolePublic, RoleContribution, RoleAdmin}
+
+// ListenerConfig is one HTTP listener, serving over TLS when a certificate is set
+type ListenerConfig struct {
+	Addr    string
+	Roles   map[ListenerRole]bool
+	TLSCert string
+	TLSKey  string
+}
+
+func (l ListenerConfig) TLS() bool {
+	return l.TLSCert != ""
+}
+
+// listenersFlag parses "addr=:8443,role=contribution,cert=hub.pem,key=hub.key"
+// values, role can be repeated and the flag too
+type listenersFlag []ListenerConfig
+
+func (l *listenersFlag) String() string {
+	addrs := make([]string, 0, len(*l))
+	for _, listener := range *l {
+		addrs = append(addrs, listener.Addr)
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (l *listenersFlag) Set(value string) error {
+	listener := ListenerConfig{Roles: make(map[ListenerRole]bool)}
+	for _, pair := range strings.Split(value, ",") {
+		key, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return fmt.Errorf("expected key=value, got %q", pair)
+		}
+		switch key {
+		case "addr":
+			listener.Addr = v
+		case "role":
+			role := ListenerRole(v)
+			if !validListenerRole(role) {
+				return fmt.Errorf("unknown listener role %q", v)
+			}
+			listener.Roles[role] = true
+		case "cert":
+			listener.TLSCert = v
+		case "key":
+			listener.TLSKey = v
+		default:
+			return fmt.Errorf("unknown listener option %q", key)
+		}
+	}
+	if listener.Addr == "" {
+		return fmt.Errorf("listener %q has no addr", value)
+	}
+	if len(listener.Roles) == 0 {
+		return fmt.Errorf("listener %q has no role", value)
+	}
+	if (listener.TLSCert == "") != (listener.TLSKey == "") {
+		return fmt.Errorf("listener %q needs both cert and key for TLS", value)
+	}
+	*l = append(*l, listener)
+	return nil
+}
+
+func validListenerRole(role ListenerRole) bool {
+	for _, r := range listenerRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// allRolesListener is the listener used when none is configured
+func allRolesListener(addr string) ListenerConfig {
+	listener := ListenerConfig{Addr: addr, Roles: make(map[ListenerRole]bool)}
+	for _, role := range listenerRoles {
+		listener.Roles[role] = true
+	}
+	return listener
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// liveFormats are the live stream formats by file extension
+var liveFormats = map[string]hub.LiveFormat{
+	".webm": hub.LiveWebM,
+	".mp4":  hub.LiveMP4,
+}
+
+// liveStreamHandler streams a stream of the room as WebM or fragmented MP4
+// for Media Source Extensions players, the fallback of the viewers WebRTC
+// is blocked for. The MIME type of the source buffer is the content type.
+func liveStreamHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		file := chi.URLParam(r, "file")
+		var streamID string
+		var format hub.LiveFormat
+		for extension, f := range liveFormats {
+			if strings.HasSuffix(file, extension) {
+				streamID, format = strings.TrimSuffix(file, extension), f
+			}
+		}
+		if streamID == "" {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown live stream file")
+			return
+		}
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		live, err := b.StartLiveStream(streamID, format)
+		switch {
+		case errors.Is(err, hub.ErrUnknownStream):
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Stream has no published track")
+			return
+		case errors.Is(err, hub.ErrLiveCodecs):
+			writeProblem(w, r, http.StatusUnprocessableEntity, ProblemUnsupportedCodec, "WebM carries VP8, VP9 and Opus, MP4 H264, VP9 and Opus")
+			return
+		case err != nil:
+			logger.Errorw("Unable to stream live", "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, err.Error())
+			return
+		}
+		defer live.Close()
+
+		flusher, _ := w.(http.Flusher)
+		logger.Infow("Live stream started", "streamID", streamID, "format", format)
+		defer logger.Infow("Live stream ended", "streamID", streamID, "format", format)
+		started := false
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case chunk, ok := <-live.Chunks():
+				if !ok {
+					if !started {
+						writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Stream ended before its first keyframe")
+					}
+					return
+				}
+				if !started {
+					// The codecs are known with the first chunk
+					w.Header().Set("Content-Type", live.ContentType())
+					w.Header().Set("Cache-Control", "no-cache")
+					w.Header().Set("X-Content-Type-Options", "nosniff")
+					w.WriteHeader(http.StatusOK)
+					started = true
+				}
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+	}
+}
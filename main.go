@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"text/template"
 	"time"
 
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"go.uber.org/zap"
@@ -63,30 +68,406 @@ func main() {
 
 	suggar := logger.Sugar()
 
-	broadcaster := NewBroadcaster(RRDist)
+	if len(os.Args) > 1 && os.Args[1] == "record" {
+		if err := runRecord(os.Args[2:]); err != nil {
+			suggar.Fatalw("Recording failed", "error", err)
+		}
+		return
+	}
+
+	config, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		suggar.Fatalw("Invalid configuration", "error", err)
+	}
+
+	rooms := NewRooms(config.RoomIdleTimeout, func(ctx context.Context, name string, b *hub.Broadcaster) {
+		suggar.Infow("Room created", "room", name)
+		b.SetReadBufferSize(config.ReadBufferSize)
+		b.SetCodecSet(config.Codecs)
+		b.SetRebalanceDelay(config.RebalanceDelay)
+		b.SetKeyframeLossThreshold(config.KeyframeLossThreshold)
+		b.SetOfferTimeout(config.OfferTimeout, config.OfferRetries)
+		// Validated by LoadConfig
+		b.UseDistribution(config.Distribution)
+		if config.Program {
+			b.EnableProgram()
+		}
+		if config.ReplayWindow > 0 {
+			b.EnableReplay(config.ReplayWindow)
+		}
+		if config.RecordDir != "" {
+			b.EnableRecording(hub.RecordingOptions{
+				Dir:     filepath.Join(config.RecordDir, name),
+				Format:  config.RecordFormat,
+				Streams: config.RecordStreams,
+			})
+		}
+		if config.HLS || config.HLSOptions.DASH {
+			b.EnableHLS(config.HLSOptions)
+		}
+		if config.Snapshots || config.Thumbnails.Interval > 0 {
+			b.EnableSnapshots(ffmpegDecoder{path: config.FFmpeg})
+		}
+		if config.Thumbnails.Interval > 0 {
+			thumbnails := config.Thumbnails
+			if thumbnails.Dir != "" {
+				thumbnails.Dir = filepath.Join(thumbnails.Dir, name)
+			}
+			b.EnableThumbnails(thumbnails)
+		}
+		if config.Previews {
+			b.EnablePreviews(ffmpegVideoCodec{path: config.FFmpeg})
+		}
+		if config.Composite {
+			if err := b.EnableCompositor(ffmpegVideoCodec{path: config.FFmpeg}, config.CompositeOptions); err != nil {
+				suggar.Errorw("Unable to composite the room video", "room", name, "error", err)
+			}
+		}
+		b.SetReconnectPolicy(hub.ReconnectPolicy{
+			RetryAfter: config.ReconnectRetryAfter,
+			MaxBackoff: config.ReconnectMaxBackoff,
+			Alternates: config.AlternateHubs,
+		})
+		if config.EgressBudget > 0 {
+			b.EnableEgressBudget(config.EgressBudget*1000, 5*time.Second)
+		}
+		if config.PublisherMaxBitrate > 0 || config.PublisherBitrateFollowReceivers {
+			b.EnablePublisherBitrateCap(config.PublisherMaxBitrate*1000, config.PublisherBitrateFollowReceivers)
+		}
+		if config.PublisherReconnectGrace > 0 {
+			b.EnableTrackContinuity(config.PublisherReconnectGrace)
+		}
+		if config.ActiveSpeakerInterval > 0 {
+			b.EnableActiveSpeakers(config.ActiveSpeakerInterval, config.ActiveSpeakerPriority)
+		}
+		if config.AudioMix {
+			if err := b.EnableAudioMixing(newMixerCodec()); err != nil {
+				suggar.Errorw("Unable to mix the room audio", "room", name, "error", err)
+			}
+		}
+		if config.LayerAdaptationInterval > 0 {
+			b.EnableLayerAdaptation(config.LayerAdaptationInterval)
+		}
+		if config.CongestionInterval > 0 {
+			b.EnableCongestionControl(config.CongestionInterval)
+		}
+		if config.SlowReceivers.Policy != "" {
+			b.EnableSlowReceiverPolicy(config.SlowReceivers, time.Second)
+		}
+		if config.WHIPConnectTimeout > 0 || config.WHIPDisconnectTimeout > 0 {
+			go b.ReapStaleSenders(ctx, config.WHIPConnectTimeout, config.WHIPDisconnectTimeout)
+		}
+		if config.PublisherIdleTimeout > 0 {
+			go b.EvictIdlePublishers(ctx, config.PublisherIdleTimeout)
+		}
+	})
+	// Relayed and pulled streams live in the default room
+	broadcaster := rooms.Get(DefaultRoom)
+
+	// Background subsystems stop when the hub starts draining
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	defer stopRunning()
+	go rooms.ReapIdle(runCtx)
+	if config.WHIPRelayURL != "" {
+		relay := NewWHIPRelay(broadcaster, config.WHIPRelayURL, config.WHIPRelayToken, config.WHIPRelayStreams)
+		go relay.Run(runCtx)
+	}
+	for _, upstream := range config.WHEPPullURLs {
+		puller := NewWHEPPuller(broadcaster, upstream, config.WHEPPullToken)
+		go puller.Run(runCtx)
+	}
+	for key, camera := range config.RTSPCameras {
+		puller := NewRTSPPuller(rooms, key, camera, ffmpegAudioCodec{path: config.FFmpeg})
+		go puller.Run(runCtx)
+	}
+	for key, description := range config.RTPIngests {
+		go func(key string, description []byte) {
+			if err := serveRTPIngest(runCtx, config, rooms, key, description, suggar); err != nil {
+				suggar.Fatalw("RTP ingest failed", "key", key, "error", err)
+			}
+		}(key, description)
+	}
+	testSources := NewTestSources(runCtx, config.FFmpeg)
+	if config.TestSource != "" {
+		// Validated by LoadConfig
+		name, streamID, _ := splitStreamKey(config.TestSource)
+		if err := testSources.Start(rooms.Get(name), streamID); err != nil {
+			suggar.Fatalw("Test source failed", "error", err)
+		}
+	}
+	var recordingStore *s3Client
+	if config.S3.Bucket != "" {
+		// Validated by LoadConfig
+		recordingStore, _ = newS3Client(config.S3)
+		go archiveRecordings(runCtx, config.RecordDir, recordingStore, config.RecordRetention, suggar)
+	}
+	vodPackager := newVODPackager(config.FFmpeg, vodSegmentDuration)
+	// The previews of every listener share their bound
+	previewSlots := make(chan struct{}, config.PreviewMax)
+
+	var placement PlacementPolicy
+	switch config.Placement {
+	case "static":
+		placement = StaticShardPlacement{Self: config.PlacementSelf, Shards: config.PlacementPeers}
+	case "least-publishers":
+		leastPublishers := NewLeastPublishersPlacement(rooms, config.PlacementPeers)
+		go leastPublishers.Run(runCtx, 5*time.Second)
+		placement = leastPublishers
+	}
 
 	indexHTML, err := os.ReadFile("index.html")
 	if err != nil {
 		panic(err)
 	}
 	indexTemplate := template.Must(template.New("").Parse(string(indexHTML)))
+	chat := chatOptions{MaxLength: config.ChatMaxLength}
+	if config.ChatRate > 0 {
+		chat.Limiter = newIPRateLimiter(config.ChatRate, config.ChatBurst)
+	}
+	receivers := receiverOptions{
+		Keepalive:   keepalive{Interval: config.SignalingPingInterval, Timeout: config.SignalingTimeout},
+		Sessions:    newReceiverSessions(config.ResumeGrace),
+		ICERestarts: config.ICERestarts,
+		MaxBitrate:  config.ReceiverMaxBitrate,
+		Chat:        chat,
+	}
+
+	sseSignaling := newSSESignalers()
+
+	capabilities := Capabilities{
+		Audio:         true,
+		Simulcast:     true,
+		Replay:        config.ReplayWindow > 0,
+		Recording:     config.RecordDir != "",
+		ServerTrickle: config.WHEPServerTrickle,
+		Codecs:        config.Codecs.MimeTypes,
+	}
 
-	router := chi.NewRouter()
-	// A good base middleware stack
-	router.Use(middleware.RequestID)
-	router.Use(middleware.RealIP)
-	router.Use(LogMiddleware(suggar))
-	router.Use(middleware.Recoverer)
+	newRouter := func(listener ListenerConfig) http.Handler {
+		router := chi.NewRouter()
+		// A good base middleware stack
+		router.Use(middleware.RequestID)
+		router.Use(ProxyMiddleware(config.TrustedProxies))
+		router.Use(LogMiddleware(suggar.With("listener", listener.Addr)))
+		router.Use(middleware.Recoverer)
 
-	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
-		if err := indexTemplate.Execute(w, "ws://"+r.Host+"/websocket"); err != nil {
-			logger.Error(err)
+		if listener.Roles[RolePublic] {
+			router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+				if err := indexTemplate.Execute(w, webSocketURL(r, roomPath(r, "/websocket", nil))); err != nil {
+					logger.Error(err)
+				}
+			})
+			router.Get("/websocket", webSocketHandler(rooms, receivers, websocketAcceptOptions(config)))
+			router.Post(grpcSignalPath, grpcSignalHandler(rooms, receivers))
+			router.Post("/events", sseCreateHandler(rooms, receivers, sseSignaling))
+			router.Get("/events/{receiverID}", sseStreamHandler(sseSignaling))
+			router.Post("/events/{receiverID}", ssePostHandler(sseSignaling))
+			router.Delete("/events/{receiverID}", sseDeleteHandler(sseSignaling))
+			router.Options("/whep", optionsHandler(capabilities))
+			router.Post("/whep", whepHandler(rooms, capabilities))
+			router.Delete("/whep/{peerID}", whepDeleteHandler(rooms))
+			router.Post("/whep/{peerID}/sse", whepSSESubscribeHandler(rooms))
+			router.Get("/whep/{peerID}/sse", whepSSEHandler(rooms))
+			if config.HLS {
+				router.Get("/hls/{streamID}/index.m3u8", hlsPlaylistHandler(rooms, 3*config.HLSOptions.SegmentDuration))
+				router.Get("/hls/{streamID}/{file}", hlsFileHandler(rooms, 3*config.HLSOptions.SegmentDuration))
+			}
+			if config.HLSOptions.DASH {
+				router.Get("/dash/{streamID}/manifest.mpd", dashManifestHandler(rooms, 3*config.HLSOptions.SegmentDuration))
+				router.Get("/dash/{streamID}/{file}", dashFileHandler(rooms))
+			}
+			if config.Thumbnails.Interval > 0 {
+				router.Get("/thumbnails", thumbnailsHandler(rooms))
+				router.Get("/thumbnails/{streamID}/{file}", thumbnailHandler(rooms, config.Thumbnails.Interval))
+			}
+			if config.Live {
+				router.Get("/live/{file}", liveStreamHandler(rooms))
+			}
+			if config.Previews {
+				router.Get("/preview/{file}", previewHandler(rooms, config.PreviewWidth, config.PreviewHeight, config.PreviewFrameRate, previewSlots))
+			}
+			if config.VOD {
+				if config.VODHLS {
+					router.Get("/vod/{recordingID}/hls/{file}", vodHLSHandler(config.RecordDir, vodPackager))
+				}
+				router.Get("/vod/{recordingID}/{file}", vodFileHandler(config.RecordDir))
+			}
 		}
-	})
-	router.Get("/websocket", webSocketHandler(&broadcaster))
-	router.Post("/whip", whipHandler(&broadcaster))
-	router.Delete("/whip/{peerID}", whipDeleteHandler(&broadcaster))
+		if listener.Roles[RoleContribution] {
+			router.Group(func(r chi.Router) {
+				if config.WHIPRateLimit > 0 {
+					r.Use(RateLimitMiddleware(config.WHIPRateLimit, config.WHIPRateBurst))
+				}
+				if placement != nil {
+					r.Use(PlacementMiddleware(placement))
+				}
+				r.Options("/whip", optionsHandler(capabilities))
+				r.Post("/whip", whipHandler(rooms, config.MaxPublishers, capabilities, chat))
+				r.Delete("/whip/{peerID}", whipDeleteHandler(rooms))
+				r.Get("/whip/{peerID}/viewers", whipViewersHandler(rooms))
+			})
+		}
+		if listener.Roles[RoleAdmin] {
+			router.Get("/api/load", loadHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Get("/api/receivers", receiversHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Get("/api/rebalances", rebalancesHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Get("/api/stats", statsHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Get("/api/distribution", distributionHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Put("/api/distribution", setDistributionHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Get("/api/program", programHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Get("/api/events", roomEventsHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Put("/api/program", switchProgramHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Put("/api/receivers/{receiverID}/pin", pinReceiverHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Delete("/api/receivers/{receiverID}/pin", unpinReceiverHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Post("/api/receivers/{receiverID}/pause", pauseTrackHandler(rooms, true))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Post("/api/receivers/{receiverID}/resume", pauseTrackHandler(rooms, false))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Put("/api/tracks/priority", trackPriorityHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Get("/api/recordings", recordingsHandler(rooms))
+			if config.RecordDir != "" {
+				router.With(RequireScope(config.APITokens, ScopeAdmin)).Get("/api/recordings/completed", completedRecordingsHandler(config.RecordDir))
+				router.With(RequireScope(config.APITokens, ScopeAdmin)).Delete("/api/recordings/completed/{recordingID}", deleteRecordingHandler(config.RecordDir, recordingStore))
+			}
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Post("/api/recordings/{streamID}", startRecordingHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Delete("/api/recordings/{streamID}", stopRecordingHandler(rooms))
+			if config.Snapshots {
+				router.With(RequireScope(config.APITokens, ScopeAdmin)).Get("/api/streams/{streamID}/snapshot.jpg", snapshotHandler(rooms))
+			}
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Post("/api/test-sources/{streamID}", startTestSourceHandler(rooms, testSources))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Delete("/api/test-sources/{streamID}", stopTestSourceHandler(rooms, testSources))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Get("/api/egress", egressesHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Post("/api/egress/rtmp", egressStartHandler(rooms, (*hub.Broadcaster).StartRTMPEgress))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Post("/api/egress/srt", egressStartHandler(rooms, (*hub.Broadcaster).StartSRTEgress))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Post("/api/egress/pipe", pipeEgressHandler(rooms, config.PipeEgresses))
+			router.With(RequireScope(config.APITokens, ScopeAdmin)).Delete("/api/egress/{egressID}", stopEgressHandler(rooms))
+			router.With(RequireScope(config.APITokens, ScopeCompliance)).
+				Get("/api/compliance/tap/{streamID}", complianceTapHandler(rooms, config.ComplianceStreams))
+		}
+		return router
+	}
+
+	// A previous hub process may hand its listeners over for a binary upgrade
+	var inherited map[string]net.Listener
+	if config.HandoffSocket != "" {
+		var state *handoffState
+		inherited, state, err = inheritListeners(config.HandoffSocket)
+		if err != nil {
+			suggar.Fatalw("Unable to take over from the previous process", "error", err)
+		}
+		if state != nil {
+			suggar.Infow("Took over listeners from the previous process", "listeners", state.Listeners, "sessions", len(state.Sessions))
+		}
+	}
+
+	servers := make([]*http.Server, 0, len(config.Listeners))
+	listeners := make([]net.Listener, 0, len(config.Listeners))
+	addrs := make([]string, 0, len(config.Listeners))
+	for _, listener := range config.Listeners {
+		ln, ok := inherited[listener.Addr]
+		if !ok {
+			if ln, err = net.Listen("tcp", listener.Addr); err != nil {
+				suggar.Fatal(err)
+			}
+		}
+		servers = append(servers, &http.Server{Addr: listener.Addr, Handler: newRouter(listener)})
+		listeners = append(listeners, ln)
+		addrs = append(addrs, listener.Addr)
+	}
+	shutdownServers := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+		defer cancel()
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				suggar.Errorw("Unable to shutdown cleanly", "addr", server.Addr, "error", err)
+			}
+		}
+	}
 
-	suggar.Fatal(http.ListenAndServe(":8080", router))
+	lingerCtx, stopLingering := context.WithCancel(context.Background())
+	defer stopLingering()
+	handedOff := make(chan struct{})
+	if config.HandoffSocket != "" {
+		err := serveHandoff(config.HandoffSocket, addrs, listeners, rooms, func() {
+			// Established sessions have their own sockets and stay up, the
+			// next process serves everything new
+			suggar.Infow("Handed listeners off, serving established sessions", "linger", config.HandoffLinger)
+			close(handedOff)
+			stopRunning()
+			shutdownServers()
+		})
+		if err != nil {
+			suggar.Fatalw("Unable to serve handoffs", "error", err)
+		}
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		suggar.Infow("Draining before shutdown", "signal", sig.String())
+		stopRunning()
+		stopLingering()
+		rooms.Drain("shutdown")
+		shutdownServers()
+	}()
+
+	if config.RTSPAddr != "" {
+		go func() {
+			if err := serveRTSP(runCtx, config, rooms, suggar); err != nil {
+				suggar.Fatalw("RTSP server failed", "error", err)
+			}
+		}()
+	}
+
+	if config.RTMPAddr != "" {
+		go func() {
+			if err := serveRTMP(runCtx, config, rooms, suggar); err != nil {
+				suggar.Fatalw("RTMP server failed", "error", err)
+			}
+		}()
+	}
+
+	if config.SRTAddr != "" {
+		go func() {
+			if err := serveSRT(runCtx, config, rooms, suggar); err != nil {
+				suggar.Fatalw("SRT listener failed", "error", err)
+			}
+		}()
+	}
+
+	if config.WebTransportAddr != "" {
+		go func() {
+			if err := serveWebTransport(runCtx, config, rooms, receivers, suggar); err != nil {
+				suggar.Fatalw("WebTransport signaling failed", "error", err)
+			}
+		}()
+	}
+
+	served := make(chan error, len(servers))
+	for i, server := range servers {
+		listener := config.Listeners[i]
+		server, ln := server, listeners[i]
+		go func() {
+			suggar.Infow("Listening", "addr", listener.Addr, "roles", listener.Roles, "tls", listener.TLS())
+			if listener.TLS() {
+				served <- server.ServeTLS(ln, listener.TLSCert, listener.TLSKey)
+			} else {
+				served <- server.Serve(ln)
+			}
+		}()
+	}
+	for range servers {
+		if err := <-served; err != http.ErrServerClosed {
+			suggar.Fatal(err)
+		}
+	}
+	select {
+	case <-handedOff:
+		ctx, cancel := context.WithTimeout(lingerCtx, config.HandoffLinger)
+		rooms.WaitIdle(ctx)
+		cancel()
+		rooms.Drain("upgrade")
+	default:
+	}
+	rooms.Close()
 }
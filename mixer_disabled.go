@@ -0,0 +1,12 @@
+//go:build !opus
+
+package main
+
+import "github.com/diconico07/webrtc-hub-example/pkg/hub"
+
+// mixerSupported tells whether the audio mix can be enabled
+const mixerSupported = false
+
+func newMixerCodec() hub.MixerCodec {
+	return nil
+}
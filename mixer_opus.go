@@ -0,0 +1,38 @@
+//go:build opus
+
+// The opus build tag links libopus and libopusfile with cgo, their
+// development packages (libopus-dev and libopusfile-dev on Debian) and
+// pkg-config must be installed
+
+package main
+
+import (
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"gopkg.in/hraban/opus.v2"
+)
+
+// mixerSupported tells whether the audio mix can be enabled
+const mixerSupported = true
+
+// opusCodec builds the decoders and encoder of the audio mix with libopus
+type opusCodec struct{}
+
+func newMixerCodec() hub.MixerCodec {
+	return opusCodec{}
+}
+
+func (opusCodec) NewDecoder() (hub.AudioDecoder, error) {
+	decoder, err := opus.NewDecoder(48000, 1)
+	if err != nil {
+		return nil, err
+	}
+	return decoder, nil
+}
+
+func (opusCodec) NewEncoder() (hub.AudioEncoder, error) {
+	encoder, err := opus.NewEncoder(48000, 1, opus.AppVoIP)
+	if err != nil {
+		return nil, err
+	}
+	return encoder, nil
+}
@@ -0,0 +1,188 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// recordingMetadataFile describes a completed recording in its directory,
+// the sessions without one are still being written or were cut short
+const recordingMetadataFile = "recording.json"
+
+// ErrUnknownRecording is returned for the recordings not found on disk
+var ErrUnknownRecording = errors.New("unknown recording")
+
+// RecordingFile is a file of a completed recording
+type RecordingFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// URL is where the file was uploaded to, if it was
+	URL string `json:"url,omitempty"`
+}
+
+// CompletedRecording describes a recording session whose files are
+// finalized
+type CompletedRecording struct {
+	ID       string    `json:"id"`
+	Room     string    `json:"room,omitempty"`
+	StreamID string    `json:"streamID"`
+	Dir      string    `json:"dir"`
+	Started  time.Time `json:"started"`
+	Ended    time.Time `json:"ended"`
+	// Duration is from the start to the end of the session
+	Duration float64         `json:"durationSeconds"`
+	Files    []RecordingFile `json:"files"`
+	// Size is the total of the files
+	Size    int64  `json:"size"`
+	Dropped uint64 `json:"dropped"`
+	// Uploaded is when the files were uploaded to object storage
+	Uploaded *time.Time `json:"uploaded,omitempty"`
+	// Offloaded recordings only have their description left on disk, their
+	// files are at their URL
+	Offloaded bool `json:"offloaded,omitempty"`
+}
+
+// completeRecording describes the session in its directory once the
+// files of all its tracks are finalized, it must run on the loop
+func (s *Broadcaster) completeRecording(session *recordingSession) {
+	ended := time.Now().UTC()
+	recorders := session.recorders
+	s.completing.Add(1)
+	go func() {
+		defer s.completing.Done()
+		for _, recorder := range recorders {
+			<-recorder.finished
+		}
+		recording := CompletedRecording{
+			ID:       session.id,
+			StreamID: session.streamID,
+			Dir:      session.dir,
+			Started:  session.started,
+			Ended:    ended,
+			Duration: ended.Sub(session.started).Seconds(),
+			Files:    []RecordingFile{},
+		}
+		for _, recorder := range recorders {
+			recording.Dropped += recorder.dropped.Load()
+		}
+		entries, err := os.ReadDir(session.dir)
+		if err != nil {
+			zap.S().Warnw("Unable to list the recording", "dir", session.dir, "error", err)
+			return
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			recording.Files = append(recording.Files, RecordingFile{Name: entry.Name(), Size: info.Size()})
+			recording.Size += info.Size()
+		}
+		if err := writeRecordingMetadata(recording); err != nil {
+			zap.S().Warnw("Unable to describe the recording", "dir", session.dir, "error", err)
+			return
+		}
+		zap.S().Infow("Recording completed", "id", recording.ID, "streamID", recording.StreamID, "size", recording.Size)
+	}()
+}
+
+// writeRecordingMetadata replaces the description of the recording
+func writeRecordingMetadata(recording CompletedRecording) error {
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Renamed into place for the listings never to read half of it
+	temporary := filepath.Join(recording.Dir, "."+recordingMetadataFile)
+	if err := os.WriteFile(temporary, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, filepath.Join(recording.Dir, recordingMetadataFile))
+}
+
+// SaveCompletedRecording replaces the description of a completed
+// recording
+func SaveCompletedRecording(recording CompletedRecording) error {
+	// The room is that of the directory
+	recording.Room = ""
+	return writeRecordingMetadata(recording)
+}
+
+// OffloadRecording removes the files of an uploaded recording, its
+// description is kept for the listings
+func OffloadRecording(recording CompletedRecording) (CompletedRecording, error) {
+	if recording.Uploaded == nil {
+		return recording, errors.New("recording is not uploaded")
+	}
+	for _, file := range recording.Files {
+		if err := os.Remove(filepath.Join(recording.Dir, file.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return recording, err
+		}
+	}
+	recording.Offloaded = true
+	return recording, SaveCompletedRecording(recording)
+}
+
+// CompletedRecordings lists the completed recordings of the recording
+// directory of a Broadcaster, oldest first
+func CompletedRecordings(dir string) ([]CompletedRecording, error) {
+	recordings := []CompletedRecording{}
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*", recordingMetadataFile))
+	if err != nil {
+		return recordings, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		recording := CompletedRecording{}
+		if err := json.Unmarshal(data, &recording); err != nil {
+			zap.S().Warnw("Invalid recording description", "file", file, "error", err)
+			continue
+		}
+		// The directories may have been moved around
+		recording.Dir = filepath.Dir(file)
+		recordings = append(recordings, recording)
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Started.Before(recordings[j].Started)
+	})
+	return recordings, nil
+}
+
+// FindCompletedRecording finds a completed recording of the recording
+// directory of a Broadcaster
+func FindCompletedRecording(dir string, id string) (CompletedRecording, error) {
+	recordings, err := CompletedRecordings(dir)
+	if err != nil {
+		return CompletedRecording{}, err
+	}
+	for _, recording := range recordings {
+		if recording.ID == id {
+			return recording, nil
+		}
+	}
+	return CompletedRecording{}, ErrUnknownRecording
+}
+
+// DeleteRecording removes the files of a completed recording of the
+// recording directory of a Broadcaster
+func DeleteRecording(dir string, id string) (CompletedRecording, error) {
+	recording, err := FindCompletedRecording(dir, id)
+	if err != nil {
+		return recording, err
+	}
+	if err := os.RemoveAll(recording.Dir); err != nil {
+		return recording, err
+	}
+	// The directory of the stream goes with its last recording
+	os.Remove(filepath.Dir(recording.Dir))
+	return recording, nil
+}
@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v4"
+)
+
+// Bounds of the send side bandwidth estimation of receiver connections, in
+// bits per second
+const (
+	bandwidthInitialEstimate = 1_000_000
+	bandwidthMinEstimate     = 100_000
+	bandwidthMaxEstimate     = 50_000_000
+)
+
+// BandwidthMonitor holds the estimator the congestion controller of a
+// receiver connection feeds with the TWCC feedback of the receiver
+type BandwidthMonitor struct {
+	lock      sync.Mutex
+	estimator cc.BandwidthEstimator
+	// ceiling caps the estimate to the rate of the pacer, if any
+	ceiling int
+}
+
+func NewBandwidthMonitor() *BandwidthMonitor {
+	return &BandwidthMonitor{}
+}
+
+// Estimate is the bandwidth towards the receiver in bits per second, zero
+// until the connection is up
+func (m *BandwidthMonitor) Estimate() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.estimator == nil {
+		return 0
+	}
+	if estimate := m.estimator.GetTargetBitrate(); m.ceiling == 0 || estimate < m.ceiling {
+		return estimate
+	}
+	return m.ceiling
+}
+
+func (m *BandwidthMonitor) setCeiling(ceiling int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.ceiling = ceiling
+}
+
+func (m *BandwidthMonitor) setEstimator(estimator cc.BandwidthEstimator) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.estimator = estimator
+}
+
+// registerBandwidthEstimation adds the TWCC header extension to the sent
+// packets and a congestion controller reading the feedback, packets are
+// not paced
+func registerBandwidthEstimation(m *webrtc.MediaEngine, i *interceptor.Registry, monitor *BandwidthMonitor) error {
+	controller, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(bandwidthInitialEstimate),
+			gcc.SendSideBWEMinBitrate(bandwidthMinEstimate),
+			gcc.SendSideBWEMaxBitrate(bandwidthMaxEstimate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return err
+	}
+	controller.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		monitor.setEstimator(estimator)
+	})
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBTransportCC}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBTransportCC}, webrtc.RTPCodecTypeAudio)
+	// The controller must see the sequence numbers the extension sets
+	i.Add(controller)
+	return webrtc.ConfigureTWCCHeaderExtensionSender(m, i)
+}
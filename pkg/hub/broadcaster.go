@@ -0,0 +1,1664 @@
+// Package hub is the fanout engine of webrtc-hub: publishers add tracks to a
+// Broadcaster, which forwards them to the receivers picked by a Distribution
+// and renegotiates each receiver over its Signaler.
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+// DefaultRebalanceDelay is how long changes are collected before receivers
+// get renegotiated, so that a burst of joins costs a single renegotiation
+const DefaultRebalanceDelay = 250 * time.Millisecond
+
+// TrackSink receives a copy of every RTP packet forwarded on a track.
+// The packet buffer is reused after WriteRTP returns.
+type TrackSink interface {
+	WriteRTP(packet []byte) error
+	Close() error
+}
+
+// Broadcaster forwards the tracks of its publishers to its receivers. Its
+// state is owned by a single goroutine running the commands sent by the
+// methods, which are safe for concurrent use. Queries return snapshots.
+type Broadcaster struct {
+	commands chan func()
+	// rebalancePending asks the loop to rebalance once the current command is done
+	rebalancePending bool
+	// rebalanceDelay coalesces the rebalances requested within that window
+	rebalanceDelay time.Duration
+	rebalanceTimer *time.Timer
+	// Offers left unanswered for offerTimeout are sent again offerRetries
+	// times before the receiver is dropped
+	offerTimeout time.Duration
+	offerRetries int
+
+	peerSender map[uuid.UUID]PeerSenderState
+	// publisherChats are the chat data channels of the publishers
+	publisherChats map[uuid.UUID]*webrtc.DataChannel
+	whepSessions   map[uuid.UUID]*WHEPSession
+	senders        map[string]webrtc.TrackLocal
+	receivers      map[uuid.UUID]ReceiverState
+	// sources are the tracks the senders forward, keyed like senders
+	sources map[string]trackSource
+
+	// The forwarding loops write to the sinks, they do not go through commands
+	sinks    map[string]map[TrackSink]bool
+	sinkLock sync.RWMutex
+	// retransmits are the caches answering the NACKs of receivers, keyed
+	// like senders and guarded by sinkLock
+	retransmits map[string]*retransmitCache
+
+	replayWindow time.Duration
+	replays      map[string]*replayBuffer
+
+	// recordings are the streams being recorded to recordingDir, those in
+	// recordStreams are as soon as they are published
+	recordingDir    string
+	recordingFormat RecordingFormat
+	recordStreams   map[string]bool
+	recordings      map[string]*recordingSession
+	// completing counts the recordings finalizing their files and the
+	// pipelines of the egresses running
+	completing sync.WaitGroup
+	// hlsStreams are the HLS renditions of the streams, packaged when hls
+	// is set
+	hls        *HLSOptions
+	hlsStreams map[string]*hlsStream
+	// egresses push streams out of the hub, keyed by their ID
+	egresses map[string]*egressSession
+	// keyframeCaches keep the last keyframe of the video tracks for the
+	// snapshots, when snapshotDecoder is set
+	snapshotDecoder KeyframeDecoder
+	keyframeCaches  map[string]*keyframeCache
+	thumbnails      *thumbnailStore
+
+	readBufferSize int
+	codecs         CodecSet
+
+	layers map[string]SimulcastLayer
+	// continuities rewrite the packets of the tracks, keyed like senders
+	continuities map[string]*trackContinuity
+	// detached are the tracks kept for continuityGrace after their
+	// publisher left, with the timer removing them
+	detached        map[string]*time.Timer
+	continuityGrace time.Duration
+
+	closed chan struct{}
+
+	meters map[string]*rateMeter
+	// stats count the packets, losses and jitter of the tracks
+	stats map[string]*statsMeter
+	// audioLevels smooth the audio levels of the tracks that have them
+	audioLevels map[string]*audioLevelMeter
+	speakers    speakerState
+	// mixer is set when the publisher audio is mixed into one track
+	mixer *mixer
+	// compositor is set when the publisher video is composited into one
+	// track
+	compositor *compositor
+	// previewCodec decodes the video of the streams previewed
+	previewCodec PreviewCodec
+	// resolutions probe the video tracks
+	resolutions   map[string]*resolutionProbe
+	egressBudget  uint64
+	budgetTrimmed bool
+
+	reconnectPolicy ReconnectPolicy
+	draining        bool
+
+	trackWatchers []chan struct{}
+	// keyframes rate limits and counts the keyframe requests of the tracks
+	keyframes *keyframeController
+	// relays are the connections the tracks without publisher are pulled
+	// from, to request their keyframes
+	relays map[string]*webrtc.PeerConnection
+	// layerAdaptation picks the simulcast layers from the bandwidth estimates
+	layerAdaptation bool
+	// highPriority are the keys of the video tracks protected by FlexFEC
+	highPriority map[string]bool
+	// congestionControl sheds the tracks receivers have no bandwidth for
+	congestionControl bool
+	// slowReceivers is the slow receiver policy, if any
+	slowReceivers *SlowReceiverOptions
+	// pendingPresence collects the joins and leaves until the next rebalance
+	pendingPresence Presence
+
+	distribution Distribution
+	// program is set in program mode, it replaces the distribution
+	program *program
+	// distributionName is the registered name of the distribution, if any
+	distributionName string
+	rebalanceStats   RebalanceStats
+
+	events *EventStream
+}
+
+// PeerSenderState is a publisher connection, its tracks are added with
+// AddSender once registered and removed along with it
+type PeerSenderState struct {
+	ETag     string
+	PeerConn *webrtc.PeerConnection
+	Created  time.Time
+	// Label names the publisher to the receivers of its tracks
+	Label string
+
+	// tracks are the keys of the senders the publisher owns
+	tracks map[string]bool
+}
+
+// NewBroadcaster starts a Broadcaster, its command loop runs until Close.
+// A nil distribution selects DefaultDistribution.
+func NewBroadcaster(distribution Distribution) *Broadcaster {
+	distributionName := ""
+	if distribution == nil {
+		distribution, _ = NewDistribution(DefaultDistribution)
+		distributionName = DefaultDistribution
+	}
+	s := &Broadcaster{
+		commands:         make(chan func()),
+		rebalanceDelay:   DefaultRebalanceDelay,
+		offerTimeout:     DefaultOfferTimeout,
+		offerRetries:     DefaultOfferRetries,
+		distribution:     distribution,
+		distributionName: distributionName,
+		senders:          make(map[string]webrtc.TrackLocal),
+		receivers:        make(map[uuid.UUID]ReceiverState),
+		sources:          make(map[string]trackSource),
+		peerSender:       make(map[uuid.UUID]PeerSenderState),
+		publisherChats:   make(map[uuid.UUID]*webrtc.DataChannel),
+		whepSessions:     make(map[uuid.UUID]*WHEPSession),
+		sinks:            make(map[string]map[TrackSink]bool),
+		retransmits:      make(map[string]*retransmitCache),
+		replays:          make(map[string]*replayBuffer),
+		recordings:       make(map[string]*recordingSession),
+		hlsStreams:       make(map[string]*hlsStream),
+		egresses:         make(map[string]*egressSession),
+		keyframeCaches:   make(map[string]*keyframeCache),
+		meters:           make(map[string]*rateMeter),
+		stats:            make(map[string]*statsMeter),
+		audioLevels:      make(map[string]*audioLevelMeter),
+		resolutions:      make(map[string]*resolutionProbe),
+		readBufferSize:   DefaultReadBufferSize,
+		codecs:           DefaultCodecSet(),
+		layers:           make(map[string]SimulcastLayer),
+		continuities:     make(map[string]*trackContinuity),
+		highPriority:     make(map[string]bool),
+		detached:         make(map[string]*time.Timer),
+		closed:           make(chan struct{}),
+		events:           NewEventStream(32),
+		keyframes:        newKeyframeController(),
+		relays:           make(map[string]*webrtc.PeerConnection),
+	}
+	go s.run()
+	go s.sampleMeters(meterSampleInterval)
+	return s
+}
+
+// run executes the commands one at a time, rebalancing after those that
+// changed the senders or the receivers
+func (s *Broadcaster) run() {
+	for {
+		select {
+		case command := <-s.commands:
+			command()
+		case <-s.closed:
+			return
+		}
+		if s.rebalancePending && !s.isClosed() {
+			s.rebalancePending = false
+			s.rebalanceReceivers()
+		}
+	}
+}
+
+// do runs command on the loop and waits for it. It returns false without
+// running it once the Broadcaster is closed. Commands must not call do.
+func (s *Broadcaster) do(command func()) bool {
+	done := make(chan struct{})
+	select {
+	case s.commands <- func() {
+		defer close(done)
+		command()
+	}:
+	case <-s.closed:
+		return false
+	}
+	<-done
+	return true
+}
+
+func (s *Broadcaster) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// scheduleRebalance rebalances the receivers once the rebalance delay
+// elapsed, the requests made in the meantime are coalesced. It must run on
+// the loop.
+func (s *Broadcaster) scheduleRebalance() {
+	if s.rebalanceDelay <= 0 {
+		s.rebalancePending = true
+		return
+	}
+	if s.rebalanceTimer != nil {
+		return
+	}
+	s.rebalanceTimer = time.AfterFunc(s.rebalanceDelay, func() {
+		s.do(func() {
+			s.rebalanceTimer = nil
+			s.rebalanceReceivers()
+		})
+	})
+}
+
+// Events streams what happens in the room, for monitoring
+func (s *Broadcaster) Events() *EventStream {
+	return s.events
+}
+
+// SetRebalanceDelay sets the window rebalances are coalesced over, 0
+// rebalances right after every change
+func (s *Broadcaster) SetRebalanceDelay(delay time.Duration) {
+	s.do(func() {
+		s.rebalanceDelay = delay
+	})
+}
+
+// SetDistribution changes how tracks are spread over the receivers and
+// rebalances them
+func (s *Broadcaster) SetDistribution(distribution Distribution) {
+	s.do(func() {
+		s.distribution = distribution
+		s.distributionName = ""
+		s.scheduleRebalance()
+	})
+}
+
+// UseDistribution switches to the distribution registered under name
+func (s *Broadcaster) UseDistribution(name string) error {
+	distribution, err := NewDistribution(name)
+	if err != nil {
+		return err
+	}
+	s.do(func() {
+		if s.distributionName == name {
+			return
+		}
+		s.distribution = distribution
+		s.distributionName = name
+		s.scheduleRebalance()
+	})
+	return nil
+}
+
+// DistributionName returns the name the current distribution was selected
+// with, empty when set with SetDistribution
+func (s *Broadcaster) DistributionName() string {
+	name := ""
+	s.do(func() {
+		name = s.distributionName
+	})
+	return name
+}
+
+// SetReadBufferSize sets the buffer new tracks are read into, packets that
+// do not fit are dropped rather than forwarded truncated
+func (s *Broadcaster) SetReadBufferSize(size int) {
+	s.do(func() {
+		s.readBufferSize = size
+	})
+}
+
+func (s *Broadcaster) ReadBufferSize() int {
+	size := DefaultReadBufferSize
+	s.do(func() {
+		size = s.readBufferSize
+	})
+	return size
+}
+
+// SetCodecSet sets the codecs negotiated by the new connections of the room
+func (s *Broadcaster) SetCodecSet(codecs CodecSet) {
+	s.do(func() {
+		s.codecs = codecs
+	})
+}
+
+func (s *Broadcaster) CodecSet() CodecSet {
+	codecs := DefaultCodecSet()
+	s.do(func() {
+		codecs = s.codecs
+	})
+	return codecs
+}
+
+// EnableReplay keeps the last window of every new track for time-shifted viewing
+func (s *Broadcaster) EnableReplay(window time.Duration) {
+	s.do(func() {
+		s.replayWindow = window
+	})
+}
+
+// AddPeerSender registers a publisher connection, it must be registered
+// before its tracks are added
+func (s *Broadcaster) AddPeerSender(peer PeerSenderState) uuid.UUID {
+	id := uuid.New()
+	peer.tracks = make(map[string]bool)
+	s.do(func() {
+		s.peerSender[id] = peer
+		s.joined(RolePublisher, peer.Label)
+	})
+	return id
+}
+
+// DeletePeerSender forgets the publisher and removes its tracks, closing its
+// connection is left to the caller
+func (s *Broadcaster) DeletePeerSender(id uuid.UUID) {
+	s.do(func() {
+		s.deletePeerSender(id)
+	})
+}
+
+// deletePeerSender must run on the loop
+func (s *Broadcaster) deletePeerSender(id uuid.UUID) {
+	peer, ok := s.peerSender[id]
+	if !ok {
+		return
+	}
+	for key := range peer.tracks {
+		s.detachSender(key)
+	}
+	delete(s.peerSender, id)
+	delete(s.publisherChats, id)
+	s.left(RolePublisher, peer.Label)
+}
+
+// ActivePeerSenders counts the publishers whose connection is still alive
+func (s *Broadcaster) ActivePeerSenders() int {
+	count := 0
+	s.do(func() {
+		count = s.activePeerSenders()
+	})
+	return count
+}
+
+func (s *Broadcaster) activePeerSenders() int {
+	count := 0
+	for _, peer := range s.peerSender {
+		switch peer.PeerConn.ConnectionState() {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		default:
+			count++
+		}
+	}
+	return count
+}
+
+// Load is what hubs report about themselves to placement policies
+type Load struct {
+	Publishers int `json:"publishers"`
+	Receivers  int `json:"receivers"`
+}
+
+// Load counts the active publishers and the receivers
+func (s *Broadcaster) Load() Load {
+	load := Load{}
+	s.do(func() {
+		load = Load{Publishers: s.activePeerSenders(), Receivers: len(s.receivers)}
+	})
+	return load
+}
+
+func (s *Broadcaster) GetPeerSender(id uuid.UUID) (PeerSenderState, bool) {
+	var peer PeerSenderState
+	ok := false
+	s.do(func() {
+		peer, ok = s.peerSender[id]
+	})
+	return peer, ok
+}
+
+// PublisherViewers is the audience of a publisher
+type PublisherViewers struct {
+	// Receivers counts the receivers and WHEP players getting at least one
+	// track of the publisher
+	Receivers int `json:"receivers"`
+	// Tracks counts the receivers and WHEP players of each track
+	Tracks map[string]int `json:"tracks"`
+}
+
+// PublisherViewers counts who gets the tracks of the publisher, it returns
+// false when the publisher is unknown
+func (s *Broadcaster) PublisherViewers(id uuid.UUID) (PublisherViewers, bool) {
+	viewers := PublisherViewers{Tracks: make(map[string]int)}
+	found := false
+	s.do(func() {
+		peer, ok := s.peerSender[id]
+		if !ok {
+			return
+		}
+		found = true
+		for key := range peer.tracks {
+			viewers.Tracks[key] = 0
+		}
+		count := func(keys map[string]bool) {
+			watching := false
+			for key := range keys {
+				if _, ok := peer.tracks[key]; ok {
+					viewers.Tracks[key]++
+					watching = true
+				}
+			}
+			if watching {
+				viewers.Receivers++
+			}
+		}
+		for _, receiver := range s.receivers {
+			count(receiver.assigned)
+		}
+		for _, session := range s.whepSessions {
+			keys := make(map[string]bool)
+			for _, sender := range session.PeerConn.GetSenders() {
+				if track := sender.Track(); track != nil {
+					keys[track.StreamID()+track.ID()] = true
+				}
+			}
+			count(keys)
+		}
+	})
+	return viewers, found
+}
+
+func (s *Broadcaster) AddWHEPSession(session *WHEPSession) uuid.UUID {
+	id := uuid.New()
+	s.do(func() {
+		s.whepSessions[id] = session
+		s.joined(RoleViewer, "")
+	})
+	return id
+}
+func (s *Broadcaster) DeleteWHEPSession(id uuid.UUID) {
+	s.do(func() {
+		if session, ok := s.whepSessions[id]; ok {
+			session.Events.Close()
+			delete(s.whepSessions, id)
+			s.left(RoleViewer, "")
+		}
+	})
+}
+func (s *Broadcaster) GetWHEPSession(id uuid.UUID) (*WHEPSession, bool) {
+	var session *WHEPSession
+	ok := false
+	s.do(func() {
+		session, ok = s.whepSessions[id]
+	})
+	return session, ok
+}
+
+// AttachWHEPTracks fills the transceivers offered by a WHEP player, using
+// placeholders when no matching track is published yet so that it can be
+// swapped in later without renegotiation.
+func (s *Broadcaster) AttachWHEPTracks(session *WHEPSession) error {
+	err := errClosed
+	s.do(func() {
+		err = s.attachWHEPTracks(session)
+	})
+	return err
+}
+
+func (s *Broadcaster) attachWHEPTracks(session *WHEPSession) error {
+	used := make(map[webrtc.TrackLocal]bool)
+	for _, transceiver := range session.PeerConn.GetTransceivers() {
+		if transceiver.Sender() != nil {
+			continue
+		}
+		track := s.pickWHEPTrack(session.StreamID, transceiver.Kind(), used)
+		if track == nil {
+			placeholder, err := whepPlaceholderTrack(transceiver.Kind())
+			if err != nil {
+				return err
+			}
+			track = placeholder
+		} else {
+			used[track] = true
+			publishWHEPTrackEvent(session, "active", track)
+		}
+		sender, err := session.PeerConn.AddTrack(track)
+		if err != nil {
+			return err
+		}
+		// WHEP connections answer NACKs from their own send buffers
+		go s.handleReceiverRTCP(sender, nil, nil, nil)
+	}
+	return nil
+}
+
+// refreshWHEPSessions swaps tracks that went away for newly published ones, it must run on the loop
+func (s *Broadcaster) refreshWHEPSessions() {
+	for _, session := range s.whepSessions {
+		used := make(map[webrtc.TrackLocal]bool)
+		for _, sender := range session.PeerConn.GetSenders() {
+			if track := sender.Track(); track != nil && s.senders[track.StreamID()+track.ID()] == track {
+				used[track] = true
+			}
+		}
+		for _, sender := range session.PeerConn.GetSenders() {
+			current := sender.Track()
+			if current != nil && used[current] {
+				continue
+			}
+			if current != nil && s.senders[current.StreamID()+current.ID()] == nil && current.StreamID() != whepPlaceholderStream {
+				publishWHEPTrackEvent(session, "inactive", current)
+			}
+			kind := webrtc.RTPCodecTypeVideo
+			if current != nil {
+				kind = current.Kind()
+			} else if transceiver := whepTransceiver(session.PeerConn, sender); transceiver != nil {
+				kind = transceiver.Kind()
+			}
+			next := s.pickWHEPTrack(session.StreamID, kind, used)
+			if next == nil {
+				if current != nil {
+					sender.ReplaceTrack(nil)
+				}
+				continue
+			}
+			if err := sender.ReplaceTrack(next); err != nil {
+				zap.S().Warnw("Unable to replace WHEP track", "error", err, "track", next.ID())
+				continue
+			}
+			used[next] = true
+			publishWHEPTrackEvent(session, "active", next)
+		}
+	}
+}
+
+func (s *Broadcaster) pickWHEPTrack(streamID string, kind webrtc.RTPCodecType, used map[webrtc.TrackLocal]bool) webrtc.TrackLocal {
+	keys := make([]string, 0, len(s.senders))
+	for key := range s.senders {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		track := s.senders[key]
+		if track.Kind() != kind || used[track] || s.isSpareLayer(key) {
+			continue
+		}
+		if streamID != "" && track.StreamID() != streamID {
+			continue
+		}
+		return track
+	}
+	return nil
+}
+
+// AddSender forwards a track of publisher until it ends or the publisher is
+// deleted. Tracks pulled from elsewhere have no publisher, they are added
+// with the zero UUID. It returns nil when the publisher is unknown.
+func (s *Broadcaster) AddSender(publisher uuid.UUID, t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
+	return s.addSender(publisher, t, nil)
+}
+
+// AddRelayedSender adds a track without publisher pulled over peer, the
+// keyframes of its receivers are requested over peer
+func (s *Broadcaster) AddRelayedSender(peer *webrtc.PeerConnection, t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
+	track := s.addSender(uuid.Nil, t, nil)
+	if track != nil {
+		s.do(func() {
+			s.relays[track.StreamID()+track.ID()] = peer
+		})
+	}
+	return track
+}
+
+// AddSimulcastSender adds one layer of a simulcast track, only the layer
+// with the lowest index of each publisher track gets distributed
+func (s *Broadcaster) AddSimulcastSender(publisher uuid.UUID, t *webrtc.TrackRemote, layer SimulcastLayer) *webrtc.TrackLocalStaticRTP {
+	return s.addSender(publisher, t, &layer)
+}
+
+func (s *Broadcaster) addSender(publisher uuid.UUID, t trackSource, layer *SimulcastLayer) *webrtc.TrackLocalStaticRTP {
+	trackID := t.ID()
+	if layer != nil {
+		// Every layer needs its own local track
+		trackID = t.ID() + "-" + layer.RID
+	}
+	trackLocal, err := webrtc.NewTrackLocalStaticRTP(
+		t.Codec().RTPCodecCapability,
+		trackID,
+		t.StreamID(),
+	)
+	if err != nil {
+		zap.S().Errorw("Unable to create local track", "trackID", t.ID(), "streamID", t.StreamID())
+		return nil
+	}
+	key := trackLocal.StreamID() + trackLocal.ID()
+
+	bufferSize := 0
+	added := false
+	var continuity *trackContinuity
+	var receiver *webrtc.RTPReceiver
+	clock := newSourceClock(t.Codec().ClockRate)
+	if ingest, ok := t.(*IngestTrack); ok {
+		// Timed by the ingest rather than by sender reports
+		clock = ingest.clock
+	}
+	s.do(func() {
+		if publisher != uuid.Nil {
+			peer, ok := s.peerSender[publisher]
+			if !ok {
+				return
+			}
+			peer.tracks[key] = true
+		}
+		added = true
+		bufferSize = s.readBufferSize
+		receiver = trackReceiver(s.peerSender[publisher], t)
+		if existing, ok := s.takeOverSender(key, t, clock); ok {
+			trackLocal, continuity = existing, s.continuities[key]
+			if publisher != uuid.Nil {
+				s.peerSender[publisher].tracks[key] = true
+			}
+			zap.S().Debugw("Track taken over", "TrackID", t.ID(), "TrackStreamID", t.StreamID())
+			return
+		}
+		continuity = newTrackContinuity(t, clock)
+		s.continuities[key] = continuity
+		s.senders[key] = trackLocal
+		s.sources[key] = t
+		if layer != nil {
+			s.layers[key] = *layer
+		}
+		zap.S().Debugw("Add new track", "TrackID", t.ID(), "TrackStreamID", t.StreamID())
+		meter := newRateMeter()
+		s.meters[key] = meter
+		stats := newStatsMeter(t.Codec().ClockRate)
+		s.stats[key] = stats
+		internalSinks := map[TrackSink]bool{meter: true, stats: true}
+		if t.Kind() == webrtc.RTPCodecTypeVideo {
+			// Encrypted payloads carry no resolution to read
+			if !s.opaque() {
+				probe := newResolutionProbe(t.Codec().RTPCodecCapability, func() {
+					// Receivers may not fit the new resolution
+					go s.do(s.scheduleRebalance)
+				})
+				s.resolutions[key] = probe
+				internalSinks[probe] = true
+				if s.snapshotDecoder != nil {
+					if cache := newKeyframeCache(t.Codec().MimeType); cache != nil {
+						s.keyframeCaches[key] = cache
+						internalSinks[cache] = true
+					}
+				}
+			}
+			cache := &retransmitCache{}
+			internalSinks[cache] = true
+			s.sinkLock.Lock()
+			s.retransmits[key] = cache
+			s.sinkLock.Unlock()
+		}
+		if s.replayWindow > 0 {
+			replay := newReplayBuffer(s.replayWindow, t.Codec().MimeType)
+			s.replays[key] = replay
+			internalSinks[replay] = true
+		}
+		if id := s.audioLevelExtensionID(s.peerSender[publisher], t); id != 0 {
+			levels := newAudioLevelMeter(id)
+			s.audioLevels[key] = levels
+			internalSinks[levels] = true
+		}
+		s.sinkLock.Lock()
+		s.sinks[key] = internalSinks
+		s.sinkLock.Unlock()
+		s.recordNewTrack(key)
+		s.packageNewTrack(key)
+		s.egressNewTrack(key)
+		s.notifyTrackWatchers()
+		s.scheduleRebalance()
+	})
+	if !added {
+		return nil
+	}
+
+	// Receivers get the timing of the publisher for A/V sync
+	if receiver != nil {
+		go readSenderReports(receiver, t, clock)
+	}
+	go func() {
+		pooled := getPacketBuffer(bufferSize)
+		defer putPacketBuffer(pooled)
+		buf := *pooled
+		// Parsed in place for every packet, so that forwarding does not
+		// allocate one per packet like TrackLocalStaticRTP.Write does
+		packet := &rtp.Packet{}
+		oversized, malformed := 0, 0
+		for {
+			i, _, err := t.Read(buf)
+			if errors.Is(err, io.ErrShortBuffer) {
+				// Forwarding a truncated packet would corrupt the stream
+				// for every receiver, drop it and keep going
+				if oversized++; oversized%100 == 1 {
+					zap.S().Warnw("Dropping RTP packet larger than the read buffer",
+						"trackID", t.ID(), "streamID", t.StreamID(), "bufferSize", bufferSize, "dropped", oversized)
+				}
+				continue
+			}
+			if err != nil {
+				s.releaseSender(key, t)
+				return
+			}
+
+			if err := packet.Unmarshal(buf[:i]); err != nil {
+				if malformed++; malformed%100 == 1 {
+					zap.S().Warnw("Dropping malformed RTP packet",
+						"trackID", t.ID(), "streamID", t.StreamID(), "error", err, "dropped", malformed)
+				}
+				continue
+			}
+			if !continuity.rewrite(t, packet, buf[:i]) {
+				// Another publisher took the track over
+				return
+			}
+			if err = trackLocal.WriteRTP(packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				return
+			}
+			s.writeSinks(key, buf[:i])
+		}
+	}()
+
+	return trackLocal
+}
+
+// AddReceiver registers a receiver connection, it gets offered its tracks
+// through its Signaler
+func (s *Broadcaster) AddReceiver(receiver ReceiverState) uuid.UUID {
+	id := uuid.New()
+	receiver.replays = make(map[string]*replaySession)
+	s.do(func() {
+		s.receivers[id] = receiver
+		s.joined(RoleViewer, "")
+	})
+	return id
+}
+
+func (s *Broadcaster) RemoveSender(t webrtc.TrackLocal) {
+	s.do(func() {
+		zap.S().Debugw("Removing Track", "StreamID", t.StreamID(), "TrackID", t.ID())
+		s.removeSender(t.StreamID() + t.ID())
+	})
+}
+
+// releaseSender detaches the track key once source stopped, unless it was
+// taken over since
+func (s *Broadcaster) releaseSender(key string, source trackSource) {
+	s.do(func() {
+		if s.sources[key] == source {
+			s.detachSender(key)
+		}
+	})
+}
+
+// removeSender stops distributing the track, it must run on the loop
+func (s *Broadcaster) removeSender(key string) {
+	if _, ok := s.senders[key]; !ok {
+		return
+	}
+
+	if timer, ok := s.detached[key]; ok {
+		timer.Stop()
+		delete(s.detached, key)
+	}
+	delete(s.continuities, key)
+	delete(s.senders, key)
+	delete(s.sources, key)
+	for _, peer := range s.peerSender {
+		delete(peer.tracks, key)
+	}
+	delete(s.layers, key)
+	delete(s.replays, key)
+	delete(s.meters, key)
+	delete(s.stats, key)
+	delete(s.audioLevels, key)
+	delete(s.resolutions, key)
+	delete(s.keyframeCaches, key)
+	delete(s.highPriority, key)
+	delete(s.relays, key)
+	s.keyframes.forget(key)
+	s.closeSinks(key)
+	s.endRecordedTrack(key)
+	s.endPackagedTrack(key)
+	s.endEgressTrack(key)
+	s.notifyTrackWatchers()
+	s.scheduleRebalance()
+}
+
+// WatchTracks returns a channel signaled whenever a track is added or removed,
+// signals are coalesced when the watcher is busy
+func (s *Broadcaster) WatchTracks() <-chan struct{} {
+	watcher := make(chan struct{}, 1)
+	s.do(func() {
+		s.trackWatchers = append(s.trackWatchers, watcher)
+	})
+	return watcher
+}
+
+// notifyTrackWatchers signals the track watchers, it must run on the loop
+func (s *Broadcaster) notifyTrackWatchers() {
+	for _, watcher := range s.trackWatchers {
+		select {
+		case watcher <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Streams returns the tracks currently published, grouped by stream ID
+func (s *Broadcaster) Streams() map[string][]webrtc.TrackLocal {
+	streams := make(map[string][]webrtc.TrackLocal)
+	s.do(func() {
+		for key, track := range s.senders {
+			if s.isSpareLayer(key) {
+				continue
+			}
+			streams[track.StreamID()] = append(streams[track.StreamID()], track)
+		}
+	})
+	return streams
+}
+
+// ReceiverInfo describes a receiver for monitoring
+type ReceiverInfo struct {
+	Room   string      `json:"room,omitempty"`
+	ID     uuid.UUID   `json:"id"`
+	State  string      `json:"state"`
+	Tracks int         `json:"tracks"`
+	Repair RepairStats `json:"repair"`
+	// Subscriptions are the streams the receiver chose, if any
+	Subscriptions []string `json:"subscriptions,omitempty"`
+	Pins          []Pin    `json:"pins,omitempty"`
+	// Telemetry is what the receiver reported, if it has a telemetry channel
+	Telemetry *TelemetrySummary `json:"telemetry,omitempty"`
+	// Retransmitted counts the packets resent to answer its NACKs
+	Retransmitted uint64 `json:"retransmitted"`
+	// Bandwidth is the estimated bandwidth towards the receiver in bits per
+	// second, zero while unknown
+	Bandwidth int `json:"bandwidthBps"`
+	// HeldForKeyframes counts the packets held back from new video streams
+	// until their first keyframe
+	HeldForKeyframes uint64 `json:"heldForKeyframes"`
+	// Layers are the simulcast layers the receiver gets by track
+	Layers map[string]string `json:"layers,omitempty"`
+	// Shed are the tracks withheld for lack of bandwidth
+	Shed []string `json:"shed,omitempty"`
+	// Slow is set while the slow receiver policy applies to the receiver
+	Slow bool `json:"slow,omitempty"`
+	// Pacer is the queue of the packets paced to the receiver, if paced
+	Pacer *PacerStats `json:"pacer,omitempty"`
+	// Quality and VideoPaused are what the receiver asked for over its
+	// control channel
+	Quality     ReceiverQuality `json:"quality"`
+	VideoPaused bool            `json:"videoPaused,omitempty"`
+}
+
+// Receivers describes the connected receivers
+func (s *Broadcaster) Receivers() []ReceiverInfo {
+	infos := []ReceiverInfo{}
+	s.do(func() {
+		for id, receiver := range s.receivers {
+			tracks := 0
+			for _, sender := range receiver.Connection.GetSenders() {
+				if sender.Track() != nil {
+					tracks++
+				}
+			}
+			info := ReceiverInfo{
+				ID:            id,
+				State:         receiver.Connection.ConnectionState().String(),
+				Tracks:        tracks,
+				Subscriptions: receiver.subscriptionList(),
+				Pins:          append([]Pin{}, receiver.pins...),
+				Layers:        s.activeLayers(receiver),
+				Slow:          receiver.slowness.applied,
+				Quality:       receiver.qualityOrAuto(),
+				VideoPaused:   receiver.videoPaused,
+			}
+			for key := range receiver.shed {
+				info.Shed = append(info.Shed, key)
+			}
+			sort.Strings(info.Shed)
+			if receiver.Repair != nil {
+				info.Repair = receiver.Repair.Stats()
+			}
+			if receiver.Retransmitter != nil {
+				info.Retransmitted = receiver.Retransmitter.Retransmitted()
+			}
+			if receiver.Bandwidth != nil {
+				info.Bandwidth = receiver.Bandwidth.Estimate()
+			}
+			if receiver.Keyframes != nil {
+				info.HeldForKeyframes = receiver.Keyframes.Held()
+			}
+			if receiver.Pacer != nil && receiver.Pacer.Rate() > 0 {
+				pacer := receiver.Pacer.Stats()
+				info.Pacer = &pacer
+			}
+			if receiver.Telemetry != nil {
+				summary := receiver.Telemetry.Summary()
+				info.Telemetry = &summary
+			}
+			infos = append(infos, info)
+		}
+	})
+	return infos
+}
+
+// StreamTracks returns the keys of the tracks currently published under streamID
+func (s *Broadcaster) StreamTracks(streamID string) []string {
+	tracks := []string{}
+	s.do(func() {
+		for key, track := range s.senders {
+			if track.StreamID() == streamID {
+				tracks = append(tracks, key)
+			}
+		}
+	})
+	return tracks
+}
+
+// AddSink attaches sink to the track, it returns false if the track doesn't exist
+func (s *Broadcaster) AddSink(trackKey string, sink TrackSink) bool {
+	added := false
+	s.do(func() {
+		if _, ok := s.senders[trackKey]; !ok {
+			return
+		}
+		s.sinkLock.Lock()
+		defer s.sinkLock.Unlock()
+		if _, ok := s.sinks[trackKey]; !ok {
+			s.sinks[trackKey] = make(map[TrackSink]bool)
+		}
+		s.sinks[trackKey][sink] = true
+		added = true
+	})
+	return added
+}
+
+// RemoveSink detaches sink from the track without closing it
+func (s *Broadcaster) RemoveSink(trackKey string, sink TrackSink) {
+	s.sinkLock.Lock()
+	defer s.sinkLock.Unlock()
+	delete(s.sinks[trackKey], sink)
+	if len(s.sinks[trackKey]) == 0 {
+		delete(s.sinks, trackKey)
+	}
+}
+
+func (s *Broadcaster) writeSinks(trackKey string, packet []byte) {
+	s.sinkLock.RLock()
+	failed := []TrackSink{}
+	for sink := range s.sinks[trackKey] {
+		if err := sink.WriteRTP(packet); err != nil {
+			failed = append(failed, sink)
+		}
+	}
+	s.sinkLock.RUnlock()
+	for _, sink := range failed {
+		zap.S().Debugw("Detaching failed sink", "track", trackKey)
+		s.RemoveSink(trackKey, sink)
+		sink.Close()
+	}
+}
+
+func (s *Broadcaster) closeSinks(trackKey string) {
+	s.sinkLock.Lock()
+	defer s.sinkLock.Unlock()
+	for sink := range s.sinks[trackKey] {
+		sink.Close()
+	}
+	delete(s.sinks, trackKey)
+	delete(s.retransmits, trackKey)
+}
+
+func (s *Broadcaster) RemoveReceiver(id uuid.UUID) {
+	s.do(func() {
+		s.removeReceiver(id, "receiver removed")
+	})
+}
+
+// removeReceiver closes the receiver, sending it a reconnect hint giving
+// reason. It must run on the loop.
+func (s *Broadcaster) removeReceiver(id uuid.UUID, reason string) {
+	s.closeReceiver(id, websocket.StatusNormalClosure, reason)
+}
+
+// closeReceiver closes the receiver with code, sending it a reconnect hint
+// giving reason. It must run on the loop.
+func (s *Broadcaster) closeReceiver(id uuid.UUID, code websocket.StatusCode, reason string) {
+	receiver, ok := s.receivers[id]
+	if !ok {
+		return
+	}
+
+	SendReconnectHint(receiver.Signaler, s.reconnectPolicy, reason)
+	if code == websocket.StatusNormalClosure {
+		receiver.Signaler.Close(code, "Ending operation")
+	} else {
+		receiver.Signaler.Close(code, reason)
+	}
+	receiver.Connection.Close()
+	receiver.stopReplays()
+	s.dropLayerSelections(receiver)
+
+	delete(s.receivers, id)
+	s.left(RoleViewer, "")
+}
+
+// ResumeReceiver hands a receiver the signaling it reconnected with and
+// renegotiates it, in case an offer got lost with the previous signaling
+func (s *Broadcaster) ResumeReceiver(id uuid.UUID, signaler Signaler) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		receiver.Signaler = signaler
+		s.reannounceTracks(id, receiver)
+		// The answer to a pending offer may have been lost with the signaling
+		if receiver.Connection.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+			if err := rollback(receiver.Connection); err != nil {
+				zap.S().Warnw("Unable to roll back the pending offer", "receiver", id, "error", err)
+			}
+		}
+		s.sendOffer(id, &receiver)
+		s.receivers[id] = receiver
+		err = nil
+	})
+	return err
+}
+
+func (s *Broadcaster) SetReconnectPolicy(policy ReconnectPolicy) {
+	s.do(func() {
+		s.reconnectPolicy = policy
+	})
+}
+
+func (s *Broadcaster) ReconnectPolicy() ReconnectPolicy {
+	policy := ReconnectPolicy{}
+	s.do(func() {
+		policy = s.reconnectPolicy
+	})
+	return policy
+}
+
+// Draining reports whether the hub refuses new sessions before shutting down
+func (s *Broadcaster) Draining() bool {
+	// A closed Broadcaster refuses new sessions as well
+	draining := true
+	s.do(func() {
+		draining = s.draining
+	})
+	return draining
+}
+
+// Drain stops accepting new sessions and sends every receiver away with
+// reconnect guidance, publishers are left alone until Close
+func (s *Broadcaster) Drain(reason string) {
+	s.do(func() {
+		s.draining = true
+		for id, receiver := range s.receivers {
+			SendReconnectHint(receiver.Signaler, s.reconnectPolicy, reason)
+			receiver.Signaler.Close(websocket.StatusGoingAway, reason)
+			receiver.Connection.Close()
+			receiver.stopReplays()
+			s.dropLayerSelections(receiver)
+			delete(s.receivers, id)
+		}
+		for id, session := range s.whepSessions {
+			session.PeerConn.Close()
+			session.Events.Close()
+			delete(s.whepSessions, id)
+		}
+	})
+}
+
+// SessionDescriptor describes an established session for handoffs
+type SessionDescriptor struct {
+	Room              string    `json:"room,omitempty"`
+	Kind              string    `json:"kind"`
+	ID                uuid.UUID `json:"id"`
+	State             string    `json:"state"`
+	LocalDescription  string    `json:"localDescription,omitempty"`
+	RemoteDescription string    `json:"remoteDescription,omitempty"`
+}
+
+func describeSession(kind string, id uuid.UUID, peer *webrtc.PeerConnection) SessionDescriptor {
+	descriptor := SessionDescriptor{Kind: kind, ID: id, State: peer.ConnectionState().String()}
+	if local := peer.CurrentLocalDescription(); local != nil {
+		descriptor.LocalDescription = local.SDP
+	}
+	if remote := peer.CurrentRemoteDescription(); remote != nil {
+		descriptor.RemoteDescription = remote.SDP
+	}
+	return descriptor
+}
+
+// SessionDescriptors lists the publisher, receiver and WHEP sessions
+func (s *Broadcaster) SessionDescriptors() []SessionDescriptor {
+	descriptors := []SessionDescriptor{}
+	s.do(func() {
+		for id, peer := range s.peerSender {
+			descriptors = append(descriptors, describeSession("whip", id, peer.PeerConn))
+		}
+		for id, receiver := range s.receivers {
+			descriptors = append(descriptors, describeSession("receiver", id, receiver.Connection))
+		}
+		for id, session := range s.whepSessions {
+			descriptors = append(descriptors, describeSession("whep", id, session.PeerConn))
+		}
+	})
+	return descriptors
+}
+
+// Idle tells whether no session is left
+func (s *Broadcaster) Idle() bool {
+	idle := true
+	s.do(func() {
+		s.pruneClosedConnections()
+		idle = len(s.receivers) == 0 && len(s.whepSessions) == 0 && len(s.senders) == 0 && len(s.peerSender) == 0
+	})
+	return idle
+}
+
+// WaitIdle returns once every session ended or when ctx is done
+func (s *Broadcaster) WaitIdle(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if s.Idle() {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close tears down the remaining publishers and stops the command loop,
+// later calls are no-ops
+func (s *Broadcaster) Close() {
+	s.do(func() {
+		if s.rebalanceTimer != nil {
+			s.rebalanceTimer.Stop()
+		}
+		for id, peer := range s.peerSender {
+			peer.PeerConn.Close()
+			s.deletePeerSender(id)
+		}
+		for _, session := range s.recordings {
+			s.stopRecording(session)
+		}
+		for _, session := range s.egresses {
+			s.stopEgress(session)
+		}
+		s.events.Close()
+		close(s.closed)
+	})
+	// The files of the recordings stopped are finalized before returning
+	s.completing.Wait()
+}
+
+// pruneClosedConnections forgets the receivers whose connection closed, it must run on the loop
+func (s *Broadcaster) pruneClosedConnections() {
+	for u, rs := range s.receivers {
+		if rs.Connection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			SendReconnectHint(rs.Signaler, s.reconnectPolicy, "WebRTC connection closed")
+			rs.Signaler.Close(websocket.StatusGoingAway, "WebRTC connection closed")
+			rs.stopReplays()
+			s.dropLayerSelections(rs)
+			delete(s.receivers, u)
+			s.left(RoleViewer, "")
+		}
+	}
+}
+
+// rebalanceReceivers applies the distribution to every receiver and
+// renegotiates those whose tracks changed, it must run on the loop
+func (s *Broadcaster) rebalanceReceivers() {
+	s.pruneClosedConnections()
+	if s.program != nil {
+		s.updateProgram()
+	}
+	if s.mixer != nil {
+		s.updateMixer()
+	}
+	if s.compositor != nil {
+		s.updateCompositor()
+	}
+
+	receivers := make([]Receiver, 0, len(s.receivers))
+	for u, receiver := range s.receivers {
+		if len(receiver.subscriptions) > 0 {
+			continue
+		}
+		info := Receiver{ID: u, Preferences: receiver.Preferences}
+		if receiver.Bandwidth != nil {
+			info.Bandwidth = receiver.Bandwidth.Estimate()
+		}
+		receivers = append(receivers, info)
+	}
+	publishers := s.trackPublishers()
+	tracks := make([]Track, 0, len(s.senders))
+	for u, sender := range s.senders {
+		// The composite is for the recordings and the egresses
+		if s.isSpareLayer(u) || u == mixKey || u == compositeKey {
+			continue
+		}
+		track := Track{
+			Key:         u,
+			ID:          sender.ID(),
+			StreamID:    sender.StreamID(),
+			Kind:        sender.Kind(),
+			PublisherID: publishers[u],
+			Bitrate:     s.trackBitrate(u),
+			SpeakerRank: s.speakers.ranks[sender.StreamID()],
+		}
+		if local, ok := sender.(*webrtc.TrackLocalStaticRTP); ok {
+			track.Codec = local.Codec().MimeType
+		}
+		if probe, ok := s.resolutions[u]; ok {
+			track.Width, track.Height = probe.resolution()
+		}
+		tracks = append(tracks, track)
+	}
+	// Sorted so that the distributions assign the same tracks to the same
+	// receivers on every rebalance, sparing them renegotiations
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].Key < tracks[j].Key })
+	sort.Slice(receivers, func(i, j int) bool { return receivers[i].ID.String() < receivers[j].ID.String() })
+	var match map[uuid.UUID]map[string]bool
+	if s.program != nil {
+		match = s.programAssignment()
+		s.applyMix(match)
+	} else {
+		// The audio and video of a stream must not be split between receivers
+		match = GroupByStream(s.distribution).Distribute(tracks, receivers)
+		for u, keys := range s.subscribedTracks(tracks) {
+			match[u] = keys
+		}
+		s.applyMix(match)
+		s.enforceCapabilities(match, tracks)
+		s.enforceMaxTracks(match, tracks)
+		s.applyPins(match, tracks)
+	}
+	s.enforceCongestion(match)
+	s.dropSlowVideo(match)
+	s.enforceEgressBudget(match)
+	renegotiated, skipped := 0, 0
+	for u, v := range match {
+		receiver := s.receivers[u]
+		// A new receiver needs its first offer even without any track
+		if receiver.negotiated && sameAssignment(receiver.assigned, v) {
+			skipped++
+			continue
+		}
+		changed := !receiver.negotiated
+		existingSenders := make(map[string]bool)
+		for _, sender := range receiver.Connection.GetSenders() {
+			if sender.Track() == nil {
+				continue
+			}
+
+			if receiver.isReplayTrack(sender.Track()) {
+				continue
+			}
+
+			// RemoveTrack clears the track of the sender
+			key := sender.Track().StreamID() + sender.Track().ID()
+			existingSenders[key] = true
+
+			if _, ok := v[key]; !ok {
+				receiver.Connection.RemoveTrack(sender)
+				s.dropLayerSelection(receiver, key)
+				changed = true
+			}
+		}
+
+		for key, sender := range receiver.paused {
+			if v[key] {
+				existingSenders[key] = true
+				continue
+			}
+			receiver.Connection.RemoveTrack(sender)
+			delete(receiver.paused, key)
+			s.dropLayerSelection(receiver, key)
+			changed = true
+		}
+
+		for trackID := range v {
+			if _, ok := existingSenders[trackID]; !ok {
+				var track webrtc.TrackLocal = s.senders[trackID]
+				// Simulcast layers get a track of their own to switch layers
+				selection := s.newLayerSelection(&receiver, trackID)
+				if selection != nil {
+					track = selection.track
+				}
+				if sender, err := receiver.Connection.AddTrack(track); err == nil {
+					if receiver.Reports != nil {
+						receiver.Reports.bind(sender, s.trackClock(trackID, selection))
+					}
+					go s.handleReceiverRTCP(sender, receiver.Retransmitter, receiver.Keyframes, selection)
+				} else if selection != nil {
+					s.dropLayerSelection(receiver, trackID)
+				}
+				changed = true
+			}
+		}
+
+		if changed && receiver.videoOff() {
+			if err := s.applyVideoControl(&receiver); err != nil {
+				zap.S().Warnw("Unable to pause the video of the receiver", "receiver", u, "error", err)
+			}
+		}
+		receiver.assigned = v
+		if changed {
+			s.announceTracks(u, &receiver, v, publishers)
+			s.sendOffer(u, &receiver)
+			receiver.negotiated = true
+			renegotiated++
+		} else {
+			skipped++
+		}
+		s.receivers[u] = receiver
+	}
+	s.rebalanceStats.Rebalances++
+	s.rebalanceStats.Renegotiated += uint64(renegotiated)
+	s.rebalanceStats.Skipped += uint64(skipped)
+	zap.S().Debugw("Rebalanced receivers", "renegotiated", renegotiated, "skipped", skipped)
+	s.refreshWHEPSessions()
+	s.flushPresence()
+}
+
+func sameAssignment(previous map[string]bool, next map[string]bool) bool {
+	if len(previous) != len(next) {
+		return false
+	}
+	for track := range next {
+		if !previous[track] {
+			return false
+		}
+	}
+	return true
+}
+
+// RebalanceStats counts the receivers renegotiated or left alone by rebalances
+type RebalanceStats struct {
+	Rebalances   uint64 `json:"rebalances"`
+	Renegotiated uint64 `json:"renegotiated"`
+	Skipped      uint64 `json:"skipped"`
+}
+
+func (s *Broadcaster) RebalanceStats() RebalanceStats {
+	stats := RebalanceStats{}
+	s.do(func() {
+		stats = s.rebalanceStats
+	})
+	return stats
+}
+
+// sendOffer renegotiates the receiver connection, or holds the offer back
+// while an exchange is in progress. It must run on the loop and the caller
+// stores the receiver back.
+func (s *Broadcaster) sendOffer(u uuid.UUID, receiver *ReceiverState) {
+	if receiver.Connection.SignalingState() != webrtc.SignalingStateStable {
+		receiver.renegotiate = true
+		return
+	}
+	receiver.renegotiate = false
+
+	offer, err := receiver.Connection.CreateOffer(&webrtc.OfferOptions{ICERestart: receiver.restartICE})
+	if err != nil {
+		zap.S().Errorw("Unable to create offer", "receiver", u)
+		return
+	}
+
+	err = receiver.Connection.SetLocalDescription(offer)
+	if err != nil {
+		zap.S().Error(err)
+	}
+	receiver.restartICE = false
+
+	zap.S().Debugw("Sending offer", "offer", offer)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := SendEvent(ctx, receiver.Signaler, "offer", offer); err != nil {
+		zap.S().Errorw("Unable to send offer", "receiver", u, "error", err)
+	}
+	s.watchOffer(u, receiver)
+}
+
+var errClosed = errors.New("broadcaster closed")
+
+// ErrUnknownReceiver is returned for receiver IDs the Broadcaster does not know
+var ErrUnknownReceiver = errors.New("unknown receiver")
+
+// ErrUnknownTrack is returned for track keys the Broadcaster does not send
+var ErrUnknownTrack = errors.New("unknown track")
+
+// StartReplay sends streamID to the receiver delayed by delay, alongside its
+// live tracks, until StopReplay is called
+func (s *Broadcaster) StartReplay(id uuid.UUID, streamID string, delay time.Duration) error {
+	err := errClosed
+	s.do(func() {
+		err = s.startReplay(id, streamID, delay)
+	})
+	return err
+}
+
+func (s *Broadcaster) startReplay(id uuid.UUID, streamID string, delay time.Duration) error {
+	receiver, ok := s.receivers[id]
+	if !ok {
+		return ErrUnknownReceiver
+	}
+	if delay <= 0 || delay > s.replayWindow {
+		return fmt.Errorf("delay must be between 0 and %s", s.replayWindow)
+	}
+	if _, ok := receiver.replays[streamID]; ok {
+		return errors.New("stream is already replaying")
+	}
+
+	session := &replaySession{stop: make(chan struct{})}
+	for key, track := range s.senders {
+		buffer, ok := s.replays[key]
+		if track.StreamID() != streamID || !ok || s.isSpareLayer(key) {
+			continue
+		}
+		replayTrack, err := webrtc.NewTrackLocalStaticRTP(
+			track.(*webrtc.TrackLocalStaticRTP).Codec(),
+			track.ID(),
+			replayStreamID(streamID),
+		)
+		if err != nil {
+			close(session.stop)
+			receiver.removeReplayTracks(session)
+			return err
+		}
+		sender, err := receiver.Connection.AddTrack(replayTrack)
+		if err != nil {
+			close(session.stop)
+			receiver.removeReplayTracks(session)
+			return err
+		}
+		go DrainRTCP(sender)
+		session.tracks = append(session.tracks, replayTrack)
+		go buffer.play(replayTrack, delay, session.stop)
+	}
+	if len(session.tracks) == 0 {
+		return errors.New("no replay buffer for stream")
+	}
+	receiver.replays[streamID] = session
+	s.sendOffer(id, &receiver)
+	s.receivers[id] = receiver
+	return nil
+}
+
+// StopReplay brings the receiver back to live for streamID
+func (s *Broadcaster) StopReplay(id uuid.UUID, streamID string) {
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			return
+		}
+		session, ok := receiver.replays[streamID]
+		if !ok {
+			return
+		}
+		close(session.stop)
+		delete(receiver.replays, streamID)
+		receiver.removeReplayTracks(session)
+		s.sendOffer(id, &receiver)
+		s.receivers[id] = receiver
+	})
+}
+
+// trackPublishers maps the track keys to the publisher owning them, it must
+// run on the loop
+func (s *Broadcaster) trackPublishers() map[string]uuid.UUID {
+	publishers := make(map[string]uuid.UUID)
+	for u, peer := range s.peerSender {
+		for key := range peer.tracks {
+			publishers[key] = u
+		}
+	}
+	return publishers
+}
+
+// ReceiverState is a receiver connection and the signaling used to
+// renegotiate it
+type ReceiverState struct {
+	Connection *webrtc.PeerConnection
+	Signaler   Signaler
+	// Repair is the monitor installed by NewReceiverAPI, if any
+	Repair *RepairMonitor
+	// Retransmitter answers the NACKs of the receiver when its API was built
+	// by NewReceiverAPI
+	Retransmitter *Retransmitter
+	// Bandwidth estimates the bandwidth towards the receiver when its API
+	// was built by NewReceiverAPI
+	Bandwidth *BandwidthMonitor
+	// Keyframes holds back new video streams until their first keyframe
+	// when its API was built by NewReceiverAPI
+	Keyframes *KeyframeGate
+	// Reports sends the sender reports of the receiver, with the timing of
+	// the publishers, when its API was built by NewReceiverAPI
+	Reports *SenderReports
+	// Stats measures the streams sent to the receiver when its API was
+	// built by NewReceiverAPI
+	Stats *ConnectionStats
+	// Pacer caps the rate of the packets sent to the receiver when its API
+	// was built by NewReceiverAPI
+	Pacer *Pacer
+	// Telemetry collects the reports of the receiver, if any
+	Telemetry *Telemetry
+	// Preferences are passed to the distribution
+	Preferences ReceiverPreferences
+
+	// replays are the time-shifted streams keyed by their live stream ID
+	replays map[string]*replaySession
+	// negotiated is set once the receiver got its first offer
+	negotiated bool
+	// assigned are the tracks the last rebalance gave the receiver
+	assigned map[string]bool
+	// subscriptions are the stream IDs the receiver chose, overriding the
+	// distribution
+	subscriptions map[string]bool
+	// pins are the tracks an administrator forced onto the receiver
+	pins []Pin
+	// paused are the senders of the tracks paused with PauseTrack
+	paused map[string]*webrtc.RTPSender
+	// renegotiate is set when an offer was held back by an exchange in
+	// progress, it is sent once the exchange completes
+	renegotiate bool
+	// offerID identifies the last offer sent, for its timeout
+	offerID uint64
+	// offerAttempts counts the offers that timed out since the last answer
+	offerAttempts int
+	// restartICE asks the next offer for new ICE credentials
+	restartICE bool
+	// announced are the tracks the receiver got a track-added event for
+	announced map[string]TrackMetadata
+	// layers send the simulcast tracks of the receiver, keyed by the layer
+	// the distribution assigned
+	layers map[string]*layerSelection
+	// layerChoices are the layers the receiver chose by stream ID
+	layerChoices map[string]string
+	// quality and videoPaused are what the receiver asked for over its
+	// control channel, controlPaused the video tracks paused for it
+	quality       ReceiverQuality
+	videoPaused   bool
+	controlPaused map[string]bool
+	// shed are the tracks taken away for lack of bandwidth
+	shed map[string]bool
+	// slowness follows the receiver for the slow receiver policy
+	slowness slowness
+}
+
+func (r ReceiverState) isReplayTrack(t webrtc.TrackLocal) bool {
+	for _, session := range r.replays {
+		for _, track := range session.tracks {
+			if track == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r ReceiverState) removeReplayTracks(session *replaySession) {
+	for _, sender := range r.Connection.GetSenders() {
+		if sender.Track() == nil {
+			continue
+		}
+		for _, track := range session.tracks {
+			if sender.Track() == track {
+				r.Connection.RemoveTrack(sender)
+			}
+		}
+	}
+}
+
+func (r ReceiverState) stopReplays() {
+	for streamID, session := range r.replays {
+		close(session.stop)
+		delete(r.replays, streamID)
+	}
+}
+
+// DrainRTCP reads incoming RTCP so that interceptors keep working
+func DrainRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
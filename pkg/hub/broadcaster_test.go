@@ -0,0 +1,219 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"nhooyr.io/websocket"
+)
+
+// answeringSignaler answers the offers of the Broadcaster with a peer
+// connection of its own, like a viewer would
+type answeringSignaler struct {
+	broadcaster *Broadcaster
+	peer        *webrtc.PeerConnection
+	// id is sent once the receiver is registered
+	id     chan uuid.UUID
+	closed chan struct{}
+	once   sync.Once
+
+	lock     sync.Mutex
+	receiver uuid.UUID
+	answers  sync.WaitGroup
+}
+
+func newAnsweringSignaler(t *testing.T, broadcaster *Broadcaster) *answeringSignaler {
+	peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &answeringSignaler{broadcaster: broadcaster, peer: peer, id: make(chan uuid.UUID, 1), closed: make(chan struct{})}
+}
+
+// Send answers the offers from a goroutine, the Broadcaster sends them
+// from its loop which HandleAnswer runs on
+func (a *answeringSignaler) Send(ctx context.Context, message Message) error {
+	if message.Event != "offer" {
+		return nil
+	}
+	offer := webrtc.SessionDescription{}
+	if err := json.Unmarshal([]byte(message.Data), &offer); err != nil {
+		return err
+	}
+	a.answers.Add(1)
+	go func() {
+		defer a.answers.Done()
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if a.receiver == uuid.Nil {
+			select {
+			case a.receiver = <-a.id:
+			case <-a.closed:
+				return
+			}
+		}
+		if a.peer.SetRemoteDescription(offer) != nil {
+			return
+		}
+		answer, err := a.peer.CreateAnswer(nil)
+		if err != nil || a.peer.SetLocalDescription(answer) != nil {
+			return
+		}
+		// The receiver may be removed meanwhile
+		a.broadcaster.HandleAnswer(a.receiver, answer)
+	}()
+	return nil
+}
+
+func (a *answeringSignaler) Receive(ctx context.Context) (Message, error) {
+	select {
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	case <-a.closed:
+		return Message{}, ErrSignalingClosed
+	}
+}
+
+func (a *answeringSignaler) Close(code websocket.StatusCode, reason string) error {
+	a.once.Do(func() { close(a.closed) })
+	return nil
+}
+
+// wait returns once the pending answers are sent and closes the peer
+func (a *answeringSignaler) wait() {
+	a.Close(websocket.StatusNormalClosure, "")
+	a.answers.Wait()
+	a.peer.Close()
+}
+
+// countingSink counts the packets of a track
+type countingSink struct {
+	lock    sync.Mutex
+	packets int
+}
+
+func (c *countingSink) WriteRTP(packet []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.packets++
+	return nil
+}
+
+func (c *countingSink) Close() error { return nil }
+
+// TestBroadcasterConcurrentUse adds and removes senders, receivers and
+// sinks, rebalances and takes the snapshots from many goroutines at once,
+// for go test -race to check the loop owns the state
+func TestBroadcasterConcurrentUse(t *testing.T) {
+	b := NewBroadcaster(nil)
+	defer b.Close()
+	// Rebalance right after every change, for as many rebalances as
+	// possible
+	b.SetRebalanceDelay(0)
+
+	const (
+		streams   = 4
+		rounds    = 5
+		receivers = 6
+	)
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	wg := sync.WaitGroup{}
+	run := func(n int, f func(i int)) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				f(i)
+			}(i)
+		}
+	}
+
+	// Publishers come and go, their packets forwarded meanwhile. The
+	// ingested tracks take the path of AddSender.
+	run(streams, func(i int) {
+		for round := 0; round < rounds; round++ {
+			track := NewIngestTrack(codec, "video", fmt.Sprintf("stream-%d", i))
+			if b.AddIngestSender(track) == nil {
+				t.Error("the sender was not added")
+				return
+			}
+			for n := 0; n < 20; n++ {
+				packet := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(n), Timestamp: uint32(n * 3000), Marker: true}, Payload: []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}}
+				if err := track.WriteRTP(packet, time.Now()); err != nil {
+					t.Error(err)
+				}
+			}
+			track.Close()
+		}
+	})
+
+	// Viewers join, answer their offers and leave
+	run(receivers, func(i int) {
+		for round := 0; round < rounds; round++ {
+			connection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			signaler := newAnsweringSignaler(t, b)
+			id := b.AddReceiver(ReceiverState{Connection: connection, Signaler: signaler})
+			signaler.id <- id
+			time.Sleep(time.Duration(i) * time.Millisecond)
+			b.RemoveReceiver(id)
+			signaler.wait()
+			connection.Close()
+		}
+	})
+
+	// The distribution changes, rebalancing every receiver
+	run(2, func(i int) {
+		for round := 0; round < 4*rounds; round++ {
+			if round%2 == i {
+				b.SetDistribution(DistributionFunc(AllDist))
+			} else if err := b.UseDistribution(DefaultDistribution); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	// Sinks attach to the tracks present
+	run(streams, func(i int) {
+		key := fmt.Sprintf("stream-%d", i) + "video"
+		for round := 0; round < 4*rounds; round++ {
+			sink := &countingSink{}
+			if b.AddSink(key, sink) {
+				b.RemoveSink(key, sink)
+			}
+		}
+	})
+
+	// The API and the metrics take snapshots meanwhile
+	run(4, func(i int) {
+		for round := 0; round < 10*rounds; round++ {
+			for streamID := range b.Streams() {
+				b.StreamTracks(streamID)
+			}
+			b.Receivers()
+			b.RebalanceStats()
+			b.Load()
+			b.Idle()
+			b.ActivePeerSenders()
+			b.SessionDescriptors()
+		}
+	})
+
+	wg.Wait()
+	if receivers := b.Receivers(); len(receivers) != 0 {
+		t.Errorf("%d receivers left, none expected", len(receivers))
+	}
+	if stats := b.RebalanceStats(); stats == (RebalanceStats{}) {
+		t.Error("no rebalance happened")
+	}
+}
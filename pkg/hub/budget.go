@@ -0,0 +1,176 @@
+package hub
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// meterSampleInterval is how often the track bitrates are measured
+const meterSampleInterval = time.Second
+
+// rateMeter is a TrackSink measuring the bitrate of a track
+type rateMeter struct {
+	bytes atomic.Uint64
+
+	lock       sync.Mutex
+	lastBytes  uint64
+	lastSample time.Time
+	rate       float64
+}
+
+func newRateMeter() *rateMeter {
+	return &rateMeter{lastSample: time.Now()}
+}
+
+func (m *rateMeter) WriteRTP(packet []byte) error {
+	m.bytes.Add(uint64(len(packet)))
+	return nil
+}
+
+func (m *rateMeter) Close() error {
+	return nil
+}
+
+// sample updates the smoothed bitrate from the bytes seen since the last call
+func (m *rateMeter) sample(now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	elapsed := now.Sub(m.lastSample).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	bytes := m.bytes.Load()
+	instant := float64(bytes-m.lastBytes) * 8 / elapsed
+	if m.rate == 0 {
+		m.rate = instant
+	} else {
+		m.rate = 0.7*m.rate + 0.3*instant
+	}
+	m.lastBytes = bytes
+	m.lastSample = now
+}
+
+// Bitrate returns the smoothed bitrate in bits per second
+func (m *rateMeter) Bitrate() float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.rate
+}
+
+// EnableEgressBudget caps the estimated bitrate delivered to all receivers
+// of the room.
+func (s *Broadcaster) EnableEgressBudget(bitsPerSecond uint64, interval time.Duration) {
+	s.do(func() {
+		s.egressBudget = bitsPerSecond
+	})
+	go s.monitorEgressBudget(interval)
+}
+
+// enforceEgressBudget trims the distribution until its estimated egress fits
+// the budget, taking the most expensive track away from the receiver holding
+// the most tracks first, it must run on the loop
+func (s *Broadcaster) enforceEgressBudget(match map[uuid.UUID]map[string]bool) {
+	if s.egressBudget == 0 {
+		return
+	}
+	total := 0.0
+	for _, tracks := range match {
+		for track := range tracks {
+			total += s.trackBitrate(track)
+		}
+	}
+	trimmed := 0
+	for total > float64(s.egressBudget) {
+		var busiest uuid.UUID
+		busiestCount := 0
+		for u, tracks := range match {
+			if len(tracks) > busiestCount {
+				busiest, busiestCount = u, len(tracks)
+			}
+		}
+		if busiestCount == 0 {
+			break
+		}
+		tracks := make([]string, 0, busiestCount)
+		for track := range match[busiest] {
+			tracks = append(tracks, track)
+		}
+		sort.Slice(tracks, func(i, j int) bool {
+			return s.trackBitrate(tracks[i]) > s.trackBitrate(tracks[j])
+		})
+		delete(match[busiest], tracks[0])
+		total -= s.trackBitrate(tracks[0])
+		trimmed++
+	}
+	s.budgetTrimmed = trimmed > 0
+	if trimmed > 0 {
+		zap.S().Infow("Egress budget exceeded, trimmed assignments", "budget", s.egressBudget, "estimate", total, "trimmed", trimmed)
+	}
+}
+
+func (s *Broadcaster) trackBitrate(trackKey string) float64 {
+	if meter, ok := s.meters[trackKey]; ok {
+		return meter.Bitrate()
+	}
+	return 0
+}
+
+// deliveredBitrate estimates the current egress from the tracks attached to receivers, it must run on the loop
+func (s *Broadcaster) deliveredBitrate() float64 {
+	total := 0.0
+	for _, receiver := range s.receivers {
+		for _, sender := range receiver.Connection.GetSenders() {
+			if track := sender.Track(); track != nil {
+				total += s.trackBitrate(track.StreamID() + track.ID())
+			}
+		}
+	}
+	return total
+}
+
+// sampleMeters measures the bitrate and the stats of every track each
+// interval until the Broadcaster is closed
+func (s *Broadcaster) sampleMeters(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-s.closed:
+			return
+		case now = <-ticker.C:
+		}
+		s.do(func() {
+			for _, meter := range s.meters {
+				meter.sample(now)
+			}
+			s.sampleStats(now)
+		})
+	}
+}
+
+func (s *Broadcaster) monitorEgressBudget(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		s.do(func() {
+			delivered := s.deliveredBitrate()
+			// Rebalance when over budget, or to give tracks back once the
+			// delivered bitrate leaves enough headroom
+			if delivered > float64(s.egressBudget) ||
+				(s.budgetTrimmed && delivered < 0.8*float64(s.egressBudget)) {
+				s.scheduleRebalance()
+			}
+		})
+	}
+}
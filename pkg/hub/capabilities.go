@@ -0,0 +1,195 @@
+package hub
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// SetCodecs restricts the receiver to the tracks of these MIME types, none
+// lifts the restriction
+func (s *Broadcaster) SetCodecs(id uuid.UUID, codecs []string) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		receiver.Preferences.Codecs = codecs
+		s.receivers[id] = receiver
+		s.scheduleRebalance()
+		err = nil
+	})
+	return err
+}
+
+// SetMaxResolution bounds the resolution of the video tracks sent to the
+// receiver, zeros lift the bound
+func (s *Broadcaster) SetMaxResolution(id uuid.UUID, width int, height int) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		receiver.Preferences.MaxWidth = width
+		receiver.Preferences.MaxHeight = height
+		s.receivers[id] = receiver
+		s.scheduleRebalance()
+		err = nil
+	})
+	return err
+}
+
+// Accepts tells whether the receiver can take the track, tracks of unknown
+// resolution fit any bound
+func (p ReceiverPreferences) Accepts(track Track) bool {
+	if len(p.Codecs) > 0 {
+		supported := false
+		for _, codec := range p.Codecs {
+			if strings.EqualFold(codec, track.Codec) {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return false
+		}
+	}
+	if p.MaxWidth > 0 && track.Width > p.MaxWidth {
+		return false
+	}
+	return p.MaxHeight <= 0 || track.Height <= p.MaxHeight
+}
+
+// enforceCapabilities takes the tracks the receivers cannot take away from
+// them. A simulcast track is swapped for a layer that fits. A stream no
+// other receiver gets moves to the least loaded distributed receiver
+// taking all its tracks, and stays put when there is none. It must run on
+// the loop.
+func (s *Broadcaster) enforceCapabilities(match map[uuid.UUID]map[string]bool, tracks []Track) {
+	byKey := make(map[string]Track, len(tracks))
+	for _, track := range tracks {
+		byKey[track.Key] = track
+	}
+
+	// Sorted so that the same receivers are picked on every rebalance
+	ids := make([]uuid.UUID, 0, len(match))
+	for u := range match {
+		ids = append(ids, u)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+
+	for _, u := range ids {
+		preferences := s.receivers[u].Preferences
+		rejected := make(map[string][]string)
+		for key := range match[u] {
+			track, ok := byKey[key]
+			if !ok || preferences.Accepts(track) {
+				continue
+			}
+			delete(match[u], key)
+			if layer, ok := s.fittingLayer(key, preferences); ok {
+				match[u][layer] = true
+				continue
+			}
+			rejected[track.StreamID] = append(rejected[track.StreamID], key)
+		}
+
+		for streamID, keys := range rejected {
+			if len(s.receivers[u].subscriptions) > 0 || s.streamHeld(match, u, keys) {
+				continue
+			}
+			members := make([]string, 0)
+			for key := range match[u] {
+				if byKey[key].StreamID == streamID {
+					members = append(members, key)
+				}
+			}
+			members = append(members, keys...)
+			target, ok := s.leastLoadedAccepting(match, ids, u, members, byKey)
+			if !ok {
+				continue
+			}
+			if match[target] == nil {
+				match[target] = make(map[string]bool)
+			}
+			for _, key := range members {
+				delete(match[u], key)
+				match[target][key] = true
+			}
+		}
+	}
+}
+
+// fittingLayer finds the best layer of a simulcast track the receiver can
+// take, it must run on the loop
+func (s *Broadcaster) fittingLayer(key string, preferences ReceiverPreferences) (string, bool) {
+	layer, ok := s.layers[key]
+	if !ok {
+		return "", false
+	}
+	streamID := s.senders[key].StreamID()
+	best, bestIndex := "", -1
+	for other, otherLayer := range s.layers {
+		if other == key || otherLayer.TrackID != layer.TrackID || s.senders[other].StreamID() != streamID {
+			continue
+		}
+		track := Track{Key: other}
+		if local, ok := s.senders[other].(*webrtc.TrackLocalStaticRTP); ok {
+			track.Codec = local.Codec().MimeType
+		}
+		if probe, ok := s.resolutions[other]; ok {
+			track.Width, track.Height = probe.resolution()
+		}
+		if !preferences.Accepts(track) {
+			continue
+		}
+		if bestIndex < 0 || otherLayer.Index < bestIndex {
+			best, bestIndex = other, otherLayer.Index
+		}
+	}
+	return best, bestIndex >= 0
+}
+
+// streamHeld tells whether a receiver other than u gets any of keys
+func (s *Broadcaster) streamHeld(match map[uuid.UUID]map[string]bool, u uuid.UUID, keys []string) bool {
+	for other, assigned := range match {
+		if other == u {
+			continue
+		}
+		for _, key := range keys {
+			if assigned[key] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// leastLoadedAccepting picks the distributed receiver other than u with the
+// fewest tracks among those taking all of keys
+func (s *Broadcaster) leastLoadedAccepting(match map[uuid.UUID]map[string]bool, ids []uuid.UUID, u uuid.UUID, keys []string, byKey map[string]Track) (uuid.UUID, bool) {
+	target, found := uuid.Nil, false
+	for _, candidate := range ids {
+		receiver := s.receivers[candidate]
+		if candidate == u || len(receiver.subscriptions) > 0 {
+			continue
+		}
+		accepts := true
+		for _, key := range keys {
+			if !receiver.Preferences.Accepts(byKey[key]) {
+				accepts = false
+				break
+			}
+		}
+		if accepts && (!found || len(match[candidate]) < len(match[target])) {
+			target, found = candidate, true
+		}
+	}
+	return target, found
+}
@@ -0,0 +1,71 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// chatSendTimeout bounds the wait for a receiver whose signaling queue is full
+const chatSendTimeout = time.Second
+
+// ChatMessage is relayed in chat events to the whole room
+type ChatMessage struct {
+	From string    `json:"from"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// AttachPublisherChat relays the chat to the publisher over channel, until
+// the publisher is deleted. It returns false for unknown publishers.
+func (s *Broadcaster) AttachPublisherChat(id uuid.UUID, channel *webrtc.DataChannel) bool {
+	attached := false
+	s.do(func() {
+		if _, ok := s.peerSender[id]; !ok {
+			return
+		}
+		s.publisherChats[id] = channel
+		attached = true
+	})
+	return attached
+}
+
+// Chat sends message to every receiver over its signaling and to the
+// publishers which attached a chat channel. The sends happen off the loop.
+func (s *Broadcaster) Chat(message ChatMessage) {
+	signalers := []Signaler{}
+	channels := []*webrtc.DataChannel{}
+	s.do(func() {
+		for _, receiver := range s.receivers {
+			signalers = append(signalers, receiver.Signaler)
+		}
+		for _, channel := range s.publisherChats {
+			channels = append(channels, channel)
+		}
+	})
+
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		zap.S().Errorw("Unable to encode chat message", "error", err)
+		return
+	}
+	for _, signaler := range signalers {
+		ctx, cancel := context.WithTimeout(context.Background(), chatSendTimeout)
+		if err := signaler.Send(ctx, Message{Event: "chat", Data: string(encoded)}); err != nil {
+			zap.S().Debugw("Unable to relay chat message", "error", err)
+		}
+		cancel()
+	}
+	for _, channel := range channels {
+		if channel.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
+		}
+		if err := channel.SendText(string(encoded)); err != nil {
+			zap.S().Debugw("Unable to relay chat message to publisher", "error", err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package hub
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+// DefaultOpusFmtp are the Opus format parameters of the default media engine
+const DefaultOpusFmtp = "minptime=10;useinbandfec=1"
+
+// DefaultH264Profiles are the H264 profile-level-ids of the default media engine
+var DefaultH264Profiles = []string{"42001f", "42e01f", "640032"}
+
+// codecNames maps the short names accepted in configurations to MIME types
+var codecNames = map[string]string{
+	"vp8":  webrtc.MimeTypeVP8,
+	"vp9":  webrtc.MimeTypeVP9,
+	"h264": webrtc.MimeTypeH264,
+	"av1":  webrtc.MimeTypeAV1,
+	"opus": webrtc.MimeTypeOpus,
+	"g722": webrtc.MimeTypeG722,
+	"pcmu": webrtc.MimeTypePCMU,
+	"pcma": webrtc.MimeTypePCMA,
+}
+
+// staticPayloadTypes are the audio codecs with a payload type of their own
+var staticPayloadTypes = map[string]webrtc.PayloadType{
+	webrtc.MimeTypePCMU: 0,
+	webrtc.MimeTypePCMA: 8,
+	webrtc.MimeTypeG722: 9,
+}
+
+// opusPayloadType is kept out of the dynamic range given to video
+const opusPayloadType = 111
+
+// videoFeedback is the RTCP feedback of every video codec
+var videoFeedback = []webrtc.RTCPFeedback{
+	{Type: webrtc.TypeRTCPFBGoogREMB},
+	{Type: webrtc.TypeRTCPFBCCM, Parameter: "fir"},
+	{Type: webrtc.TypeRTCPFBNACK},
+	{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"},
+}
+
+// CodecSet selects the codecs registered on the connections of a room, the
+// same set is used for publishers and receivers so that every accepted
+// track can be forwarded
+type CodecSet struct {
+	// MimeTypes are the enabled codecs, e.g. video/VP8
+	MimeTypes []string
+	// H264Profiles are the profile-level-ids offered for H264
+	H264Profiles []string
+	// OpusFmtp are the format parameters offered for Opus
+	OpusFmtp string
+	// FlexFEC offers FlexFEC-03 to receivers along with the video codecs,
+	// the media engine then gives every video encoding a repair stream
+	FlexFEC bool
+	// RED offers receivers Opus as RED, each packet carrying this many
+	// previous ones, 0 disables
+	RED int
+	// E2EE forwards the payloads as opaque, for end-to-end encrypted
+	// conferences, and negotiates the frame descriptors they rely on
+	E2EE bool
+}
+
+// DefaultCodecSet matches the codecs of the default media engine, with AV1
+func DefaultCodecSet() CodecSet {
+	return CodecSet{
+		MimeTypes: []string{
+			webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, webrtc.MimeTypeH264, webrtc.MimeTypeAV1,
+			webrtc.MimeTypeOpus, webrtc.MimeTypeG722, webrtc.MimeTypePCMU, webrtc.MimeTypePCMA,
+		},
+		H264Profiles: DefaultH264Profiles,
+		OpusFmtp:     DefaultOpusFmtp,
+	}
+}
+
+// ParseCodecSet builds a codec set from short codec names such as vp8 or
+// opus, the default set is returned when names is empty. Empty profiles
+// and fmtp keep the default ones.
+func ParseCodecSet(names []string, h264Profiles []string, opusFmtp string) (CodecSet, error) {
+	set := DefaultCodecSet()
+	if len(names) > 0 {
+		set.MimeTypes = nil
+		for _, name := range names {
+			mimeType, ok := codecNames[strings.ToLower(name)]
+			if !ok {
+				return set, fmt.Errorf("unknown codec %q", name)
+			}
+			if !set.Enabled(mimeType) {
+				set.MimeTypes = append(set.MimeTypes, mimeType)
+			}
+		}
+	}
+	if len(h264Profiles) > 0 {
+		for _, profile := range h264Profiles {
+			if len(profile) != 6 || strings.Trim(strings.ToLower(profile), "0123456789abcdef") != "" {
+				return set, fmt.Errorf("invalid H264 profile-level-id %q", profile)
+			}
+		}
+		set.H264Profiles = h264Profiles
+	}
+	if opusFmtp != "" {
+		set.OpusFmtp = opusFmtp
+	}
+	// Catches sets needing more payload types than there are
+	if err := set.register(&webrtc.MediaEngine{}); err != nil {
+		return set, err
+	}
+	return set, nil
+}
+
+// Enabled tells whether the set has the codec of mimeType
+func (c CodecSet) Enabled(mimeType string) bool {
+	for _, enabled := range c.MimeTypes {
+		if strings.EqualFold(enabled, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// register adds the codecs of the set to m, video codecs get a
+// retransmission payload type each
+func (c CodecSet) register(m *webrtc.MediaEngine) error {
+	next := webrtc.PayloadType(96)
+	allocate := func() (webrtc.PayloadType, error) {
+		if next == opusPayloadType {
+			next++
+		}
+		if next > 127 {
+			return 0, fmt.Errorf("too many codecs enabled, the dynamic payload types are exhausted")
+		}
+		next++
+		return next - 1, nil
+	}
+	registerVideo := func(mimeType string, fmtp string) error {
+		payloadType, err := allocate()
+		if err != nil {
+			return err
+		}
+		rtx, err := allocate()
+		if err != nil {
+			return err
+		}
+		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000, SDPFmtpLine: fmtp, RTCPFeedback: videoFeedback},
+			PayloadType:        payloadType,
+		}, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+		return m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, SDPFmtpLine: fmt.Sprintf("apt=%d", payloadType)},
+			PayloadType:        rtx,
+		}, webrtc.RTPCodecTypeVideo)
+	}
+
+	for _, mimeType := range c.MimeTypes {
+		var err error
+		switch mimeType {
+		case webrtc.MimeTypeVP8, webrtc.MimeTypeAV1:
+			err = registerVideo(mimeType, "")
+		case webrtc.MimeTypeVP9:
+			if err = registerVideo(mimeType, "profile-id=0"); err == nil {
+				err = registerVideo(mimeType, "profile-id=1")
+			}
+		case webrtc.MimeTypeH264:
+			for i := 0; i < len(c.H264Profiles)*2 && err == nil; i++ {
+				fmtp := fmt.Sprintf("level-asymmetry-allowed=1;packetization-mode=%d;profile-level-id=%s", 1-i%2, c.H264Profiles[i/2])
+				err = registerVideo(mimeType, fmtp)
+			}
+		case webrtc.MimeTypeOpus:
+			err = m.RegisterCodec(webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 48000, Channels: 2, SDPFmtpLine: c.OpusFmtp},
+				PayloadType:        opusPayloadType,
+			}, webrtc.RTPCodecTypeAudio)
+		default:
+			err = m.RegisterCodec(webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 8000},
+				PayloadType:        staticPayloadTypes[mimeType],
+			}, webrtc.RTPCodecTypeAudio)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if c.E2EE {
+		if err := registerFrameDescriptorExtensions(m); err != nil {
+			return err
+		}
+	}
+	if c.RED > 0 && c.Enabled(webrtc.MimeTypeOpus) {
+		payloadType, err := allocate()
+		if err != nil {
+			return err
+		}
+		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: MimeTypeRED, ClockRate: 48000, Channels: 2, SDPFmtpLine: redFmtp},
+			PayloadType:        payloadType,
+		}, webrtc.RTPCodecTypeAudio); err != nil {
+			return err
+		}
+	}
+	if c.FlexFEC {
+		payloadType, err := allocate()
+		if err != nil {
+			return err
+		}
+		return m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: MimeTypeFlexFEC, ClockRate: 90000, SDPFmtpLine: flexFECFmtp},
+			PayloadType:        payloadType,
+		}, webrtc.RTPCodecTypeVideo)
+	}
+	return nil
+}
+
+// NewEgressAPI builds the API of the connections sending tracks outside of
+// receiver sessions, such as WHEP players and WHIP relays
+func NewEgressAPI(codecs CodecSet) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := codecs.register(m); err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i)), nil
+}
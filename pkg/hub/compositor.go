@@ -0,0 +1,428 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+	"go.uber.org/zap"
+)
+
+const (
+	// CompositeStreamID is the stream of the composited video track
+	CompositeStreamID = "composite"
+	compositeTrackID  = "video"
+	compositeKey      = CompositeStreamID + compositeTrackID
+
+	// compositeFmtp is constrained baseline H264, which the RTMP ingests
+	// and the browsers all take
+	compositeFmtp = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"
+	// compositeBorder is the width of the highlight of the dominant speaker
+	compositeBorder = 4
+	// compositeKeyframeInterval is how often the tiles ask their publisher
+	// for a keyframe, their decoders recover from the losses on them
+	compositeKeyframeInterval = 5 * time.Second
+	compositeMTU              = 1200
+)
+
+var (
+	compositeBackground = color.RGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xff}
+	compositeHighlight  = color.RGBA{R: 0xff, G: 0xc1, B: 0x07, A: 0xff}
+)
+
+// CompositorOptions size the composited video track
+type CompositorOptions struct {
+	Width, Height int
+	FrameRate     int
+	// Bitrate of the composite in bits per second
+	Bitrate int
+}
+
+// VideoDecoder decodes the frames of a video track into pictures
+type VideoDecoder interface {
+	// Decode feeds the next frame, depacketized as for KeyframeDecoder.
+	// It may be decoded after it returns.
+	Decode(frame []byte) error
+	// Picture is the last picture decoded, nil before the first one. It is
+	// not written anymore once returned.
+	Picture() image.Image
+	Close() error
+}
+
+// VideoEncoder encodes the pictures of the composite
+type VideoEncoder interface {
+	// Encode feeds the next picture, which may be reused once it returns
+	Encode(picture *image.RGBA) error
+	Close() error
+}
+
+// CompositorCodec builds the video decoders and the encoder of the
+// compositor, the hub itself does not link video codecs
+type CompositorCodec interface {
+	// NewDecoder decodes a track of mimeType into pictures of width by
+	// height, letterboxed
+	NewDecoder(mimeType string, width, height int) (VideoDecoder, error)
+	// NewEncoder encodes the pictures in constrained baseline H264 with
+	// the parameter sets on every keyframe, output gets each access unit
+	// in Annex B
+	NewEncoder(options CompositorOptions, output func(accessUnit []byte)) (VideoEncoder, error)
+}
+
+// compositor arranges the video tracks of the publishers in a grid, the
+// dominant speaker highlighted, and encodes it as a single track
+type compositor struct {
+	codec   CompositorCodec
+	options CompositorOptions
+	track   *webrtc.TrackLocalStaticRTP
+	encoder VideoEncoder
+
+	lock sync.Mutex
+	// tiles are the tracks composited, by key
+	tiles    map[string]*compositeTile
+	dominant string
+}
+
+// videoDecodingWriter is the recordingWriter decoding a video track, its
+// trackRecorder is the sink
+type videoDecodingWriter struct {
+	key     string
+	builder *samplebuilder.SampleBuilder
+	// newDecoder makes the decoder on the first frame
+	newDecoder func() (VideoDecoder, error)
+	// done is closed once the track is removed or the sink closed
+	done chan struct{}
+
+	lock    sync.Mutex
+	decoder VideoDecoder
+	failed  bool
+}
+
+// newVideoDecodingWriter decodes a track of codec, nil when its codec
+// cannot be depacketized into frames
+func newVideoDecodingWriter(key string, codec webrtc.RTPCodecCapability, newDecoder func() (VideoDecoder, error)) *videoDecodingWriter {
+	var depacketizer rtp.Depacketizer
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		depacketizer = &codecs.VP8Packet{}
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP9):
+		depacketizer = &codecs.VP9Packet{}
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+		depacketizer = &codecs.H264Packet{}
+	default:
+		return nil
+	}
+	return &videoDecodingWriter{
+		key:        key,
+		builder:    samplebuilder.New(ivfMaxLate, depacketizer, codec.ClockRate),
+		newDecoder: newDecoder,
+		done:       make(chan struct{}),
+	}
+}
+
+func (w *videoDecodingWriter) WriteRTP(packet *rtp.Packet) error {
+	w.builder.Push(packet)
+	for sample := w.builder.Pop(); sample != nil; sample = w.builder.Pop() {
+		decoder := w.videoDecoder()
+		if decoder == nil {
+			return nil
+		}
+		if err := decoder.Decode(sample.Data); err != nil {
+			zap.S().Debugw("Unable to decode video", "track", w.key, "error", err)
+		}
+	}
+	return nil
+}
+
+func (w *videoDecodingWriter) videoDecoder() VideoDecoder {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.decoder != nil || w.failed {
+		return w.decoder
+	}
+	decoder, err := w.newDecoder()
+	if err != nil {
+		zap.S().Errorw("Unable to create a video decoder", "track", w.key, "error", err)
+		w.failed = true
+		return nil
+	}
+	w.decoder = decoder
+	return decoder
+}
+
+func (w *videoDecodingWriter) picture() image.Image {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.decoder == nil {
+		return nil
+	}
+	return w.decoder.Picture()
+}
+
+// Close is called by the recorder once it is closed
+func (w *videoDecodingWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.failed = true
+	close(w.done)
+	if w.decoder != nil {
+		return w.decoder.Close()
+	}
+	return nil
+}
+
+// compositeTile decodes a video track for the composite
+type compositeTile struct {
+	*videoDecodingWriter
+	compositor *compositor
+	streamID   string
+	recorder   *trackRecorder
+}
+
+// Close is called by the recorder once the track is removed
+func (t *compositeTile) Close() error {
+	t.compositor.lock.Lock()
+	if t.compositor.tiles[t.key] == t {
+		delete(t.compositor.tiles, t.key)
+	}
+	t.compositor.lock.Unlock()
+	return t.videoDecodingWriter.Close()
+}
+
+// EnableCompositor decodes the video of every publisher with codec and
+// sends their grid, the dominant speaker highlighted when the active
+// speakers are ranked, as the H264 track of CompositeStreamID. It can be
+// recorded and pushed out like any other stream.
+func (s *Broadcaster) EnableCompositor(codec CompositorCodec, options CompositorOptions) error {
+	if codec == nil {
+		return errors.New("no codec for the compositor")
+	}
+	if options.Width <= 0 || options.Height <= 0 || options.Width%2 != 0 || options.Height%2 != 0 {
+		return fmt.Errorf("invalid composite size %dx%d", options.Width, options.Height)
+	}
+	if options.FrameRate <= 0 {
+		return fmt.Errorf("invalid composite frame rate %d", options.FrameRate)
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: compositeFmtp,
+	}, compositeTrackID, CompositeStreamID)
+	if err != nil {
+		return err
+	}
+	c := &compositor{codec: codec, options: options, track: track, tiles: make(map[string]*compositeTile)}
+	packetizer := rtp.NewPacketizer(compositeMTU, 0, rand.Uint32(), &codecs.H264Payloader{}, rtp.NewRandomSequencer(), 90000)
+	samples := uint32(90000 / options.FrameRate)
+	if c.encoder, err = codec.NewEncoder(options, func(accessUnit []byte) {
+		// Called by the encoder only, in order
+		for _, packet := range packetizer.Packetize(accessUnit, samples) {
+			if err := track.WriteRTP(packet); err != nil {
+				zap.S().Debugw("Unable to write the composite", "error", err)
+			}
+			if raw, err := packet.Marshal(); err == nil {
+				s.writeSinks(compositeKey, raw)
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	enabled, opaque := false, false
+	s.do(func() {
+		if opaque = s.opaque(); opaque || s.compositor != nil {
+			return
+		}
+		s.compositor = c
+		s.senders[compositeKey] = track
+		enabled = true
+		s.recordNewTrack(compositeKey)
+		s.packageNewTrack(compositeKey)
+		s.notifyTrackWatchers()
+		s.scheduleRebalance()
+	})
+	if !enabled {
+		c.encoder.Close()
+	}
+	if opaque {
+		return errors.New("end-to-end encrypted video cannot be composited")
+	}
+	if !enabled {
+		return errors.New("the compositor is already enabled")
+	}
+	go s.runCompositor(c)
+	return nil
+}
+
+// updateCompositor decodes the video tracks not composited yet, it must
+// run on the loop
+func (s *Broadcaster) updateCompositor() {
+	s.sinkLock.Lock()
+	defer s.sinkLock.Unlock()
+	s.compositor.lock.Lock()
+	defer s.compositor.lock.Unlock()
+	for key, sender := range s.senders {
+		local, ok := sender.(*webrtc.TrackLocalStaticRTP)
+		if !ok || local.Kind() != webrtc.RTPCodecTypeVideo || local.StreamID() == CompositeStreamID || s.isSpareLayer(key) {
+			continue
+		}
+		if _, ok := s.compositor.tiles[key]; ok {
+			continue
+		}
+		c, codec := s.compositor, local.Codec()
+		// The decoders are made at the size of the tiles on their first
+		// frame
+		writer := newVideoDecodingWriter(key, codec, func() (VideoDecoder, error) {
+			width, height := c.tileSize()
+			return c.codec.NewDecoder(codec.MimeType, width, height)
+		})
+		if writer == nil {
+			continue
+		}
+		tile := &compositeTile{videoDecodingWriter: writer, compositor: c, streamID: local.StreamID()}
+		key := key
+		tile.recorder = newTrackRecorder(CompositeStreamID, codec.MimeType, tile, func() {
+			go s.do(func() { s.requestKeyframe(key, keyframeSubscriber) })
+		})
+		tile.recorder.keyframeInterval = compositeKeyframeInterval
+		s.compositor.tiles[key] = tile
+		if _, ok := s.sinks[key]; !ok {
+			s.sinks[key] = make(map[TrackSink]bool)
+		}
+		s.sinks[key][tile.recorder] = true
+	}
+}
+
+// compositeSpeaker highlights the stream of the dominant speaker, it must
+// run on the loop
+func (s *Broadcaster) compositeSpeaker(streamID string) {
+	if s.compositor == nil {
+		return
+	}
+	s.compositor.lock.Lock()
+	s.compositor.dominant = streamID
+	s.compositor.lock.Unlock()
+}
+
+// runCompositor encodes the grid at the frame rate until the Broadcaster
+// is closed. Nothing is encoded while there is no tile.
+func (s *Broadcaster) runCompositor(c *compositor) {
+	ticker := time.NewTicker(time.Second / time.Duration(c.options.FrameRate))
+	defer ticker.Stop()
+	canvas := image.NewRGBA(image.Rect(0, 0, c.options.Width, c.options.Height))
+	for {
+		select {
+		case <-s.closed:
+			c.lock.Lock()
+			tiles := c.tiles
+			c.tiles = make(map[string]*compositeTile)
+			c.lock.Unlock()
+			for _, tile := range tiles {
+				tile.recorder.Close()
+			}
+			c.encoder.Close()
+			return
+		case <-ticker.C:
+		}
+		if !c.render(canvas) {
+			continue
+		}
+		if err := c.encoder.Encode(canvas); err != nil {
+			zap.S().Warnw("Unable to encode the composite", "error", err)
+		}
+	}
+}
+
+// compositeGrid returns the columns and rows of the grid of count tiles
+func compositeGrid(count int) (int, int) {
+	if count == 0 {
+		return 1, 1
+	}
+	columns := int(math.Ceil(math.Sqrt(float64(count))))
+	return columns, (count + columns - 1) / columns
+}
+
+// tileSize is the size of the tiles once a new one is added
+func (c *compositor) tileSize() (int, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	columns, rows := compositeGrid(len(c.tiles))
+	return c.options.Width / columns &^ 1, c.options.Height / rows &^ 1
+}
+
+// render draws the grid on canvas, by stream then track, it returns false
+// when there is no tile
+func (c *compositor) render(canvas *image.RGBA) bool {
+	c.lock.Lock()
+	tiles := make([]*compositeTile, 0, len(c.tiles))
+	for _, tile := range c.tiles {
+		tiles = append(tiles, tile)
+	}
+	dominant := c.dominant
+	c.lock.Unlock()
+	if len(tiles) == 0 {
+		return false
+	}
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].streamID != tiles[j].streamID {
+			return tiles[i].streamID < tiles[j].streamID
+		}
+		return tiles[i].key < tiles[j].key
+	})
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(compositeBackground), image.Point{}, draw.Src)
+	columns, rows := compositeGrid(len(tiles))
+	width, height := c.options.Width/columns, c.options.Height/rows
+	for i, tile := range tiles {
+		cell := image.Rect(0, 0, width, height).Add(image.Pt(i%columns*width, i/columns*height))
+		if picture := tile.picture(); picture != nil {
+			drawScaled(canvas, cell.Inset(compositeBorder), picture)
+		}
+		if dominant != "" && tile.streamID == dominant {
+			for _, edge := range []image.Rectangle{
+				image.Rect(cell.Min.X, cell.Min.Y, cell.Max.X, cell.Min.Y+compositeBorder),
+				image.Rect(cell.Min.X, cell.Max.Y-compositeBorder, cell.Max.X, cell.Max.Y),
+				image.Rect(cell.Min.X, cell.Min.Y, cell.Min.X+compositeBorder, cell.Max.Y),
+				image.Rect(cell.Max.X-compositeBorder, cell.Min.Y, cell.Max.X, cell.Max.Y),
+			} {
+				draw.Draw(canvas, edge, image.NewUniform(compositeHighlight), image.Point{}, draw.Src)
+			}
+		}
+	}
+	return true
+}
+
+// drawScaled fits picture in the middle of cell with the nearest pixels,
+// keeping its aspect ratio
+func drawScaled(canvas *image.RGBA, cell image.Rectangle, picture image.Image) {
+	source, ok := picture.(*image.RGBA)
+	if !ok {
+		source = image.NewRGBA(picture.Bounds())
+		draw.Draw(source, source.Bounds(), picture, picture.Bounds().Min, draw.Src)
+	}
+	bounds := source.Bounds()
+	if bounds.Empty() || cell.Empty() {
+		return
+	}
+	scale := math.Min(float64(cell.Dx())/float64(bounds.Dx()), float64(cell.Dy())/float64(bounds.Dy()))
+	width, height := int(float64(bounds.Dx())*scale), int(float64(bounds.Dy())*scale)
+	origin := cell.Min.Add(image.Pt((cell.Dx()-width)/2, (cell.Dy()-height)/2))
+	for y := 0; y < height; y++ {
+		sy := bounds.Min.Y + y*bounds.Dy()/height
+		row := canvas.PixOffset(origin.X, origin.Y+y)
+		for x := 0; x < width; x++ {
+			sx := bounds.Min.X + x*bounds.Dx()/width
+			from := source.PixOffset(sx, sy)
+			copy(canvas.Pix[row+4*x:row+4*x+4], source.Pix[from:from+4])
+		}
+	}
+}
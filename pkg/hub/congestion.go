@@ -0,0 +1,152 @@
+package hub
+
+import (
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// congestionRecovery is how much more than they need the estimate of a
+// receiver must allow before its shed tracks come back, so that tracks do
+// not flap around the estimate
+const congestionRecovery = 1.25
+
+// EnableCongestionControl compares the estimated bandwidth of every receiver
+// with the bitrate of its tracks every interval. The video tracks of the
+// quietest streams are shed from receivers that cannot keep up, audio is
+// always kept, and restored once their bandwidth recovers. Pinned tracks
+// are never shed.
+func (s *Broadcaster) EnableCongestionControl(interval time.Duration) {
+	s.do(func() {
+		s.congestionControl = true
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.closed:
+				return
+			case <-ticker.C:
+			}
+			s.do(s.checkCongestion)
+		}
+	}()
+}
+
+// sheddingBitrate is the bitrate the receiver saves by not getting key, the
+// lowest layer for simulcast tracks since the layer adaptation falls back
+// to it before anything is shed. It must run on the loop.
+func (s *Broadcaster) sheddingBitrate(key string) float64 {
+	if group := s.simulcastGroup(key); len(group) > 0 {
+		return s.trackBitrate(group[0])
+	}
+	return s.trackBitrate(key)
+}
+
+// receiverBudget is the bitrate the receiver is expected to sustain, zero
+// while its bandwidth is unknown. It must run on the loop.
+func (s *Broadcaster) receiverBudget(receiver ReceiverState) float64 {
+	if receiver.Bandwidth == nil {
+		return 0
+	}
+	return float64(receiver.Bandwidth.Estimate()) * layerHeadroom
+}
+
+// checkCongestion rebalances when a receiver gets more than its bandwidth
+// allows or has room for its shed tracks again, it must run on the loop
+func (s *Broadcaster) checkCongestion() {
+	for _, receiver := range s.receivers {
+		budget := s.receiverBudget(receiver)
+		if budget == 0 {
+			continue
+		}
+		sending, shed := 0.0, 0.0
+		for key := range receiver.assigned {
+			sending += s.sheddingBitrate(key)
+		}
+		for key := range receiver.shed {
+			shed += s.sheddingBitrate(key)
+		}
+		if sending > budget || (shed > 0 && (sending+shed)*congestionRecovery <= budget) {
+			s.scheduleRebalance()
+			return
+		}
+	}
+}
+
+// enforceCongestion sheds the video tracks the receivers have no bandwidth
+// for, those of the quietest streams and the most expensive first. Tracks
+// shed by the previous rebalance stay shed until there is room to spare for
+// them. It must run on the loop.
+func (s *Broadcaster) enforceCongestion(match map[uuid.UUID]map[string]bool) {
+	if !s.congestionControl {
+		return
+	}
+	for u, keys := range match {
+		receiver, ok := s.receivers[u]
+		if !ok {
+			continue
+		}
+		budget := s.receiverBudget(receiver)
+		if budget == 0 {
+			receiver.shed = nil
+			s.receivers[u] = receiver
+			continue
+		}
+		pinned := s.pinnedTracks(receiver)
+		total := 0.0
+		candidates := make([]string, 0, len(keys))
+		for key := range keys {
+			total += s.sheddingBitrate(key)
+			sender, ok := s.senders[key]
+			if ok && sender.Kind() == webrtc.RTPCodecTypeVideo && !pinned[key] {
+				candidates = append(candidates, key)
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			first, second := s.senders[candidates[i]].StreamID(), s.senders[candidates[j]].StreamID()
+			if s.quietness(first) != s.quietness(second) {
+				return s.quietness(first) > s.quietness(second)
+			}
+			if s.sheddingBitrate(candidates[i]) != s.sheddingBitrate(candidates[j]) {
+				return s.sheddingBitrate(candidates[i]) > s.sheddingBitrate(candidates[j])
+			}
+			return candidates[i] < candidates[j]
+		})
+
+		shed := make(map[string]bool)
+		keepShed := total*congestionRecovery > budget
+		for _, key := range candidates {
+			if total <= budget && !(keepShed && receiver.shed[key]) {
+				continue
+			}
+			delete(keys, key)
+			total -= s.sheddingBitrate(key)
+			shed[key] = true
+		}
+		if len(shed) != len(receiver.shed) {
+			zap.S().Infow("Receiver bandwidth changed, adjusted its tracks", "receiver", u, "budget", budget, "estimate", total, "shed", len(shed))
+		}
+		receiver.shed = shed
+		s.receivers[u] = receiver
+	}
+}
+
+// pinnedTracks are the keys of the tracks pinned to the receiver, it must
+// run on the loop
+func (s *Broadcaster) pinnedTracks(receiver ReceiverState) map[string]bool {
+	publishers := s.trackPublishers()
+	pinned := make(map[string]bool)
+	for _, pin := range receiver.pins {
+		for key := range s.senders {
+			if key == pin.Track || (pin.Publisher != uuid.Nil && publishers[key] == pin.Publisher) {
+				pinned[key] = true
+			}
+		}
+	}
+	return pinned
+}
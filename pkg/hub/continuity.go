@@ -0,0 +1,69 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// EnableTrackContinuity keeps the tracks of a publisher that left for grace,
+// so that when it reconnects with the same tracks receivers keep them and
+// see their stream go on instead of renegotiating
+func (s *Broadcaster) EnableTrackContinuity(grace time.Duration) {
+	s.do(func() {
+		s.continuityGrace = grace
+	})
+}
+
+// takeOverSender makes source the publisher of the track key when it is
+// already distributed with the same codec, clock follows its sender
+// reports. It must run on the loop.
+func (s *Broadcaster) takeOverSender(key string, source trackSource, clock *sourceClock) (*webrtc.TrackLocalStaticRTP, bool) {
+	existing, ok := s.senders[key].(*webrtc.TrackLocalStaticRTP)
+	continuity := s.continuities[key]
+	if !ok || continuity == nil || existing.Codec().MimeType != source.Codec().MimeType {
+		return nil, false
+	}
+	if timer, ok := s.detached[key]; ok {
+		timer.Stop()
+		delete(s.detached, key)
+	}
+	for _, peer := range s.peerSender {
+		delete(peer.tracks, key)
+	}
+	s.sources[key] = source
+	continuity.takeOver(source, clock)
+	s.keyframes.reset(key)
+	s.scheduleRebalance()
+	return existing, true
+}
+
+// detachSender keeps distributing the track key for the continuity grace
+// period once its publisher left, it is removed right away when there is
+// none. It must run on the loop.
+func (s *Broadcaster) detachSender(key string) {
+	if _, ok := s.senders[key]; !ok {
+		return
+	}
+	if s.continuityGrace <= 0 {
+		s.removeSender(key)
+		return
+	}
+	if _, ok := s.detached[key]; ok {
+		return
+	}
+	zap.S().Debugw("Track detached from its publisher", "track", key, "grace", s.continuityGrace)
+	for _, peer := range s.peerSender {
+		delete(peer.tracks, key)
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(s.continuityGrace, func() {
+		s.do(func() {
+			if s.detached[key] == timer {
+				s.removeSender(key)
+			}
+		})
+	})
+	s.detached[key] = timer
+}
@@ -0,0 +1,181 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// ControlChannelLabel is the label of the data channel receivers change
+// their quality over, without signaling round trips nor renegotiation
+const ControlChannelLabel = "control"
+
+// ReceiverQuality is the video quality a receiver asks for
+type ReceiverQuality string
+
+const (
+	// QualityAuto lets the hub pick the layers, the default
+	QualityAuto ReceiverQuality = "auto"
+	// QualityLow sends the lowest simulcast layer of every track
+	QualityLow ReceiverQuality = "low"
+	// QualityHigh sends the highest simulcast layer of every track
+	QualityHigh ReceiverQuality = "high"
+	// QualityAudioOnly stops the video, its transceivers are kept
+	QualityAudioOnly ReceiverQuality = "audio-only"
+)
+
+// The types of the control messages
+const (
+	// ControlQuality sets the quality of the receiver
+	ControlQuality = "quality"
+	// ControlPauseVideo and ControlResumeVideo stop and restart the video
+	ControlPauseVideo  = "pause-video"
+	ControlResumeVideo = "resume-video"
+	// ControlState is the answer of the hub, with the state it applied
+	ControlState = "state"
+	// ControlError answers the requests the hub could not apply
+	ControlError = "error"
+)
+
+// ControlMessage is sent as JSON over the control data channel
+type ControlMessage struct {
+	Type    string          `json:"type"`
+	Quality ReceiverQuality `json:"quality,omitempty"`
+	// VideoPaused is set in states while the video is paused
+	VideoPaused bool   `json:"videoPaused,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ServeControl applies the requests of the receiver over its control
+// channel until it closes, every request is answered with the state or an
+// error
+func (s *Broadcaster) ServeControl(id uuid.UUID, channel *webrtc.DataChannel) {
+	channel.OnMessage(func(raw webrtc.DataChannelMessage) {
+		message := ControlMessage{}
+		err := json.Unmarshal(raw.Data, &message)
+		if err == nil {
+			message, err = s.handleControl(id, message)
+		}
+		if err != nil {
+			message = ControlMessage{Type: ControlError, Error: err.Error()}
+		}
+		answer, err := json.Marshal(message)
+		if err != nil {
+			zap.S().Errorw("Unable to encode control answer", "error", err)
+			return
+		}
+		if err := channel.SendText(string(answer)); err != nil {
+			zap.S().Debugw("Unable to answer over the control channel", "receiver", id, "error", err)
+		}
+	})
+}
+
+func (s *Broadcaster) handleControl(id uuid.UUID, message ControlMessage) (ControlMessage, error) {
+	switch message.Type {
+	case ControlQuality:
+		return s.SetReceiverQuality(id, message.Quality)
+	case ControlPauseVideo:
+		return s.PauseVideo(id, true)
+	case ControlResumeVideo:
+		return s.PauseVideo(id, false)
+	}
+	return ControlMessage{}, fmt.Errorf("unknown control message %q", message.Type)
+}
+
+// SetReceiverQuality changes the video quality of the receiver, it returns
+// the state applied
+func (s *Broadcaster) SetReceiverQuality(id uuid.UUID, quality ReceiverQuality) (ControlMessage, error) {
+	switch quality {
+	case QualityAuto, QualityLow, QualityHigh, QualityAudioOnly:
+	default:
+		return ControlMessage{}, fmt.Errorf("unknown quality %q", quality)
+	}
+	return s.updateControl(id, func(receiver *ReceiverState) {
+		receiver.quality = quality
+	})
+}
+
+// PauseVideo stops or restarts the video of the receiver without
+// renegotiating, it returns the state applied
+func (s *Broadcaster) PauseVideo(id uuid.UUID, pause bool) (ControlMessage, error) {
+	return s.updateControl(id, func(receiver *ReceiverState) {
+		receiver.videoPaused = pause
+	})
+}
+
+func (s *Broadcaster) updateControl(id uuid.UUID, update func(*ReceiverState)) (ControlMessage, error) {
+	state := ControlMessage{}
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		update(&receiver)
+		err = s.applyVideoControl(&receiver)
+		s.receivers[id] = receiver
+		s.adaptReceiverLayers(receiver)
+		state = ControlMessage{Type: ControlState, Quality: receiver.qualityOrAuto(), VideoPaused: receiver.videoPaused}
+	})
+	return state, err
+}
+
+func (r ReceiverState) qualityOrAuto() ReceiverQuality {
+	if r.quality == "" {
+		return QualityAuto
+	}
+	return r.quality
+}
+
+// videoOff tells whether the receiver asked to get no video
+func (r ReceiverState) videoOff() bool {
+	return r.videoPaused || r.quality == QualityAudioOnly
+}
+
+// applyVideoControl pauses the video tracks of the receiver while it asked
+// for no video, and resumes those it paused once it asks for video again.
+// The tracks paused with PauseTrack are left alone. It must run on the loop
+// and the caller stores the receiver back.
+func (s *Broadcaster) applyVideoControl(receiver *ReceiverState) error {
+	var err error
+	keep := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	if !receiver.videoOff() {
+		keys := make([]string, 0, len(receiver.controlPaused))
+		for key := range receiver.controlPaused {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			delete(receiver.controlPaused, key)
+			if _, ok := receiver.paused[key]; ok {
+				keep(s.resumeTrack(receiver, key))
+			}
+		}
+		return err
+	}
+	for _, sender := range receiver.Connection.GetSenders() {
+		track := sender.Track()
+		if track == nil || track.Kind() != webrtc.RTPCodecTypeVideo || receiver.isReplayTrack(track) {
+			continue
+		}
+		key := track.StreamID() + track.ID()
+		if e := s.pauseTrack(receiver, key); e != nil {
+			keep(e)
+			continue
+		}
+		if receiver.controlPaused == nil {
+			receiver.controlPaused = make(map[string]bool)
+		}
+		receiver.controlPaused[key] = true
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dashTimeLayout is the xs:dateTime of the manifests
+const dashTimeLayout = "2006-01-02T15:04:05.000Z"
+
+// dashDuration writes an xs:duration in seconds
+func dashDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// manifest writes the dynamic DASH manifest of the segments once there is
+// one, waiting until ctx is done. Each publication is a period with an
+// adaptation set per track, the segments are addressed by their time.
+// query is added to the URLs of the files.
+func (h *hlsStream) manifest(ctx context.Context, query string) ([]byte, error) {
+	if !h.wait(ctx, func() bool { return len(h.segments) > 0 }) {
+		h.lock.Lock()
+		if len(h.segments) == 0 {
+			h.lock.Unlock()
+			return nil, ErrSegmentNotFound
+		}
+	}
+	defer h.lock.Unlock()
+	if query != "" {
+		escaped := &bytes.Buffer{}
+		xml.EscapeText(escaped, []byte("?"+query))
+		query = escaped.String()
+	}
+	window := time.Duration(0)
+	target := h.options.SegmentDuration
+	for _, segment := range h.segments {
+		window += segment.duration
+		if segment.duration > target {
+			target = segment.duration
+		}
+	}
+	manifest := &bytes.Buffer{}
+	fmt.Fprintf(manifest, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(manifest, "<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:isoff-live:2011\" type=\"dynamic\"")
+	fmt.Fprintf(manifest, " availabilityStartTime=\"%s\" publishTime=\"%s\"", h.availability.UTC().Format(dashTimeLayout), time.Now().UTC().Format(dashTimeLayout))
+	if !h.ended {
+		// Done updating once the stream went away
+		fmt.Fprintf(manifest, " minimumUpdatePeriod=\"%s\"", dashDuration(h.options.SegmentDuration))
+	}
+	fmt.Fprintf(manifest, " minBufferTime=\"%s\" timeShiftBufferDepth=\"%s\" suggestedPresentationDelay=\"%s\">\n",
+		dashDuration(target), dashDuration(window), dashDuration(3*target))
+	for first := 0; first < len(h.segments); {
+		last := first + 1
+		for last < len(h.segments) && h.segments[last].init == h.segments[first].init {
+			last++
+		}
+		h.writePeriod(manifest, h.segments[first:last], query)
+		first = last
+	}
+	fmt.Fprintf(manifest, "</MPD>\n")
+	return manifest.Bytes(), nil
+}
+
+// writePeriod writes the period of the segments of a publication, it must
+// be called with the lock held
+func (h *hlsStream) writePeriod(manifest *bytes.Buffer, segments []hlsSegment, query string) {
+	init := h.inits[segments[0].init]
+	fmt.Fprintf(manifest, "  <Period id=\"%d\" start=\"%s\">\n", segments[0].init, dashDuration(init.date.Sub(h.availability)))
+	for _, track := range init.tracks {
+		contentType, attributes := "audio", fmt.Sprintf("audioSamplingRate=\"%d\"", track.clockRate)
+		if track.video() {
+			contentType, attributes = "video", fmt.Sprintf("width=\"%d\" height=\"%d\"", track.width, track.height)
+		}
+		size, duration := 0, time.Duration(0)
+		for _, segment := range segments {
+			if run, ok := segment.runs[track.number]; ok {
+				size += len(run.data)
+				duration += segment.duration
+			}
+		}
+		if duration == 0 {
+			continue
+		}
+		bandwidth := int64(float64(size*8) / duration.Seconds())
+		fmt.Fprintf(manifest, "    <AdaptationSet id=\"%d\" contentType=\"%s\" mimeType=\"%s/mp4\" segmentAlignment=\"true\" startWithSAP=\"1\">\n", track.number, contentType, contentType)
+		fmt.Fprintf(manifest, "      <Representation id=\"%d\" codecs=\"%s\" bandwidth=\"%d\" %s>\n", track.number, mp4Codec(track), bandwidth, attributes)
+		fmt.Fprintf(manifest, "        <SegmentTemplate timescale=\"%d\" initialization=\"init-%d-$RepresentationID$.mp4%s\" media=\"%d-$RepresentationID$-$Time$.m4s%s\">\n",
+			track.clockRate, segments[0].init, query, segments[0].init, query)
+		fmt.Fprintf(manifest, "          <SegmentTimeline>\n")
+		for _, segment := range segments {
+			if run, ok := segment.runs[track.number]; ok {
+				fmt.Fprintf(manifest, "            <S t=\"%d\" d=\"%d\"/>\n", run.decodeTime, run.duration)
+			}
+		}
+		fmt.Fprintf(manifest, "          </SegmentTimeline>\n        </SegmentTemplate>\n      </Representation>\n    </AdaptationSet>\n")
+	}
+	fmt.Fprintf(manifest, "  </Period>\n")
+}
+
+// dashFile returns the init segment init-I-T.mp4 of the track T of the
+// publication I or its media segment I-T-D.m4s decoding from D
+func (h *hlsStream) dashFile(name string) ([]byte, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var fields []string
+	switch {
+	case strings.HasPrefix(name, "init-") && strings.HasSuffix(name, ".mp4"):
+		fields = strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "init-"), ".mp4"), "-")
+		if len(fields) != 2 {
+			return nil, ErrSegmentNotFound
+		}
+	case strings.HasSuffix(name, ".m4s"):
+		fields = strings.Split(strings.TrimSuffix(name, ".m4s"), "-")
+		if len(fields) != 3 {
+			return nil, ErrSegmentNotFound
+		}
+	default:
+		return nil, ErrSegmentNotFound
+	}
+	init, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, ErrSegmentNotFound
+	}
+	number, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return nil, ErrSegmentNotFound
+	}
+	if len(fields) == 2 {
+		if init, ok := h.inits[init]; ok && init.dash[uint8(number)] != nil {
+			return init.dash[uint8(number)], nil
+		}
+		return nil, ErrSegmentNotFound
+	}
+	decodeTime, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return nil, ErrSegmentNotFound
+	}
+	for _, segment := range h.segments {
+		if run, ok := segment.runs[uint8(number)]; ok && segment.init == init && run.decodeTime == decodeTime {
+			return run.data, nil
+		}
+	}
+	return nil, ErrSegmentNotFound
+}
+
+// DASHManifest returns the DASH manifest of streamID, waiting until ctx is
+// done for its first segment. query is added to the URLs it lists.
+func (s *Broadcaster) DASHManifest(ctx context.Context, streamID string, query string) ([]byte, error) {
+	stream, err := s.hlsStream(streamID)
+	if err != nil {
+		return nil, err
+	}
+	if !stream.options.DASH {
+		return nil, ErrUnknownStream
+	}
+	return stream.manifest(ctx, query)
+}
+
+// DASHFile returns an init or a media segment listed by the DASH manifest
+// of streamID
+func (s *Broadcaster) DASHFile(streamID string, name string) ([]byte, error) {
+	stream, err := s.hlsStream(streamID)
+	if err != nil {
+		return nil, err
+	}
+	if !stream.options.DASH {
+		return nil, ErrUnknownStream
+	}
+	return stream.dashFile(name)
+}
@@ -0,0 +1,273 @@
+package hub
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// reportClock maps the NTP time of the sender reports of a session to the
+// local clock, with the same offset for all its tracks
+type reportClock struct {
+	offset time.Duration
+	synced bool
+}
+
+// report maps the clock of track to the local one with its sender reports
+func (c *reportClock) report(track *describedTrack, packet []byte) {
+	packets, err := rtcp.Unmarshal(packet)
+	if err != nil {
+		return
+	}
+	for _, packet := range packets {
+		report, ok := packet.(*rtcp.SenderReport)
+		if !ok {
+			continue
+		}
+		ntp := time.Unix(int64(report.NTPTime>>32)-2208988800, int64((report.NTPTime&0xFFFFFFFF)*1e9>>32))
+		if !c.synced {
+			c.synced, c.offset = true, time.Since(ntp)
+		}
+		track.reported, track.reportedRTP, track.reportedAt = true, report.RTPTime, ntp.Add(c.offset)
+	}
+}
+
+// describedTrack is an RTP stream described by SDP, forwarded as an
+// ingest track
+type describedTrack struct {
+	codec webrtc.RTPCodecCapability
+	// channel is the interleaved channel of its RTP packets over RTSP
+	channel byte
+	track   *IngestTrack
+	// parameterSets is a STAP-A of the SPS and PPS of the description,
+	// spsTimestamp the last access unit carrying them
+	parameterSets []byte
+	spsTimestamp  uint32
+	spsSeen       bool
+	// offset renumbers the packets once parameter sets were inserted
+	offset uint16
+	// aacConfig is the AudioSpecificConfig of the AAC transcoded into
+	// transcoded
+	aacConfig  []byte
+	transcoded *packetizedTrack
+	transcode  func(timestamp uint32, at time.Time) (*packetizedTrack, error)
+
+	reported    bool
+	reportedRTP uint32
+	reportedAt  time.Time
+}
+
+// newDescribedTrack reads the codec of the first format of media, false
+// when it cannot be forwarded
+func newDescribedTrack(media *sdp.MediaDescription) (*describedTrack, bool) {
+	if len(media.MediaName.Formats) == 0 {
+		return nil, false
+	}
+	format := media.MediaName.Formats[0]
+	encoding, fmtp := "", ""
+	clockRate, channels := uint32(0), uint16(0)
+	for _, attribute := range media.Attributes {
+		payloadType, value, _ := strings.Cut(attribute.Value, " ")
+		if payloadType != format {
+			continue
+		}
+		switch attribute.Key {
+		case "rtpmap":
+			parts := strings.Split(value, "/")
+			encoding = strings.ToLower(parts[0])
+			if len(parts) > 1 {
+				rate, _ := strconv.Atoi(parts[1])
+				clockRate = uint32(rate)
+			}
+			if len(parts) > 2 {
+				count, _ := strconv.Atoi(parts[2])
+				channels = uint16(count)
+			}
+		case "fmtp":
+			fmtp = value
+		}
+	}
+	switch format {
+	case "0":
+		encoding, clockRate = "pcmu", 8000
+	case "8":
+		encoding, clockRate = "pcma", 8000
+	}
+	params := map[string]string{}
+	for _, param := range strings.Split(fmtp, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		params[strings.ToLower(name)] = value
+	}
+	t := &describedTrack{}
+	switch encoding {
+	case "h264":
+		profile := []byte{0x42, 0xE0, 0x1F}
+		if decoded, err := hex.DecodeString(params["profile-level-id"]); err == nil && len(decoded) == 3 {
+			profile = decoded
+		}
+		t.parameterSets = []byte{0x78}
+		for _, set := range strings.Split(params["sprop-parameter-sets"], ",") {
+			nal, err := base64.StdEncoding.DecodeString(set)
+			if err != nil || len(nal) == 0 {
+				continue
+			}
+			if nal[0]&0x1F == 7 && len(nal) >= 4 && params["profile-level-id"] == "" {
+				profile = nal[1:4]
+			}
+			t.parameterSets = append(t.parameterSets, u16(uint16(len(nal)))...)
+			t.parameterSets = append(t.parameterSets, nal...)
+		}
+		if len(t.parameterSets) == 1 {
+			t.parameterSets = nil
+		}
+		t.codec = ingestH264Codec(profile)
+	case "vp8":
+		t.codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	case "vp9":
+		t.codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"}
+	case "opus":
+		t.codec = ingestOpusCodec()
+	case "pcmu":
+		t.codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}
+	case "pcma":
+		t.codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}
+	case "mpeg4-generic":
+		// AAC-hbr, 13 bits sizes and 3 bits indexes
+		config, err := hex.DecodeString(params["config"])
+		if err != nil || len(config) < 2 || !strings.EqualFold(params["mode"], "AAC-hbr") || clockRate == 0 {
+			return nil, false
+		}
+		t.aacConfig = config
+		t.codec = webrtc.RTPCodecCapability{MimeType: "audio/mpeg4-generic", ClockRate: clockRate, Channels: channels}
+	default:
+		return nil, false
+	}
+	return t, true
+}
+
+// start forwards the track as a track of streamID
+func (t *describedTrack) start(s *Broadcaster, streamID string, transcoder AudioTranscoder) error {
+	if t.aacConfig != nil {
+		t.transcode = func(timestamp uint32, at time.Time) (*packetizedTrack, error) {
+			return s.addTranscodedTrack(transcoder, "audio", streamID, timestamp, at)
+		}
+		return nil
+	}
+	kind := "audio"
+	if (mediaTrack{mimeType: t.codec.MimeType}).video() {
+		kind = "video"
+	}
+	t.track = NewIngestTrack(t.codec, kind, streamID)
+	if s.AddIngestSender(t.track) == nil {
+		return errClosed
+	}
+	return nil
+}
+
+// forward sends an RTP packet of the server, the AAC being transcoded
+func (t *describedTrack) forward(raw []byte) error {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(raw); err != nil {
+		return nil
+	}
+	at := time.Now()
+	if t.reported {
+		at = t.reportedAt.Add(time.Duration(int32(packet.Timestamp-t.reportedRTP)) * time.Second / time.Duration(t.codec.ClockRate))
+	}
+	if t.aacConfig != nil {
+		return t.writeAAC(packet, at)
+	}
+	if t.parameterSets != nil {
+		if h264PacketCarries(packet.Payload, 7) {
+			t.spsSeen, t.spsTimestamp = true, packet.Timestamp
+		}
+		if h264PacketCarries(packet.Payload, 5) && (!t.spsSeen || t.spsTimestamp != packet.Timestamp) {
+			t.spsSeen, t.spsTimestamp = true, packet.Timestamp
+			sets := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: packet.SequenceNumber + t.offset, Timestamp: packet.Timestamp},
+				Payload: t.parameterSets,
+			}
+			if err := t.track.WriteRTP(sets, at); err != nil {
+				return err
+			}
+			t.offset++
+		}
+	}
+	packet.SequenceNumber += t.offset
+	// Forwarded without the extensions of the server
+	packet.Extension, packet.Extensions = false, nil
+	return t.track.WriteRTP(packet, at)
+}
+
+// writeAAC writes the access units of an AAC-hbr packet to the
+// transcoder, started on the first one
+func (t *describedTrack) writeAAC(packet *rtp.Packet, at time.Time) error {
+	payload := packet.Payload
+	if len(payload) < 2 {
+		return nil
+	}
+	if t.transcoded == nil {
+		var err error
+		timestamp := uint32(uint64(packet.Timestamp) * 48000 / uint64(t.codec.ClockRate))
+		if t.transcoded, err = t.transcode(timestamp, at); err != nil {
+			return err
+		}
+	}
+	headersLength := int(binary.BigEndian.Uint16(payload)+7) / 8
+	if 2+headersLength > len(payload) {
+		return nil
+	}
+	headers, data := payload[2:2+headersLength], payload[2+headersLength:]
+	for i := 0; i+2 <= len(headers); i += 2 {
+		size := int(binary.BigEndian.Uint16(headers[i:]) >> 3)
+		if size > len(data) {
+			// Fragmented access units are not reassembled
+			return nil
+		}
+		if _, err := t.transcoded.transcoder.Write(adtsFrame(t.aacConfig, data[:size])); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// close ends the track
+func (t *describedTrack) close() {
+	if t.track != nil {
+		t.track.Close()
+	}
+	if t.transcoded != nil {
+		t.transcoded.Close()
+	}
+}
+
+// h264PacketCarries tells whether an H264 RTP packet holds or starts a NAL
+// unit of nalType
+func h264PacketCarries(payload []byte, nalType byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch payload[0] & 0x1F {
+	case 24: // STAP-A
+		for offset := 1; offset+2 < len(payload); {
+			if payload[offset+2]&0x1F == nalType {
+				return true
+			}
+			offset += 2 + int(binary.BigEndian.Uint16(payload[offset:]))
+		}
+		return false
+	case 28: // FU-A
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1F == nalType
+	default:
+		return payload[0]&0x1F == nalType
+	}
+}
@@ -0,0 +1,383 @@
+package hub
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// Track describes a published track to the distributions
+type Track struct {
+	// Key is the stream ID followed by the track ID, the assignments use it
+	Key      string
+	ID       string
+	StreamID string
+	Kind     webrtc.RTPCodecType
+	// Codec is the MIME type of the track codec
+	Codec string
+	// Width and Height are the resolution of video tracks, zeros while
+	// unknown
+	Width  int
+	Height int
+	// PublisherID is the publisher connection the track comes from, it is
+	// the zero UUID for tracks pulled from elsewhere
+	PublisherID uuid.UUID
+	// Bitrate is the measured bitrate of the track in bits per second
+	Bitrate float64
+	// SpeakerRank is the position of the stream among the active speakers,
+	// 1 for the loudest, 0 when it is not speaking or detection is off
+	SpeakerRank int
+}
+
+// ReceiverPreferences are the limits a receiver asked for, zero values
+// leave the choice to the distribution
+type ReceiverPreferences struct {
+	// MaxTracks caps the number of tracks sent to the receiver
+	MaxTracks int
+	// Capacity weighs the receiver against the others, a receiver with
+	// twice the capacity gets twice the tracks from weighted distributions
+	Capacity int
+	// WantedStreams restricts the receiver to these stream IDs
+	WantedStreams []string
+	// Codecs are the MIME types the receiver decodes, any when empty
+	Codecs []string
+	// MaxWidth and MaxHeight bound the resolution of the video tracks the
+	// receiver gets, zeros leave it unbounded
+	MaxWidth  int
+	MaxHeight int
+}
+
+// Receiver describes a receiver to the distributions
+type Receiver struct {
+	ID          uuid.UUID
+	Preferences ReceiverPreferences
+	// Bandwidth is the estimated bandwidth towards the receiver in bits per
+	// second, zero while unknown
+	Bandwidth int
+}
+
+// Distribution decides which tracks every receiver gets, the result maps
+// each receiver to the keys of its tracks
+type Distribution interface {
+	Distribute(tracks []Track, receivers []Receiver) map[uuid.UUID]map[string]bool
+}
+
+// DistributionFunc adapts a function of the track keys and receiver IDs to
+// the Distribution interface, for distributions ignoring the metadata
+type DistributionFunc func([]string, []uuid.UUID) map[uuid.UUID]map[string]bool
+
+func (f DistributionFunc) Distribute(tracks []Track, receivers []Receiver) map[uuid.UUID]map[string]bool {
+	return f(TrackKeys(tracks), ReceiverIDs(receivers))
+}
+
+// TrackKeys returns the keys of the tracks
+func TrackKeys(tracks []Track) []string {
+	keys := make([]string, 0, len(tracks))
+	for _, track := range tracks {
+		keys = append(keys, track.Key)
+	}
+	return keys
+}
+
+// ReceiverIDs returns the IDs of the receivers
+func ReceiverIDs(receivers []Receiver) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(receivers))
+	for _, receiver := range receivers {
+		ids = append(ids, receiver.ID)
+	}
+	return ids
+}
+
+// GroupByStream wraps a distribution so that the tracks sharing a stream
+// ID, such as the audio and video of a publisher, always go to the same
+// receiver. The wrapped distribution sees one track per stream, keyed by
+// the stream ID and of the video kind when the stream has video.
+func GroupByStream(d Distribution) Distribution {
+	return streamGroups{d}
+}
+
+type streamGroups struct {
+	Distribution
+}
+
+func (g streamGroups) Distribute(tracks []Track, receivers []Receiver) map[uuid.UUID]map[string]bool {
+	members := make(map[string][]string)
+	groups := []Track{}
+	index := make(map[string]int)
+	for _, track := range tracks {
+		members[track.StreamID] = append(members[track.StreamID], track.Key)
+		i, ok := index[track.StreamID]
+		if !ok {
+			index[track.StreamID] = len(groups)
+			groups = append(groups, Track{
+				Key:         track.StreamID,
+				StreamID:    track.StreamID,
+				Kind:        track.Kind,
+				Codec:       track.Codec,
+				PublisherID: track.PublisherID,
+				SpeakerRank: track.SpeakerRank,
+			})
+			continue
+		}
+		if track.Kind == webrtc.RTPCodecTypeVideo && groups[i].Kind != webrtc.RTPCodecTypeVideo {
+			groups[i].Kind = track.Kind
+			groups[i].Codec = track.Codec
+		}
+	}
+
+	outputMap := make(map[uuid.UUID]map[string]bool)
+	for receiver, assigned := range g.Distribution.Distribute(groups, receivers) {
+		keys := make(map[string]bool)
+		for streamID := range assigned {
+			for _, key := range members[streamID] {
+				keys[key] = true
+			}
+		}
+		outputMap[receiver] = keys
+	}
+	return outputMap
+}
+
+// DefaultDistribution is used by Broadcasters created without a distribution
+const DefaultDistribution = "roundrobin"
+
+// DistributionFactory builds a Distribution, it is called once per
+// Broadcaster so that stateful distributions are not shared
+type DistributionFactory func() Distribution
+
+var (
+	distributionsLock sync.RWMutex
+	distributions     = map[string]DistributionFactory{
+		"all":            func() Distribution { return DistributionFunc(AllDist) },
+		"roundrobin":     func() Distribution { return DistributionFunc(RRDist) },
+		"sticky":         func() Distribution { return NewStickyDist() },
+		"consistenthash": func() Distribution { return DistributionFunc(ConsistentHashDist) },
+		"weighted":       func() Distribution { return WeightedDist{} },
+	}
+)
+
+// RegisterDistribution makes a distribution selectable by name, replacing
+// any distribution registered under the same name
+func RegisterDistribution(name string, factory DistributionFactory) {
+	distributionsLock.Lock()
+	defer distributionsLock.Unlock()
+	distributions[name] = factory
+}
+
+// NewDistribution builds the distribution registered under name
+func NewDistribution(name string) (Distribution, error) {
+	distributionsLock.RLock()
+	defer distributionsLock.RUnlock()
+	factory, ok := distributions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown distribution %q", name)
+	}
+	return factory(), nil
+}
+
+// DistributionNames lists the registered distributions
+func DistributionNames() []string {
+	distributionsLock.RLock()
+	defer distributionsLock.RUnlock()
+	names := make([]string, 0, len(distributions))
+	for name := range distributions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AllDist sends every track to every receiver
+func AllDist(senders []string, receivers []uuid.UUID) map[uuid.UUID]map[string]bool {
+	outputMap := make(map[uuid.UUID]map[string]bool)
+	for _, receiver := range receivers {
+		sendersMap := make(map[string]bool)
+		for _, sender := range senders {
+			sendersMap[sender] = true
+		}
+		outputMap[receiver] = sendersMap
+	}
+	return outputMap
+}
+
+// RRDist spreads the tracks over the receivers, one track per receiver in turn
+func RRDist(senders []string, receivers []uuid.UUID) map[uuid.UUID]map[string]bool {
+	outputMap := make(map[uuid.UUID]map[string]bool)
+	if len(receivers) == 0 {
+		return outputMap
+	}
+	// Sorted so that the same tracks go to the same receivers on every call
+	senders = append([]string{}, senders...)
+	sort.Strings(senders)
+	receivers = append([]uuid.UUID{}, receivers...)
+	sort.Slice(receivers, func(i, j int) bool { return receivers[i].String() < receivers[j].String() })
+	for _, receiver := range receivers {
+		outputMap[receiver] = make(map[string]bool)
+	}
+	for i, sender := range senders {
+		outputMap[receivers[i%len(receivers)]][sender] = true
+	}
+	return outputMap
+}
+
+// WeightedDist spreads the tracks over the receivers in proportion to their
+// Capacity, receivers without one count as a capacity of 1
+type WeightedDist struct{}
+
+func (WeightedDist) Distribute(tracks []Track, receivers []Receiver) map[uuid.UUID]map[string]bool {
+	outputMap := make(map[uuid.UUID]map[string]bool)
+	if len(receivers) == 0 {
+		return outputMap
+	}
+	// Sorted so that ties are broken the same way on every call
+	receivers = append([]Receiver{}, receivers...)
+	sort.Slice(receivers, func(i, j int) bool { return receivers[i].ID.String() < receivers[j].ID.String() })
+	keys := TrackKeys(tracks)
+	sort.Strings(keys)
+	for _, receiver := range receivers {
+		outputMap[receiver.ID] = make(map[string]bool)
+	}
+	for _, key := range keys {
+		// The receiver whose share grows the least by taking the track
+		best, bestShare := receivers[0].ID, 0.0
+		for i, receiver := range receivers {
+			capacity := receiver.Preferences.Capacity
+			if capacity <= 0 {
+				capacity = 1
+			}
+			share := float64(len(outputMap[receiver.ID])+1) / float64(capacity)
+			if i == 0 || share < bestShare {
+				best, bestShare = receiver.ID, share
+			}
+		}
+		outputMap[best][key] = true
+	}
+	return outputMap
+}
+
+// consistentHashReplicas is the number of points every receiver gets on the
+// ring, more points spread the tracks more evenly
+const consistentHashReplicas = 64
+
+// ConsistentHashDist hashes the tracks onto a ring of receivers. A receiver
+// joining or leaving only moves the tracks hashed next to its points.
+func ConsistentHashDist(senders []string, receivers []uuid.UUID) map[uuid.UUID]map[string]bool {
+	outputMap := make(map[uuid.UUID]map[string]bool)
+	if len(receivers) == 0 {
+		return outputMap
+	}
+	type point struct {
+		hash     uint64
+		receiver uuid.UUID
+	}
+	ring := make([]point, 0, len(receivers)*consistentHashReplicas)
+	for _, receiver := range receivers {
+		outputMap[receiver] = make(map[string]bool)
+		for i := 0; i < consistentHashReplicas; i++ {
+			ring = append(ring, point{hash: ringHash(receiver.String() + "#" + strconv.Itoa(i)), receiver: receiver})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	for _, sender := range senders {
+		h := ringHash(sender)
+		i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+		if i == len(ring) {
+			i = 0
+		}
+		outputMap[ring[i].receiver][sender] = true
+	}
+	return outputMap
+}
+
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// StickyDist spreads the tracks like RRDist but keeps every track on the
+// receiver it was given to, so that joins and leaves only move the tracks
+// of the receivers that left and the few needed to keep the receivers
+// within one track of each other. It is stateful, give each Broadcaster
+// its own.
+type StickyDist struct {
+	lock     sync.Mutex
+	assigned map[string]uuid.UUID
+}
+
+func NewStickyDist() *StickyDist {
+	return &StickyDist{assigned: make(map[string]uuid.UUID)}
+}
+
+func (d *StickyDist) Distribute(tracks []Track, receiverList []Receiver) map[uuid.UUID]map[string]bool {
+	senders, receivers := TrackKeys(tracks), ReceiverIDs(receiverList)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	outputMap := make(map[uuid.UUID]map[string]bool)
+	if len(receivers) == 0 {
+		d.assigned = make(map[string]uuid.UUID)
+		return outputMap
+	}
+	// Sorted so that ties are broken the same way on every call
+	sort.Slice(receivers, func(i, j int) bool { return receivers[i].String() < receivers[j].String() })
+	sort.Strings(senders)
+	for _, receiver := range receivers {
+		outputMap[receiver] = make(map[string]bool)
+	}
+
+	assigned := make(map[string]uuid.UUID)
+	orphans := []string{}
+	for _, sender := range senders {
+		receiver, ok := d.assigned[sender]
+		if _, present := outputMap[receiver]; !ok || !present {
+			orphans = append(orphans, sender)
+			continue
+		}
+		outputMap[receiver][sender] = true
+		assigned[sender] = receiver
+	}
+	for _, sender := range orphans {
+		receiver := leastLoaded(outputMap, receivers)
+		outputMap[receiver][sender] = true
+		assigned[sender] = receiver
+	}
+	// Only move tracks off receivers holding two more than the least loaded one
+	for {
+		least := leastLoaded(outputMap, receivers)
+		most := receivers[0]
+		for _, receiver := range receivers {
+			if len(outputMap[receiver]) > len(outputMap[most]) {
+				most = receiver
+			}
+		}
+		if len(outputMap[most])-len(outputMap[least]) < 2 {
+			break
+		}
+		moved := ""
+		for _, sender := range senders {
+			if outputMap[most][sender] {
+				moved = sender
+			}
+		}
+		delete(outputMap[most], moved)
+		outputMap[least][moved] = true
+		assigned[moved] = least
+	}
+	d.assigned = assigned
+	return outputMap
+}
+
+func leastLoaded(outputMap map[uuid.UUID]map[string]bool, receivers []uuid.UUID) uuid.UUID {
+	least := receivers[0]
+	for _, receiver := range receivers {
+		if len(outputMap[receiver]) < len(outputMap[least]) {
+			least = receiver
+		}
+	}
+	return least
+}
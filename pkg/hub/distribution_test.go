@@ -0,0 +1,266 @@
+package hub
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// testReceivers returns n receivers of IDs sorting in their order
+func testReceivers(n int) []Receiver {
+	receivers := make([]Receiver, 0, n)
+	for i := 1; i <= n; i++ {
+		receivers = append(receivers, Receiver{ID: uuid.MustParse(fmt.Sprintf("00000000-0000-0000-0000-%012d", i))})
+	}
+	return receivers
+}
+
+// testTracks returns a video track of stream "stream" per key
+func testTracks(keys ...string) []Track {
+	tracks := make([]Track, 0, len(keys))
+	for _, key := range keys {
+		tracks = append(tracks, Track{Key: key, ID: key, StreamID: "stream", Kind: webrtc.RTPCodecTypeVideo})
+	}
+	return tracks
+}
+
+// assignment maps every track key to the receiver it went to
+func assignment(t *testing.T, outputMap map[uuid.UUID]map[string]bool) map[string]uuid.UUID {
+	t.Helper()
+	assigned := make(map[string]uuid.UUID)
+	for receiver, keys := range outputMap {
+		for key := range keys {
+			if other, ok := assigned[key]; ok {
+				t.Fatalf("track %s sent to %s and %s", key, other, receiver)
+			}
+			assigned[key] = receiver
+		}
+	}
+	return assigned
+}
+
+func TestDistributions(t *testing.T) {
+	receivers := testReceivers(3)
+	r1, r2, r3 := receivers[0].ID, receivers[1].ID, receivers[2].ID
+	weighted := testReceivers(2)
+	weighted[0].Preferences.Capacity = 2
+	tests := []struct {
+		name         string
+		distribution Distribution
+		tracks       []Track
+		receivers    []Receiver
+		want         map[uuid.UUID]map[string]bool
+	}{
+		{
+			name:         "all",
+			distribution: DistributionFunc(AllDist),
+			tracks:       testTracks("b", "a"),
+			receivers:    receivers[:2],
+			want: map[uuid.UUID]map[string]bool{
+				r1: {"a": true, "b": true},
+				r2: {"a": true, "b": true},
+			},
+		},
+		{
+			name:         "all without tracks",
+			distribution: DistributionFunc(AllDist),
+			receivers:    receivers[:1],
+			want:         map[uuid.UUID]map[string]bool{r1: {}},
+		},
+		{
+			name:         "round robin",
+			distribution: DistributionFunc(RRDist),
+			tracks:       testTracks("d", "b", "a", "c"),
+			receivers:    []Receiver{receivers[2], receivers[0], receivers[1]},
+			want: map[uuid.UUID]map[string]bool{
+				r1: {"a": true, "d": true},
+				r2: {"b": true},
+				r3: {"c": true},
+			},
+		},
+		{
+			name:         "round robin without receivers",
+			distribution: DistributionFunc(RRDist),
+			tracks:       testTracks("a"),
+			want:         map[uuid.UUID]map[string]bool{},
+		},
+		{
+			name:         "weighted",
+			distribution: WeightedDist{},
+			tracks:       testTracks("f", "e", "d", "c", "b", "a"),
+			receivers:    weighted,
+			want: map[uuid.UUID]map[string]bool{
+				r1: {"a": true, "b": true, "d": true, "e": true},
+				r2: {"c": true, "f": true},
+			},
+		},
+		{
+			name:         "weighted without capacities",
+			distribution: WeightedDist{},
+			tracks:       testTracks("a", "b", "c", "d"),
+			receivers:    receivers[:2],
+			want: map[uuid.UUID]map[string]bool{
+				r1: {"a": true, "c": true},
+				r2: {"b": true, "d": true},
+			},
+		},
+		{
+			name:         "grouped by stream",
+			distribution: GroupByStream(DistributionFunc(RRDist)),
+			tracks: []Track{
+				{Key: "s2audio", ID: "audio", StreamID: "s2", Kind: webrtc.RTPCodecTypeAudio},
+				{Key: "s1video", ID: "video", StreamID: "s1", Kind: webrtc.RTPCodecTypeVideo},
+				{Key: "s3audio", ID: "audio", StreamID: "s3", Kind: webrtc.RTPCodecTypeAudio},
+				{Key: "s1audio", ID: "audio", StreamID: "s1", Kind: webrtc.RTPCodecTypeAudio},
+				{Key: "s2video", ID: "video", StreamID: "s2", Kind: webrtc.RTPCodecTypeVideo},
+			},
+			receivers: receivers[:2],
+			want: map[uuid.UUID]map[string]bool{
+				r1: {"s1audio": true, "s1video": true, "s3audio": true},
+				r2: {"s2audio": true, "s2video": true},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.distribution.Distribute(test.tracks, test.receivers)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("distributed %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestDistributionsStable checks the stateless distributions give the same
+// assignment whatever the order of the tracks and receivers
+func TestDistributionsStable(t *testing.T) {
+	tracks := testTracks("a", "b", "c", "d", "e", "f", "g")
+	receivers := testReceivers(3)
+	reversedTracks := make([]Track, 0, len(tracks))
+	for i := len(tracks) - 1; i >= 0; i-- {
+		reversedTracks = append(reversedTracks, tracks[i])
+	}
+	reversedReceivers := []Receiver{receivers[2], receivers[1], receivers[0]}
+	tests := []struct {
+		name         string
+		distribution Distribution
+	}{
+		{name: "all", distribution: DistributionFunc(AllDist)},
+		{name: "round robin", distribution: DistributionFunc(RRDist)},
+		{name: "weighted", distribution: WeightedDist{}},
+		{name: "consistent hash", distribution: DistributionFunc(ConsistentHashDist)},
+		{name: "grouped by stream", distribution: GroupByStream(DistributionFunc(RRDist))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first := test.distribution.Distribute(tracks, receivers)
+			if again := test.distribution.Distribute(tracks, receivers); !reflect.DeepEqual(again, first) {
+				t.Errorf("distributed %v then %v", first, again)
+			}
+			if reordered := test.distribution.Distribute(reversedTracks, reversedReceivers); !reflect.DeepEqual(reordered, first) {
+				t.Errorf("distributed %v, %v once reordered", first, reordered)
+			}
+		})
+	}
+}
+
+func TestConsistentHashDistMovement(t *testing.T) {
+	keys := make([]string, 0, 200)
+	for i := 0; i < cap(keys); i++ {
+		keys = append(keys, fmt.Sprintf("stream-%dvideo", i))
+	}
+	all := ReceiverIDs(testReceivers(5))
+	tests := []struct {
+		name   string
+		before []uuid.UUID
+		after  []uuid.UUID
+	}{
+		{name: "receiver joining", before: all[:4], after: all},
+		{name: "receiver leaving", before: all, after: append([]uuid.UUID{all[0], all[1]}, all[3:]...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := assignment(t, ConsistentHashDist(keys, test.before))
+			after := assignment(t, ConsistentHashDist(keys, test.after))
+			present := make(map[uuid.UUID]bool)
+			for _, receiver := range test.after {
+				present[receiver] = true
+			}
+			stayed := make(map[uuid.UUID]bool)
+			for _, receiver := range test.before {
+				stayed[receiver] = present[receiver]
+			}
+			moved := 0
+			for _, key := range keys {
+				if before[key] == after[key] {
+					continue
+				}
+				moved++
+				// Only the tracks of the leaving receiver, or those taken
+				// by the joining one, move
+				if stayed[before[key]] && stayed[after[key]] {
+					t.Errorf("track %s moved from %s to %s, both still there", key, before[key], after[key])
+				}
+			}
+			// One receiver out of five holds about a fifth of the tracks
+			if moved == 0 || moved > len(keys)/3 {
+				t.Errorf("%d tracks out of %d moved", moved, len(keys))
+			}
+		})
+	}
+}
+
+func TestStickyDist(t *testing.T) {
+	receivers := testReceivers(3)
+	tests := []struct {
+		name      string
+		tracks    []Track
+		receivers []Receiver
+		// joined are the receivers added since the previous step, the
+		// tracks of the receivers still there may only move to them
+		joined []uuid.UUID
+	}{
+		{name: "first assignment", tracks: testTracks("a", "b", "c", "d", "e", "f"), receivers: receivers[:2]},
+		{name: "track added", tracks: testTracks("a", "b", "c", "d", "e", "f", "g"), receivers: receivers[:2]},
+		{name: "receiver joining", tracks: testTracks("a", "b", "c", "d", "e", "f", "g"), receivers: receivers, joined: []uuid.UUID{receivers[2].ID}},
+		{name: "track removed", tracks: testTracks("a", "b", "c", "e", "f", "g"), receivers: receivers},
+		{name: "receiver leaving", tracks: testTracks("a", "b", "c", "e", "f", "g"), receivers: receivers[1:]},
+	}
+	d := NewStickyDist()
+	previous := map[string]uuid.UUID{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outputMap := d.Distribute(test.tracks, test.receivers)
+			assigned := assignment(t, outputMap)
+			if len(assigned) != len(test.tracks) {
+				t.Fatalf("%d tracks assigned out of %d", len(assigned), len(test.tracks))
+			}
+			least, most := len(test.tracks), 0
+			for _, receiver := range test.receivers {
+				if n := len(outputMap[receiver.ID]); n < least {
+					least = n
+				}
+				if n := len(outputMap[receiver.ID]); n > most {
+					most = n
+				}
+			}
+			if most-least > 1 {
+				t.Errorf("receivers holding from %d to %d tracks", least, most)
+			}
+			joined := make(map[uuid.UUID]bool)
+			for _, receiver := range test.joined {
+				joined[receiver] = true
+			}
+			for key, receiver := range assigned {
+				before, ok := previous[key]
+				if _, stayed := outputMap[before]; ok && stayed && before != receiver && !joined[receiver] {
+					t.Errorf("track %s moved from %s to %s", key, before, receiver)
+				}
+			}
+			previous = assigned
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package hub
+
+import "github.com/pion/webrtc/v4"
+
+// frameDescriptorExtensions describe the video frames in the clear, for the
+// receivers to depacketize end-to-end encrypted payloads the hub cannot read
+var frameDescriptorExtensions = []string{
+	"https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-rtp-header-extension",
+	"http://www.webrtc.org/experiments/rtp-hdrext/generic-frame-descriptor-00",
+}
+
+// registerFrameDescriptorExtensions negotiates the extensions end-to-end
+// encrypted video needs, they are forwarded as is
+func registerFrameDescriptorExtensions(m *webrtc.MediaEngine) error {
+	for _, uri := range frameDescriptorExtensions {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// opaque tells whether the payloads are end-to-end encrypted, the hub then
+// never reads them: switches do not wait for keyframes, new streams are not
+// held back until one and nothing is decoded. It must run on the loop.
+func (s *Broadcaster) opaque() bool {
+	return s.codecs.E2EE
+}
@@ -0,0 +1,311 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// egressKeyframeInterval is how often a stream pushed out asks for a
+// keyframe, the ingests of the streaming platforms want one every few
+// seconds
+const egressKeyframeInterval = 2 * time.Second
+
+// ErrUnknownEgress is returned when stopping an egress that is not running
+var ErrUnknownEgress = errors.New("unknown egress")
+
+// ErrEgressURL is returned for the destinations that cannot be pushed to
+var ErrEgressURL = errors.New("invalid egress URL")
+
+// ErrEgressUnreachable is returned when the destination refuses the stream
+var ErrEgressUnreachable = errors.New("egress destination unreachable")
+
+// EgressInfo describes a stream pushed out of the hub
+type EgressInfo struct {
+	ID       string `json:"id"`
+	Room     string `json:"room,omitempty"`
+	StreamID string `json:"streamID"`
+	Protocol string `json:"protocol"`
+	// URL is the destination without its credentials
+	URL     string    `json:"url"`
+	Started time.Time `json:"started"`
+	// Dropped counts the packets lost for the destination not keeping up
+	Dropped uint64 `json:"dropped"`
+	// Error is why the destination failed
+	Error string `json:"error,omitempty"`
+}
+
+// egressSession pushes the tracks of a stream to a destination until it is
+// stopped or the stream goes away
+type egressSession struct {
+	id       string
+	streamID string
+	protocol string
+	url      string
+	started  time.Time
+	tracks   map[string]egressSink
+	dropped  uint64
+	// sink makes the sink of a track of the stream
+	sink func(key string, codec webrtc.RTPCodecCapability) (egressSink, error)
+	// failure tells why the destination failed, nil while it goes on
+	failure func() error
+}
+
+// egressSink is the sink of a track pushed out
+type egressSink interface {
+	TrackSink
+	// droppedPackets counts the packets lost for the destination not
+	// keeping up
+	droppedPackets() uint64
+}
+
+// egressDestination is a connection a stream is pushed to
+type egressDestination interface {
+	muxContainer
+	io.Closer
+	// failure tells why the connection failed, nil while it sends
+	failure() error
+}
+
+func (e *egressSession) info() EgressInfo {
+	info := EgressInfo{ID: e.id, StreamID: e.streamID, Protocol: e.protocol, URL: e.url, Started: e.started, Dropped: e.dropped}
+	for _, track := range e.tracks {
+		info.Dropped += track.droppedPackets()
+	}
+	if err := e.failure(); err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
+
+// StartRTMPEgress pushes streamID to an RTMP or RTMPS URL, its last path
+// segment being the stream key. H264 goes as AVC, VP9 and Opus with
+// Enhanced RTMP, the hub does not transcode.
+func (s *Broadcaster) StartRTMPEgress(ctx context.Context, streamID string, rawURL string) (EgressInfo, error) {
+	if s.opaque() {
+		return EgressInfo{}, errors.New("end-to-end encrypted media cannot be pushed out")
+	}
+	if _, _, _, err := rtmpTarget(rawURL); err != nil {
+		return EgressInfo{}, fmt.Errorf("%w: %v", ErrEgressURL, err)
+	}
+	if err := s.checkPublished(streamID); err != nil {
+		return EgressInfo{}, err
+	}
+	conn, err := dialRTMP(ctx, rawURL)
+	if err != nil {
+		return EgressInfo{}, fmt.Errorf("%w: %v", ErrEgressUnreachable, err)
+	}
+	return s.pushOut(streamID, "rtmp", RedactRTMPURL(rawURL), conn)
+}
+
+// StartSRTEgress pushes streamID as MPEG-TS over SRT, H264 and Opus only.
+// The URL is srt://host:port?mode=caller|listener&latency=ms&streamid=, a
+// caller connects before it returns and a listener sends to the last
+// caller that connected to host:port.
+func (s *Broadcaster) StartSRTEgress(ctx context.Context, streamID string, rawURL string) (EgressInfo, error) {
+	if s.opaque() {
+		return EgressInfo{}, errors.New("end-to-end encrypted media cannot be pushed out")
+	}
+	if _, err := parseSRTURL(rawURL); err != nil {
+		return EgressInfo{}, fmt.Errorf("%w: %v", ErrEgressURL, err)
+	}
+	if err := s.checkPublished(streamID); err != nil {
+		return EgressInfo{}, err
+	}
+	socket, err := dialSRT(ctx, rawURL)
+	if err != nil {
+		return EgressInfo{}, fmt.Errorf("%w: %v", ErrEgressUnreachable, err)
+	}
+	return s.pushOut(streamID, "srt", RedactSRTURL(rawURL), socket)
+}
+
+// checkPublished tells whether streamID has tracks to push out
+func (s *Broadcaster) checkPublished(streamID string) error {
+	published := false
+	if !s.do(func() { published = len(s.streamKeys(streamID)) > 0 }) {
+		return errClosed
+	}
+	if !published {
+		return ErrUnknownStream
+	}
+	return nil
+}
+
+func newEgressSession(streamID string, protocol string, redactedURL string, failure func() error) *egressSession {
+	return &egressSession{
+		id:       uuid.New().String(),
+		streamID: streamID,
+		protocol: protocol,
+		url:      redactedURL,
+		started:  time.Now().UTC(),
+		tracks:   make(map[string]egressSink),
+		failure:  failure,
+	}
+}
+
+// pushOut muxes streamID into the destination, which is closed when it
+// cannot start
+func (s *Broadcaster) pushOut(streamID string, protocol string, redactedURL string, destination egressDestination) (EgressInfo, error) {
+	session := newEgressSession(streamID, protocol, redactedURL, destination.failure)
+	muxer := newStreamMuxer(destination, session.started)
+	session.sink = func(key string, codec webrtc.RTPCodecCapability) (egressSink, error) {
+		muxed, err := muxer.addTrack(codec, s.trackClock(key, nil))
+		if err != nil {
+			return nil, err
+		}
+		sender := newTrackRecorder(session.url, codec.MimeType, muxed, func() {
+			go s.do(func() { s.requestKeyframe(key, keyframeEgress) })
+		})
+		sender.keyframeInterval = egressKeyframeInterval
+		return sender, nil
+	}
+	return s.startEgressSession(session, destination)
+}
+
+// startEgressSession pushes the tracks of the session out to destination,
+// which is closed when it cannot start
+func (s *Broadcaster) startEgressSession(session *egressSession, destination io.Closer) (EgressInfo, error) {
+	info := EgressInfo{}
+	err := errClosed
+	s.do(func() {
+		if err = s.startEgress(session); err == nil {
+			info = session.info()
+		}
+	})
+	if err != nil {
+		destination.Close()
+	}
+	return info, err
+}
+
+// StopEgress stops pushing out a stream and closes its destination
+func (s *Broadcaster) StopEgress(id string) (EgressInfo, error) {
+	info := EgressInfo{}
+	err := errClosed
+	s.do(func() {
+		session, ok := s.egresses[id]
+		if !ok {
+			err = ErrUnknownEgress
+			return
+		}
+		info, err = s.stopEgress(session), nil
+	})
+	return info, err
+}
+
+// Egresses returns the streams being pushed out
+func (s *Broadcaster) Egresses() []EgressInfo {
+	egresses := []EgressInfo{}
+	s.do(func() {
+		for _, session := range s.egresses {
+			egresses = append(egresses, session.info())
+		}
+	})
+	sort.Slice(egresses, func(i, j int) bool {
+		return egresses[i].Started.Before(egresses[j].Started)
+	})
+	return egresses
+}
+
+// streamKeys are the tracks of streamID, without the spare simulcast
+// layers. It must run on the loop.
+func (s *Broadcaster) streamKeys(streamID string) []string {
+	keys := []string{}
+	for key, track := range s.senders {
+		if track.StreamID() == streamID && !s.isSpareLayer(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// startEgress muxes the tracks of the stream of the session, it must run
+// on the loop
+func (s *Broadcaster) startEgress(session *egressSession) error {
+	keys := s.streamKeys(session.streamID)
+	if len(keys) == 0 {
+		return ErrUnknownStream
+	}
+	for _, key := range keys {
+		s.egressTrack(session, key)
+	}
+	if len(session.tracks) == 0 {
+		return errors.New("no track of the stream has a codec that can be pushed out")
+	}
+	s.egresses[session.id] = session
+	zap.S().Infow("Egress started", "id", session.id, "streamID", session.streamID, "url", session.url)
+	return nil
+}
+
+// egressTrack adds the track key to the session, it must run on the loop
+func (s *Broadcaster) egressTrack(session *egressSession, key string) {
+	track, ok := s.senders[key].(*webrtc.TrackLocalStaticRTP)
+	if !ok {
+		return
+	}
+	sender, err := session.sink(key, track.Codec())
+	if err != nil {
+		zap.S().Infow("Not pushing track out", "track", key, "egress", session.id, "error", err)
+		return
+	}
+	session.tracks[key] = sender
+	s.sinkLock.Lock()
+	if _, ok := s.sinks[key]; !ok {
+		s.sinks[key] = make(map[TrackSink]bool)
+	}
+	s.sinks[key][sender] = true
+	s.sinkLock.Unlock()
+}
+
+// egressNewTrack pushes the track key out with the other tracks of its
+// stream, it must run on the loop
+func (s *Broadcaster) egressNewTrack(key string) {
+	if s.isSpareLayer(key) {
+		return
+	}
+	streamID := s.senders[key].StreamID()
+	for _, session := range s.egresses {
+		if _, ok := session.tracks[key]; session.streamID == streamID && !ok {
+			s.egressTrack(session, key)
+		}
+	}
+}
+
+// endEgressTrack forgets the removed track key, its sink is closed
+// already. The session ends with the last track of its stream. It must
+// run on the loop.
+func (s *Broadcaster) endEgressTrack(key string) {
+	for id, session := range s.egresses {
+		sender, ok := session.tracks[key]
+		if !ok {
+			continue
+		}
+		delete(session.tracks, key)
+		session.dropped += sender.droppedPackets()
+		if len(session.tracks) == 0 {
+			delete(s.egresses, id)
+			zap.S().Infow("Egress ended", "id", id, "streamID", session.streamID)
+		}
+	}
+}
+
+// stopEgress detaches the tracks of the session, the destination is closed
+// once the frames queued are sent. It must run on the loop.
+func (s *Broadcaster) stopEgress(session *egressSession) EgressInfo {
+	info := session.info()
+	for key, sender := range session.tracks {
+		s.RemoveSink(key, sender)
+		sender.Close()
+	}
+	delete(s.egresses, session.id)
+	zap.S().Infow("Egress stopped", "id", session.id, "streamID", session.streamID)
+	return info
+}
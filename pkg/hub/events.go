@@ -0,0 +1,86 @@
+package hub
+
+import "sync"
+
+// ServerEvent is one server-sent event
+type ServerEvent struct {
+	Event string
+	Data  string
+}
+
+// EventStream fans server-sent events out to every subscriber. The last
+// events are kept so that a client subscribing late, typically right after
+// receiving its answer, doesn't miss what happened in between.
+type EventStream struct {
+	lock        sync.Mutex
+	backlog     []ServerEvent
+	maxBacklog  int
+	subscribers map[chan ServerEvent]bool
+	closed      bool
+}
+
+func NewEventStream(maxBacklog int) *EventStream {
+	return &EventStream{
+		maxBacklog:  maxBacklog,
+		subscribers: make(map[chan ServerEvent]bool),
+	}
+}
+
+func (e *EventStream) Publish(event string, data string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.closed {
+		return
+	}
+	ev := ServerEvent{Event: event, Data: data}
+	e.backlog = append(e.backlog, ev)
+	if len(e.backlog) > e.maxBacklog {
+		e.backlog = e.backlog[len(e.backlog)-e.maxBacklog:]
+	}
+	for sub := range e.subscribers {
+		select {
+		case sub <- ev:
+		default:
+			// Slow subscriber, it will have to reconnect
+			delete(e.subscribers, sub)
+			close(sub)
+		}
+	}
+}
+
+// Subscribe returns a channel replaying the backlog then receiving new
+// events, it is closed when the stream ends or the subscriber lags behind.
+func (e *EventStream) Subscribe() (<-chan ServerEvent, func()) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	sub := make(chan ServerEvent, len(e.backlog)+64)
+	for _, ev := range e.backlog {
+		sub <- ev
+	}
+	if e.closed {
+		close(sub)
+		return sub, func() {}
+	}
+	e.subscribers[sub] = true
+	return sub, func() {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		if _, ok := e.subscribers[sub]; ok {
+			delete(e.subscribers, sub)
+			close(sub)
+		}
+	}
+}
+
+func (e *EventStream) Close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.closed {
+		return
+	}
+	e.closed = true
+	for sub := range e.subscribers {
+		close(sub)
+	}
+	e.subscribers = make(map[chan ServerEvent]bool)
+}
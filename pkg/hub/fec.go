@@ -0,0 +1,257 @@
+package hub
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// MimeTypeFlexFEC is the FlexFEC-03 repair format
+const MimeTypeFlexFEC = "video/flexfec-03"
+
+// flexFECFmtp lets receivers keep protected packets for 10 seconds
+const flexFECFmtp = "repair-window=10000000"
+
+// The FEC of a stream protects blocks of fecRows by fecColumns packets with
+// one repair packet per column, so that losing up to fecColumns packets in
+// a row is recovered
+const (
+	fecColumns = 4
+	fecRows    = 4
+)
+
+// fecStream is the repair stream protecting a media stream
+type fecStream struct {
+	ssrc        uint32
+	payloadType uint8
+}
+
+// protect sends the FEC of the stream ssrc in its repair stream
+func (m *RepairMonitor) protect(ssrc uint32, stream fecStream) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.fec[ssrc] = stream
+}
+
+func (m *RepairMonitor) unprotect(ssrc uint32) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.fec, ssrc)
+}
+
+func (m *RepairMonitor) protection(ssrc uint32) (fecStream, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stream, ok := m.fec[ssrc]
+	return stream, ok
+}
+
+// fecEncoder builds the FlexFEC-03 packets of a media stream
+type fecEncoder struct {
+	seq uint16
+	// block holds the packets of the current block, marshalled
+	block [][]byte
+	base  uint16
+}
+
+// push adds a sent packet to the block, it returns the repair packets once
+// the block is complete
+func (e *fecEncoder) push(header *rtp.Header, payload []byte, stream fecStream) []*rtp.Packet {
+	if len(e.block) > 0 && header.SequenceNumber != e.base+uint16(len(e.block)) {
+		// A gap in the sequence numbers, e.g. a dropped packet, starts over
+		e.block = e.block[:0]
+	}
+	if len(e.block) == 0 {
+		e.base = header.SequenceNumber
+	}
+	raw := make([]byte, header.MarshalSize()+len(payload))
+	n, err := header.MarshalTo(raw)
+	if err != nil {
+		return nil
+	}
+	copy(raw[n:], payload)
+	e.block = append(e.block, raw)
+	if len(e.block) < fecColumns*fecRows {
+		return nil
+	}
+
+	repairs := make([]*rtp.Packet, 0, fecColumns)
+	for column := 0; column < fecColumns; column++ {
+		protected := make([][]byte, 0, fecRows)
+		for row := 0; row < fecRows; row++ {
+			protected = append(protected, e.block[row*fecColumns+column])
+		}
+		e.seq++
+		repairs = append(repairs, &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    stream.payloadType,
+				SequenceNumber: e.seq,
+				Timestamp:      header.Timestamp,
+				SSRC:           stream.ssrc,
+			},
+			Payload: flexFECPayload(header.SSRC, e.base+uint16(column), protected),
+		})
+	}
+	e.block = e.block[:0]
+	return repairs
+}
+
+// flexFECPayload builds the FlexFEC-03 header and repair payload of the
+// packets of ssrc from base every fecColumns sequence numbers
+func flexFECPayload(ssrc uint32, base uint16, packets [][]byte) []byte {
+	longest := 0
+	for _, packet := range packets {
+		if len(packet)-12 > longest {
+			longest = len(packet) - 12
+		}
+	}
+	const headerSize = 20
+	payload := make([]byte, headerSize+longest)
+	var lengths uint16
+	var mask uint16
+	for i, packet := range packets {
+		payload[0] ^= packet[0]
+		payload[1] ^= packet[1]
+		lengths ^= uint16(len(packet) - 12)
+		for j := 4; j < 8; j++ {
+			payload[j] ^= packet[j]
+		}
+		for j, b := range packet[12:] {
+			payload[headerSize+j] ^= b
+		}
+		mask |= 1 << (14 - i*fecColumns)
+	}
+	// The R and F bits are cleared, the version bits are not recovered
+	payload[0] &= 0x3F
+	binary.BigEndian.PutUint16(payload[2:4], lengths)
+	payload[8] = 1
+	binary.BigEndian.PutUint32(payload[12:16], ssrc)
+	binary.BigEndian.PutUint16(payload[16:18], base)
+	// The k bit ends the mask after its first 15 bits
+	binary.BigEndian.PutUint16(payload[18:20], 0x8000|mask)
+	return payload
+}
+
+// fecInterceptor sends the FEC of the protected streams of its connection
+// along with their packets
+type fecInterceptor struct {
+	interceptor.NoOp
+	monitor *RepairMonitor
+}
+
+type fecInterceptorFactory struct {
+	monitor *RepairMonitor
+}
+
+func (f *fecInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &fecInterceptor{monitor: f.monitor}, nil
+}
+
+func (i *fecInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(info.MimeType, "video/") {
+		return writer
+	}
+	encoder := &fecEncoder{seq: uint16(rand.Uint32())}
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, a)
+		if err != nil {
+			return n, err
+		}
+		// Protection starts once the receiver accepted FlexFEC
+		stream, ok := i.monitor.protection(info.SSRC)
+		if !ok {
+			return n, nil
+		}
+		for _, repair := range encoder.push(header, payload, stream) {
+			if _, err := writer.Write(&repair.Header, repair.Payload, interceptor.Attributes{}); err != nil {
+				zap.S().Debugw("Unable to send FEC", "ssrc", info.SSRC, "error", err)
+			}
+		}
+		return n, nil
+	})
+}
+
+func (i *fecInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.monitor.unprotect(info.SSRC)
+}
+
+// SetTrackPriority marks the track key as high-priority, or not anymore.
+// The receivers accepting FlexFEC get forward error correction for the
+// high-priority video tracks.
+func (s *Broadcaster) SetTrackPriority(key string, high bool) error {
+	err := errClosed
+	s.do(func() {
+		if _, ok := s.senders[key]; !ok {
+			err = ErrUnknownTrack
+			return
+		}
+		if high {
+			s.highPriority[key] = true
+		} else {
+			delete(s.highPriority, key)
+		}
+		if !s.codecs.FlexFEC {
+			err = nil
+			return
+		}
+		// The repair streams are in the negotiated descriptions already,
+		// they only start or stop carrying FEC
+		for _, receiver := range s.receivers {
+			s.updateFEC(receiver)
+		}
+		err = nil
+	})
+	return err
+}
+
+// protected tells whether track is high-priority, simulcast tracks are when
+// any of their layers is. It must run on the loop.
+func (s *Broadcaster) protected(track webrtc.TrackLocal) bool {
+	key := track.StreamID() + track.ID()
+	if s.highPriority[key] {
+		return true
+	}
+	for _, layerKey := range s.simulcastGroup(key) {
+		if s.highPriority[layerKey] {
+			return true
+		}
+	}
+	return false
+}
+
+// updateFEC protects the high-priority video the receiver negotiated
+// FlexFEC for, it must run on the loop
+func (s *Broadcaster) updateFEC(receiver ReceiverState) {
+	if receiver.Repair == nil {
+		return
+	}
+	for _, sender := range receiver.Connection.GetSenders() {
+		track := sender.Track()
+		if track == nil || track.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		parameters := sender.GetParameters()
+		var payloadType uint8
+		for _, codec := range parameters.Codecs {
+			if strings.EqualFold(codec.MimeType, MimeTypeFlexFEC) {
+				payloadType = uint8(codec.PayloadType)
+			}
+		}
+		for _, encoding := range parameters.Encodings {
+			// The media engine gives every video encoding a repair stream
+			// in the descriptions, left without an SSRC once the receiver
+			// declined FlexFEC
+			if payloadType != 0 && encoding.FEC.SSRC != 0 && s.protected(track) {
+				receiver.Repair.protect(uint32(encoding.SSRC), fecStream{ssrc: uint32(encoding.FEC.SSRC), payloadType: payloadType})
+			} else {
+				receiver.Repair.unprotect(uint32(encoding.SSRC))
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package hub
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// TestFlexFECNegotiated checks the repair streams are part of the local
+// descriptions of the receiver connections, and dropped once the receiver
+// declines FlexFEC
+func TestFlexFECNegotiated(t *testing.T) {
+	tests := []struct {
+		name string
+		// flexFEC tells whether the receiver answers with FlexFEC
+		flexFEC bool
+	}{
+		{name: "accepted", flexFEC: true},
+		{name: "declined", flexFEC: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			codecs := DefaultCodecSet()
+			codecs.FlexFEC = true
+			api, err := NewReceiverAPI(codecs, ReceiverAPIOptions{Repair: NewRepairMonitor()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			connection, err := api.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer connection.Close()
+			track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "stream")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sender, err := connection.AddTrack(track)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			offer, err := connection.CreateOffer(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := connection.SetLocalDescription(offer); err != nil {
+				t.Fatal(err)
+			}
+			encoding := sender.GetParameters().Encodings[0]
+			if encoding.FEC.SSRC == 0 {
+				t.Fatal("no repair stream")
+			}
+			group := fmt.Sprintf("a=ssrc-group:FEC-FR %d %d", encoding.SSRC, encoding.FEC.SSRC)
+			if !strings.Contains(connection.LocalDescription().SDP, group) {
+				t.Errorf("%q missing from the local description", group)
+			}
+
+			answering := DefaultCodecSet()
+			answering.FlexFEC = test.flexFEC
+			m := &webrtc.MediaEngine{}
+			if err := answering.register(m); err != nil {
+				t.Fatal(err)
+			}
+			peer, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer peer.Close()
+			if err := peer.SetRemoteDescription(offer); err != nil {
+				t.Fatal(err)
+			}
+			answer, err := peer.CreateAnswer(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := connection.SetRemoteDescription(answer); err != nil {
+				t.Fatal(err)
+			}
+			if fec := sender.GetParameters().Encodings[0].FEC.SSRC; (fec != 0) != test.flexFEC {
+				t.Errorf("repair stream SSRC %d once FlexFEC was answered %t", fec, test.flexFEC)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package hub
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// mp4Sample is a frame of a fragment, its duration in the timescale of
+// its track
+type mp4Sample struct {
+	duration uint32
+	keyframe bool
+	data     []byte
+}
+
+// mp4Run are the samples of a track in a fragment, starting at decodeTime
+type mp4Run struct {
+	track      mediaTrack
+	decodeTime uint64
+	samples    []mp4Sample
+}
+
+func mp4Box(boxType string, payloads ...[]byte) []byte {
+	size := 8
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+	box := make([]byte, 0, size)
+	box = binary.BigEndian.AppendUint32(box, uint32(size))
+	box = append(box, boxType...)
+	for _, payload := range payloads {
+		box = append(box, payload...)
+	}
+	return box
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(boxType, append([][]byte{header}, payloads...)...)
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// mp4Matrix is the identity transformation of the movie and its tracks
+var mp4Matrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+// The sample flags of the keyframes and of the frames depending on others
+const (
+	mp4SyncSample    = 0x02000000
+	mp4NonSyncSample = 0x01010000
+)
+
+// mp4InitSegment is the CMAF header of the tracks, their timescale is
+// their clock rate
+func mp4InitSegment(tracks []mediaTrack) []byte {
+	ftyp := mp4Box("ftyp", []byte("iso6"), u32(0), []byte("iso6cmfcmp41"))
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(1000), u32(0),
+		u32(0x00010000), u16(0x0100), make([]byte, 10),
+		mp4Matrix, make([]byte, 24), u32(uint32(len(tracks)+1)))
+	traks := [][]byte{mvhd}
+	trexs := [][]byte{}
+	for _, track := range tracks {
+		traks = append(traks, mp4Trak(track))
+		trexs = append(trexs, mp4FullBox("trex", 0, 0, u32(uint32(track.number)), u32(1), u32(0), u32(0), u32(0)))
+	}
+	traks = append(traks, mp4Box("mvex", trexs...))
+	return append(ftyp, mp4Box("moov", traks...)...)
+}
+
+func mp4Trak(track mediaTrack) []byte {
+	width, height, volume := uint32(0), uint32(0), uint16(0x0100)
+	handler, name, header := "soun", "SoundHandler", mp4FullBox("smhd", 0, 0, u16(0), u16(0))
+	if track.video() {
+		width, height, volume = uint32(track.width)<<16, uint32(track.height)<<16, 0
+		handler, name, header = "vide", "VideoHandler", mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	}
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		u32(0), u32(0), u32(uint32(track.number)), u32(0), u32(0),
+		make([]byte, 8), u16(0), u16(0), u16(volume), u16(0),
+		mp4Matrix, u32(width), u32(height))
+	// The language is und
+	mdhd := mp4FullBox("mdhd", 0, 0, u32(0), u32(0), u32(track.clockRate), u32(0), u16(0x55C4), u16(0))
+	hdlr := mp4FullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), []byte(name+"\x00"))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, u32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, u32(1), mp4SampleEntry(track)),
+		mp4FullBox("stts", 0, 0, u32(0)),
+		mp4FullBox("stsc", 0, 0, u32(0)),
+		mp4FullBox("stsz", 0, 0, u32(0), u32(0)),
+		mp4FullBox("stco", 0, 0, u32(0)))
+	minf := mp4Box("minf", header, dinf, stbl)
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, minf))
+}
+
+func mp4SampleEntry(track mediaTrack) []byte {
+	if !track.video() {
+		dOps := mp4Box("dOps", []byte{0, byte(track.channels)}, u16(0), u32(track.clockRate), u16(0), []byte{0})
+		return mp4Box("Opus",
+			make([]byte, 6), u16(1), make([]byte, 8),
+			u16(track.channels), u16(16), u16(0), u16(0), u32(track.clockRate<<16),
+			dOps)
+	}
+	visual := [][]byte{
+		make([]byte, 6), u16(1), u16(0), u16(0), make([]byte, 12),
+		u16(uint16(track.width)), u16(uint16(track.height)),
+		u32(0x00480000), u32(0x00480000), u32(0), u16(1),
+		make([]byte, 32), u16(0x0018), u16(0xFFFF),
+	}
+	if strings.EqualFold(track.mimeType, webrtc.MimeTypeVP9) {
+		vpcC := mp4FullBox("vpcC", 1, 0, vp9CodecConfiguration())
+		return mp4Box("vp09", append(visual, vpcC)...)
+	}
+	return mp4Box("avc1", append(visual, mp4Box("avcC", track.codecPrivate))...)
+}
+
+// vp9CodecConfiguration is the VPCodecConfigurationRecord of the VP9 the
+// browsers send: profile 0, level 3.1, 8 bits 4:2:0 in BT.709
+func vp9CodecConfiguration() []byte {
+	return []byte{0, 31, 8<<4 | 1<<1, 1, 1, 1, 0, 0}
+}
+
+// mp4Codec is the RFC 6381 codec of the track, for the playlists
+func mp4Codec(track mediaTrack) string {
+	switch {
+	case strings.EqualFold(track.mimeType, webrtc.MimeTypeH264) && len(track.codecPrivate) >= 4:
+		return fmt.Sprintf("avc1.%02x%02x%02x", track.codecPrivate[1], track.codecPrivate[2], track.codecPrivate[3])
+	case strings.EqualFold(track.mimeType, webrtc.MimeTypeVP9):
+		return "vp09.00.31.08"
+	}
+	return "opus"
+}
+
+// mp4Fragment is a CMAF fragment holding the runs of its tracks
+func mp4Fragment(sequence uint32, runs []mp4Run) []byte {
+	moof := func(dataOffset uint32) []byte {
+		trafs := [][]byte{mp4FullBox("mfhd", 0, 0, u32(sequence))}
+		for _, run := range runs {
+			// Data offset, sample duration, size and flags
+			trun := [][]byte{u32(uint32(len(run.samples))), u32(dataOffset)}
+			for _, sample := range run.samples {
+				flags := uint32(mp4NonSyncSample)
+				if sample.keyframe || !run.track.video() {
+					flags = mp4SyncSample
+				}
+				trun = append(trun, u32(sample.duration), u32(uint32(len(sample.data))), u32(flags))
+				dataOffset += uint32(len(sample.data))
+			}
+			trafs = append(trafs, mp4Box("traf",
+				// The offsets are from the start of the moof
+				mp4FullBox("tfhd", 0, 0x020000, u32(uint32(run.track.number))),
+				mp4FullBox("tfdt", 1, 0, u64(run.decodeTime)),
+				mp4FullBox("trun", 0, 0x000701, trun...)))
+		}
+		return mp4Box("moof", trafs...)
+	}
+	// The samples follow the moof and the mdat header
+	header := moof(0)
+	fragment := moof(uint32(len(header) + 8))
+	data := [][]byte{}
+	for _, run := range runs {
+		for _, sample := range run.samples {
+			data = append(data, sample.data)
+		}
+	}
+	return append(fragment, mp4Box("mdat", data...)...)
+}
@@ -0,0 +1,655 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// hlsLinger is how long the playlist of a stream that went away is served
+// with its last segments
+const hlsLinger = time.Minute
+
+// hlsFrameDuration is given to the last frame of a stream going away
+const hlsFrameDuration = 20 * time.Millisecond
+
+// ErrSegmentNotFound is returned for the HLS files not in the playlist
+var ErrSegmentNotFound = errors.New("segment not found")
+
+// ErrFutureSegment is returned for the blocking playlist reloads waiting
+// for a segment past the next one
+var ErrFutureSegment = errors.New("segment too far in the future")
+
+// HLSOptions configure the HLS packaging of the streams of a Broadcaster
+type HLSOptions struct {
+	// SegmentDuration is the target duration of the segments, the video
+	// ones are cut on the first keyframe after it
+	SegmentDuration time.Duration
+	// Window is how many segments the playlists list
+	Window int
+	// PartDuration is the target duration of the parts of the segments for
+	// Low-Latency HLS, 0 disables it
+	PartDuration time.Duration
+	// DASH packages every track on its own as well, for the DASH manifests
+	DASH bool
+}
+
+// hlsInit is the init segment of a publication, starting at date
+type hlsInit struct {
+	data   []byte
+	tracks []mediaTrack
+	date   time.Time
+	// dash are the init segments of the tracks on their own
+	dash map[uint8][]byte
+}
+
+// dashRun is the fragment of a track on its own, starting at decodeTime and
+// lasting duration in its timescale
+type dashRun struct {
+	decodeTime uint64
+	duration   uint64
+	data       []byte
+}
+
+// hlsPart is a partial segment of Low-Latency HLS, independent when it
+// starts with a keyframe
+type hlsPart struct {
+	duration    time.Duration
+	independent bool
+	data        []byte
+	runs        map[uint8]dashRun
+}
+
+// hlsSegment is a media segment, its sequence is its name. Its data are
+// its parts one after the other.
+type hlsSegment struct {
+	sequence uint64
+	// init is the version of the init segment it decodes with, a new
+	// publication of the stream starting a new one after a discontinuity
+	init          int
+	discontinuity bool
+	duration      time.Duration
+	parts         []hlsPart
+	data          []byte
+	// runs are the fragments of the tracks for DASH, keyed by number
+	runs map[uint8]dashRun
+}
+
+// hlsStream is the HLS rendition of a stream, its segments are served as
+// DASH as well. It outlives the publications of the stream so that players
+// go on with the next one.
+type hlsStream struct {
+	streamID string
+	options  HLSOptions
+
+	// muxer, tracks and publication are owned by the loop, the muxer
+	// packages the tracks of the current publication
+	muxer       *streamMuxer
+	tracks      map[string]*trackRecorder
+	publication int
+
+	lock  sync.Mutex
+	inits map[int]*hlsInit
+	init  int
+	// availability is when the first publication started, the origin of
+	// the DASH timeline
+	availability time.Time
+	segments     []hlsSegment
+	// parts are those of the segment being packaged, sequence and
+	// decoding with partInit
+	parts           []hlsPart
+	partInit        int
+	sequence        uint64
+	discontinuities int
+	ended           bool
+	// changed is closed when a part is added or the stream ends
+	changed chan struct{}
+}
+
+func newHLSStream(streamID string, options HLSOptions) *hlsStream {
+	return &hlsStream{
+		streamID: streamID,
+		options:  options,
+		tracks:   make(map[string]*trackRecorder),
+		inits:    make(map[int]*hlsInit),
+		changed:  make(chan struct{}),
+	}
+}
+
+// accepts the codecs fMP4 carries for the players, VP8 has no mapping
+func (h *hlsStream) accepts(mimeType string) bool {
+	return strings.EqualFold(mimeType, webrtc.MimeTypeH264) ||
+		strings.EqualFold(mimeType, webrtc.MimeTypeVP9) ||
+		strings.EqualFold(mimeType, webrtc.MimeTypeOpus)
+}
+
+// lowLatency tells whether the parts are listed by the playlist
+func (h *hlsStream) lowLatency() bool {
+	return h.options.PartDuration > 0
+}
+
+// create starts the segments of a publication with a new init segment
+func (h *hlsStream) create(tracks []mediaTrack, date time.Time) (frameWriter, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.init++
+	init := &hlsInit{data: mp4InitSegment(tracks), tracks: tracks, date: date}
+	if h.options.DASH {
+		init.dash = make(map[uint8][]byte, len(tracks))
+		for _, track := range tracks {
+			init.dash[track.number] = mp4InitSegment([]mediaTrack{track})
+		}
+	}
+	if h.availability.IsZero() {
+		h.availability = date
+	}
+	h.inits[h.init] = init
+	h.ended = false
+	writer := &hlsWriter{stream: h, init: h.init, tracks: tracks, frames: make(map[uint8][]hlsFrame)}
+	for _, track := range tracks {
+		writer.video = writer.video || track.video()
+	}
+	return writer, nil
+}
+
+// addPart appends a part to the segment being packaged
+func (h *hlsStream) addPart(init int, part hlsPart) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if init != h.partInit {
+		// The parts left by a previous publication are never completed
+		h.parts, h.partInit = nil, init
+	}
+	h.parts = append(h.parts, part)
+	h.notify()
+}
+
+// addSegment completes the segment of the parts packaged, those out of the
+// window are dropped
+func (h *hlsStream) addSegment(init int, duration time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if init != h.partInit || len(h.parts) == 0 {
+		return
+	}
+	segment := hlsSegment{sequence: h.sequence, init: init, duration: duration, parts: h.parts}
+	for _, part := range h.parts {
+		segment.data = append(segment.data, part.data...)
+		for number, run := range part.runs {
+			if segment.runs == nil {
+				segment.runs = make(map[uint8]dashRun)
+			}
+			merged, ok := segment.runs[number]
+			if !ok {
+				merged.decodeTime = run.decodeTime
+			}
+			merged.duration += run.duration
+			merged.data = append(merged.data, run.data...)
+			segment.runs[number] = merged
+		}
+	}
+	if h.sequence > 0 && (len(h.segments) == 0 || h.segments[len(h.segments)-1].init != init) {
+		segment.discontinuity = true
+	}
+	h.sequence++
+	h.parts = nil
+	h.segments = append(h.segments, segment)
+	for len(h.segments) > h.options.Window {
+		if h.segments[0].discontinuity {
+			h.discontinuities++
+		}
+		h.segments = h.segments[1:]
+	}
+	for init := range h.inits {
+		if init < h.segments[0].init && init != h.init {
+			delete(h.inits, init)
+		}
+	}
+	h.notify()
+}
+
+// end marks the playlist as complete, unless the stream is published
+// again since the init segment
+func (h *hlsStream) end(init int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if init == h.init {
+		h.ended = true
+		h.notify()
+	}
+}
+
+// notify wakes up the requests waiting for the playlist, it must be
+// called with the lock held
+func (h *hlsStream) notify() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// wait blocks until ready, called with the lock held, tells or ctx is done.
+// It returns with the lock held when ready.
+func (h *hlsStream) wait(ctx context.Context, ready func() bool) bool {
+	h.lock.Lock()
+	for !ready() {
+		if h.ended {
+			h.lock.Unlock()
+			return false
+		}
+		changed := h.changed
+		h.lock.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+		h.lock.Lock()
+	}
+	return true
+}
+
+// has tells whether the segment sequence, or its part when not negative,
+// is packaged. It must be called with the lock held.
+func (h *hlsStream) has(sequence uint64, part int) bool {
+	if sequence < h.sequence {
+		return true
+	}
+	return sequence == h.sequence && part >= 0 && part < len(h.parts)
+}
+
+// playlist writes the media playlist once it has a segment, waiting until
+// ctx is done. Blocking reloads wait for the segment msn, or its part when
+// not negative, when msn is. query is added to the URIs of the files.
+func (h *hlsStream) playlist(ctx context.Context, query string, msn int64, part int) ([]byte, error) {
+	h.lock.Lock()
+	if msn > int64(h.sequence)+1 {
+		h.lock.Unlock()
+		return nil, ErrFutureSegment
+	}
+	h.lock.Unlock()
+	ready := func() bool {
+		return len(h.segments) > 0 && (msn < 0 || h.has(uint64(msn), part))
+	}
+	if !h.wait(ctx, ready) {
+		h.lock.Lock()
+		if !ready() && (len(h.segments) == 0 || !h.ended) {
+			h.lock.Unlock()
+			return nil, ErrSegmentNotFound
+		}
+	}
+	defer h.lock.Unlock()
+	if query != "" {
+		query = "?" + query
+	}
+	target := h.options.SegmentDuration
+	for _, segment := range h.segments {
+		if segment.duration > target {
+			target = segment.duration
+		}
+	}
+	targetDuration := int(math.Ceil(target.Seconds()))
+	playlist := &bytes.Buffer{}
+	fmt.Fprintf(playlist, "#EXTM3U\n#EXT-X-VERSION:7\n")
+	fmt.Fprintf(playlist, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	if h.lowLatency() {
+		fmt.Fprintf(playlist, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", (3 * h.options.PartDuration).Seconds())
+		fmt.Fprintf(playlist, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", h.options.PartDuration.Seconds())
+	}
+	fmt.Fprintf(playlist, "#EXT-X-MEDIA-SEQUENCE:%d\n", h.segments[0].sequence)
+	fmt.Fprintf(playlist, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", h.discontinuities)
+	fmt.Fprintf(playlist, "#EXT-X-INDEPENDENT-SEGMENTS\n")
+	// The parts are listed for the last three target durations
+	listed := len(h.segments)
+	if h.lowLatency() {
+		recent := time.Duration(0)
+		for _, part := range h.parts {
+			recent += part.duration
+		}
+		for listed > 0 && recent < 3*time.Duration(targetDuration)*time.Second {
+			listed--
+			recent += h.segments[listed].duration
+		}
+	}
+	writeParts := func(sequence uint64, parts []hlsPart) {
+		for i, part := range parts {
+			independent := ""
+			if part.independent {
+				independent = ",INDEPENDENT=YES"
+			}
+			fmt.Fprintf(playlist, "#EXT-X-PART:DURATION=%.5f,URI=\"%d.%d.m4s%s\"%s\n", part.duration.Seconds(), sequence, i, query, independent)
+		}
+	}
+	for i, segment := range h.segments {
+		if segment.discontinuity {
+			fmt.Fprintf(playlist, "#EXT-X-DISCONTINUITY\n")
+		}
+		if i == 0 || segment.init != h.segments[i-1].init {
+			fmt.Fprintf(playlist, "#EXT-X-MAP:URI=\"init-%d.mp4%s\"\n", segment.init, query)
+		}
+		if i >= listed {
+			writeParts(segment.sequence, segment.parts)
+		}
+		fmt.Fprintf(playlist, "#EXTINF:%.3f,\n%d.m4s%s\n", segment.duration.Seconds(), segment.sequence, query)
+	}
+	if h.ended {
+		fmt.Fprintf(playlist, "#EXT-X-ENDLIST\n")
+		return playlist.Bytes(), nil
+	}
+	if h.lowLatency() {
+		if len(h.parts) > 0 && h.partInit != h.segments[len(h.segments)-1].init {
+			fmt.Fprintf(playlist, "#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init-%d.mp4%s\"\n", h.partInit, query)
+		}
+		writeParts(h.sequence, h.parts)
+		fmt.Fprintf(playlist, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%d.%d.m4s%s\"\n", h.sequence, len(h.parts), query)
+	}
+	return playlist.Bytes(), nil
+}
+
+// file returns the init segment init-N.mp4, the media segment N.m4s or its
+// part N.P.m4s. The segments and the parts not packaged yet are waited for
+// until ctx is done, for the preload hints.
+func (h *hlsStream) file(ctx context.Context, name string) ([]byte, error) {
+	if strings.HasPrefix(name, "init-") && strings.HasSuffix(name, ".mp4") {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if init, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "init-"), ".mp4")); err == nil {
+			if init, ok := h.inits[init]; ok {
+				return init.data, nil
+			}
+		}
+		return nil, ErrSegmentNotFound
+	}
+	if !strings.HasSuffix(name, ".m4s") {
+		return nil, ErrSegmentNotFound
+	}
+	fields := strings.Split(strings.TrimSuffix(name, ".m4s"), ".")
+	sequence, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil || len(fields) > 2 {
+		return nil, ErrSegmentNotFound
+	}
+	part := -1
+	if len(fields) == 2 {
+		if part, err = strconv.Atoi(fields[1]); err != nil || part < 0 || !h.lowLatency() {
+			return nil, ErrSegmentNotFound
+		}
+	}
+	h.lock.Lock()
+	// Only the next segment is worth waiting for
+	future := sequence > h.sequence+1
+	h.lock.Unlock()
+	if future || !h.wait(ctx, func() bool { return h.has(sequence, part) }) {
+		return nil, ErrSegmentNotFound
+	}
+	defer h.lock.Unlock()
+	if sequence == h.sequence {
+		return h.parts[part].data, nil
+	}
+	i := sort.Search(len(h.segments), func(i int) bool { return h.segments[i].sequence >= sequence })
+	if i == len(h.segments) || h.segments[i].sequence != sequence {
+		return nil, ErrSegmentNotFound
+	}
+	if part < 0 {
+		return h.segments[i].data, nil
+	}
+	if part >= len(h.segments[i].parts) {
+		return nil, ErrSegmentNotFound
+	}
+	return h.segments[i].parts[part].data, nil
+}
+
+// hlsFrame is a frame of the segment being packaged
+type hlsFrame struct {
+	at       time.Duration
+	keyframe bool
+	data     []byte
+}
+
+// hlsWriter cuts the frames of a publication into the segments of its
+// stream, on the video keyframes when it has video, and into their parts
+// for Low-Latency HLS
+type hlsWriter struct {
+	stream *hlsStream
+	init   int
+	tracks []mediaTrack
+	video  bool
+
+	// start and partStart are when the segment and the part being packaged
+	// start, previous the last frame of the track they are cut on
+	start     time.Duration
+	partStart time.Duration
+	previous  time.Duration
+	latest    time.Duration
+	frames    map[uint8][]hlsFrame
+	fragments uint32
+}
+
+func (w *hlsWriter) writeFrame(track mediaTrack, at time.Duration, keyframe bool, frame []byte) error {
+	if track.video() == w.video {
+		options := w.stream.options
+		switch {
+		case keyframe && at-w.start >= options.SegmentDuration:
+			w.cut(at)
+		case options.PartDuration > 0 && at > w.partStart && 2*at-w.partStart-w.previous > options.PartDuration:
+			// The part would go over its target with the next frame
+			w.cutPart(at)
+		}
+		w.previous = at
+	}
+	w.frames[track.number] = append(w.frames[track.number], hlsFrame{at: at, keyframe: keyframe, data: frame})
+	if at > w.latest {
+		w.latest = at
+	}
+	return nil
+}
+
+// cutPart packages the frames before end into a part of the segment
+func (w *hlsWriter) cutPart(end time.Duration) {
+	runs, durations := mp4Runs(w.tracks, w.frames, end)
+	w.frames = make(map[uint8][]hlsFrame)
+	if len(runs) == 0 {
+		return
+	}
+	independent := !w.video
+	for _, run := range runs {
+		if run.track.video() && run.samples[0].keyframe {
+			independent = true
+		}
+	}
+	w.fragments++
+	part := hlsPart{duration: end - w.partStart, independent: independent, data: mp4Fragment(w.fragments, runs)}
+	if w.stream.options.DASH {
+		part.runs = make(map[uint8]dashRun, len(runs))
+		for i, run := range runs {
+			part.runs[run.track.number] = dashRun{
+				decodeTime: run.decodeTime,
+				duration:   durations[i],
+				data:       mp4Fragment(w.fragments, []mp4Run{run}),
+			}
+		}
+	}
+	w.stream.addPart(w.init, part)
+	w.partStart = end
+}
+
+// mp4Runs times the frames of the tracks, the video ones ending at end,
+// into their runs along with the duration of each in the timescale of its
+// track
+func mp4Runs(tracks []mediaTrack, frames map[uint8][]hlsFrame, end time.Duration) ([]mp4Run, []uint64) {
+	runs := []mp4Run{}
+	durations := []uint64{}
+	for _, track := range tracks {
+		frames := frames[track.number]
+		if len(frames) == 0 {
+			continue
+		}
+		rate := float64(track.clockRate)
+		scale := func(at time.Duration) uint64 {
+			return uint64(math.Round(at.Seconds() * rate))
+		}
+		run := mp4Run{track: track, decodeTime: scale(frames[0].at)}
+		total := uint64(0)
+		last := hlsFrameDuration
+		for i, frame := range frames {
+			// The last audio frame lasts as long as the previous one
+			duration := last
+			if i+1 < len(frames) {
+				duration = frames[i+1].at - frame.at
+			} else if track.video() {
+				duration = end - frame.at
+			}
+			if duration <= 0 {
+				duration = last
+			}
+			last = duration
+			sample := uint32(scale(frame.at+duration) - scale(frame.at))
+			total += uint64(sample)
+			run.samples = append(run.samples, mp4Sample{
+				duration: sample,
+				keyframe: frame.keyframe,
+				data:     frame.data,
+			})
+		}
+		runs = append(runs, run)
+		durations = append(durations, total)
+	}
+	return runs, durations
+}
+
+// cut packages the frames before end into the last part of the segment
+func (w *hlsWriter) cut(end time.Duration) {
+	w.cutPart(end)
+	w.stream.addSegment(w.init, end-w.start)
+	w.start, w.partStart = end, end
+}
+
+// Close packages the frames left and ends the playlist
+func (w *hlsWriter) Close() error {
+	w.cut(w.latest + hlsFrameDuration)
+	w.stream.end(w.init)
+	return nil
+}
+
+// EnableHLS packages every stream published as HLS, and as DASH with
+// options.DASH
+func (s *Broadcaster) EnableHLS(options HLSOptions) {
+	s.do(func() {
+		s.hls = &options
+		keys := make([]string, 0, len(s.senders))
+		for key := range s.senders {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s.packageNewTrack(key)
+		}
+	})
+}
+
+// HLSPlaylist returns the media playlist of streamID, waiting until ctx is
+// done for its first segment. A blocking reload waits for the segment msn,
+// or its part when not negative, when msn is not negative. query is added
+// to the URIs it lists.
+func (s *Broadcaster) HLSPlaylist(ctx context.Context, streamID string, query string, msn int64, part int) ([]byte, error) {
+	stream, err := s.hlsStream(streamID)
+	if err != nil {
+		return nil, err
+	}
+	return stream.playlist(ctx, query, msn, part)
+}
+
+// HLSFile returns an init segment, a media segment or a part listed by the
+// playlist of streamID, waiting until ctx is done for those coming next
+func (s *Broadcaster) HLSFile(ctx context.Context, streamID string, name string) ([]byte, error) {
+	stream, err := s.hlsStream(streamID)
+	if err != nil {
+		return nil, err
+	}
+	return stream.file(ctx, name)
+}
+
+func (s *Broadcaster) hlsStream(streamID string) (*hlsStream, error) {
+	var stream *hlsStream
+	if !s.do(func() { stream = s.hlsStreams[streamID] }) {
+		return nil, errClosed
+	}
+	if stream == nil {
+		return nil, ErrUnknownStream
+	}
+	return stream, nil
+}
+
+// packageNewTrack adds the track key to the HLS rendition of its stream,
+// starting a new publication once the previous one went away. It must run
+// on the loop.
+func (s *Broadcaster) packageNewTrack(key string) {
+	if s.hls == nil || s.opaque() || s.isSpareLayer(key) {
+		return
+	}
+	track, ok := s.senders[key].(*webrtc.TrackLocalStaticRTP)
+	if !ok {
+		return
+	}
+	streamID := track.StreamID()
+	stream, ok := s.hlsStreams[streamID]
+	if !ok {
+		stream = newHLSStream(streamID, *s.hls)
+		s.hlsStreams[streamID] = stream
+	}
+	if len(stream.tracks) == 0 {
+		stream.publication++
+		stream.muxer = newStreamMuxer(stream, time.Now())
+	}
+	codec := track.Codec()
+	muxed, err := stream.muxer.addTrack(codec, s.trackClock(key, nil))
+	if err != nil {
+		zap.S().Infow("Not packaging track as HLS", "track", key, "error", err)
+		if !ok {
+			delete(s.hlsStreams, streamID)
+		}
+		return
+	}
+	packager := newTrackRecorder(streamID, codec.MimeType, muxed, func() {
+		go s.do(func() { s.requestKeyframe(key, keyframeSegment) })
+	})
+	// The segments are cut on keyframes
+	packager.keyframeInterval = stream.options.SegmentDuration
+	stream.tracks[key] = packager
+	s.sinkLock.Lock()
+	if _, ok := s.sinks[key]; !ok {
+		s.sinks[key] = make(map[TrackSink]bool)
+	}
+	s.sinks[key][packager] = true
+	s.sinkLock.Unlock()
+}
+
+// endPackagedTrack forgets the removed track key, its sink is closed
+// already. The rendition of a stream without tracks is dropped after
+// hlsLinger unless it is published again. It must run on the loop.
+func (s *Broadcaster) endPackagedTrack(key string) {
+	for streamID, stream := range s.hlsStreams {
+		if _, ok := stream.tracks[key]; !ok {
+			continue
+		}
+		delete(stream.tracks, key)
+		if len(stream.tracks) > 0 {
+			continue
+		}
+		streamID, stream, publication := streamID, stream, stream.publication
+		time.AfterFunc(hlsLinger, func() {
+			s.do(func() {
+				if len(stream.tracks) == 0 && stream.publication == publication && s.hlsStreams[streamID] == stream {
+					delete(s.hlsStreams, streamID)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package hub
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+// DefaultReadBufferSize fits an Ethernet MTU worth of RTP
+const DefaultReadBufferSize = 1500
+
+// NewIngestAPI builds the API used for publisher connections, its receive
+// MTU matches the track read buffer so that pion does not cut large packets
+// short before they reach the forwarding loop. Only the codecs of the set
+// are negotiated.
+func NewIngestAPI(readBufferSize int, codecs CodecSet) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	// The hub does not recover the losses of publishers with their FEC
+	// and redundancy
+	codecs.FlexFEC, codecs.RED = false, 0
+	if err := codecs.register(m); err != nil {
+		return nil, err
+	}
+	if err := registerSimulcastExtensions(m); err != nil {
+		return nil, err
+	}
+	// Publishers tag their audio with its level for the active speakers
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: audioLevelExtension}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+	// Publishers honor the REMBs of EnablePublisherBitrateCap
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBGoogREMB}, webrtc.RTPCodecTypeVideo)
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	settings := webrtc.SettingEngine{}
+	settings.SetReceiveMTU(uint(readBufferSize))
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(i),
+		webrtc.WithSettingEngine(settings),
+	), nil
+}
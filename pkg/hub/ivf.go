@@ -0,0 +1,119 @@
+package hub
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+// ivfHeaderSize is the size of the IVF file header, the frame count it
+// holds is at ivfFrameCountOffset
+const (
+	ivfHeaderSize       = 32
+	ivfFrameCountOffset = 24
+)
+
+// ivfMaxLate is how many packets a frame is waited for before it is dropped
+const ivfMaxLate = 512
+
+// ivfWriter assembles the frames of a VP8, VP9 or H264 track and writes
+// them to an IVF file, timed with the RTP clock of the track. H264 frames
+// are written in Annex B.
+type ivfWriter struct {
+	file    *os.File
+	builder *samplebuilder.SampleBuilder
+	frames  uint32
+	// pts is the time of the last frame in RTP clock units since the first
+	pts       uint64
+	timestamp uint32
+	started   bool
+}
+
+// ivfFourCC tells the IVF fourcc and the depacketizer of a codec, ok is
+// false for the codecs IVF cannot carry
+func ivfFourCC(mimeType string) (string, rtp.Depacketizer, bool) {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return "VP80", &codecs.VP8Packet{}, true
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return "VP90", &codecs.VP9Packet{}, true
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return "H264", &codecs.H264Packet{}, true
+	}
+	return "", nil, false
+}
+
+func newIVFWriter(fileName string, codec webrtc.RTPCodecCapability) (*ivfWriter, error) {
+	fourcc, depacketizer, ok := ivfFourCC(codec.MimeType)
+	if !ok {
+		return nil, fmt.Errorf("IVF cannot carry %s", codec.MimeType)
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, ivfHeaderSize)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)
+	binary.LittleEndian.PutUint16(header[6:], ivfHeaderSize)
+	copy(header[8:], fourcc)
+	// The size is left to the bitstream, the time base is the RTP clock
+	binary.LittleEndian.PutUint32(header[16:], codec.ClockRate)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &ivfWriter{
+		file:    file,
+		builder: samplebuilder.New(ivfMaxLate, depacketizer, codec.ClockRate),
+	}, nil
+}
+
+func (w *ivfWriter) WriteRTP(packet *rtp.Packet) error {
+	w.builder.Push(packet)
+	for sample := w.builder.Pop(); sample != nil; sample = w.builder.Pop() {
+		if err := w.writeFrame(sample.PacketTimestamp, sample.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *ivfWriter) writeFrame(timestamp uint32, frame []byte) error {
+	if w.started {
+		// Frames come out in order, a timestamp going back is a new clock
+		if elapsed := int32(timestamp - w.timestamp); elapsed > 0 {
+			w.pts += uint64(elapsed)
+		}
+	}
+	w.started, w.timestamp = true, timestamp
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(frame)))
+	binary.LittleEndian.PutUint64(header[4:], w.pts)
+	if _, err := w.file.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.file.Write(frame); err != nil {
+		return err
+	}
+	w.frames++
+	return nil
+}
+
+// Close writes the frame count to the header and closes the file
+func (w *ivfWriter) Close() error {
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, w.frames)
+	if _, err := w.file.WriteAt(count, ivfFrameCountOffset); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,290 @@
+package hub
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// keyframeRequestInterval is the least time between two keyframe requests
+// sent to the publisher of a track, whatever asks for them
+const keyframeRequestInterval = 500 * time.Millisecond
+
+// DefaultKeyframeLossThreshold is the fraction of packets a receiver may
+// report lost before a keyframe is requested for it
+const DefaultKeyframeLossThreshold = 0.1
+
+// keyframeReason is why a keyframe is requested from a publisher
+type keyframeReason string
+
+const (
+	// keyframeSubscriber is a receiver starting on a running track
+	keyframeSubscriber keyframeReason = "subscriber"
+	// keyframeReceiver is a PLI or a FIR of a receiver
+	keyframeReceiver keyframeReason = "receiver"
+	// keyframeLoss is a receiver reporting more loss than the threshold
+	keyframeLoss keyframeReason = "loss"
+	// keyframeSwitch is a switch of layer or of program source
+	keyframeSwitch keyframeReason = "switch"
+	// keyframeResume is a receiver resuming a paused track
+	keyframeResume keyframeReason = "resume"
+	// keyframeRecording is a recording starting on a running track
+	keyframeRecording keyframeReason = "recording"
+	// keyframeSegment starts a segment of a packaged stream
+	keyframeSegment keyframeReason = "segment"
+	// keyframeEgress is the periodic keyframe of a stream pushed out
+	keyframeEgress keyframeReason = "egress"
+)
+
+// KeyframeRequests count the keyframe requests of a track
+type KeyframeRequests struct {
+	// Sent are the requests sent to the publisher by reason
+	Sent map[string]uint64 `json:"sent"`
+	// Throttled counts the requests dropped for following another too soon
+	Throttled uint64 `json:"throttled"`
+}
+
+// keyframeController sends the keyframe requests of the tracks only when
+// something needs one, at most once per keyframeRequestInterval each
+type keyframeController struct {
+	lock          sync.Mutex
+	last          map[string]time.Time
+	requests      map[string]*KeyframeRequests
+	lossThreshold float64
+}
+
+func newKeyframeController() *keyframeController {
+	return &keyframeController{
+		last:          make(map[string]time.Time),
+		requests:      make(map[string]*KeyframeRequests),
+		lossThreshold: DefaultKeyframeLossThreshold,
+	}
+}
+
+// allow tells whether a request for key is sent, and counts it
+func (c *keyframeController) allow(key string, reason keyframeReason, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	requests, ok := c.requests[key]
+	if !ok {
+		requests = &KeyframeRequests{Sent: make(map[string]uint64)}
+		c.requests[key] = requests
+	}
+	if now.Sub(c.last[key]) < keyframeRequestInterval {
+		requests.Throttled++
+		return false
+	}
+	c.last[key] = now
+	requests.Sent[string(reason)]++
+	return true
+}
+
+// lossy tells whether a receiver reporting fractionLost needs a keyframe
+func (c *keyframeController) lossy(fractionLost uint8) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lossThreshold > 0 && float64(fractionLost)/256 > c.lossThreshold
+}
+
+func (c *keyframeController) stats(key string) (KeyframeRequests, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	requests, ok := c.requests[key]
+	if !ok {
+		return KeyframeRequests{}, false
+	}
+	stats := KeyframeRequests{Sent: make(map[string]uint64, len(requests.Sent)), Throttled: requests.Throttled}
+	for reason, count := range requests.Sent {
+		stats.Sent[reason] = count
+	}
+	return stats, true
+}
+
+// reset lets the next request for key through, e.g. for a new publisher
+func (c *keyframeController) reset(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.last, key)
+}
+
+func (c *keyframeController) forget(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.last, key)
+	delete(c.requests, key)
+}
+
+// SetKeyframeLossThreshold sets the fraction of packets a receiver may
+// report lost before a keyframe is requested for it, 0 disables
+func (s *Broadcaster) SetKeyframeLossThreshold(threshold float64) {
+	s.keyframes.lock.Lock()
+	defer s.keyframes.lock.Unlock()
+	s.keyframes.lossThreshold = threshold
+}
+
+// keyframeGateTimeout lets a held back stream through when its keyframe
+// does not come, e.g. for a publisher ignoring keyframe requests
+const keyframeGateTimeout = 3 * time.Second
+
+// KeyframeGate holds back the video streams of a receiver connection until
+// their first keyframe, so that a receiver attached to a running track
+// starts decoding cleanly instead of from a delta frame. Held back streams
+// ask their publisher for a keyframe.
+type KeyframeGate struct {
+	lock     sync.Mutex
+	requests map[uint32]func()
+	held     uint64
+}
+
+func NewKeyframeGate() *KeyframeGate {
+	return &KeyframeGate{requests: make(map[uint32]func())}
+}
+
+// Held counts the packets dropped while waiting for keyframes
+func (g *KeyframeGate) Held() uint64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.held
+}
+
+// watch calls request, off the write path, while the stream ssrc is held
+// back waiting for a keyframe
+func (g *KeyframeGate) watch(ssrc uint32, request func()) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.requests[ssrc] = request
+}
+
+func (g *KeyframeGate) forget(ssrc uint32) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.requests, ssrc)
+}
+
+// hold records a packet held back on ssrc, the keyframe is requested again
+// when due
+func (g *KeyframeGate) hold(ssrc uint32, requestDue bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.held++
+	if request := g.requests[ssrc]; request != nil && requestDue {
+		go request()
+	}
+}
+
+// keyframeGateInterceptor drops the packets of new video streams of a
+// receiver connection until their first keyframe
+type keyframeGateInterceptor struct {
+	interceptor.NoOp
+	gate *KeyframeGate
+}
+
+type keyframeGateInterceptorFactory struct {
+	gate *KeyframeGate
+}
+
+func (f *keyframeGateInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &keyframeGateInterceptor{gate: f.gate}, nil
+}
+
+func (i *keyframeGateInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return writer
+	}
+	var lock sync.Mutex
+	open := false
+	var since, lastRequest time.Time
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		lock.Lock()
+		if !open {
+			now := time.Now()
+			if since.IsZero() {
+				since = now
+			}
+			open = isKeyframe(info.MimeType, payload) || now.Sub(since) >= keyframeGateTimeout
+			if !open {
+				requestDue := now.Sub(lastRequest) >= keyframeRequestInterval
+				if requestDue {
+					lastRequest = now
+				}
+				lock.Unlock()
+				i.gate.hold(info.SSRC, requestDue)
+				return 0, nil
+			}
+		}
+		lock.Unlock()
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+// handleReceiverRTCP reads the RTCP of a sender towards a receiver until it
+// is stopped. PLIs and FIRs are forwarded to the publisher of the track it
+// sends at that time, or of the layer selection sends, NACKs are answered
+// by retransmitter unless nil. Keyframes are requested the same way while
+// gate holds the sender back, and when the receiver reports heavy loss.
+func (s *Broadcaster) handleReceiverRTCP(sender *webrtc.RTPSender, retransmitter *Retransmitter, gate *KeyframeGate, selection *layerSelection) {
+	ssrcs := make(map[uint32]bool)
+	for _, encoding := range sender.GetParameters().Encodings {
+		ssrc := uint32(encoding.SSRC)
+		ssrcs[ssrc] = true
+		if gate != nil {
+			gate.watch(ssrc, func() {
+				s.requestSenderKeyframe(sender, selection, keyframeSubscriber)
+			})
+			defer gate.forget(ssrc)
+		}
+	}
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		keyframeRequested := false
+		for _, packet := range packets {
+			track := sender.Track()
+			if track == nil || track.Kind() != webrtc.RTPCodecTypeVideo {
+				break
+			}
+			key := track.StreamID() + track.ID()
+			switch packet := packet.(type) {
+			case *rtcp.TransportLayerNack:
+				if retransmitter != nil {
+					s.retransmit(retransmitter, key, selection, packet)
+				}
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if !keyframeRequested {
+					keyframeRequested = s.requestSenderKeyframe(sender, selection, keyframeReceiver)
+				}
+			case *rtcp.ReceiverReport:
+				for _, report := range packet.Reports {
+					if ssrcs[report.SSRC] && s.keyframes.lossy(report.FractionLost) && !keyframeRequested {
+						keyframeRequested = s.requestSenderKeyframe(sender, selection, keyframeLoss)
+					}
+				}
+			}
+		}
+	}
+}
+
+// requestSenderKeyframe asks the publisher of the video track sender sends
+// for a keyframe, unless one was just requested. It returns whether it did.
+func (s *Broadcaster) requestSenderKeyframe(sender *webrtc.RTPSender, selection *layerSelection, reason keyframeReason) bool {
+	track := sender.Track()
+	if track == nil || track.Kind() != webrtc.RTPCodecTypeVideo {
+		return false
+	}
+	key := track.StreamID() + track.ID()
+	if selection != nil {
+		key = selection.keyframeSource(key)
+	}
+	requested := false
+	s.do(func() {
+		requested = s.requestKeyframe(key, reason)
+	})
+	return requested
+}
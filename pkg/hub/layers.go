@@ -0,0 +1,297 @@
+package hub
+
+import (
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// layerHeadroom is the share of its estimated bandwidth a receiver is
+// expected to fill, the rest absorbs the estimation errors
+const layerHeadroom = 0.85
+
+// layerSelection forwards the simulcast layers of a publisher track to a
+// receiver on a track of its own, so that each receiver gets the layer
+// that fits it and switches seamlessly
+type layerSelection struct {
+	switcher
+	streamID string
+	// trackID is the publisher track the layers belong to
+	trackID string
+	sinks   map[string]*switcherSink
+}
+
+// SelectLayer pins the receiver to the simulcast layer rid of the tracks of
+// streamID, an empty rid lets the hub pick the layer from the bandwidth
+// estimate again
+func (s *Broadcaster) SelectLayer(id uuid.UUID, streamID string, rid string) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		if receiver.layerChoices == nil {
+			receiver.layerChoices = make(map[string]string)
+		}
+		if rid == "" {
+			delete(receiver.layerChoices, streamID)
+		} else {
+			receiver.layerChoices[streamID] = rid
+		}
+		s.receivers[id] = receiver
+		s.adaptReceiverLayers(receiver)
+		err = nil
+	})
+	return err
+}
+
+// EnableLayerAdaptation picks the simulcast layer of every receiver from its
+// estimated bandwidth every interval
+func (s *Broadcaster) EnableLayerAdaptation(interval time.Duration) {
+	s.do(func() {
+		s.layerAdaptation = true
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.closed:
+				return
+			case <-ticker.C:
+			}
+			s.do(func() {
+				for _, receiver := range s.receivers {
+					s.adaptReceiverLayers(receiver)
+				}
+			})
+		}
+	}()
+}
+
+// simulcastGroup returns the keys of the layers of the publisher track key
+// belongs to, by index. It must run on the loop.
+func (s *Broadcaster) simulcastGroup(key string) []string {
+	layer, ok := s.layers[key]
+	if !ok {
+		return nil
+	}
+	streamID := s.senders[key].StreamID()
+	group := []string{}
+	for other, otherLayer := range s.layers {
+		if otherLayer.TrackID == layer.TrackID && s.senders[other].StreamID() == streamID {
+			group = append(group, other)
+		}
+	}
+	sort.Slice(group, func(i, j int) bool {
+		return s.layers[group[i]].Index < s.layers[group[j]].Index
+	})
+	return group
+}
+
+// newLayerSelection creates the track sending the layers of key to the
+// receiver, it returns nil when key is not a simulcast layer. It must run
+// on the loop and the caller stores the receiver back.
+func (s *Broadcaster) newLayerSelection(receiver *ReceiverState, key string) *layerSelection {
+	layer, ok := s.layers[key]
+	if !ok {
+		return nil
+	}
+	local, ok := s.senders[key].(*webrtc.TrackLocalStaticRTP)
+	if !ok {
+		return nil
+	}
+	// The receiver sees the layer the distribution assigned
+	track, err := webrtc.NewTrackLocalStaticRTP(local.Codec(), local.ID(), local.StreamID())
+	if err != nil {
+		zap.S().Errorw("Unable to create layer track", "track", key, "error", err)
+		return nil
+	}
+	selection := &layerSelection{
+		switcher: switcher{track: track, opaque: s.opaque()},
+		streamID: local.StreamID(),
+		trackID:  layer.TrackID,
+		sinks:    make(map[string]*switcherSink),
+	}
+	if receiver.layers == nil {
+		receiver.layers = make(map[string]*layerSelection)
+	}
+	receiver.layers[key] = selection
+	s.syncLayerSelection(selection, key)
+	s.adaptLayer(*receiver, selection, key)
+	return selection
+}
+
+// syncLayerSelection listens to the layers of the group of key, it must run
+// on the loop
+func (s *Broadcaster) syncLayerSelection(selection *layerSelection, key string) {
+	group := s.simulcastGroup(key)
+	mimeType := selection.track.Codec().MimeType
+	s.sinkLock.Lock()
+	defer s.sinkLock.Unlock()
+	for layerKey, sink := range selection.sinks {
+		if _, ok := s.layers[layerKey]; !ok {
+			delete(s.sinks[layerKey], sink)
+			delete(selection.sinks, layerKey)
+		}
+	}
+	for _, layerKey := range group {
+		if _, ok := selection.sinks[layerKey]; ok {
+			continue
+		}
+		// The layers reach the switcher rewritten by their continuity
+		sink := &switcherSink{switcher: &selection.switcher, key: layerKey, mimeType: mimeType, clock: s.continuities[layerKey]}
+		selection.sinks[layerKey] = sink
+		if _, ok := s.sinks[layerKey]; !ok {
+			s.sinks[layerKey] = make(map[TrackSink]bool)
+		}
+		s.sinks[layerKey][sink] = true
+	}
+}
+
+// dropLayerSelection stops the layer track of key, it must run on the loop
+func (s *Broadcaster) dropLayerSelection(receiver ReceiverState, key string) {
+	selection, ok := receiver.layers[key]
+	if !ok {
+		return
+	}
+	s.sinkLock.Lock()
+	for layerKey, sink := range selection.sinks {
+		delete(s.sinks[layerKey], sink)
+	}
+	s.sinkLock.Unlock()
+	delete(receiver.layers, key)
+}
+
+// dropLayerSelections stops the layer tracks of a receiver going away, it
+// must run on the loop
+func (s *Broadcaster) dropLayerSelections(receiver ReceiverState) {
+	for key := range receiver.layers {
+		s.dropLayerSelection(receiver, key)
+	}
+}
+
+// adaptReceiverLayers switches every layer track of the receiver to the
+// layer that fits it, it must run on the loop
+func (s *Broadcaster) adaptReceiverLayers(receiver ReceiverState) {
+	for key, selection := range receiver.layers {
+		s.syncLayerSelection(selection, key)
+		s.adaptLayer(receiver, selection, key)
+	}
+}
+
+// adaptLayer switches selection to the layer the receiver chose or else to
+// the best one its bandwidth fits, it must run on the loop
+func (s *Broadcaster) adaptLayer(receiver ReceiverState, selection *layerSelection, key string) {
+	target := s.targetLayer(receiver, selection, key)
+	if target == "" {
+		return
+	}
+	active, pending := selection.state()
+	if target == active && pending == "" || target == pending {
+		return
+	}
+	selection.switchTo(target)
+	s.requestKeyframe(target, keyframeSwitch)
+}
+
+// targetLayer picks the layer of selection, it must run on the loop
+func (s *Broadcaster) targetLayer(receiver ReceiverState, selection *layerSelection, key string) string {
+	group := make([]string, 0, len(selection.sinks))
+	for layerKey := range selection.sinks {
+		group = append(group, layerKey)
+	}
+	if (s.downgraded(receiver) || receiver.quality == QualityLow) && len(group) > 0 {
+		sort.Slice(group, func(i, j int) bool { return s.layers[group[i]].Index < s.layers[group[j]].Index })
+		return group[0]
+	}
+	if receiver.quality == QualityHigh && len(group) > 0 {
+		sort.Slice(group, func(i, j int) bool { return s.layers[group[i]].Index > s.layers[group[j]].Index })
+		return group[0]
+	}
+	if rid, ok := receiver.layerChoices[selection.streamID]; ok {
+		for _, layerKey := range group {
+			if s.layers[layerKey].RID == rid {
+				return layerKey
+			}
+		}
+	}
+	active, pending := selection.state()
+	fallback := key
+	if active != "" {
+		fallback = active
+	}
+	if pending != "" {
+		fallback = pending
+	}
+	if !s.layerAdaptation || receiver.Bandwidth == nil {
+		return fallback
+	}
+	estimate := receiver.Bandwidth.Estimate()
+	if estimate == 0 {
+		return fallback
+	}
+	videos := 0
+	for assigned := range receiver.assigned {
+		if track, ok := s.senders[assigned]; ok && track.Kind() == webrtc.RTPCodecTypeVideo {
+			videos++
+		}
+	}
+	if videos == 0 {
+		videos = 1
+	}
+	share := float64(estimate) * layerHeadroom / float64(videos)
+
+	// Layers the publisher stopped sending are left out
+	sending := []string{}
+	for _, layerKey := range group {
+		if s.trackBitrate(layerKey) > 0 {
+			sending = append(sending, layerKey)
+		}
+	}
+	if len(sending) == 0 {
+		return fallback
+	}
+	sort.Slice(sending, func(i, j int) bool {
+		return s.trackBitrate(sending[i]) < s.trackBitrate(sending[j])
+	})
+	target := sending[0]
+	for _, layerKey := range sending[1:] {
+		if s.trackBitrate(layerKey) <= share {
+			target = layerKey
+		}
+	}
+	return target
+}
+
+// keyframeSource is the layer a keyframe request of the receiver goes to
+func (l *layerSelection) keyframeSource(key string) string {
+	active, pending := l.state()
+	if pending != "" {
+		return pending
+	}
+	if active != "" {
+		return active
+	}
+	return key
+}
+
+// activeLayers describes the layer each layer track of the receiver sends,
+// it must run on the loop
+func (s *Broadcaster) activeLayers(receiver ReceiverState) map[string]string {
+	if len(receiver.layers) == 0 {
+		return nil
+	}
+	layers := make(map[string]string)
+	for key, selection := range receiver.layers {
+		if active, _ := selection.state(); active != "" {
+			layers[key] = s.layers[active].RID
+		}
+	}
+	return layers
+}
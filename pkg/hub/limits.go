@@ -0,0 +1,134 @@
+package hub
+
+import (
+	"sort"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// SetMaxTracks caps the number of tracks sent to the receiver, 0 removes
+// the cap
+func (s *Broadcaster) SetMaxTracks(id uuid.UUID, limit int) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		receiver.Preferences.MaxTracks = limit
+		s.receivers[id] = receiver
+		s.scheduleRebalance()
+		err = nil
+	})
+	return err
+}
+
+// SetCapacity sets the weight of the receiver for weighted distributions
+func (s *Broadcaster) SetCapacity(id uuid.UUID, capacity int) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		receiver.Preferences.Capacity = capacity
+		s.receivers[id] = receiver
+		s.scheduleRebalance()
+		err = nil
+	})
+	return err
+}
+
+// enforceMaxTracks trims the receivers assigned more tracks than their
+// MaxTracks. Whole streams are taken away, those other receivers also get
+// first. The streams no receiver gets anymore spill over to the least
+// loaded receiver with room, they are dropped when none has. It must run
+// on the loop.
+func (s *Broadcaster) enforceMaxTracks(match map[uuid.UUID]map[string]bool, tracks []Track) {
+	members := make(map[string][]string)
+	streamOf := make(map[string]string)
+	for _, track := range tracks {
+		members[track.StreamID] = append(members[track.StreamID], track.Key)
+		streamOf[track.Key] = track.StreamID
+	}
+	streamsOf := func(keys map[string]bool) []string {
+		streams := make(map[string]bool)
+		for key := range keys {
+			streams[streamOf[key]] = true
+		}
+		list := make([]string, 0, len(streams))
+		for streamID := range streams {
+			list = append(list, streamID)
+		}
+		sort.Strings(list)
+		return list
+	}
+
+	// Sorted so that the same receivers get trimmed on every rebalance
+	ids := make([]uuid.UUID, 0, len(match))
+	holders := make(map[string]int)
+	for u, keys := range match {
+		ids = append(ids, u)
+		for _, streamID := range streamsOf(keys) {
+			holders[streamID]++
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+
+	spilled := []string{}
+	trimmedFrom := make(map[string]uuid.UUID)
+	for _, u := range ids {
+		limit := s.receivers[u].Preferences.MaxTracks
+		if limit <= 0 || len(match[u]) <= limit {
+			continue
+		}
+		streams := streamsOf(match[u])
+		sort.SliceStable(streams, func(i, j int) bool { return holders[streams[i]] > holders[streams[j]] })
+		if s.speakers.prioritize {
+			// The silent streams go first, the loudest speakers last
+			sort.SliceStable(streams, func(i, j int) bool { return s.quietness(streams[i]) > s.quietness(streams[j]) })
+		}
+		for _, streamID := range streams {
+			if len(match[u]) <= limit {
+				break
+			}
+			for _, key := range members[streamID] {
+				delete(match[u], key)
+			}
+			if holders[streamID]--; holders[streamID] == 0 {
+				spilled = append(spilled, streamID)
+				trimmedFrom[streamID] = u
+			}
+		}
+	}
+
+	for _, streamID := range spilled {
+		var target uuid.UUID
+		found := false
+		for _, u := range ids {
+			receiver := s.receivers[u]
+			if u == trimmedFrom[streamID] || len(receiver.subscriptions) > 0 {
+				continue
+			}
+			if limit := receiver.Preferences.MaxTracks; limit > 0 && len(match[u])+len(members[streamID]) > limit {
+				continue
+			}
+			if !found || len(match[u]) < len(match[target]) {
+				target, found = u, true
+			}
+		}
+		if !found {
+			zap.S().Debugw("No receiver has room for stream", "streamID", streamID)
+			continue
+		}
+		if match[target] == nil {
+			match[target] = make(map[string]bool)
+		}
+		for _, key := range members[streamID] {
+			match[target][key] = true
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// liveFragmentDuration is how much media the fMP4 fragments of the live
+// streams hold, shorter than the segments for the latency
+const liveFragmentDuration = 200 * time.Millisecond
+
+// liveBuffer is the chunks queued for a live stream client, which is
+// dropped once it falls that far behind
+const liveBuffer = 256
+
+// ErrLiveCodecs is returned for the streams without a track the format
+// carries
+var ErrLiveCodecs = errors.New("no track of the stream can be muxed in the format")
+
+// errLiveClientBehind fails the live streams whose client does not keep up
+var errLiveClientBehind = errors.New("live stream client does not keep up")
+
+// LiveFormat is the container of a live stream
+type LiveFormat string
+
+const (
+	// LiveWebM carries VP8, VP9 and Opus
+	LiveWebM LiveFormat = "webm"
+	// LiveMP4 is fragmented MP4 carrying H264, VP9 and Opus
+	LiveMP4 LiveFormat = "mp4"
+)
+
+// LiveStream muxes a stream for a single HTTP client as it comes, to be
+// appended to a Media Source Extensions source buffer
+type LiveStream struct {
+	broadcaster *Broadcaster
+	output      *liveOutput
+	sinks       map[string]*trackRecorder
+}
+
+// liveOutput is the container of a LiveStream, it queues the bytes muxed
+// for its client
+type liveOutput struct {
+	format LiveFormat
+	chunks chan []byte
+
+	lock        sync.Mutex
+	ended       bool
+	contentType string
+}
+
+func (o *liveOutput) accepts(mimeType string) bool {
+	accepted := []string{webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, webrtc.MimeTypeOpus}
+	if o.format == LiveMP4 {
+		// VP8 has no fMP4 mapping
+		accepted = []string{webrtc.MimeTypeH264, webrtc.MimeTypeVP9, webrtc.MimeTypeOpus}
+	}
+	for _, mime := range accepted {
+		if strings.EqualFold(mimeType, mime) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *liveOutput) create(tracks []mediaTrack, date time.Time) (frameWriter, error) {
+	kind, codecs := "audio", []string{}
+	for _, track := range tracks {
+		if track.video() {
+			kind = "video"
+		}
+		switch {
+		case o.format == LiveMP4:
+			codecs = append(codecs, mp4Codec(track))
+		case strings.EqualFold(track.mimeType, webrtc.MimeTypeVP8):
+			codecs = append(codecs, "vp8")
+		case strings.EqualFold(track.mimeType, webrtc.MimeTypeVP9):
+			codecs = append(codecs, "vp9")
+		default:
+			codecs = append(codecs, "opus")
+		}
+	}
+	o.lock.Lock()
+	o.contentType = fmt.Sprintf("%s/%s; codecs=\"%s\"", kind, o.format, strings.Join(codecs, ","))
+	o.lock.Unlock()
+
+	if o.format == LiveMP4 {
+		if _, err := o.Write(mp4InitSegment(tracks)); err != nil {
+			return nil, err
+		}
+		writer := &liveMP4Writer{out: o, tracks: tracks, frames: make(map[uint8][]hlsFrame)}
+		for _, track := range tracks {
+			writer.video = writer.video || track.video()
+		}
+		return writer, nil
+	}
+	header, _ := webmHeader("webm", tracks, date, false)
+	if _, err := o.Write(header); err != nil {
+		return nil, err
+	}
+	return &webmWriter{out: o}, nil
+}
+
+// Write queues a copy of p for the client, failing when it fell behind
+func (o *liveOutput) Write(p []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.ended {
+		return 0, errLiveClientBehind
+	}
+	select {
+	case o.chunks <- append([]byte(nil), p...):
+		return len(p), nil
+	default:
+		o.ended = true
+		close(o.chunks)
+		return 0, errLiveClientBehind
+	}
+}
+
+// Close ends the chunks once the muxer is done
+func (o *liveOutput) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if !o.ended {
+		o.ended = true
+		close(o.chunks)
+	}
+	return nil
+}
+
+// liveMP4Writer cuts the frames into short fMP4 fragments, on the video
+// frames when there is video
+type liveMP4Writer struct {
+	out    io.Writer
+	tracks []mediaTrack
+	video  bool
+
+	start     time.Duration
+	latest    time.Duration
+	frames    map[uint8][]hlsFrame
+	fragments uint32
+}
+
+func (w *liveMP4Writer) writeFrame(track mediaTrack, at time.Duration, keyframe bool, frame []byte) error {
+	if track.video() == w.video && at-w.start >= liveFragmentDuration {
+		if err := w.cut(at); err != nil {
+			return err
+		}
+	}
+	w.frames[track.number] = append(w.frames[track.number], hlsFrame{at: at, keyframe: keyframe, data: frame})
+	if at > w.latest {
+		w.latest = at
+	}
+	return nil
+}
+
+// cut writes the frames before end as a fragment
+func (w *liveMP4Writer) cut(end time.Duration) error {
+	runs, _ := mp4Runs(w.tracks, w.frames, end)
+	w.frames = make(map[uint8][]hlsFrame)
+	w.start = end
+	if len(runs) == 0 {
+		return nil
+	}
+	w.fragments++
+	_, err := w.out.Write(mp4Fragment(w.fragments, runs))
+	return err
+}
+
+// Close writes the frames left and ends the stream
+func (w *liveMP4Writer) Close() error {
+	err := w.cut(w.latest + hlsFrameDuration)
+	if closer, ok := w.out.(io.Closer); ok {
+		closer.Close()
+	}
+	return err
+}
+
+// StartLiveStream muxes the tracks streamID has as format, starting on a
+// video keyframe, until the stream goes away or the LiveStream is closed
+func (s *Broadcaster) StartLiveStream(streamID string, format LiveFormat) (*LiveStream, error) {
+	if format != LiveWebM && format != LiveMP4 {
+		return nil, fmt.Errorf("unknown live stream format %q", format)
+	}
+	if s.opaque() {
+		return nil, errors.New("end-to-end encrypted media cannot be muxed")
+	}
+	output := &liveOutput{format: format, chunks: make(chan []byte, liveBuffer)}
+	live := &LiveStream{broadcaster: s, output: output, sinks: make(map[string]*trackRecorder)}
+	muxer := newStreamMuxer(output, time.Now())
+	err := errClosed
+	s.do(func() {
+		keys := s.streamKeys(streamID)
+		if len(keys) == 0 {
+			err = ErrUnknownStream
+			return
+		}
+		s.sinkLock.Lock()
+		defer s.sinkLock.Unlock()
+		for _, key := range keys {
+			track, ok := s.senders[key].(*webrtc.TrackLocalStaticRTP)
+			if !ok {
+				continue
+			}
+			codec := track.Codec()
+			muxed, addErr := muxer.addTrack(codec, s.trackClock(key, nil))
+			if addErr != nil {
+				zap.S().Debugw("Not streaming track live", "track", key, "error", addErr)
+				continue
+			}
+			key := key
+			sink := newTrackRecorder(streamID, codec.MimeType, muxed, func() {
+				go s.do(func() { s.requestKeyframe(key, keyframeSubscriber) })
+			})
+			live.sinks[key] = sink
+			if _, ok := s.sinks[key]; !ok {
+				s.sinks[key] = make(map[TrackSink]bool)
+			}
+			s.sinks[key][sink] = true
+		}
+		err = nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(live.sinks) == 0 {
+		output.Close()
+		return nil, ErrLiveCodecs
+	}
+	return live, nil
+}
+
+// Chunks are the bytes to append in order, starting with the
+// initialization segment. It is closed once the stream ends or when the
+// client fell behind.
+func (l *LiveStream) Chunks() <-chan []byte {
+	return l.output.chunks
+}
+
+// ContentType is the MIME type with the codecs of the chunks for the
+// source buffer, known once the first chunk is
+func (l *LiveStream) ContentType() string {
+	l.output.lock.Lock()
+	defer l.output.lock.Unlock()
+	return l.output.contentType
+}
+
+// Close detaches the tracks, the chunks are closed once the frames queued
+// are muxed
+func (l *LiveStream) Close() {
+	for key, sink := range l.sinks {
+		l.broadcaster.RemoveSink(key, sink)
+		sink.Close()
+	}
+}
@@ -0,0 +1,74 @@
+package hub
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// TrackMetadata describes a track to the receivers it is sent to, in the
+// track-added and track-removed events sent ahead of the offers
+type TrackMetadata struct {
+	StreamID string `json:"streamID"`
+	TrackID  string `json:"trackID"`
+	Kind     string `json:"kind"`
+	// Publisher is the label the publisher of the track gave, if any
+	Publisher string `json:"publisher,omitempty"`
+}
+
+// trackMetadata describes the track key, it must run on the loop
+func (s *Broadcaster) trackMetadata(key string, publishers map[string]uuid.UUID) TrackMetadata {
+	track := s.senders[key]
+	return TrackMetadata{
+		StreamID:  track.StreamID(),
+		TrackID:   track.ID(),
+		Kind:      track.Kind().String(),
+		Publisher: s.peerSender[publishers[key]].Label,
+	}
+}
+
+// announceTracks tells the receiver about the tracks it gains and loses with
+// assigned. It must run on the loop and the caller stores the receiver back.
+func (s *Broadcaster) announceTracks(u uuid.UUID, receiver *ReceiverState, assigned map[string]bool, publishers map[string]uuid.UUID) {
+	if receiver.announced == nil {
+		receiver.announced = make(map[string]TrackMetadata)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for key, metadata := range receiver.announced {
+		if assigned[key] {
+			continue
+		}
+		delete(receiver.announced, key)
+		if err := SendEvent(ctx, receiver.Signaler, "track-removed", metadata); err != nil {
+			zap.S().Debugw("Unable to send track metadata", "receiver", u, "error", err)
+		}
+	}
+	for key := range assigned {
+		if _, ok := receiver.announced[key]; ok {
+			continue
+		}
+		if _, ok := s.senders[key]; !ok {
+			continue
+		}
+		metadata := s.trackMetadata(key, publishers)
+		receiver.announced[key] = metadata
+		if err := SendEvent(ctx, receiver.Signaler, "track-added", metadata); err != nil {
+			zap.S().Debugw("Unable to send track metadata", "receiver", u, "error", err)
+		}
+	}
+}
+
+// reannounceTracks sends the metadata of every track of the receiver again,
+// for a new signaling. It must run on the loop.
+func (s *Broadcaster) reannounceTracks(u uuid.UUID, receiver ReceiverState) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, metadata := range receiver.announced {
+		if err := SendEvent(ctx, receiver.Signaler, "track-added", metadata); err != nil {
+			zap.S().Debugw("Unable to send track metadata", "receiver", u, "error", err)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package hub
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// MixStreamID is the stream of the mixed audio track
+	MixStreamID = "mix"
+	mixTrackID  = "audio"
+	mixKey      = MixStreamID + mixTrackID
+
+	// The mix is mono Opus in 20ms frames
+	mixSampleRate   = 48000
+	mixFrameSamples = mixSampleRate / 50
+	mixFrameTime    = 20 * time.Millisecond
+	// mixQueueFrames bounds the audio a source may have ahead of the mix,
+	// older samples are dropped
+	mixQueueFrames = 5
+	// mixMaxPacketSamples fits the longest Opus packet, 120ms
+	mixMaxPacketSamples = 6 * mixFrameSamples
+	mixMaxPayload       = 1500
+)
+
+// AudioDecoder decodes Opus packets to 48kHz mono PCM, returning the number
+// of samples
+type AudioDecoder interface {
+	Decode(payload []byte, pcm []int16) (int, error)
+}
+
+// AudioEncoder encodes 48kHz mono PCM frames to Opus packets, returning the
+// size of the packet
+type AudioEncoder interface {
+	Encode(pcm []int16, payload []byte) (int, error)
+}
+
+// MixerCodec builds the Opus decoders and encoder of the audio mixer, the
+// hub itself does not link an Opus implementation
+type MixerCodec interface {
+	NewDecoder() (AudioDecoder, error)
+	NewEncoder() (AudioEncoder, error)
+}
+
+// mixer combines the Opus audio tracks of the publishers into one track
+type mixer struct {
+	codec   MixerCodec
+	encoder AudioEncoder
+	track   *webrtc.TrackLocalStaticRTP
+
+	lock sync.Mutex
+	// sources are the tracks mixed, by key
+	sources map[string]*mixerSource
+}
+
+// mixerSource is a TrackSink decoding a publisher track for the mix
+type mixerSource struct {
+	mixer   *mixer
+	key     string
+	decoder AudioDecoder
+	packet  rtp.Packet
+	pcm     []int16
+
+	lock    sync.Mutex
+	samples []int16
+}
+
+func (m *mixerSource) WriteRTP(raw []byte) error {
+	if err := m.packet.Unmarshal(raw); err != nil || len(m.packet.Payload) == 0 {
+		return nil
+	}
+	n, err := m.decoder.Decode(m.packet.Payload, m.pcm)
+	if err != nil {
+		zap.S().Debugw("Unable to decode audio for the mix", "track", m.key, "error", err)
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.samples = append(m.samples, m.pcm[:n]...)
+	if excess := len(m.samples) - mixQueueFrames*mixFrameSamples; excess > 0 {
+		m.samples = append(m.samples[:0], m.samples[excess:]...)
+	}
+	return nil
+}
+
+func (m *mixerSource) Close() error {
+	m.mixer.lock.Lock()
+	defer m.mixer.lock.Unlock()
+	if m.mixer.sources[m.key] == m {
+		delete(m.mixer.sources, m.key)
+	}
+	return nil
+}
+
+// take adds the next frame of the source to mix, it returns false when the
+// source has no full frame yet
+func (m *mixerSource) take(mix []int32) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.samples) < mixFrameSamples {
+		return false
+	}
+	for i, sample := range m.samples[:mixFrameSamples] {
+		mix[i] += int32(sample)
+	}
+	m.samples = append(m.samples[:0], m.samples[mixFrameSamples:]...)
+	return true
+}
+
+// EnableAudioMixing decodes the Opus audio of every publisher with codec and
+// sends receivers their mix on a single track in place of the publisher
+// audio tracks. Sinks can be attached to the mix like to any other track.
+func (s *Broadcaster) EnableAudioMixing(codec MixerCodec) error {
+	if codec == nil {
+		return errors.New("no codec for the audio mix")
+	}
+	encoder, err := codec.NewEncoder()
+	if err != nil {
+		return err
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeOpus,
+		ClockRate:   mixSampleRate,
+		Channels:    2,
+		SDPFmtpLine: DefaultOpusFmtp,
+	}, mixTrackID, MixStreamID)
+	if err != nil {
+		return err
+	}
+	m := &mixer{codec: codec, encoder: encoder, track: track, sources: make(map[string]*mixerSource)}
+	enabled, opaque := false, false
+	s.do(func() {
+		if opaque = s.opaque(); opaque || s.mixer != nil {
+			return
+		}
+		s.mixer = m
+		s.senders[mixKey] = track
+		enabled = true
+		s.notifyTrackWatchers()
+		s.scheduleRebalance()
+	})
+	if opaque {
+		return errors.New("end-to-end encrypted audio cannot be mixed")
+	}
+	if !enabled {
+		return errors.New("audio mixing is already enabled")
+	}
+	go s.runMixer(m)
+	return nil
+}
+
+// updateMixer decodes the Opus tracks not mixed yet, it must run on the loop
+func (s *Broadcaster) updateMixer() {
+	s.sinkLock.Lock()
+	defer s.sinkLock.Unlock()
+	s.mixer.lock.Lock()
+	defer s.mixer.lock.Unlock()
+	for key, sender := range s.senders {
+		local, ok := sender.(*webrtc.TrackLocalStaticRTP)
+		if key == mixKey || !ok || !strings.EqualFold(local.Codec().MimeType, webrtc.MimeTypeOpus) {
+			continue
+		}
+		if _, ok := s.mixer.sources[key]; ok {
+			continue
+		}
+		decoder, err := s.mixer.codec.NewDecoder()
+		if err != nil {
+			zap.S().Errorw("Unable to create a decoder for the mix", "track", key, "error", err)
+			continue
+		}
+		source := &mixerSource{mixer: s.mixer, key: key, decoder: decoder, pcm: make([]int16, mixMaxPacketSamples)}
+		s.mixer.sources[key] = source
+		if _, ok := s.sinks[key]; !ok {
+			s.sinks[key] = make(map[TrackSink]bool)
+		}
+		s.sinks[key][source] = true
+	}
+}
+
+// applyMix swaps the mixed audio tracks of every receiver for the mix, it
+// must run on the loop
+func (s *Broadcaster) applyMix(match map[uuid.UUID]map[string]bool) {
+	if s.mixer == nil {
+		return
+	}
+	s.mixer.lock.Lock()
+	defer s.mixer.lock.Unlock()
+	for u := range s.receivers {
+		if match[u] == nil {
+			match[u] = make(map[string]bool)
+		}
+		for key := range match[u] {
+			if _, ok := s.mixer.sources[key]; ok {
+				delete(match[u], key)
+			}
+		}
+		match[u][mixKey] = true
+	}
+}
+
+// runMixer sends a frame of the mix every 20ms until the Broadcaster is
+// closed. Nothing is sent while no source has audio, the timestamps go on.
+func (s *Broadcaster) runMixer(m *mixer) {
+	ticker := time.NewTicker(mixFrameTime)
+	defer ticker.Stop()
+	mix := make([]int32, mixFrameSamples)
+	pcm := make([]int16, mixFrameSamples)
+	payload := make([]byte, mixMaxPayload)
+	packet := &rtp.Packet{Header: rtp.Header{
+		Version:        2,
+		SequenceNumber: uint16(rand.Uint32()),
+		Timestamp:      rand.Uint32(),
+	}}
+	silent := true
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		for i := range mix {
+			mix[i] = 0
+		}
+		m.lock.Lock()
+		mixed := 0
+		for _, source := range m.sources {
+			if source.take(mix) {
+				mixed++
+			}
+		}
+		m.lock.Unlock()
+		packet.Timestamp += mixFrameSamples
+		if mixed == 0 {
+			silent = true
+			continue
+		}
+		for i, sample := range mix {
+			pcm[i] = int16(clampSample(sample))
+		}
+		n, err := m.encoder.Encode(pcm, payload)
+		if err != nil {
+			zap.S().Warnw("Unable to encode the mix", "error", err)
+			continue
+		}
+		packet.SequenceNumber++
+		// The marker starts a talkspurt
+		packet.Marker, silent = silent, false
+		packet.Payload = payload[:n]
+		if err := m.track.WriteRTP(packet); err != nil {
+			zap.S().Debugw("Unable to write the mix", "error", err)
+		}
+		if raw, err := packet.Marshal(); err == nil {
+			s.writeSinks(mixKey, raw)
+		}
+	}
+}
+
+func clampSample(sample int32) int32 {
+	if sample > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if sample < math.MinInt16 {
+		return math.MinInt16
+	}
+	return sample
+}
@@ -0,0 +1,457 @@
+package hub
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// tsPacketSize is the size of the MPEG-TS packets
+const tsPacketSize = 188
+
+// The PIDs of the program table, the video and the audio
+const (
+	tsPMTPID   = 0x1000
+	tsVideoPID = 0x100
+	tsAudioPID = 0x101
+)
+
+// tsDelay is how far the frames are presented after the PCR, for the
+// decoders to buffer them
+const tsDelay = 500 * time.Millisecond
+
+// tsTablesInterval is how often the program tables are repeated besides
+// before the video keyframes
+const tsTablesInterval = 500 * time.Millisecond
+
+// tsWriter muxes H264 and Opus into an MPEG-TS single program, the tables
+// are repeated for the receivers joining on the way
+type tsWriter struct {
+	out      io.Writer
+	tracks   []mediaTrack
+	pids     map[uint8]uint16
+	pcrPID   uint16
+	counters map[uint16]byte
+	// parameterSets are the SPS and PPS of the avcC, in Annex B
+	parameterSets []byte
+	tables        time.Duration
+	tablesSent    bool
+}
+
+// tsAccepts tells whether MPEG-TS carries the codec
+func tsAccepts(mimeType string) bool {
+	return strings.EqualFold(mimeType, webrtc.MimeTypeH264) || strings.EqualFold(mimeType, webrtc.MimeTypeOpus)
+}
+
+func newTSWriter(out io.Writer, tracks []mediaTrack) *tsWriter {
+	w := &tsWriter{out: out, tracks: tracks, pids: make(map[uint8]uint16), counters: make(map[uint16]byte)}
+	for _, track := range tracks {
+		if track.video() {
+			w.pids[track.number], w.pcrPID = tsVideoPID, tsVideoPID
+			w.parameterSets = avcParameterSets(track.codecPrivate)
+		} else {
+			w.pids[track.number] = tsAudioPID
+		}
+	}
+	if w.pcrPID == 0 {
+		w.pcrPID = tsAudioPID
+	}
+	return w
+}
+
+func (w *tsWriter) writeFrame(track mediaTrack, at time.Duration, keyframe bool, frame []byte) error {
+	pid := w.pids[track.number]
+	if !w.tablesSent || (track.video() && keyframe) || at-w.tables >= tsTablesInterval {
+		if err := w.writeTables(); err != nil {
+			return err
+		}
+		w.tablesSent, w.tables = true, at
+	}
+	// 90kHz clock, nanoseconds * 90000 / 1e9
+	pts := uint64(at+tsDelay) * 9 / 100000
+	var pcr *uint64
+	if pid == w.pcrPID {
+		clock := uint64(at) * 9 / 100000
+		pcr = &clock
+	}
+	if track.video() {
+		return w.writePES(pid, 0xE0, pts, pcr, keyframe, w.annexB(frame, keyframe))
+	}
+	// The Opus control header, then the size of the packet
+	payload := []byte{0x7F, 0xE0}
+	for size := len(frame); ; size -= 255 {
+		if size < 255 {
+			payload = append(payload, byte(size))
+			break
+		}
+		payload = append(payload, 0xFF)
+	}
+	return w.writePES(pid, 0xBD, pts, pcr, true, append(payload, frame...))
+}
+
+// Close flushes nothing, the output is owned by the caller
+func (w *tsWriter) Close() error {
+	return nil
+}
+
+// annexB converts an AVC frame with an access unit delimiter, the keyframes
+// get the parameter sets when they do not carry them
+func (w *tsWriter) annexB(frame []byte, keyframe bool) []byte {
+	data := []byte{0, 0, 0, 1, 0x09, 0xF0}
+	hasParameterSets := false
+	nals := [][]byte{}
+	for offset := 0; offset+4 <= len(frame); {
+		size := int(binary.BigEndian.Uint32(frame[offset:]))
+		offset += 4
+		if size == 0 || offset+size > len(frame) {
+			break
+		}
+		nal := frame[offset : offset+size]
+		offset += size
+		switch nal[0] & 0x1F {
+		case 7:
+			hasParameterSets = true
+		case 9:
+			continue
+		}
+		nals = append(nals, nal)
+	}
+	if keyframe && !hasParameterSets {
+		data = append(data, w.parameterSets...)
+	}
+	for _, nal := range nals {
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, nal...)
+	}
+	return data
+}
+
+// avcParameterSets are the SPS and PPS of an avcC in Annex B
+func avcParameterSets(avcC []byte) []byte {
+	data := []byte{}
+	if len(avcC) < 6 {
+		return data
+	}
+	offset, count := 6, int(avcC[5]&0x1F)
+	for set := 0; set < 2; set++ {
+		for i := 0; i < count && offset+2 <= len(avcC); i++ {
+			size := int(binary.BigEndian.Uint16(avcC[offset:]))
+			offset += 2
+			if offset+size > len(avcC) {
+				return data
+			}
+			data = append(data, 0, 0, 0, 1)
+			data = append(data, avcC[offset:offset+size]...)
+			offset += size
+		}
+		if offset >= len(avcC) {
+			break
+		}
+		// The PPS follow
+		count = int(avcC[offset])
+		offset++
+	}
+	return data
+}
+
+// writeTables writes the PAT and the PMT
+func (w *tsWriter) writeTables() error {
+	pat := []byte{0x00, 0xB0, 0, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xE0 | tsPMTPID>>8, tsPMTPID & 0xFF}
+	pmt := []byte{0x02, 0xB0, 0, 0x00, 0x01, 0xC1, 0x00, 0x00, 0xE0 | byte(w.pcrPID>>8), byte(w.pcrPID), 0xF0, 0x00}
+	for _, track := range w.tracks {
+		pid := w.pids[track.number]
+		if track.video() {
+			pmt = append(pmt, 0x1B, 0xE0|byte(pid>>8), byte(pid), 0xF0, 0x00)
+			continue
+		}
+		// Private data registered as Opus, with its channel configuration
+		descriptors := []byte{0x05, 4, 'O', 'p', 'u', 's', 0x7F, 2, 0x80, byte(track.channels)}
+		pmt = append(pmt, 0x06, 0xE0|byte(pid>>8), byte(pid), 0xF0, byte(len(descriptors)))
+		pmt = append(pmt, descriptors...)
+	}
+	for _, table := range []struct {
+		pid     uint16
+		section []byte
+	}{{0, pat}, {tsPMTPID, pmt}} {
+		section := table.section
+		// The length counts from after itself to the CRC included
+		section[2] = byte(len(section) - 3 + 4)
+		section = binary.BigEndian.AppendUint32(section, tsCRC(section))
+		packet := []byte{0x47, 0x40 | byte(table.pid>>8), byte(table.pid), 0x10 | w.counter(table.pid), 0x00}
+		packet = append(packet, section...)
+		for len(packet) < tsPacketSize {
+			packet = append(packet, 0xFF)
+		}
+		if _, err := w.out.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePES writes the payload as a PES in TS packets, the first one
+// carrying the PCR and the random access flag
+func (w *tsWriter) writePES(pid uint16, streamID byte, pts uint64, pcr *uint64, random bool, payload []byte) error {
+	header := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5,
+		0x21 | byte(pts>>29)&0x0E, byte(pts >> 22), byte(pts>>14)&0xFE | 1, byte(pts >> 7), byte(pts<<1) | 1}
+	// The video PES are unbounded
+	if length := len(header) - 6 + len(payload); streamID != 0xE0 && length <= 0xFFFF {
+		binary.BigEndian.PutUint16(header[4:], uint16(length))
+	}
+	data := append(header, payload...)
+	out := make([]byte, 0, (len(data)/(tsPacketSize-4)+1)*tsPacketSize)
+	for first := true; len(data) > 0; first = false {
+		packet := []byte{0x47, byte(pid >> 8), byte(pid), 0}
+		if first {
+			packet[1] |= 0x40
+		}
+		adaptation, hasAdaptation := []byte{}, false
+		if first && (pcr != nil || random) {
+			flags := byte(0)
+			if random {
+				flags |= 0x40
+			}
+			adaptation, hasAdaptation = append(adaptation, flags), true
+			if pcr != nil {
+				base := *pcr
+				adaptation[0] |= 0x10
+				adaptation = append(adaptation, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1), byte(base<<7)|0x7E, 0)
+			}
+		}
+		space := tsPacketSize - 4
+		if hasAdaptation {
+			space -= 1 + len(adaptation)
+		}
+		if stuffing := space - len(data); stuffing > 0 {
+			if !hasAdaptation {
+				// The adaptation field length alone is one byte of stuffing
+				hasAdaptation, stuffing = true, stuffing-1
+				if stuffing > 0 {
+					adaptation, stuffing = append(adaptation, 0), stuffing-1
+				}
+			}
+			for ; stuffing > 0; stuffing-- {
+				adaptation = append(adaptation, 0xFF)
+			}
+			space = len(data)
+		}
+		packet[3] = 0x10 | w.counter(pid)
+		if hasAdaptation {
+			packet[3] |= 0x20
+			packet = append(packet, byte(len(adaptation)))
+			packet = append(packet, adaptation...)
+		}
+		packet = append(packet, data[:space]...)
+		data = data[space:]
+		out = append(out, packet...)
+	}
+	_, err := w.out.Write(out)
+	return err
+}
+
+// counter returns the next continuity counter of the pid
+func (w *tsWriter) counter(pid uint16) byte {
+	counter := w.counters[pid]
+	w.counters[pid] = (counter + 1) & 0x0F
+	return counter
+}
+
+// tsCRC is the CRC-32/MPEG-2 of the tables
+func tsCRC(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// The stream types of the PMT read, Opus is private data registered as
+// such
+const (
+	tsStreamAAC     = 0x0F
+	tsStreamH264    = 0x1B
+	tsStreamPrivate = 0x06
+)
+
+// tsReader demuxes the elementary streams of an MPEG-TS single program,
+// output is called with every PES of H264, AAC or Opus and its PTS at
+// 90kHz. The tables must fit in a packet.
+type tsReader struct {
+	output  func(streamType byte, pts uint64, data []byte) error
+	pmtPID  uint16
+	streams map[uint16]*tsStream
+}
+
+// tsStream is an elementary stream being demuxed, Opus has the private
+// stream type
+type tsStream struct {
+	streamType byte
+	pes        []byte
+}
+
+func newTSReader(output func(streamType byte, pts uint64, data []byte) error) *tsReader {
+	return &tsReader{output: output, streams: make(map[uint16]*tsStream)}
+}
+
+// Write demuxes whole TS packets
+func (r *tsReader) Write(p []byte) (int, error) {
+	for offset := 0; offset+tsPacketSize <= len(p); offset += tsPacketSize {
+		if err := r.packet(p[offset : offset+tsPacketSize]); err != nil {
+			return offset, err
+		}
+	}
+	return len(p), nil
+}
+
+func (r *tsReader) packet(packet []byte) error {
+	if packet[0] != 0x47 || packet[3]&0x10 == 0 {
+		return nil
+	}
+	start := packet[1]&0x40 != 0
+	pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+	payload := packet[4:]
+	if packet[3]&0x20 != 0 {
+		if int(payload[0])+1 > len(payload) {
+			return nil
+		}
+		payload = payload[1+int(payload[0]):]
+	}
+	switch {
+	case pid == 0:
+		if start {
+			r.readPAT(payload)
+		}
+	case pid == r.pmtPID:
+		if start {
+			r.readPMT(payload)
+		}
+	default:
+		stream, ok := r.streams[pid]
+		if !ok {
+			return nil
+		}
+		if start {
+			if err := r.flush(stream); err != nil {
+				return err
+			}
+			stream.pes = []byte{}
+		}
+		if stream.pes == nil {
+			// Joined in the middle of a PES
+			return nil
+		}
+		stream.pes = append(stream.pes, payload...)
+		// The bounded PES are complete without waiting for the next one
+		if len(stream.pes) >= 6 {
+			if length := int(binary.BigEndian.Uint16(stream.pes[4:])); length > 0 && len(stream.pes) >= 6+length {
+				return r.flush(stream)
+			}
+		}
+	}
+	return nil
+}
+
+// section returns the table section starting in payload, without its CRC
+func (r *tsReader) section(payload []byte) []byte {
+	if len(payload) < 1 || 1+int(payload[0]) >= len(payload) {
+		return nil
+	}
+	section := payload[1+int(payload[0]):]
+	if len(section) < 3 {
+		return nil
+	}
+	length := int(section[1]&0x0F)<<8 | int(section[2])
+	if length < 9 || 3+length > len(section) {
+		return nil
+	}
+	return section[:3+length-4]
+}
+
+// readPAT finds the PMT of the first program
+func (r *tsReader) readPAT(payload []byte) {
+	section := r.section(payload)
+	for offset := 8; offset+4 <= len(section); offset += 4 {
+		if program := binary.BigEndian.Uint16(section[offset:]); program != 0 {
+			r.pmtPID = binary.BigEndian.Uint16(section[offset+2:]) & 0x1FFF
+			return
+		}
+	}
+}
+
+// readPMT finds the elementary streams demuxed, those known are kept
+func (r *tsReader) readPMT(payload []byte) {
+	section := r.section(payload)
+	if len(section) < 12 {
+		return
+	}
+	offset := 12 + (int(section[10]&0x0F)<<8 | int(section[11]))
+	for offset+5 <= len(section) {
+		streamType := section[offset]
+		pid := binary.BigEndian.Uint16(section[offset+1:]) & 0x1FFF
+		infoLength := int(binary.BigEndian.Uint16(section[offset+3:]) & 0x0FFF)
+		offset += 5
+		if offset+infoLength > len(section) {
+			return
+		}
+		descriptors := section[offset : offset+infoLength]
+		offset += infoLength
+		if _, ok := r.streams[pid]; ok {
+			continue
+		}
+		switch streamType {
+		case tsStreamH264, tsStreamAAC:
+		case tsStreamPrivate:
+			// Registered as Opus
+			opus := false
+			for i := 0; i+2 <= len(descriptors); i += 2 + int(descriptors[i+1]) {
+				if descriptors[i] == 0x05 && i+6 <= len(descriptors) && string(descriptors[i+2:i+6]) == "Opus" {
+					opus = true
+				}
+			}
+			if !opus {
+				continue
+			}
+		default:
+			continue
+		}
+		r.streams[pid] = &tsStream{streamType: streamType}
+	}
+}
+
+// flush outputs the PES of stream, those without PTS are dropped
+func (r *tsReader) flush(stream *tsStream) error {
+	pes := stream.pes
+	stream.pes = nil
+	if len(pes) < 14 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || pes[7]&0x80 == 0 {
+		return nil
+	}
+	if length := int(binary.BigEndian.Uint16(pes[4:])); length > 0 && 6+length <= len(pes) {
+		pes = pes[:6+length]
+	}
+	headerEnd := 9 + int(pes[8])
+	if headerEnd > len(pes) {
+		return nil
+	}
+	pts := uint64(pes[9]>>1&0x07)<<30 | uint64(pes[10])<<22 | uint64(pes[11]>>1)<<15 | uint64(pes[12])<<7 | uint64(pes[13]>>1)
+	return r.output(stream.streamType, pts, pes[headerEnd:])
+}
+
+// tsTicks is the signed time from base to pts at 90kHz, the PTS of 33
+// bits wrapping around
+func tsTicks(pts uint64, base uint64) int64 {
+	ticks := int64((pts - base) & (1<<33 - 1))
+	if ticks >= 1<<32 {
+		ticks -= 1 << 33
+	}
+	return ticks
+}
@@ -0,0 +1,113 @@
+package hub
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// rtpMunger rewrites the sequence numbers and timestamps of the packets of
+// successive sources into a single continuous stream, so that decoders do
+// not reset when the source changes. The first source goes through as is.
+type rtpMunger struct {
+	started   bool
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+	seqOffset uint16
+	tsOffset  uint32
+	// switchSeq is the first sequence number written from the current source
+	switchSeq uint16
+}
+
+// rebase makes packet, the first of a new source, follow the last packet
+// written. Its timestamp is ahead by the time elapsed since, on the clock
+// of the stream.
+func (m *rtpMunger) rebase(packet *rtp.Packet, clockRate uint32, now time.Time) {
+	if !m.started {
+		m.switchSeq = packet.SequenceNumber
+		return
+	}
+	gap := uint32(now.Sub(m.lastWrite).Seconds() * float64(clockRate))
+	if gap == 0 {
+		gap = 1
+	}
+	m.seqOffset = m.lastSeq + 1 - packet.SequenceNumber
+	m.tsOffset = m.lastTS + gap - packet.Timestamp
+	m.switchSeq = m.lastSeq + 1
+}
+
+// rewrite applies the offsets of the current source to packet
+func (m *rtpMunger) rewrite(packet *rtp.Packet, now time.Time) {
+	packet.SequenceNumber += m.seqOffset
+	packet.Timestamp += m.tsOffset
+	m.started = true
+	m.lastSeq, m.lastTS, m.lastWrite = packet.SequenceNumber, packet.Timestamp, now
+}
+
+// original maps a sequence number written from the current source back to
+// the one of the source
+func (m *rtpMunger) original(seq uint16) (uint16, bool) {
+	if !m.started || seq-m.switchSeq > m.lastSeq-m.switchSeq {
+		return 0, false
+	}
+	return seq - m.seqOffset, true
+}
+
+// trackContinuity keeps a published track going across reconnections of its
+// publisher, the packets of the publisher that took it over last continue
+// the stream of the previous one
+type trackContinuity struct {
+	lock      sync.Mutex
+	source    trackSource
+	clock     *sourceClock
+	clockRate uint32
+	munger    rtpMunger
+	rebase    bool
+}
+
+func newTrackContinuity(source trackSource, clock *sourceClock) *trackContinuity {
+	return &trackContinuity{source: source, clock: clock, clockRate: source.Codec().ClockRate}
+}
+
+// takeOver makes source, timed by clock, the publisher of the track
+func (c *trackContinuity) takeOver(source trackSource, clock *sourceClock) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.source, c.clock = source, clock
+	c.rebase = true
+}
+
+// rtpTime maps the clock of the publisher into the rewritten timestamps,
+// unknown until the publisher that took the track over sends its first
+// packet
+func (c *trackContinuity) rtpTime(now time.Time) (uint32, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.rebase {
+		return 0, false
+	}
+	rtpTime, ok := c.clock.rtpTime(now)
+	return rtpTime + c.munger.tsOffset, ok
+}
+
+// rewrite continues the stream with packet, read from source into raw which
+// is rewritten as well. It returns false once source was taken over.
+func (c *trackContinuity) rewrite(source trackSource, packet *rtp.Packet, raw []byte) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if source != c.source {
+		return false
+	}
+	now := time.Now()
+	if c.rebase {
+		c.rebase = false
+		c.munger.rebase(packet, c.clockRate, now)
+	}
+	c.munger.rewrite(packet, now)
+	binary.BigEndian.PutUint16(raw[2:4], packet.SequenceNumber)
+	binary.BigEndian.PutUint32(raw[4:8], packet.Timestamp)
+	return true
+}
@@ -0,0 +1,345 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+// muxReorderWindow is how long frames are held so that those of the audio
+// and the video are written in order
+const muxReorderWindow = 500 * time.Millisecond
+
+// muxTrackWait is how long the audio of a stream waits for a video track
+// before its file is written without
+const muxTrackWait = 2 * time.Second
+
+// opusSeekPreRoll is the audio decoded ahead of a seek, as Opus needs
+const opusSeekPreRoll = 80 * time.Millisecond
+
+// maxDuration flushes every queued frame
+const maxDuration = time.Duration(1<<63 - 1)
+
+// muxFrame is a frame waiting to be written, at is from the muxer start
+type muxFrame struct {
+	track    *muxedTrack
+	at       time.Duration
+	keyframe bool
+	data     []byte
+}
+
+// mediaTrack describes a track of a muxed output, numbered from 1
+type mediaTrack struct {
+	number    uint8
+	mimeType  string
+	clockRate uint32
+	channels  uint16
+	// width, height and codecPrivate describe the video, codecPrivate is
+	// the avcC of H264
+	width, height int
+	codecPrivate  []byte
+}
+
+func (t mediaTrack) video() bool {
+	return !strings.EqualFold(t.mimeType, webrtc.MimeTypeOpus)
+}
+
+// muxContainer creates the output of a streamMuxer
+type muxContainer interface {
+	// accepts tells whether the container can hold the codec
+	accepts(mimeType string) bool
+	// create starts the output holding tracks, its first frame is at date
+	create(tracks []mediaTrack, date time.Time) (frameWriter, error)
+}
+
+// frameWriter writes the frames of the tracks in order, at is from the
+// first frame
+type frameWriter interface {
+	writeFrame(track mediaTrack, at time.Duration, keyframe bool, frame []byte) error
+	Close() error
+}
+
+// streamMuxer writes the audio and the video of a stream to a single
+// output of its container. The frames are timed on the sender reports of
+// the publisher so that audio and video stay in sync, on their arrival
+// until the first reports. The output starts with a video keyframe once
+// the tracks it holds are known, the tracks coming later are not muxed.
+type streamMuxer struct {
+	container muxContainer
+	start     time.Time
+
+	lock         sync.Mutex
+	video, audio *muxedTrack
+	open         int
+	queue        []muxFrame
+	latest       time.Duration
+	writer       frameWriter
+	tracks       map[*muxedTrack]mediaTrack
+	base         time.Duration
+	failed       error
+}
+
+func newStreamMuxer(container muxContainer, start time.Time) *streamMuxer {
+	return &streamMuxer{container: container, start: start}
+}
+
+// file is the name of the file written, once its header is
+func (m *streamMuxer) file() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if writer, ok := m.writer.(*webmWriter); ok && writer.file != nil {
+		return writer.file.Name()
+	}
+	return ""
+}
+
+// addTrack muxes a track timed by clock, which may be nil, until its
+// writer is closed
+func (m *streamMuxer) addTrack(codec webrtc.RTPCodecCapability, clock rtpClock) (*muxedTrack, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.writer != nil {
+		return nil, errors.New("the muxed output is already started")
+	}
+	if !m.container.accepts(codec.MimeType) {
+		return nil, fmt.Errorf("%s cannot be muxed", codec.MimeType)
+	}
+	track := &muxedTrack{muxer: m, codec: codec, clock: clock, keyframes: make(map[uint32]bool)}
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		if m.audio != nil {
+			return nil, errors.New("a single audio track is muxed")
+		}
+		m.audio = track
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		track.builder = samplebuilder.New(ivfMaxLate, &codecs.VP8Packet{}, codec.ClockRate)
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP9):
+		track.builder = samplebuilder.New(ivfMaxLate, &codecs.VP9Packet{}, codec.ClockRate)
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+		track.builder = samplebuilder.New(ivfMaxLate, &codecs.H264Packet{IsAVC: true}, codec.ClockRate)
+	default:
+		return nil, fmt.Errorf("%s cannot be muxed", codec.MimeType)
+	}
+	if track.builder != nil {
+		if m.video != nil {
+			return nil, errors.New("a single video track is muxed")
+		}
+		m.video = track
+	}
+	m.open++
+	return track, nil
+}
+
+// push queues the frame and writes those out of the reorder window
+func (m *streamMuxer) push(frame muxFrame) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.failed != nil {
+		return m.failed
+	}
+	i := sort.Search(len(m.queue), func(i int) bool { return m.queue[i].at > frame.at })
+	m.queue = append(m.queue, muxFrame{})
+	copy(m.queue[i+1:], m.queue[i:])
+	m.queue[i] = frame
+	if frame.at > m.latest {
+		m.latest = frame.at
+	}
+	m.failed = m.flush(m.latest - muxReorderWindow)
+	return m.failed
+}
+
+// flush writes the frames queued up to until, it must be called with the
+// lock held
+func (m *streamMuxer) flush(until time.Duration) error {
+	for len(m.queue) > 0 && m.queue[0].at <= until {
+		frame := m.queue[0]
+		if m.writer == nil {
+			if m.video == nil && frame.at < muxTrackWait && until != maxDuration {
+				// The video of the stream may still come
+				return nil
+			}
+			if m.video != nil && (frame.track != m.video || !frame.keyframe || !m.video.ready) {
+				m.queue = m.queue[1:]
+				continue
+			}
+			if err := m.create(frame.at); err != nil {
+				return err
+			}
+		}
+		m.queue = m.queue[1:]
+		track, ok := m.tracks[frame.track]
+		if !ok {
+			continue
+		}
+		if err := m.writer.writeFrame(track, frame.at-m.base, frame.keyframe, frame.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// create starts the output at base, it must be called with the lock held
+func (m *streamMuxer) create(base time.Duration) error {
+	m.tracks = make(map[*muxedTrack]mediaTrack)
+	tracks := []mediaTrack{}
+	for _, muxed := range []*muxedTrack{m.video, m.audio} {
+		if muxed == nil {
+			continue
+		}
+		track := mediaTrack{
+			number:       uint8(len(tracks) + 1),
+			mimeType:     muxed.codec.MimeType,
+			clockRate:    muxed.codec.ClockRate,
+			channels:     muxed.codec.Channels,
+			width:        muxed.width,
+			height:       muxed.height,
+			codecPrivate: muxed.codecPrivate,
+		}
+		if !track.video() && track.channels == 0 {
+			track.channels = 2
+		}
+		m.tracks[muxed] = track
+		tracks = append(tracks, track)
+	}
+	writer, err := m.container.create(tracks, m.start.Add(base))
+	if err != nil {
+		return err
+	}
+	m.writer, m.base = writer, base
+	return nil
+}
+
+// describe sets the size and codec data of the video track
+func (m *streamMuxer) describe(track *muxedTrack, width, height int, codecPrivate []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	track.width, track.height, track.codecPrivate, track.ready = width, height, codecPrivate, true
+}
+
+// closeTrack stops muxing track, the output is finalized with its last
+// track
+func (m *streamMuxer) closeTrack(track *muxedTrack) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.writer == nil {
+		// Not in the output, the others may still be written without it
+		if m.video == track {
+			m.video = nil
+		}
+		if m.audio == track {
+			m.audio = nil
+		}
+	}
+	if m.open--; m.open > 0 {
+		return nil
+	}
+	err := m.failed
+	if err == nil {
+		err = m.flush(maxDuration)
+	}
+	m.queue = nil
+	if m.writer == nil {
+		// The containers holding a connection release it
+		if closer, ok := m.container.(io.Closer); ok {
+			closer.Close()
+		}
+		return err
+	}
+	if closeErr := m.writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// muxedTrack is the recordingWriter of a track muxed into a streamMuxer
+type muxedTrack struct {
+	muxer *streamMuxer
+	codec webrtc.RTPCodecCapability
+	clock rtpClock
+	// builder assembles the video frames, nil for the audio
+	builder *samplebuilder.SampleBuilder
+	// keyframes are the timestamps of the keyframes being assembled
+	keyframes map[uint32]bool
+	// ready is set once the size and codec data of the video are known,
+	// with the lock of the muxer held
+	ready         bool
+	width, height int
+	codecPrivate  []byte
+
+	started bool
+	// origin is when the first frame was sent from the muxer start,
+	// elapsed the RTP clock since
+	origin    time.Duration
+	timestamp uint32
+	elapsed   int64
+}
+
+func (t *muxedTrack) WriteRTP(packet *rtp.Packet) error {
+	if t.builder == nil {
+		return t.frame(packet.Timestamp, append([]byte(nil), packet.Payload...), true)
+	}
+	if isKeyframe(t.codec.MimeType, packet.Payload) {
+		t.keyframes[packet.Timestamp] = true
+	}
+	t.builder.Push(packet)
+	for sample := t.builder.Pop(); sample != nil; sample = t.builder.Pop() {
+		keyframe := t.keyframes[sample.PacketTimestamp]
+		delete(t.keyframes, sample.PacketTimestamp)
+		if err := t.frame(sample.PacketTimestamp, sample.Data, keyframe); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *muxedTrack) frame(timestamp uint32, data []byte, keyframe bool) error {
+	if t.builder != nil && keyframe && !t.ready {
+		var width, height int
+		var codecPrivate []byte
+		var ok bool
+		switch {
+		case strings.EqualFold(t.codec.MimeType, webrtc.MimeTypeVP8):
+			width, height, ok = vp8FrameSize(data)
+		case strings.EqualFold(t.codec.MimeType, webrtc.MimeTypeVP9):
+			width, height, ok = vp9FrameSize(data)
+		default:
+			codecPrivate, width, height, ok = avcDecoderConfiguration(data)
+		}
+		if ok {
+			t.muxer.describe(t, width, height, codecPrivate)
+		}
+	}
+	return t.muxer.push(muxFrame{track: t, at: t.at(timestamp), keyframe: keyframe, data: data})
+}
+
+// at times the frame sent at timestamp from the muxer start
+func (t *muxedTrack) at(timestamp uint32) time.Duration {
+	rate := float64(t.codec.ClockRate)
+	if !t.started {
+		t.started, t.timestamp = true, timestamp
+		t.origin = time.Since(t.muxer.start)
+		if t.clock != nil {
+			// The sender reports map the clocks of all the tracks of the
+			// publisher to its wall clock
+			if rtpTime, ok := t.clock.rtpTime(t.muxer.start); ok {
+				t.origin = time.Duration(float64(int32(timestamp-rtpTime)) / rate * float64(time.Second))
+			}
+		}
+	}
+	t.elapsed += int64(int32(timestamp - t.timestamp))
+	t.timestamp = timestamp
+	return t.origin + time.Duration(float64(t.elapsed)/rate*float64(time.Second))
+}
+
+func (t *muxedTrack) Close() error {
+	return t.muxer.closeTrack(t)
+}
@@ -0,0 +1,182 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// The Broadcaster is the polite peer: its offers wait for the exchange in
+// progress to complete and are rolled back when they collide with an offer
+// of the receiver, which goes first.
+
+const (
+	// DefaultOfferTimeout is how long receivers have to answer an offer
+	DefaultOfferTimeout = 10 * time.Second
+	// DefaultOfferRetries is how many times an unanswered offer is sent again
+	DefaultOfferRetries = 2
+)
+
+// SetOfferTimeout sets how long receivers have to answer an offer and how
+// many times it is sent again before they are dropped, a timeout of 0
+// waits forever
+func (s *Broadcaster) SetOfferTimeout(timeout time.Duration, retries int) {
+	s.do(func() {
+		s.offerTimeout = timeout
+		s.offerRetries = retries
+	})
+}
+
+// HandleAnswer applies the answer of a receiver to the last offer, then sends
+// the offer held back meanwhile, if any. Answers to offers rolled back since
+// are ignored.
+func (s *Broadcaster) HandleAnswer(id uuid.UUID, answer webrtc.SessionDescription) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		if receiver.Connection.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+			zap.S().Debugw("Ignoring answer without a pending offer", "receiver", id)
+			err = nil
+			return
+		}
+		err = receiver.Connection.SetRemoteDescription(answer)
+		if errors.Is(err, webrtc.ErrSessionDescriptionMissingIceUfrag) {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+		receiver.offerAttempts = 0
+		s.updateRepair(receiver)
+		if receiver.renegotiate {
+			s.sendOffer(id, &receiver)
+		}
+		s.receivers[id] = receiver
+	})
+	return err
+}
+
+// HandleOffer answers an offer of a receiver, rolling back the pending offer
+// of the Broadcaster on glare, which is sent again once the receiver offer
+// is answered
+func (s *Broadcaster) HandleOffer(id uuid.UUID, offer webrtc.SessionDescription) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		err = s.answerOffer(id, &receiver, offer)
+		if err == nil && receiver.renegotiate {
+			s.sendOffer(id, &receiver)
+		}
+		s.receivers[id] = receiver
+	})
+	return err
+}
+
+// RestartICE renegotiates the receiver with new ICE credentials, to recover
+// its connection after a failure while its signaling is still up
+func (s *Broadcaster) RestartICE(id uuid.UUID) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		// The pending offer carries the failed credentials
+		if receiver.Connection.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+			if err = rollback(receiver.Connection); err != nil {
+				return
+			}
+		}
+		receiver.restartICE = true
+		s.sendOffer(id, &receiver)
+		s.receivers[id] = receiver
+		err = nil
+	})
+	return err
+}
+
+// answerOffer runs the exchange of a receiver offer, it must run on the loop
+func (s *Broadcaster) answerOffer(id uuid.UUID, receiver *ReceiverState, offer webrtc.SessionDescription) error {
+	pc := receiver.Connection
+	if pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		zap.S().Debugw("Offer collision, rolling back", "receiver", id)
+		if err := rollback(pc); err != nil {
+			return err
+		}
+		receiver.renegotiate = true
+	}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err == nil {
+		err = pc.SetLocalDescription(answer)
+	}
+	if err != nil {
+		// Back to stable so that the next exchange can proceed
+		if rollbackErr := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); rollbackErr != nil {
+			zap.S().Warnw("Unable to roll back the receiver offer", "receiver", id, "error", rollbackErr)
+		}
+		return err
+	}
+
+	s.updateRepair(*receiver)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return SendEvent(ctx, receiver.Signaler, "answer", answer)
+}
+
+// watchOffer checks on the offer just sent once the offer timeout elapsed,
+// it must run on the loop
+func (s *Broadcaster) watchOffer(id uuid.UUID, receiver *ReceiverState) {
+	receiver.offerID++
+	if s.offerTimeout <= 0 {
+		return
+	}
+	offerID := receiver.offerID
+	time.AfterFunc(s.offerTimeout, func() {
+		s.do(func() {
+			s.offerTimedOut(id, offerID)
+		})
+	})
+}
+
+// offerTimedOut sends the offer again, or drops the receiver once out of
+// retries, unless it was answered or superseded. It must run on the loop.
+func (s *Broadcaster) offerTimedOut(id uuid.UUID, offerID uint64) {
+	receiver, ok := s.receivers[id]
+	if !ok || receiver.offerID != offerID || receiver.Connection.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return
+	}
+	receiver.offerAttempts++
+	if receiver.offerAttempts > s.offerRetries {
+		zap.S().Warnw("Receiver never answered, dropping it", "receiver", id, "attempts", receiver.offerAttempts)
+		s.removeReceiver(id, "offer not answered")
+		return
+	}
+	zap.S().Infow("Offer not answered, sending it again", "receiver", id, "attempt", receiver.offerAttempts)
+	if err := rollback(receiver.Connection); err != nil {
+		zap.S().Warnw("Unable to roll back the pending offer", "receiver", id, "error", err)
+	}
+	s.sendOffer(id, &receiver)
+	s.receivers[id] = receiver
+}
+
+// rollback discards the pending local offer of pc
+func rollback(pc *webrtc.PeerConnection) error {
+	return pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback})
+}
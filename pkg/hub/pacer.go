@@ -0,0 +1,170 @@
+package hub
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"go.uber.org/zap"
+)
+
+// Bounds of the pacer of a receiver connection
+const (
+	// pacerInterval is how often the queued packets are sent
+	pacerInterval = 5 * time.Millisecond
+	// pacerBurstTime is how much of its rate a pacer sends at once
+	pacerBurstTime = 10 * time.Millisecond
+	// pacerMinBurst lets a couple of full packets through at any rate
+	pacerMinBurst = 2 * 1500
+	// pacerMaxQueue is how many packets are queued before dropping
+	pacerMaxQueue = 1024
+)
+
+// Pacer spreads the packets sent to a receiver so that they never go over
+// its rate, packets are queued meanwhile and dropped when the queue is full
+type Pacer struct {
+	// rate is in bits per second, 0 sends the packets right away
+	rate  uint64
+	burst float64
+
+	lock   sync.Mutex
+	queue  []pacedPacket
+	tokens float64
+	last   time.Time
+	// peak is the deepest the queue got
+	peak    int
+	dropped atomic.Uint64
+}
+
+// pacedPacket is a packet waiting for its turn
+type pacedPacket struct {
+	writer     interceptor.RTPWriter
+	header     rtp.Header
+	payload    []byte
+	attributes interceptor.Attributes
+}
+
+// PacerStats describe the queue of a pacer
+type PacerStats struct {
+	// Rate is the ceiling in bits per second
+	Rate uint64 `json:"rateBps"`
+	// Queue is the number of packets waiting, Peak the most ever waiting
+	Queue   int    `json:"queue"`
+	Peak    int    `json:"peak"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// NewPacer sends at most rate bits per second, 0 disables pacing
+func NewPacer(rate uint64) *Pacer {
+	burst := float64(rate) / 8 * pacerBurstTime.Seconds()
+	if burst < pacerMinBurst {
+		burst = pacerMinBurst
+	}
+	return &Pacer{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Rate is the ceiling of the pacer in bits per second, 0 when unpaced
+func (p *Pacer) Rate() uint64 {
+	return p.rate
+}
+
+func (p *Pacer) Stats() PacerStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return PacerStats{Rate: p.rate, Queue: len(p.queue), Peak: p.peak, Dropped: p.dropped.Load()}
+}
+
+func (p *Pacer) enqueue(packet pacedPacket) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.queue) >= pacerMaxQueue {
+		p.dropped.Add(1)
+		return
+	}
+	p.queue = append(p.queue, packet)
+	if len(p.queue) > p.peak {
+		p.peak = len(p.queue)
+	}
+}
+
+// due takes the packets the bucket has tokens for at now
+func (p *Pacer) due(now time.Time) []pacedPacket {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.tokens += now.Sub(p.last).Seconds() * float64(p.rate) / 8
+	if p.tokens > p.burst {
+		p.tokens = p.burst
+	}
+	p.last = now
+	n := 0
+	for n < len(p.queue) {
+		size := float64(p.queue[n].header.MarshalSize() + len(p.queue[n].payload))
+		if size > p.tokens {
+			break
+		}
+		p.tokens -= size
+		n++
+	}
+	due := append([]pacedPacket(nil), p.queue[:n]...)
+	p.queue = p.queue[n:]
+	if len(p.queue) == 0 {
+		p.queue = nil
+	}
+	return due
+}
+
+// pacerInterceptor queues the packets of its connection in the pacer and
+// sends them as the rate allows
+type pacerInterceptor struct {
+	interceptor.NoOp
+	pacer *Pacer
+	close chan struct{}
+	once  sync.Once
+}
+
+type pacerInterceptorFactory struct {
+	pacer *Pacer
+}
+
+func (f *pacerInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	i := &pacerInterceptor{pacer: f.pacer, close: make(chan struct{})}
+	go i.loop()
+	return i, nil
+}
+
+func (i *pacerInterceptor) loop() {
+	ticker := time.NewTicker(pacerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.close:
+			return
+		case now := <-ticker.C:
+			for _, packet := range i.pacer.due(now) {
+				if _, err := packet.writer.Write(&packet.header, packet.payload, packet.attributes); err != nil {
+					zap.S().Debugw("Unable to send paced packet", "ssrc", packet.header.SSRC, "error", err)
+				}
+			}
+		}
+	}
+}
+
+func (i *pacerInterceptor) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		// The buffers are reused by the caller once Write returns
+		i.pacer.enqueue(pacedPacket{
+			writer:     writer,
+			header:     header.Clone(),
+			payload:    append([]byte(nil), payload...),
+			attributes: a,
+		})
+		return header.MarshalSize() + len(payload), nil
+	})
+}
+
+func (i *pacerInterceptor) Close() error {
+	i.once.Do(func() { close(i.close) })
+	return nil
+}
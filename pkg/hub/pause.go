@@ -0,0 +1,119 @@
+package hub
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// PauseTrack stops forwarding the track to the receiver but keeps its
+// transceiver, so that ResumeTrack does not need a renegotiation
+func (s *Broadcaster) PauseTrack(id uuid.UUID, key string) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		err = s.pauseTrack(&receiver, key)
+		s.receivers[id] = receiver
+	})
+	return err
+}
+
+// pauseTrack must run on the loop and the caller stores the receiver back
+func (s *Broadcaster) pauseTrack(receiver *ReceiverState, key string) error {
+	if _, ok := receiver.paused[key]; ok {
+		return nil
+	}
+	for _, sender := range receiver.Connection.GetSenders() {
+		track := sender.Track()
+		if track == nil || track.StreamID()+track.ID() != key || receiver.isReplayTrack(track) {
+			continue
+		}
+		if err := sender.ReplaceTrack(nil); err != nil {
+			return err
+		}
+		if receiver.paused == nil {
+			receiver.paused = make(map[string]*webrtc.RTPSender)
+		}
+		receiver.paused[key] = sender
+		return nil
+	}
+	return errors.New("track is not sent to the receiver")
+}
+
+// ResumeTrack forwards a paused track to the receiver again, a keyframe is
+// requested from the publisher so that the video recovers right away
+func (s *Broadcaster) ResumeTrack(id uuid.UUID, key string) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		err = s.resumeTrack(&receiver, key)
+		s.receivers[id] = receiver
+	})
+	return err
+}
+
+// resumeTrack must run on the loop and the caller stores the receiver back
+func (s *Broadcaster) resumeTrack(receiver *ReceiverState, key string) error {
+	sender, ok := receiver.paused[key]
+	if !ok {
+		return errors.New("track is not paused")
+	}
+	delete(receiver.paused, key)
+	track, ok := s.senders[key]
+	if !ok {
+		// The track went away while paused, the rebalance drops its transceiver
+		s.scheduleRebalance()
+		return nil
+	}
+	source := key
+	if selection, ok := receiver.layers[key]; ok {
+		track, source = selection.track, selection.keyframeSource(key)
+	}
+	if err := sender.ReplaceTrack(track); err != nil {
+		return err
+	}
+	s.requestKeyframe(source, keyframeResume)
+	return nil
+}
+
+// requestKeyframe sends a PLI to the publisher of the track, or over the
+// connection it is relayed from, unless one was just sent. The program track
+// forwards it to its source. It returns whether it was sent and must run on
+// the loop.
+func (s *Broadcaster) requestKeyframe(key string, reason keyframeReason) bool {
+	if key == programKey && s.program != nil {
+		active, pending := s.program.state()
+		if key = active; pending != "" {
+			key = pending
+		}
+	}
+	source, ok := s.sources[key]
+	if !ok || source.Kind() != webrtc.RTPCodecTypeVideo {
+		return false
+	}
+	peer := s.relays[key]
+	if publisher, ok := s.trackPublishers()[key]; ok {
+		peer = s.peerSender[publisher].PeerConn
+	}
+	if peer == nil || !s.keyframes.allow(key, reason, time.Now()) {
+		return false
+	}
+	if err := peer.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(source.SSRC())},
+	}); err != nil {
+		zap.S().Warnw("Unable to request a keyframe", "track", key, "error", err)
+	}
+	return true
+}
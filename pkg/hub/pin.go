@@ -0,0 +1,77 @@
+package hub
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// Pin forces a track, or every track of a publisher, onto a receiver
+// whatever the distribution, subscriptions and track limits decide
+type Pin struct {
+	// Track is the key of a track, its stream ID followed by its ID
+	Track string `json:"track,omitempty"`
+	// Publisher is the ID of a publisher session
+	Publisher uuid.UUID `json:"publisher,omitempty"`
+}
+
+// Pin adds pin to the receiver, pinning the same track twice is a no-op
+func (s *Broadcaster) Pin(id uuid.UUID, pin Pin) error {
+	if (pin.Track == "") == (pin.Publisher == uuid.Nil) {
+		return errors.New("a pin needs either a track or a publisher")
+	}
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		err = nil
+		for _, existing := range receiver.pins {
+			if existing == pin {
+				return
+			}
+		}
+		receiver.pins = append(receiver.pins, pin)
+		s.receivers[id] = receiver
+		s.scheduleRebalance()
+	})
+	return err
+}
+
+// Unpin removes the pins of the receiver, its tracks are left to the
+// distribution again
+func (s *Broadcaster) Unpin(id uuid.UUID) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		receiver.pins = nil
+		s.receivers[id] = receiver
+		s.scheduleRebalance()
+		err = nil
+	})
+	return err
+}
+
+// applyPins adds the pinned tracks to the assignment of their receivers, it
+// must run on the loop
+func (s *Broadcaster) applyPins(match map[uuid.UUID]map[string]bool, tracks []Track) {
+	for u, receiver := range s.receivers {
+		for _, pin := range receiver.pins {
+			for _, track := range tracks {
+				if track.Key != pin.Track && (pin.Publisher == uuid.Nil || track.PublisherID != pin.Publisher) {
+					continue
+				}
+				if match[u] == nil {
+					match[u] = make(map[string]bool)
+				}
+				match[u][track.Key] = true
+			}
+		}
+	}
+}
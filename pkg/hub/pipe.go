@@ -0,0 +1,439 @@
+package hub
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// pipeStopTimeout is how long a pipeline is given to finalize its output
+// at each step of its stop, before it is interrupted then killed
+const pipeStopTimeout = 5 * time.Second
+
+// pipeOutputTail is how much of the last output of a pipeline its failure
+// quotes
+const pipeOutputTail = 512
+
+// PipeEgress is an external pipeline, such as ffmpeg or GStreamer, a
+// stream is pushed to for the transcodes and the outputs the hub does not
+// have
+type PipeEgress struct {
+	Name string
+	// Command runs the pipeline, without a shell. It reads the stream as
+	// MPEG-TS on its standard input, H264 and Opus only, unless an argument
+	// holds {sdp}: it is replaced by the path of a session description of
+	// the tracks sent as RTP to localhost, any codec. {stream} is replaced
+	// by the stream ID made safe for file names.
+	Command []string
+}
+
+func (p PipeEgress) rtp() bool {
+	for _, arg := range p.Command {
+		if strings.Contains(arg, "{sdp}") {
+			return true
+		}
+	}
+	return false
+}
+
+// StartPipeEgress runs pipeline fed with streamID until the egress is
+// stopped or the stream goes away. Its standard input is then closed and
+// it is interrupted, the Broadcaster closes once it exited.
+func (s *Broadcaster) StartPipeEgress(streamID string, pipeline PipeEgress) (EgressInfo, error) {
+	if s.opaque() {
+		return EgressInfo{}, errors.New("end-to-end encrypted media cannot be pushed out")
+	}
+	if len(pipeline.Command) == 0 {
+		return EgressInfo{}, errors.New("pipeline has no command")
+	}
+	if pipeline.rtp() {
+		return s.pipeRTP(streamID, pipeline)
+	}
+	if err := s.checkPublished(streamID); err != nil {
+		return EgressInfo{}, err
+	}
+	process, err := s.startPipeProcess(pipeline, streamID, "")
+	if err != nil {
+		return EgressInfo{}, err
+	}
+	return s.pushOut(streamID, "pipe", "pipe:"+pipeline.Name, process)
+}
+
+// pipeRTP sends the tracks of streamID as RTP to the ports of the session
+// description of the pipeline it starts
+func (s *Broadcaster) pipeRTP(streamID string, pipeline PipeEgress) (EgressInfo, error) {
+	medias, err := s.streamMedia(streamID)
+	if err != nil {
+		return EgressInfo{}, err
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return EgressInfo{}, err
+	}
+	destination := &pipeRTPDestination{conn: conn, tracks: make(map[string]*pipeRTPTrack), done: make(chan struct{})}
+	sdp := &strings.Builder{}
+	fmt.Fprintf(sdp, "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=%s\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n", streamID)
+	for i, media := range medias {
+		port, err := freeUDPPortPair()
+		if err != nil {
+			conn.Close()
+			return EgressInfo{}, err
+		}
+		writeSDPMedia(sdp, media.codec, rtspPayloadType+i, port)
+		track := &pipeRTPTrack{
+			key:         media.key,
+			destination: destination,
+			payloadType: uint8(rtspPayloadType + i),
+			rtp:         &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+			rtcp:        &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port + 1},
+		}
+		track.stream.clockRate = float64(media.codec.ClockRate)
+		destination.tracks[media.key] = track
+	}
+	file, err := os.CreateTemp("", "pipe-egress-*.sdp")
+	if err != nil {
+		conn.Close()
+		return EgressInfo{}, err
+	}
+	_, err = file.WriteString(sdp.String())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		conn.Close()
+		return EgressInfo{}, err
+	}
+	process, err := s.startPipeProcess(pipeline, streamID, file.Name())
+	if err != nil {
+		os.Remove(file.Name())
+		conn.Close()
+		return EgressInfo{}, err
+	}
+	destination.process = process
+
+	session := newEgressSession(streamID, "pipe", "pipe:"+pipeline.Name, process.failure)
+	session.sink = func(key string, codec webrtc.RTPCodecCapability) (egressSink, error) {
+		track, ok := destination.tracks[key]
+		if !ok {
+			return nil, errors.New("track published after the pipeline started")
+		}
+		track.clock = s.trackClock(key, nil)
+		destination.attach(track)
+		s.requestKeyframe(key, keyframeEgress)
+		return track, nil
+	}
+	go destination.run(s)
+	return s.startEgressSession(session, destination)
+}
+
+// freeUDPPortPair finds an even port of localhost free along with the
+// next one, for RTP and RTCP. They may be taken again before the pipeline
+// listens.
+func freeUDPPortPair() (int, error) {
+	for attempt := 0; attempt < 16; attempt++ {
+		rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return 0, err
+		}
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+		if port%2 != 0 {
+			rtp.Close()
+			continue
+		}
+		rtcp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port + 1})
+		rtp.Close()
+		if err != nil {
+			continue
+		}
+		rtcp.Close()
+		return port, nil
+	}
+	return 0, errors.New("no free UDP port pair")
+}
+
+// pipeProcess is a running pipeline, a destination its standard input is
+// the MPEG-TS output of
+type pipeProcess struct {
+	name   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	output *tailBuffer
+	// exited is closed once the process exited for err
+	exited chan struct{}
+	err    error
+	once   sync.Once
+}
+
+// startPipeProcess runs pipeline for streamID, reading the session
+// description sdp which is removed once it exits, or its standard input
+// when sdp is empty
+func (s *Broadcaster) startPipeProcess(pipeline PipeEgress, streamID string, sdp string) (*pipeProcess, error) {
+	args := make([]string, len(pipeline.Command))
+	for i, arg := range pipeline.Command {
+		arg = strings.ReplaceAll(arg, "{stream}", sanitizeFileName(streamID))
+		args[i] = strings.ReplaceAll(arg, "{sdp}", sdp)
+	}
+	p := &pipeProcess{
+		name:   pipeline.Name,
+		cmd:    exec.Command(args[0], args[1:]...),
+		output: &tailBuffer{size: pipeOutputTail},
+		exited: make(chan struct{}),
+	}
+	p.cmd.Stdout, p.cmd.Stderr = p.output, p.output
+	if sdp == "" {
+		stdin, err := p.cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		p.stdin = stdin
+	}
+	if err := p.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEgressUnreachable, err)
+	}
+	zap.S().Infow("Pipeline started", "pipeline", pipeline.Name, "streamID", streamID, "pid", p.cmd.Process.Pid)
+	s.completing.Add(1)
+	go func() {
+		defer s.completing.Done()
+		err := p.cmd.Wait()
+		if err == nil {
+			err = errors.New("exited")
+		}
+		p.err = fmt.Errorf("pipeline %s %v: %s", pipeline.Name, err, p.output.String())
+		if sdp != "" {
+			os.Remove(sdp)
+		}
+		close(p.exited)
+		zap.S().Infow("Pipeline exited", "pipeline", pipeline.Name, "streamID", streamID, "error", err)
+	}()
+	return p, nil
+}
+
+// accepts the codecs MPEG-TS carries
+func (p *pipeProcess) accepts(mimeType string) bool {
+	return tsAccepts(mimeType)
+}
+
+// create muxes the tracks into MPEG-TS written to the standard input
+func (p *pipeProcess) create(tracks []mediaTrack, date time.Time) (frameWriter, error) {
+	return &pipeWriter{tsWriter: newTSWriter(p.stdin, tracks), process: p}, nil
+}
+
+// failure tells how the process exited, nil while it runs
+func (p *pipeProcess) failure() error {
+	select {
+	case <-p.exited:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+// Close closes the standard input for the process to finish its output,
+// and interrupts then kills it when it does not exit in time
+func (p *pipeProcess) Close() error {
+	p.once.Do(func() {
+		go func() {
+			if p.stdin != nil {
+				p.stdin.Close()
+				if p.wait(pipeStopTimeout) {
+					return
+				}
+			}
+			// Both ffmpeg and gst-launch -e finish their output on SIGINT
+			p.cmd.Process.Signal(os.Interrupt)
+			if !p.wait(pipeStopTimeout) {
+				p.cmd.Process.Kill()
+			}
+		}()
+	})
+	return nil
+}
+
+// wait tells whether the process exits within timeout
+func (p *pipeProcess) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.exited:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// pipeWriter stops its process with the output
+type pipeWriter struct {
+	*tsWriter
+	process *pipeProcess
+}
+
+func (w *pipeWriter) Close() error {
+	return w.process.Close()
+}
+
+// tailBuffer keeps the last size bytes written to it
+type tailBuffer struct {
+	size int
+	lock sync.Mutex
+	data []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.data = append(t.data, p...)
+	if len(t.data) > t.size {
+		t.data = append([]byte(nil), t.data[len(t.data)-t.size:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return strings.TrimSpace(string(t.data))
+}
+
+// pipeRTPDestination sends the tracks of a pipeline over UDP with their
+// sender reports, the process is stopped once they are all closed
+type pipeRTPDestination struct {
+	conn    *net.UDPConn
+	process *pipeProcess
+	// tracks are set before the process starts
+	tracks map[string]*pipeRTPTrack
+
+	lock     sync.Mutex
+	attached map[*pipeRTPTrack]bool
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (d *pipeRTPDestination) attach(track *pipeRTPTrack) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.attached == nil {
+		d.attached = make(map[*pipeRTPTrack]bool)
+	}
+	d.attached[track] = true
+}
+
+// detach closes the destination with its last track
+func (d *pipeRTPDestination) detach(track *pipeRTPTrack) {
+	d.lock.Lock()
+	delete(d.attached, track)
+	last := len(d.attached) == 0
+	d.lock.Unlock()
+	if last {
+		d.Close()
+	}
+}
+
+// run sends the sender reports of the tracks and asks for keyframes at
+// egressKeyframeInterval, the pipelines copying the video need them
+func (d *pipeRTPDestination) run(s *Broadcaster) {
+	reports := time.NewTicker(senderReportInterval)
+	defer reports.Stop()
+	keyframes := time.NewTicker(egressKeyframeInterval)
+	defer keyframes.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case now := <-reports.C:
+			d.lock.Lock()
+			for track := range d.attached {
+				track.stream.lock.Lock()
+				sent := track.stream.packets > 0
+				track.stream.lock.Unlock()
+				if !sent {
+					continue
+				}
+				if report, err := track.stream.report(now, track.clock).Marshal(); err == nil {
+					d.conn.WriteToUDP(report, track.rtcp)
+				}
+			}
+			d.lock.Unlock()
+		case <-keyframes.C:
+			d.lock.Lock()
+			keys := make([]string, 0, len(d.attached))
+			for track := range d.attached {
+				keys = append(keys, track.key)
+			}
+			d.lock.Unlock()
+			go s.do(func() {
+				for _, key := range keys {
+					s.requestKeyframe(key, keyframeEgress)
+				}
+			})
+		}
+	}
+}
+
+// Close stops the process and releases the socket
+func (d *pipeRTPDestination) Close() error {
+	d.once.Do(func() {
+		close(d.done)
+		d.conn.Close()
+		d.process.Close()
+	})
+	return nil
+}
+
+// pipeRTPTrack is the sink of a track sent to a pipeline
+type pipeRTPTrack struct {
+	key         string
+	destination *pipeRTPDestination
+	payloadType uint8
+	rtp, rtcp   *net.UDPAddr
+	clock       rtpClock
+	stream      reportedStream
+	dropped     atomic.Uint64
+	closed      atomic.Bool
+}
+
+func (t *pipeRTPTrack) WriteRTP(packet []byte) error {
+	if t.closed.Load() {
+		return errors.New("pipeline track closed")
+	}
+	if len(packet) < 12 {
+		return nil
+	}
+	p := make([]byte, len(packet))
+	copy(p, packet)
+	p[1] = p[1]&0x80 | t.payloadType
+	t.stream.lock.Lock()
+	t.stream.ssrc = binary.BigEndian.Uint32(p[8:])
+	t.stream.lastRTP, t.stream.lastSent = binary.BigEndian.Uint32(p[4:]), time.Now()
+	t.stream.packets++
+	t.stream.octets += uint32(len(p) - 12)
+	t.stream.lock.Unlock()
+	// The pipeline may not listen yet or anymore, UDP goes on regardless
+	if _, err := t.destination.conn.WriteToUDP(p, t.rtp); err != nil {
+		t.dropped.Add(1)
+	}
+	return nil
+}
+
+func (t *pipeRTPTrack) droppedPackets() uint64 {
+	return t.dropped.Load()
+}
+
+// Close is called once the track is removed or the egress stopped
+func (t *pipeRTPTrack) Close() error {
+	if !t.closed.Swap(true) {
+		t.destination.detach(t)
+	}
+	return nil
+}
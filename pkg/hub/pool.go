@@ -0,0 +1,35 @@
+package hub
+
+import "sync"
+
+// packetBuffers pools the read buffers of the forwarding loops by size, so
+// that tracks coming and going do not each allocate their own
+var packetBuffers = struct {
+	lock  sync.Mutex
+	pools map[int]*sync.Pool
+}{pools: make(map[int]*sync.Pool)}
+
+// getPacketBuffer returns a buffer of size bytes, to be given back with
+// putPacketBuffer once nothing references it anymore
+func getPacketBuffer(size int) *[]byte {
+	packetBuffers.lock.Lock()
+	pool, ok := packetBuffers.pools[size]
+	if !ok {
+		pool = &sync.Pool{New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}}
+		packetBuffers.pools[size] = pool
+	}
+	packetBuffers.lock.Unlock()
+	return pool.Get().(*[]byte)
+}
+
+func putPacketBuffer(buf *[]byte) {
+	packetBuffers.lock.Lock()
+	pool, ok := packetBuffers.pools[len(*buf)]
+	packetBuffers.lock.Unlock()
+	if ok {
+		pool.Put(buf)
+	}
+}
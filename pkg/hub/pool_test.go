@@ -0,0 +1,67 @@
+package hub
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// signalingSink closes done once it got count packets
+type signalingSink struct {
+	count    int64
+	received atomic.Int64
+	done     chan struct{}
+}
+
+func (s *signalingSink) WriteRTP(packet []byte) error {
+	if s.received.Add(1) == s.count {
+		close(s.done)
+	}
+	return nil
+}
+
+func (s *signalingSink) Close() error { return nil }
+
+// BenchmarkForwardIngest forwards packets written to an ingested track
+// through addSender, with its pooled read buffer and reused packet, to a
+// sink. An op is a packet, from its write to the ingest to its delivery,
+// the ingest marshalling it is the one allocation expected.
+func BenchmarkForwardIngest(b *testing.B) {
+	broadcaster := NewBroadcaster(nil)
+	defer broadcaster.Close()
+	track := NewIngestTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "stream")
+	defer track.Close()
+	if broadcaster.AddIngestSender(track) == nil {
+		b.Fatal("the sender was not added")
+	}
+	sink := &signalingSink{count: int64(b.N), done: make(chan struct{})}
+	if !broadcaster.AddSink("stream"+"video", sink) {
+		b.Fatal("the sink was not added")
+	}
+	packet := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, Marker: true},
+		Payload: make([]byte, 1100),
+	}
+	if err := packet.SetExtension(1, []byte{0x01, 0x02, 0x03}); err != nil {
+		b.Fatal(err)
+	}
+	at := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		packet.SequenceNumber = uint16(n)
+		packet.Timestamp = uint32(n * 3000)
+		if err := track.WriteRTP(packet, at.Add(time.Duration(n)*time.Second/30)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	select {
+	case <-sink.done:
+	case <-time.After(10 * time.Second):
+		b.Fatalf("%d packets forwarded out of %d", sink.received.Load(), b.N)
+	}
+}
@@ -0,0 +1,88 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The roles of the sessions presence events report
+const (
+	RolePublisher = "publisher"
+	RoleViewer    = "viewer"
+)
+
+// PresenceChange is a session joining or leaving the room
+type PresenceChange struct {
+	Role string `json:"role"`
+	// Label is the label of publishers, if they gave one
+	Label string `json:"label,omitempty"`
+}
+
+// Presence is sent in presence events to every receiver and on the room
+// event stream. The changes since the previous event are batched along
+// with the counts of publishers and viewers, WHEP sessions included.
+type Presence struct {
+	Joined     []PresenceChange `json:"joined,omitempty"`
+	Left       []PresenceChange `json:"left,omitempty"`
+	Publishers int              `json:"publishers"`
+	Viewers    int              `json:"viewers"`
+}
+
+// joined notes a session joining for the next presence event, it must run
+// on the loop
+func (s *Broadcaster) joined(role string, label string) {
+	s.pendingPresence.Joined = append(s.pendingPresence.Joined, PresenceChange{Role: role, Label: label})
+	s.scheduleRebalance()
+}
+
+// left notes a session leaving for the next presence event, it must run on
+// the loop
+func (s *Broadcaster) left(role string, label string) {
+	s.pendingPresence.Left = append(s.pendingPresence.Left, PresenceChange{Role: role, Label: label})
+	s.scheduleRebalance()
+}
+
+// Presence counts the publishers and the viewers
+func (s *Broadcaster) Presence() Presence {
+	presence := Presence{}
+	s.do(func() {
+		presence = s.presence()
+	})
+	return presence
+}
+
+func (s *Broadcaster) presence() Presence {
+	return Presence{
+		Publishers: len(s.peerSender),
+		Viewers:    len(s.receivers) + len(s.whepSessions),
+	}
+}
+
+// flushPresence sends the presence event for the changes noted since the
+// last one, it runs on the loop along with the rebalances
+func (s *Broadcaster) flushPresence() {
+	if len(s.pendingPresence.Joined) == 0 && len(s.pendingPresence.Left) == 0 {
+		return
+	}
+	presence := s.presence()
+	presence.Joined = s.pendingPresence.Joined
+	presence.Left = s.pendingPresence.Left
+	s.pendingPresence = Presence{}
+
+	encoded, err := json.Marshal(presence)
+	if err != nil {
+		zap.S().Errorw("Unable to encode presence", "error", err)
+		return
+	}
+	s.events.Publish("presence", string(encoded))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for u, receiver := range s.receivers {
+		if err := receiver.Signaler.Send(ctx, Message{Event: "presence", Data: string(encoded)}); err != nil {
+			zap.S().Debugw("Unable to send presence", "receiver", u, "error", err)
+		}
+	}
+}
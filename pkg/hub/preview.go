@@ -0,0 +1,108 @@
+package hub
+
+import (
+	"errors"
+	"image"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// previewKeyframeInterval is how often the previews ask their publisher
+// for a keyframe, their decoders recover from the losses on them
+const previewKeyframeInterval = 5 * time.Second
+
+// ErrNoVideo is returned for the streams without a video track that can
+// be decoded
+var ErrNoVideo = errors.New("no VP8, VP9 or H264 video track")
+
+// PreviewCodec builds the video decoders of the previews
+type PreviewCodec interface {
+	// NewDecoder decodes a track of mimeType into pictures of width by
+	// height, letterboxed
+	NewDecoder(mimeType string, width, height int) (VideoDecoder, error)
+}
+
+// Preview decodes the video of a stream until closed, for the clients
+// which can neither take WebRTC nor HLS
+type Preview struct {
+	broadcaster *Broadcaster
+	key         string
+	writer      *videoDecodingWriter
+	recorder    *trackRecorder
+}
+
+// EnablePreviews lets Preview decode the video of the streams with codec
+func (s *Broadcaster) EnablePreviews(codec PreviewCodec) {
+	s.do(func() {
+		s.previewCodec = codec
+	})
+}
+
+// Preview decodes the first video track of streamID into pictures of width
+// by height
+func (s *Broadcaster) Preview(streamID string, width, height int) (*Preview, error) {
+	var preview *Preview
+	published := false
+	var codec PreviewCodec
+	if !s.do(func() {
+		if codec = s.previewCodec; codec == nil {
+			return
+		}
+		for _, key := range s.streamKeys(streamID) {
+			published = true
+			local, ok := s.senders[key].(*webrtc.TrackLocalStaticRTP)
+			if !ok || local.Kind() != webrtc.RTPCodecTypeVideo {
+				continue
+			}
+			capability := local.Codec()
+			writer := newVideoDecodingWriter(key, capability, func() (VideoDecoder, error) {
+				return codec.NewDecoder(capability.MimeType, width, height)
+			})
+			if writer == nil {
+				continue
+			}
+			key := key
+			recorder := newTrackRecorder(streamID, capability.MimeType, writer, func() {
+				go s.do(func() { s.requestKeyframe(key, keyframeSubscriber) })
+			})
+			recorder.keyframeInterval = previewKeyframeInterval
+			s.sinkLock.Lock()
+			if _, ok := s.sinks[key]; !ok {
+				s.sinks[key] = make(map[TrackSink]bool)
+			}
+			s.sinks[key][recorder] = true
+			s.sinkLock.Unlock()
+			preview = &Preview{broadcaster: s, key: key, writer: writer, recorder: recorder}
+			return
+		}
+	}) {
+		return nil, errClosed
+	}
+	if codec == nil {
+		return nil, errors.New("previews are not enabled")
+	}
+	if !published {
+		return nil, ErrUnknownStream
+	}
+	if preview == nil {
+		return nil, ErrNoVideo
+	}
+	return preview, nil
+}
+
+// Picture is the last picture decoded, nil until the first keyframe
+func (p *Preview) Picture() image.Image {
+	return p.writer.picture()
+}
+
+// Done is closed once the track is removed
+func (p *Preview) Done() <-chan struct{} {
+	return p.writer.done
+}
+
+// Close stops decoding the track
+func (p *Preview) Close() {
+	p.broadcaster.RemoveSink(p.key, p.recorder)
+	p.recorder.Close()
+}
@@ -0,0 +1,263 @@
+package hub
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// ProgramStreamID is the stream of the program track sent in program mode
+	ProgramStreamID = "program"
+	programTrackID  = "video"
+	programKey      = ProgramStreamID + programTrackID
+)
+
+// ProgramState describes the program track in program mode
+type ProgramState struct {
+	// Source is the key of the track on air
+	Source string `json:"source"`
+	// Pending is the source waiting for a keyframe to go on air
+	Pending string `json:"pending,omitempty"`
+	// Sources are the tracks that can be switched to
+	Sources []string `json:"sources"`
+}
+
+// program puts one source at a time on the program track so that receivers
+// see a single continuous video while the source changes
+type program struct {
+	switcher
+
+	// sinks are the source tracks the program listens to
+	sinks map[string]*switcherSink
+}
+
+// EnableProgram switches the Broadcaster to program mode: every receiver
+// gets the program track alone, its source is picked with SwitchProgram
+func (s *Broadcaster) EnableProgram() {
+	s.do(func() {
+		if s.program != nil {
+			return
+		}
+		s.program = &program{sinks: make(map[string]*switcherSink)}
+		s.program.switcher.opaque = s.opaque()
+		s.scheduleRebalance()
+	})
+}
+
+// SwitchProgram puts the video track key on air, the switch happens on its
+// next keyframe which is requested right away
+func (s *Broadcaster) SwitchProgram(key string) error {
+	err := errClosed
+	s.do(func() {
+		if s.program == nil {
+			err = errors.New("program mode is not enabled")
+			return
+		}
+		s.updateProgram()
+		if _, ok := s.program.sinks[key]; !ok {
+			err = errors.New("not a program source")
+			return
+		}
+		s.program.switchTo(key)
+		// A switch waits for the keyframe, whatever was requested before
+		s.keyframes.reset(key)
+		s.requestKeyframe(key, keyframeSwitch)
+		err = nil
+	})
+	return err
+}
+
+// ProgramState describes the program, it returns false outside of program mode
+func (s *Broadcaster) ProgramState() (ProgramState, bool) {
+	state := ProgramState{Sources: []string{}}
+	enabled := false
+	s.do(func() {
+		if s.program == nil {
+			return
+		}
+		enabled = true
+		state.Source, state.Pending = s.program.state()
+		for key := range s.program.sinks {
+			state.Sources = append(state.Sources, key)
+		}
+		sort.Strings(state.Sources)
+	})
+	return state, enabled
+}
+
+// updateProgram creates the program track from the first video source and
+// listens to the video tracks sharing its codec, putting one on air when
+// the program has no source left. It must run on the loop.
+func (s *Broadcaster) updateProgram() {
+	keys := []string{}
+	for key, track := range s.senders {
+		if key == programKey || track.Kind() != webrtc.RTPCodecTypeVideo || s.isSpareLayer(key) {
+			continue
+		}
+		if _, ok := track.(*webrtc.TrackLocalStaticRTP); ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 && s.program.track == nil {
+		return
+	}
+	sort.Strings(keys)
+
+	if s.program.track == nil {
+		codec := s.senders[keys[0]].(*webrtc.TrackLocalStaticRTP).Codec()
+		track, err := webrtc.NewTrackLocalStaticRTP(codec, programTrackID, ProgramStreamID)
+		if err != nil {
+			zap.S().Errorw("Unable to create the program track", "error", err)
+			return
+		}
+		s.program.track = track
+		s.senders[programKey] = track
+		s.notifyTrackWatchers()
+	}
+
+	mimeType := s.program.track.Codec().MimeType
+	// The sinks of removed tracks were closed along with them
+	for key := range s.program.sinks {
+		if _, ok := s.senders[key]; !ok {
+			delete(s.program.sinks, key)
+		}
+	}
+	s.sinkLock.Lock()
+	for _, key := range keys {
+		codec := s.senders[key].(*webrtc.TrackLocalStaticRTP).Codec()
+		if _, ok := s.program.sinks[key]; ok || !strings.EqualFold(codec.MimeType, mimeType) {
+			continue
+		}
+		sink := &switcherSink{switcher: &s.program.switcher, key: key, mimeType: mimeType}
+		s.program.sinks[key] = sink
+		if _, ok := s.sinks[key]; !ok {
+			s.sinks[key] = make(map[TrackSink]bool)
+		}
+		s.sinks[key][sink] = true
+	}
+	s.sinkLock.Unlock()
+
+	active, pending := s.program.state()
+	if _, ok := s.program.sinks[active]; !ok && pending == "" {
+		for _, key := range keys {
+			if _, ok := s.program.sinks[key]; ok {
+				s.program.switchTo(key)
+				s.requestKeyframe(key, keyframeSwitch)
+				break
+			}
+		}
+	}
+}
+
+// programAssignment gives the program track to every receiver, it must run
+// on the loop
+func (s *Broadcaster) programAssignment() map[uuid.UUID]map[string]bool {
+	match := make(map[uuid.UUID]map[string]bool)
+	for u := range s.receivers {
+		match[u] = make(map[string]bool)
+		if s.program.track != nil {
+			match[u][programKey] = true
+		}
+	}
+	return match
+}
+
+// isKeyframe tells whether an RTP payload starts a keyframe. Codecs it
+// cannot parse are always switched right away.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		return isAV1Keyframe(payload)
+	}
+	return true
+}
+
+func isVP8Keyframe(payload []byte) bool {
+	offset, ok := vp8HeaderOffset(payload)
+	// The P bit of the VP8 frame header is 0 on keyframes
+	return ok && len(payload) > offset && payload[offset]&0x01 == 0
+}
+
+// vp8HeaderOffset skips the payload descriptor of a packet starting a VP8
+// frame, it returns false for other packets
+func vp8HeaderOffset(payload []byte) (int, bool) {
+	if len(payload) < 1 {
+		return 0, false
+	}
+	// Start of partition 0 only
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return 0, false
+	}
+	offset := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return 0, false
+		}
+		extension := payload[1]
+		offset++
+		if extension&0x80 != 0 {
+			if len(payload) <= offset {
+				return 0, false
+			}
+			if payload[offset]&0x80 != 0 {
+				offset += 2
+			} else {
+				offset++
+			}
+		}
+		if extension&0x40 != 0 {
+			offset++
+		}
+		if extension&0x30 != 0 {
+			offset++
+		}
+	}
+	return offset, true
+}
+
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	isKey := func(nalType byte) bool {
+		// IDR slice or SPS, which precedes the IDR slice
+		return nalType == 5 || nalType == 7
+	}
+	switch nalType := payload[0] & 0x1F; nalType {
+	case 24: // STAP-A
+		for offset := 1; offset+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[offset:]))
+			if isKey(payload[offset+2] & 0x1F) {
+				return true
+			}
+			offset += 2 + size
+		}
+		return false
+	case 28: // FU-A
+		return len(payload) > 1 && payload[1]&0x80 != 0 && isKey(payload[1]&0x1F)
+	default:
+		return isKey(nalType)
+	}
+}
+
+func isVP9Keyframe(payload []byte) bool {
+	// Start of a frame (B bit) that is not inter-picture predicted (P bit)
+	return len(payload) > 0 && payload[0]&0x08 != 0 && payload[0]&0x40 == 0
+}
+
+func isAV1Keyframe(payload []byte) bool {
+	// The N bit of the aggregation header starts a coded video sequence
+	return len(payload) > 0 && payload[0]&0x08 != 0
+}
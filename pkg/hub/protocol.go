@@ -0,0 +1,99 @@
+package hub
+
+import (
+	"encoding/json"
+	"strings"
+
+	"nhooyr.io/websocket"
+)
+
+// The websocket subprotocols of the receiver signaling. Clients offering the
+// unversioned one speak v1.
+const (
+	// SubprotocolV1 carries the data of the messages as a JSON encoded string
+	SubprotocolV1 = "webRTCBroadcast.v1"
+	// SubprotocolV2 carries the data of the messages as a JSON value
+	SubprotocolV2 = "webRTCBroadcast.v2"
+	// SubprotocolProto carries the protobuf messages of signaling.proto in
+	// binary frames
+	SubprotocolProto = "webRTCBroadcast.proto"
+
+	legacySubprotocol = "webRTCBroadcast"
+)
+
+// Subprotocols are the signaling subprotocols accepted, the preferred first
+var Subprotocols = []string{SubprotocolProto, SubprotocolV2, SubprotocolV1, legacySubprotocol}
+
+// wireCodec maps the messages to the schema of a subprotocol
+type wireCodec interface {
+	messageType() websocket.MessageType
+	encode(message Message) ([]byte, error)
+	decode(raw []byte) (Message, error)
+}
+
+// codecFor returns the codec of the negotiated subprotocol
+func codecFor(subprotocol string) wireCodec {
+	switch {
+	case strings.EqualFold(subprotocol, SubprotocolProto):
+		return protoCodec{}
+	case strings.EqualFold(subprotocol, SubprotocolV2):
+		return v2Codec{}
+	}
+	return v1Codec{}
+}
+
+type v1Codec struct{}
+
+func (v1Codec) messageType() websocket.MessageType {
+	return websocket.MessageText
+}
+
+func (v1Codec) encode(message Message) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (v1Codec) decode(raw []byte) (Message, error) {
+	message := Message{}
+	err := json.Unmarshal(raw, &message)
+	return message, err
+}
+
+// v2Codec inlines the data of the messages when it is valid JSON and sends
+// it as a string otherwise, strings are decoded back to their content
+type v2Codec struct{}
+
+func (v2Codec) messageType() websocket.MessageType {
+	return websocket.MessageText
+}
+
+type v2Message struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+func (v2Codec) encode(message Message) ([]byte, error) {
+	wire := v2Message{Event: message.Event}
+	if json.Valid([]byte(message.Data)) {
+		wire.Data = json.RawMessage(message.Data)
+	} else if message.Data != "" {
+		encoded, err := json.Marshal(message.Data)
+		if err != nil {
+			return nil, err
+		}
+		wire.Data = encoded
+	}
+	return json.Marshal(wire)
+}
+
+func (v2Codec) decode(raw []byte) (Message, error) {
+	wire := v2Message{}
+	if err := json.Unmarshal(raw, &wire); err != nil {
+		return Message{}, err
+	}
+	message := Message{Event: wire.Event, Data: string(wire.Data)}
+	var text string
+	if json.Unmarshal(wire.Data, &text) == nil {
+		message.Data = text
+	}
+	return message, nil
+}
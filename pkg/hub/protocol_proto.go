@@ -0,0 +1,216 @@
+package hub
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+	"nhooyr.io/websocket"
+)
+
+// protoCodec speaks the protobuf schema of signaling.proto. It is written
+// against the wire format directly, the schema being small and stable.
+type protoCodec struct{}
+
+// The fields of SignalingMessage
+const (
+	protoOffer       = 1
+	protoAnswer      = 2
+	protoCandidate   = 3
+	protoSubscribe   = 4
+	protoUnsubscribe = 5
+	protoGeneric     = 15
+)
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoMalformed = errors.New("malformed protobuf signaling message")
+
+func (protoCodec) messageType() websocket.MessageType {
+	return websocket.MessageBinary
+}
+
+func (protoCodec) encode(message Message) ([]byte, error) {
+	switch message.Event {
+	case "offer", "answer":
+		description := webrtc.SessionDescription{}
+		if err := json.Unmarshal([]byte(message.Data), &description); err != nil {
+			return nil, err
+		}
+		field := protoOffer
+		if message.Event == "answer" {
+			field = protoAnswer
+		}
+		return appendProtoBytes(nil, field, appendProtoString(nil, 1, description.SDP)), nil
+	case "candidate":
+		candidate := webrtc.ICECandidateInit{}
+		if err := json.Unmarshal([]byte(message.Data), &candidate); err != nil {
+			return nil, err
+		}
+		encoded := appendProtoString(nil, 1, candidate.Candidate)
+		if candidate.SDPMid != nil {
+			encoded = appendProtoString(encoded, 2, *candidate.SDPMid)
+		}
+		if candidate.SDPMLineIndex != nil {
+			encoded = appendProtoVarint(encoded, 3, uint64(*candidate.SDPMLineIndex))
+		}
+		if candidate.UsernameFragment != nil {
+			encoded = appendProtoString(encoded, 4, *candidate.UsernameFragment)
+		}
+		return appendProtoBytes(nil, protoCandidate, encoded), nil
+	case "subscribe":
+		return appendProtoString(nil, protoSubscribe, message.Data), nil
+	case "unsubscribe":
+		return appendProtoString(nil, protoUnsubscribe, message.Data), nil
+	}
+	generic := appendProtoString(nil, 1, message.Event)
+	generic = appendProtoString(generic, 2, message.Data)
+	return appendProtoBytes(nil, protoGeneric, generic), nil
+}
+
+func (protoCodec) decode(raw []byte) (Message, error) {
+	message := Message{}
+	err := walkProto(raw, func(field int, value []byte, _ uint64) error {
+		var err error
+		switch field {
+		case protoOffer, protoAnswer:
+			description := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer}
+			message.Event = "offer"
+			if field == protoAnswer {
+				description.Type, message.Event = webrtc.SDPTypeAnswer, "answer"
+			}
+			err = walkProto(value, func(field int, value []byte, _ uint64) error {
+				if field == 1 {
+					description.SDP = string(value)
+				}
+				return nil
+			})
+			message.Data, err = encodeData(description, err)
+		case protoCandidate:
+			message.Event = "candidate"
+			candidate, walkErr := decodeProtoCandidate(value)
+			message.Data, err = encodeData(candidate, walkErr)
+		case protoSubscribe:
+			message.Event, message.Data = "subscribe", string(value)
+		case protoUnsubscribe:
+			message.Event, message.Data = "unsubscribe", string(value)
+		case protoGeneric:
+			err = walkProto(value, func(field int, value []byte, _ uint64) error {
+				switch field {
+				case 1:
+					message.Event = string(value)
+				case 2:
+					message.Data = string(value)
+				}
+				return nil
+			})
+		}
+		return err
+	})
+	if err == nil && message.Event == "" {
+		err = errProtoMalformed
+	}
+	return message, err
+}
+
+func decodeProtoCandidate(raw []byte) (webrtc.ICECandidateInit, error) {
+	candidate := webrtc.ICECandidateInit{}
+	err := walkProto(raw, func(field int, value []byte, number uint64) error {
+		switch field {
+		case 1:
+			candidate.Candidate = string(value)
+		case 2:
+			mid := string(value)
+			candidate.SDPMid = &mid
+		case 3:
+			if number > 0xFFFF {
+				return errProtoMalformed
+			}
+			index := uint16(number)
+			candidate.SDPMLineIndex = &index
+		case 4:
+			fragment := string(value)
+			candidate.UsernameFragment = &fragment
+		}
+		return nil
+	})
+	return candidate, err
+}
+
+// encodeData encodes v as the data of a message unless err is set
+func encodeData(v interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(v)
+	return string(encoded), err
+}
+
+func appendProtoTag(b []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendProtoVarint(b []byte, field int, value uint64) []byte {
+	return binary.AppendUvarint(appendProtoTag(b, field, protoVarint), value)
+}
+
+func appendProtoBytes(b []byte, field int, value []byte) []byte {
+	b = binary.AppendUvarint(appendProtoTag(b, field, protoBytes), uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendProtoString(b []byte, field int, value string) []byte {
+	return appendProtoBytes(b, field, []byte(value))
+}
+
+// walkProto calls visit with the fields of a protobuf message, value is set
+// for length delimited fields and number for varints. Fixed size fields are
+// skipped.
+func walkProto(raw []byte, visit func(field int, value []byte, number uint64) error) error {
+	for len(raw) > 0 {
+		tag, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return errProtoMalformed
+		}
+		raw = raw[n:]
+		field, wireType := int(tag>>3), int(tag&0x7)
+		var value []byte
+		var number uint64
+		switch wireType {
+		case protoVarint:
+			if number, n = binary.Uvarint(raw); n <= 0 {
+				return errProtoMalformed
+			}
+			raw = raw[n:]
+		case protoBytes:
+			length, n := binary.Uvarint(raw)
+			if n <= 0 || length > uint64(len(raw)-n) {
+				return errProtoMalformed
+			}
+			value, raw = raw[n:n+int(length)], raw[n+int(length):]
+		case protoFixed64, protoFixed32:
+			size := 8
+			if wireType == protoFixed32 {
+				size = 4
+			}
+			if len(raw) < size {
+				return errProtoMalformed
+			}
+			raw = raw[size:]
+			continue
+		default:
+			return fmt.Errorf("%w: wire type %d", errProtoMalformed, wireType)
+		}
+		if err := visit(field, value, number); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// ReapStaleSenders closes the WHIP sessions that never got connected within
+// connectTimeout or that stayed disconnected longer than disconnectTimeout,
+// freeing their resource URL. A zero timeout disables the matching check.
+func (s *Broadcaster) ReapStaleSenders(ctx context.Context, connectTimeout time.Duration, disconnectTimeout time.Duration) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	disconnectedSince := make(map[uuid.UUID]time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for id, peer := range s.staleSenders(connectTimeout, disconnectTimeout, disconnectedSince) {
+			zap.S().Infow("Reaping stale WHIP session", "peerID", id, "state", peer.PeerConn.ConnectionState().String())
+			if err := peer.PeerConn.Close(); err != nil {
+				zap.S().Errorw("Unable to close stale WHIP session", "peerID", id, "error", err)
+			}
+		}
+	}
+}
+
+// staleSenders removes and returns the sessions to reap, disconnectedSince
+// keeps track of when each session was first seen disconnected
+func (s *Broadcaster) staleSenders(connectTimeout time.Duration, disconnectTimeout time.Duration, disconnectedSince map[uuid.UUID]time.Time) map[uuid.UUID]PeerSenderState {
+	stale := make(map[uuid.UUID]PeerSenderState)
+	s.do(func() {
+		now := time.Now()
+		for id, peer := range s.peerSender {
+			switch peer.PeerConn.ConnectionState() {
+			case webrtc.PeerConnectionStateNew, webrtc.PeerConnectionStateConnecting:
+				if connectTimeout > 0 && now.Sub(peer.Created) > connectTimeout {
+					stale[id] = peer
+				}
+			case webrtc.PeerConnectionStateConnected:
+				delete(disconnectedSince, id)
+			default:
+				since, ok := disconnectedSince[id]
+				if !ok {
+					disconnectedSince[id] = now
+					continue
+				}
+				if disconnectTimeout > 0 && now.Sub(since) > disconnectTimeout {
+					stale[id] = peer
+				}
+			}
+		}
+		for id := range stale {
+			s.deletePeerSender(id)
+			delete(disconnectedSince, id)
+		}
+		// Forget the sessions deleted through the WHIP resource
+		for id := range disconnectedSince {
+			if _, ok := s.peerSender[id]; !ok {
+				delete(disconnectedSince, id)
+			}
+		}
+	})
+	return stale
+}
+
+// trackActivity is the forwarded byte count of a track when it last changed
+type trackActivity struct {
+	bytes uint64
+	since time.Time
+}
+
+// EvictedPublisher is the data of the publisher-evicted event
+type EvictedPublisher struct {
+	// PublisherID is the zero UUID for tracks pulled from elsewhere
+	PublisherID uuid.UUID `json:"publisherID"`
+	Tracks      []string  `json:"tracks"`
+}
+
+// EvictIdlePublishers removes the publishers whose tracks all forwarded
+// nothing for timeout, closing their connection and publishing a
+// publisher-evicted event. Idle tracks without a publisher are removed alone.
+func (s *Broadcaster) EvictIdlePublishers(ctx context.Context, timeout time.Duration) {
+	interval := timeout / 2
+	if interval > 5*time.Second {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	activity := make(map[string]trackActivity)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, evicted := range s.idlePublishers(timeout, activity) {
+			zap.S().Infow("Evicting idle publisher", "peerID", evicted.publisher.PublisherID, "tracks", evicted.publisher.Tracks)
+			if evicted.peer != nil {
+				if err := evicted.peer.Close(); err != nil {
+					zap.S().Errorw("Unable to close idle publisher", "peerID", evicted.publisher.PublisherID, "error", err)
+				}
+			}
+			if data, err := json.Marshal(evicted.publisher); err == nil {
+				s.events.Publish("publisher-evicted", string(data))
+			}
+		}
+	}
+}
+
+type idlePublisher struct {
+	publisher EvictedPublisher
+	peer      *webrtc.PeerConnection
+}
+
+// idlePublishers removes and returns the publishers to evict, activity keeps
+// track of when the byte count of each track last changed
+func (s *Broadcaster) idlePublishers(timeout time.Duration, activity map[string]trackActivity) []idlePublisher {
+	evicted := []idlePublisher{}
+	s.do(func() {
+		now := time.Now()
+		idle := make(map[string]bool)
+		for key, meter := range s.meters {
+			bytes := meter.bytes.Load()
+			if last, ok := activity[key]; !ok || last.bytes != bytes {
+				activity[key] = trackActivity{bytes: bytes, since: now}
+				continue
+			}
+			if now.Sub(activity[key].since) > timeout {
+				idle[key] = true
+			}
+		}
+		for key := range activity {
+			if _, ok := s.meters[key]; !ok {
+				delete(activity, key)
+			}
+		}
+		if len(idle) == 0 {
+			return
+		}
+
+		// A publisher is idle once all of its tracks are
+		publishers := s.trackPublishers()
+		tracks := make(map[uuid.UUID][]string)
+		for key := range s.meters {
+			id := publishers[key]
+			tracks[id] = append(tracks[id], key)
+		}
+		for id, keys := range tracks {
+			candidate := idlePublisher{publisher: EvictedPublisher{PublisherID: id}}
+			for _, key := range keys {
+				if idle[key] {
+					candidate.publisher.Tracks = append(candidate.publisher.Tracks, key)
+				}
+			}
+			if len(candidate.publisher.Tracks) == 0 || (id != uuid.Nil && len(candidate.publisher.Tracks) != len(keys)) {
+				continue
+			}
+			if id == uuid.Nil {
+				for _, key := range candidate.publisher.Tracks {
+					s.removeSender(key)
+				}
+			} else {
+				candidate.peer = s.peerSender[id].PeerConn
+				s.deletePeerSender(id)
+			}
+			evicted = append(evicted, candidate)
+		}
+	})
+	return evicted
+}
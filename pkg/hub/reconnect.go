@@ -0,0 +1,79 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ReconnectPolicy tells clients when and where to reconnect once the hub
+// drops them, so that fleets of players and encoders fail over in an
+// orderly way instead of all hammering the same hub at once.
+type ReconnectPolicy struct {
+	RetryAfter time.Duration
+	// MaxBackoff bounds the exponential backoff clients apply on repeated failures
+	MaxBackoff time.Duration
+	// Alternates are other hubs clients may fail over to
+	Alternates []string
+}
+
+// ReconnectBackoff is the exponential backoff clients apply, in seconds
+type ReconnectBackoff struct {
+	Initial    float64 `json:"initial"`
+	Max        float64 `json:"max"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+// ReconnectHint is the "reconnect" message sent to a receiver before it is dropped
+type ReconnectHint struct {
+	Reason string `json:"reason"`
+	// RetryAfter in seconds, jittered per client
+	RetryAfter float64          `json:"retryAfter"`
+	Backoff    ReconnectBackoff `json:"backoff"`
+	Alternates []string         `json:"alternates,omitempty"`
+}
+
+// jitteredRetryAfter spreads reconnections over up to 1.5 times RetryAfter
+func (p ReconnectPolicy) jitteredRetryAfter() time.Duration {
+	if p.RetryAfter <= 0 {
+		return 0
+	}
+	return p.RetryAfter + time.Duration(rand.Int63n(int64(p.RetryAfter)/2+1))
+}
+
+// Hint builds the reconnect message for reason
+func (p ReconnectPolicy) Hint(reason string) ReconnectHint {
+	return ReconnectHint{
+		Reason:     reason,
+		RetryAfter: p.jitteredRetryAfter().Seconds(),
+		Backoff: ReconnectBackoff{
+			Initial:    p.RetryAfter.Seconds(),
+			Max:        p.MaxBackoff.Seconds(),
+			Multiplier: 2,
+		},
+		Alternates: p.Alternates,
+	}
+}
+
+// WriteHeaders adds Retry-After and alternate hub Link headers to an HTTP response
+func (p ReconnectPolicy) WriteHeaders(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(p.jitteredRetryAfter().Seconds()))))
+	for _, alternate := range p.Alternates {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"alternate\"", alternate))
+	}
+}
+
+// SendReconnectHint writes the final "reconnect" message before the signaling is closed
+func SendReconnectHint(s Signaler, policy ReconnectPolicy, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := SendEvent(ctx, s, "reconnect", policy.Hint(reason)); err != nil {
+		zap.S().Debugw("Unable to send reconnect hint", "error", err)
+	}
+}
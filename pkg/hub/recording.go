@@ -0,0 +1,489 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"go.uber.org/zap"
+)
+
+// recordingTimeLayout names the directory of a recording session after
+// its start
+const recordingTimeLayout = "20060102T150405Z"
+
+// recordingKeyframeInterval is how often a video track being recorded asks
+// for a keyframe until it gets its first one
+const recordingKeyframeInterval = time.Second
+
+// ErrRecordingDisabled is returned when recordings have no directory
+var ErrRecordingDisabled = errors.New("recording disabled")
+
+// ErrRecording is returned when starting a stream already being recorded
+var ErrRecording = errors.New("stream already being recorded")
+
+// ErrNotRecording is returned when stopping a stream not being recorded
+var ErrNotRecording = errors.New("stream not being recorded")
+
+// ErrUnknownStream is returned for streams without any track
+var ErrUnknownStream = errors.New("unknown stream")
+
+// RecordingFormat is how the tracks of a recorded stream are written
+type RecordingFormat string
+
+const (
+	// RecordingTracks writes every track to its own file, VP8, VP9 and H264
+	// as IVF and Opus as Ogg
+	RecordingTracks RecordingFormat = "tracks"
+	// RecordingWebM muxes the audio and the video of a stream into a single
+	// WebM file, Matroska when the video is H264
+	RecordingWebM RecordingFormat = "webm"
+)
+
+// ParseRecordingFormat checks the name of a recording format
+func ParseRecordingFormat(name string) (RecordingFormat, error) {
+	switch format := RecordingFormat(name); format {
+	case RecordingTracks, RecordingWebM:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown recording format %q", name)
+}
+
+// RecordingOptions configure the recordings of a Broadcaster
+type RecordingOptions struct {
+	// Dir is where the sessions are written, in a directory per stream and
+	// session
+	Dir    string
+	Format RecordingFormat
+	// Streams are recorded as soon as they are published
+	Streams []string
+}
+
+// RecordingInfo describes a recording session of a stream
+type RecordingInfo struct {
+	Room     string `json:"room,omitempty"`
+	StreamID string `json:"streamID"`
+	// Dir holds the files of the session, one per track
+	Dir     string    `json:"dir"`
+	Started time.Time `json:"started"`
+	// Files are the names of the track files in Dir
+	Files []string `json:"files"`
+	// Dropped counts the packets lost for the disk not keeping up
+	Dropped uint64 `json:"dropped"`
+}
+
+// recordingSession writes the tracks of a stream to the files of its
+// directory until it is stopped or the stream goes away
+type recordingSession struct {
+	id       string
+	streamID string
+	dir      string
+	started  time.Time
+	tracks   map[string]*trackRecorder
+	// recorders are those of every track recorded, the session is complete
+	// once they all finalized their file
+	recorders []*trackRecorder
+	// muxer writes the tracks to a single file, nil for a file per track
+	muxer *streamMuxer
+	// files keeps the files of the tracks that went away
+	files   []string
+	dropped uint64
+}
+
+func (r *recordingSession) info() RecordingInfo {
+	info := RecordingInfo{StreamID: r.streamID, Dir: r.dir, Started: r.started, Dropped: r.dropped, Files: []string{}}
+	info.Files = append(info.Files, r.files...)
+	for _, track := range r.tracks {
+		if r.muxer == nil {
+			info.Files = append(info.Files, filepath.Base(track.fileName))
+		}
+		info.Dropped += track.dropped.Load()
+	}
+	if r.muxer != nil {
+		if file := r.muxer.file(); file != "" {
+			info.Files = append(info.Files, filepath.Base(file))
+		}
+	}
+	sort.Strings(info.Files)
+	return info
+}
+
+// recordingWriter is implemented by the writers of the track files
+type recordingWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+	Close() error
+}
+
+// trackRecorder is a TrackSink writing a track to its file. The packets
+// are written by its own goroutine so that the disk never holds up the
+// forwarding, they are dropped when it cannot keep up.
+type trackRecorder struct {
+	fileName string
+	mimeType string
+	writer   recordingWriter
+	// requestKeyframe is called until the first keyframe of a video track,
+	// then every keyframeInterval when it is set
+	requestKeyframe  func()
+	keyframeInterval time.Duration
+
+	packets chan []byte
+	done    chan struct{}
+	once    sync.Once
+	dropped atomic.Uint64
+	// finished is closed once the file is finalized
+	finished chan struct{}
+}
+
+// newTrackRecorder writes a track of mimeType with writer, named fileName
+func newTrackRecorder(fileName string, mimeType string, writer recordingWriter, requestKeyframe func()) *trackRecorder {
+	r := &trackRecorder{
+		fileName:        fileName,
+		mimeType:        mimeType,
+		writer:          writer,
+		requestKeyframe: requestKeyframe,
+		packets:         make(chan []byte, 512),
+		done:            make(chan struct{}),
+		finished:        make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// newTrackFile creates the file of a track recorded on its own
+func newTrackFile(fileName string, codec webrtc.RTPCodecCapability) (recordingWriter, error) {
+	if strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) {
+		channels := codec.Channels
+		if channels == 0 {
+			channels = 2
+		}
+		return oggwriter.New(fileName, codec.ClockRate, channels)
+	}
+	return newIVFWriter(fileName, codec)
+}
+
+// recordingExtension is the file extension of the codecs that are
+// recorded, ok is false for the others
+func recordingExtension(mimeType string) (string, bool) {
+	if strings.EqualFold(mimeType, webrtc.MimeTypeOpus) {
+		return ".ogg", true
+	}
+	if _, _, ok := ivfFourCC(mimeType); ok {
+		return ".ivf", true
+	}
+	return "", false
+}
+
+func (r *trackRecorder) WriteRTP(packet []byte) error {
+	select {
+	case <-r.done:
+		return errors.New("recorder closed")
+	default:
+	}
+	p := make([]byte, len(packet))
+	copy(p, packet)
+	select {
+	case r.packets <- p:
+	default:
+		r.dropped.Add(1)
+	}
+	return nil
+}
+
+func (r *trackRecorder) droppedPackets() uint64 {
+	return r.dropped.Load()
+}
+
+// Close stops the recording, the file is finalized once the packets
+// already queued are written
+func (r *trackRecorder) Close() error {
+	r.once.Do(func() { close(r.done) })
+	return nil
+}
+
+func (r *trackRecorder) run() {
+	defer func() {
+		if err := r.writer.Close(); err != nil {
+			zap.S().Warnw("Unable to finalize recording", "file", r.fileName, "error", err)
+		}
+		close(r.finished)
+	}()
+	// Video files start with a keyframe, audio right away
+	keyframed := !strings.HasPrefix(strings.ToLower(r.mimeType), "video/")
+	interval := recordingKeyframeInterval
+	if r.keyframeInterval > 0 {
+		interval = r.keyframeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	if !keyframed {
+		r.requestKeyframe()
+	}
+	write := func(raw []byte) error {
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(raw); err != nil {
+			return nil
+		}
+		if !keyframed {
+			if !isKeyframe(r.mimeType, packet.Payload) {
+				return nil
+			}
+			keyframed = true
+		}
+		return r.writer.WriteRTP(packet)
+	}
+	for {
+		select {
+		case <-r.done:
+			for {
+				select {
+				case raw := <-r.packets:
+					if err := write(raw); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case raw := <-r.packets:
+			if err := write(raw); err != nil {
+				zap.S().Warnw("Recording failed", "file", r.fileName, "error", err)
+				r.Close()
+				return
+			}
+		case <-ticker.C:
+			if !keyframed || r.keyframeInterval > 0 {
+				r.requestKeyframe()
+			}
+		}
+	}
+}
+
+// EnableRecording lets streams be recorded, those of the options as soon
+// as they are published
+func (s *Broadcaster) EnableRecording(options RecordingOptions) {
+	s.do(func() {
+		s.recordingDir, s.recordingFormat = options.Dir, options.Format
+		s.recordStreams = make(map[string]bool, len(options.Streams))
+		for _, streamID := range options.Streams {
+			s.recordStreams[streamID] = true
+		}
+		for key := range s.senders {
+			s.recordNewTrack(key)
+		}
+	})
+}
+
+// StartRecording records the tracks of streamID, those it gets later on as
+// well, until StopRecording or until the stream goes away
+func (s *Broadcaster) StartRecording(streamID string) (RecordingInfo, error) {
+	info := RecordingInfo{}
+	err := errClosed
+	s.do(func() {
+		var session *recordingSession
+		if session, err = s.startRecording(streamID); err == nil {
+			info = session.info()
+		}
+	})
+	return info, err
+}
+
+// StopRecording stops recording streamID and finalizes its files
+func (s *Broadcaster) StopRecording(streamID string) (RecordingInfo, error) {
+	info := RecordingInfo{}
+	err := errClosed
+	s.do(func() {
+		session, ok := s.recordings[streamID]
+		if !ok {
+			err = ErrNotRecording
+			return
+		}
+		info, err = s.stopRecording(session), nil
+	})
+	return info, err
+}
+
+// Recordings returns the streams being recorded
+func (s *Broadcaster) Recordings() []RecordingInfo {
+	recordings := []RecordingInfo{}
+	s.do(func() {
+		for _, session := range s.recordings {
+			recordings = append(recordings, session.info())
+		}
+	})
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].StreamID < recordings[j].StreamID
+	})
+	return recordings
+}
+
+// startRecording opens a session for streamID, it must run on the loop
+func (s *Broadcaster) startRecording(streamID string) (*recordingSession, error) {
+	if s.recordingDir == "" {
+		return nil, ErrRecordingDisabled
+	}
+	if s.opaque() {
+		return nil, errors.New("end-to-end encrypted media cannot be recorded")
+	}
+	if _, ok := s.recordings[streamID]; ok {
+		return nil, ErrRecording
+	}
+	keys := []string{}
+	for key, track := range s.senders {
+		if track.StreamID() == streamID && !s.isSpareLayer(key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, ErrUnknownStream
+	}
+	started := time.Now().UTC()
+	session := &recordingSession{
+		id:       uuid.New().String(),
+		streamID: streamID,
+		dir:      filepath.Join(s.recordingDir, sanitizeFileName(streamID), started.Format(recordingTimeLayout)),
+		started:  started,
+		tracks:   make(map[string]*trackRecorder),
+	}
+	if err := os.MkdirAll(session.dir, 0o755); err != nil {
+		return nil, err
+	}
+	if s.recordingFormat == RecordingWebM {
+		session.muxer = newStreamMuxer(webmContainer{dir: session.dir, name: sanitizeFileName(streamID)}, started)
+	}
+	s.recordings[streamID] = session
+	sort.Strings(keys)
+	for _, key := range keys {
+		s.recordTrack(session, key)
+	}
+	zap.S().Infow("Recording started", "streamID", streamID, "dir", session.dir)
+	return session, nil
+}
+
+// recordTrack adds the track key to the session, the tracks with a codec
+// that is not recorded are skipped. It must run on the loop.
+func (s *Broadcaster) recordTrack(session *recordingSession, key string) {
+	track, ok := s.senders[key].(*webrtc.TrackLocalStaticRTP)
+	if !ok {
+		return
+	}
+	codec := track.Codec()
+	var writer recordingWriter
+	var err error
+	fileName := filepath.Join(session.dir, sanitizeFileName(track.ID()))
+	if session.muxer != nil {
+		writer, err = session.muxer.addTrack(codec, s.trackClock(key, nil))
+	} else {
+		extension, ok := recordingExtension(codec.MimeType)
+		if !ok {
+			zap.S().Infow("Not recording track, unsupported codec", "track", key, "codec", codec.MimeType)
+			return
+		}
+		for i := 1; fileExists(fileName + extension); i++ {
+			// A track published again within the session
+			fileName = filepath.Join(session.dir, fmt.Sprintf("%s-%d", sanitizeFileName(track.ID()), i))
+		}
+		fileName += extension
+		writer, err = newTrackFile(fileName, codec)
+	}
+	if err != nil {
+		zap.S().Infow("Not recording track", "track", key, "error", err)
+		return
+	}
+	recorder := newTrackRecorder(fileName, codec.MimeType, writer, func() {
+		go s.do(func() { s.requestKeyframe(key, keyframeRecording) })
+	})
+	session.tracks[key] = recorder
+	session.recorders = append(session.recorders, recorder)
+	s.sinkLock.Lock()
+	if _, ok := s.sinks[key]; !ok {
+		s.sinks[key] = make(map[TrackSink]bool)
+	}
+	s.sinks[key][recorder] = true
+	s.sinkLock.Unlock()
+}
+
+// recordNewTrack records the track key when its stream is being recorded
+// or is to be, it must run on the loop
+func (s *Broadcaster) recordNewTrack(key string) {
+	if s.recordingDir == "" || s.isSpareLayer(key) {
+		return
+	}
+	streamID := s.senders[key].StreamID()
+	session, ok := s.recordings[streamID]
+	if !ok {
+		if s.recordStreams[streamID] {
+			if _, err := s.startRecording(streamID); err != nil {
+				zap.S().Errorw("Unable to start recording", "streamID", streamID, "error", err)
+			}
+		}
+		return
+	}
+	if _, ok := session.tracks[key]; !ok {
+		s.recordTrack(session, key)
+	}
+}
+
+// endRecordedTrack forgets the removed track key, its sink is closed
+// already. The session ends with the last track of its stream. It must
+// run on the loop.
+func (s *Broadcaster) endRecordedTrack(key string) {
+	for streamID, session := range s.recordings {
+		recorder, ok := session.tracks[key]
+		if !ok {
+			continue
+		}
+		delete(session.tracks, key)
+		if session.muxer == nil {
+			session.files = append(session.files, filepath.Base(recorder.fileName))
+		}
+		session.dropped += recorder.dropped.Load()
+		if len(session.tracks) == 0 {
+			delete(s.recordings, streamID)
+			s.completeRecording(session)
+			zap.S().Infow("Recording ended", "streamID", streamID, "dir", session.dir)
+		}
+	}
+}
+
+// stopRecording closes the files of the session, it must run on the loop
+func (s *Broadcaster) stopRecording(session *recordingSession) RecordingInfo {
+	info := session.info()
+	for key, recorder := range session.tracks {
+		s.RemoveSink(key, recorder)
+		recorder.Close()
+	}
+	delete(s.recordings, session.streamID)
+	s.completeRecording(session)
+	zap.S().Infow("Recording stopped", "streamID", session.streamID, "dir", session.dir)
+	return info
+}
+
+// sanitizeFileName keeps the IDs chosen by publishers from escaping the
+// recording directory
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return "_" + name
+	}
+	return name
+}
+
+func fileExists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
+}
@@ -0,0 +1,153 @@
+package hub
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// MimeTypeRED is the redundant audio format of RFC 2198
+const MimeTypeRED = "audio/red"
+
+// redFmtp is the RED fmtp browsers offer, Opus carrying Opus whatever the
+// number of redundant packets
+var redFmtp = fmt.Sprintf("%d/%d", opusPayloadType, opusPayloadType)
+
+// The RED block headers cannot express larger offsets and lengths
+const (
+	redMaxTimestampOffset = 1<<14 - 1
+	redMaxBlockLength     = 1<<10 - 1
+)
+
+// redundant sends the Opus stream ssrc as RED in payloadType
+func (m *RepairMonitor) redundant(ssrc uint32, payloadType uint8) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.red[ssrc] = payloadType
+}
+
+func (m *RepairMonitor) notRedundant(ssrc uint32) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.red, ssrc)
+}
+
+func (m *RepairMonitor) redundancy(ssrc uint32) (uint8, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	payloadType, ok := m.red[ssrc]
+	return payloadType, ok
+}
+
+// redBlock is an Opus packet kept to be sent again as redundancy
+type redBlock struct {
+	timestamp uint32
+	payload   []byte
+}
+
+// redEncoder wraps the packets of an Opus stream in RED payloads carrying
+// the previous packets along
+type redEncoder struct {
+	distance int
+	history  []redBlock
+}
+
+// encode returns the RED payload of the Opus payload sent at timestamp
+func (e *redEncoder) encode(timestamp uint32, payload []byte) []byte {
+	blocks := make([]redBlock, 0, len(e.history))
+	size := 1 + len(payload)
+	for _, block := range e.history {
+		offset := timestamp - block.timestamp
+		if offset == 0 || offset > redMaxTimestampOffset || len(block.payload) > redMaxBlockLength {
+			continue
+		}
+		blocks = append(blocks, block)
+		size += 4 + len(block.payload)
+	}
+
+	red := make([]byte, 0, size)
+	for _, block := range blocks {
+		header := 1<<31 | uint32(opusPayloadType)<<24 | (timestamp-block.timestamp)<<10 | uint32(len(block.payload))
+		red = binary.BigEndian.AppendUint32(red, header)
+	}
+	red = append(red, opusPayloadType)
+	for _, block := range blocks {
+		red = append(red, block.payload...)
+	}
+	red = append(red, payload...)
+
+	e.history = append(e.history, redBlock{timestamp: timestamp, payload: append([]byte(nil), payload...)})
+	if len(e.history) > e.distance {
+		e.history = e.history[1:]
+	}
+	return red
+}
+
+// redInterceptor sends the Opus streams of its connection as RED once the
+// receiver accepted it
+type redInterceptor struct {
+	interceptor.NoOp
+	monitor  *RepairMonitor
+	distance int
+}
+
+type redInterceptorFactory struct {
+	monitor  *RepairMonitor
+	distance int
+}
+
+func (f *redInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &redInterceptor{monitor: f.monitor, distance: f.distance}, nil
+}
+
+func (i *redInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.EqualFold(info.MimeType, webrtc.MimeTypeOpus) || i.distance == 0 {
+		return writer
+	}
+	encoder := &redEncoder{distance: i.distance}
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		payloadType, ok := i.monitor.redundancy(info.SSRC)
+		if !ok {
+			return writer.Write(header, payload, a)
+		}
+		red := *header
+		red.PayloadType = payloadType
+		return writer.Write(&red, encoder.encode(header.Timestamp, payload), a)
+	})
+}
+
+func (i *redInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.monitor.notRedundant(info.SSRC)
+}
+
+// updateRED sends RED to the receiver for the Opus tracks it negotiated RED
+// for, it must run on the loop
+func (s *Broadcaster) updateRED(receiver ReceiverState) {
+	if receiver.Repair == nil {
+		return
+	}
+	for _, sender := range receiver.Connection.GetSenders() {
+		track := sender.Track()
+		if track == nil || track.Kind() != webrtc.RTPCodecTypeAudio {
+			continue
+		}
+		parameters := sender.GetParameters()
+		var payloadType uint8
+		for _, codec := range parameters.Codecs {
+			if strings.EqualFold(codec.MimeType, MimeTypeRED) {
+				payloadType = uint8(codec.PayloadType)
+			}
+		}
+		for _, encoding := range parameters.Encodings {
+			if payloadType != 0 {
+				receiver.Repair.redundant(uint32(encoding.SSRC), payloadType)
+			} else {
+				receiver.Repair.notRedundant(uint32(encoding.SSRC))
+			}
+		}
+	}
+}
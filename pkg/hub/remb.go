@@ -0,0 +1,129 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// publisherBitrateInterval is how often the publishers get their REMB, the
+// browsers forget it after a while
+const publisherBitrateInterval = time.Second
+
+// publisherBitrateCap is the REMB to send to a publisher
+type publisherBitrateCap struct {
+	id      uuid.UUID
+	peer    *webrtc.PeerConnection
+	ssrcs   []uint32
+	bitrate int
+}
+
+// EnablePublisherBitrateCap sends REMBs to the publishers so that their
+// video does not exceed maxBitrate bits per second. With followReceivers
+// the cap also follows the estimated bandwidth of the slowest receiver of
+// each publisher, simulcast publishers excepted as their low layers are
+// there for slow receivers. A zero maxBitrate only follows the receivers.
+func (s *Broadcaster) EnablePublisherBitrateCap(maxBitrate int, followReceivers bool) {
+	go s.capPublisherBitrates(maxBitrate, followReceivers)
+}
+
+func (s *Broadcaster) capPublisherBitrates(maxBitrate int, followReceivers bool) {
+	ticker := time.NewTicker(publisherBitrateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		caps := []publisherBitrateCap{}
+		s.do(func() {
+			caps = s.publisherBitrateCaps(maxBitrate, followReceivers)
+		})
+		for _, capped := range caps {
+			if err := capped.peer.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{
+				Bitrate: float32(capped.bitrate),
+				SSRCs:   capped.ssrcs,
+			}}); err != nil {
+				zap.S().Debugw("Unable to send REMB", "publisher", capped.id, "error", err)
+			}
+		}
+	}
+}
+
+// publisherBitrateCaps computes the cap of every publisher sending video,
+// it must run on the loop
+func (s *Broadcaster) publisherBitrateCaps(maxBitrate int, followReceivers bool) []publisherBitrateCap {
+	var receiverCaps map[uuid.UUID]int
+	if followReceivers {
+		receiverCaps = s.receiverBitrateCaps()
+	}
+	caps := []publisherBitrateCap{}
+	for id, peer := range s.peerSender {
+		capped := publisherBitrateCap{id: id, peer: peer.PeerConn, bitrate: maxBitrate}
+		simulcast := false
+		for key := range peer.tracks {
+			source, ok := s.sources[key]
+			if !ok || source.Kind() != webrtc.RTPCodecTypeVideo {
+				continue
+			}
+			capped.ssrcs = append(capped.ssrcs, uint32(source.SSRC()))
+			if _, ok := s.layers[key]; ok {
+				simulcast = true
+			}
+		}
+		if len(capped.ssrcs) == 0 {
+			continue
+		}
+		if limit, ok := receiverCaps[id]; ok && !simulcast && (capped.bitrate == 0 || limit < capped.bitrate) {
+			capped.bitrate = limit
+		}
+		if capped.bitrate == 0 {
+			continue
+		}
+		if capped.bitrate < bandwidthMinEstimate {
+			capped.bitrate = bandwidthMinEstimate
+		}
+		caps = append(caps, capped)
+	}
+	return caps
+}
+
+// receiverBitrateCaps splits the estimated bandwidth of every receiver
+// evenly between the video tracks it gets, each publisher is capped at the
+// smallest share its tracks get. It must run on the loop.
+func (s *Broadcaster) receiverBitrateCaps() map[uuid.UUID]int {
+	publishers := s.trackPublishers()
+	caps := make(map[uuid.UUID]int)
+	for _, receiver := range s.receivers {
+		if receiver.Bandwidth == nil {
+			continue
+		}
+		estimate := receiver.Bandwidth.Estimate()
+		if estimate == 0 {
+			continue
+		}
+		videos := make(map[uuid.UUID]int)
+		total := 0
+		for key := range receiver.assigned {
+			source, ok := s.sources[key]
+			if !ok || source.Kind() != webrtc.RTPCodecTypeVideo {
+				continue
+			}
+			total++
+			if publisher, ok := publishers[key]; ok {
+				videos[publisher]++
+			}
+		}
+		for publisher, count := range videos {
+			share := estimate * count / total
+			if current, ok := caps[publisher]; !ok || share < current {
+				caps[publisher] = share
+			}
+		}
+	}
+	return caps
+}
@@ -0,0 +1,237 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// RepairStrategy is how packet loss towards a receiver gets repaired
+type RepairStrategy string
+
+const (
+	// RepairNACK retransmits lost packets, efficient when the RTT is low
+	RepairNACK RepairStrategy = "nack"
+	// RepairFEC stops answering NACKs whose retransmission would arrive too
+	// late for the streams protected by forward error correction
+	RepairFEC RepairStrategy = "fec"
+)
+
+// Hysteresis around the RTT at which retransmissions stop being useful
+const (
+	repairFECAboveRTT  = 250 * time.Millisecond
+	repairNACKBelowRTT = 150 * time.Millisecond
+)
+
+// RepairMonitor measures a receiver RTT and loss from its RTCP receiver
+// reports and picks the repair strategy accordingly
+type RepairMonitor struct {
+	lock     sync.Mutex
+	rtt      time.Duration
+	loss     float64
+	strategy RepairStrategy
+	// fec are the repair streams of the protected streams by media SSRC
+	fec map[uint32]fecStream
+	// red are the RED payload types of the redundant Opus streams
+	red map[uint32]uint8
+}
+
+func NewRepairMonitor() *RepairMonitor {
+	return &RepairMonitor{strategy: RepairNACK, fec: make(map[uint32]fecStream), red: make(map[uint32]uint8)}
+}
+
+type RepairStats struct {
+	RTT      float64        `json:"rttMs"`
+	Loss     float64        `json:"loss"`
+	Strategy RepairStrategy `json:"strategy"`
+}
+
+func (m *RepairMonitor) Stats() RepairStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return RepairStats{
+		RTT:      float64(m.rtt) / float64(time.Millisecond),
+		Loss:     m.loss,
+		Strategy: m.strategy,
+	}
+}
+
+func (m *RepairMonitor) Strategy() RepairStrategy {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.strategy
+}
+
+// dropsNACK tells whether the NACKs of the stream ssrc are left to its
+// FlexFEC, those of the streams without FEC are always answered
+func (m *RepairMonitor) dropsNACK(ssrc uint32) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, protected := m.fec[ssrc]
+	return protected && m.strategy == RepairFEC
+}
+
+func (m *RepairMonitor) onReceptionReport(report rtcp.ReceptionReport, now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.loss = 0.8*m.loss + 0.2*float64(report.FractionLost)/256
+	// RTT can only be computed once the receiver got one of our sender reports
+	if report.LastSenderReport != 0 {
+		compact := ntpCompact(now)
+		rtt := compact - report.LastSenderReport - report.Delay
+		m.rtt = (4*m.rtt + time.Duration(rtt)*time.Second/65536) / 5
+	}
+	switch {
+	case m.strategy == RepairNACK && m.rtt > repairFECAboveRTT:
+		m.strategy = RepairFEC
+	case m.strategy == RepairFEC && m.rtt < repairNACKBelowRTT:
+		m.strategy = RepairNACK
+	}
+}
+
+// ntpCompact returns the middle 32 bits of the NTP timestamp of t
+func ntpCompact(t time.Time) uint32 {
+	return uint32(ntpTime(t) >> 16)
+}
+
+// updateRepair applies the FlexFEC and RED the receiver negotiated, it must
+// run on the loop
+func (s *Broadcaster) updateRepair(receiver ReceiverState) {
+	s.updateFEC(receiver)
+	s.updateRED(receiver)
+}
+
+// repairInterceptor feeds the monitor and swallows the NACKs of the streams
+// FEC repairs, before the Retransmitter gets them
+type repairInterceptor struct {
+	interceptor.NoOp
+	monitor *RepairMonitor
+}
+
+type repairInterceptorFactory struct {
+	monitor *RepairMonitor
+}
+
+func (f *repairInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &repairInterceptor{monitor: f.monitor}, nil
+}
+
+func (i *repairInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		for {
+			n, attr, err := reader.Read(b, a)
+			if err != nil {
+				return 0, nil, err
+			}
+			pkts, err := rtcp.Unmarshal(b[:n])
+			if err != nil {
+				return n, attr, nil
+			}
+			now := time.Now()
+			kept := make([]rtcp.Packet, 0, len(pkts))
+			dropped := false
+			for _, pkt := range pkts {
+				if rr, ok := pkt.(*rtcp.ReceiverReport); ok {
+					for _, report := range rr.Reports {
+						i.monitor.onReceptionReport(report, now)
+					}
+				}
+				if nack, ok := pkt.(*rtcp.TransportLayerNack); ok && i.monitor.dropsNACK(nack.MediaSSRC) {
+					dropped = true
+					continue
+				}
+				kept = append(kept, pkt)
+			}
+			if !dropped {
+				return n, attr, nil
+			}
+			if len(kept) == 0 {
+				continue
+			}
+			raw, err := rtcp.Marshal(kept)
+			if err != nil {
+				return 0, nil, err
+			}
+			// The packets changed, drop the attributes caching the parsed ones
+			return copy(b, raw), make(interceptor.Attributes), nil
+		}
+	})
+}
+
+// ReceiverAPIOptions are the monitors of a receiver connection, each one
+// left nil leaves its interceptor out
+type ReceiverAPIOptions struct {
+	// Repair picks how losses are repaired, FlexFEC protecting the
+	// high-priority video and RED the Opus audio when negotiated
+	Repair *RepairMonitor
+	// Retransmitter answers the NACKs from the track caches instead of a
+	// NACK responder
+	Retransmitter *Retransmitter
+	// Bandwidth is fed the TWCC feedback
+	Bandwidth *BandwidthMonitor
+	// Keyframes holds new video streams back until their first keyframe
+	Keyframes *KeyframeGate
+	// Reports sends the sender reports with the timing of the publishers
+	Reports *SenderReports
+	// Stats measures the streams
+	Stats *ConnectionStats
+	// Pacer paces the packets sent
+	Pacer *Pacer
+}
+
+// NewReceiverAPI builds the API used for receiver connections, with the
+// interceptors of options in front of the default ones
+func NewReceiverAPI(codecs CodecSet, options ReceiverAPIOptions) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := codecs.register(m); err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	// Ahead of the other interceptors to see the RTCP they send
+	if options.Stats != nil {
+		if err := registerConnectionStats(i, options.Stats); err != nil {
+			return nil, err
+		}
+	}
+	// Behind the other interceptors to pace every packet they send
+	if options.Pacer != nil && options.Pacer.Rate() > 0 {
+		i.Add(&pacerInterceptorFactory{pacer: options.Pacer})
+		if options.Bandwidth != nil {
+			options.Bandwidth.setCeiling(int(options.Pacer.Rate()))
+		}
+	}
+	if options.Repair != nil {
+		i.Add(&repairInterceptorFactory{monitor: options.Repair})
+	}
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	receiverReports, err := report.NewReceiverInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	i.Add(receiverReports)
+	if options.Reports != nil {
+		i.Add(&senderReportInterceptorFactory{reports: options.Reports})
+	}
+	if options.Repair != nil {
+		// Ahead of the TWCC extension, which the repair packets protect
+		i.Add(&fecInterceptorFactory{monitor: options.Repair})
+		i.Add(&redInterceptorFactory{monitor: options.Repair, distance: codecs.RED})
+	}
+	if options.Bandwidth != nil {
+		if err := registerBandwidthEstimation(m, i, options.Bandwidth); err != nil {
+			return nil, err
+		}
+	}
+	if options.Keyframes != nil {
+		i.Add(&keyframeGateInterceptorFactory{gate: options.Keyframes})
+	}
+	if options.Retransmitter != nil {
+		i.Add(&retransmitInterceptorFactory{retransmitter: options.Retransmitter})
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i)), nil
+}
@@ -0,0 +1,178 @@
+package hub
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+type replayPacket struct {
+	arrival time.Time
+	data    []byte
+	// keyframe packets start a frame decodable on its own, playback
+	// starts from one of them
+	keyframe  bool
+	timestamp uint32
+}
+
+// replayBuffer is a TrackSink keeping a rolling window of the RTP packets
+// of a track so that receivers can watch it time-shifted.
+type replayBuffer struct {
+	window   time.Duration
+	mimeType string
+
+	lock sync.Mutex
+	// packets[head:] are in the window, the trimmed packets before head
+	// are dropped once they make half of the slice
+	packets []replayPacket
+	head    int
+	// first is the absolute index of packets[head], it keeps cursors
+	// valid while old packets get trimmed
+	first  uint64
+	closed bool
+	notify chan struct{}
+}
+
+func newReplayBuffer(window time.Duration, mimeType string) *replayBuffer {
+	return &replayBuffer{
+		window:   window,
+		mimeType: mimeType,
+		notify:   make(chan struct{}),
+	}
+}
+
+func (b *replayBuffer) WriteRTP(packet []byte) error {
+	data := make([]byte, len(packet))
+	copy(data, packet)
+	now := time.Now()
+	keyframe := false
+	header := rtp.Header{}
+	if offset, err := header.Unmarshal(data); err == nil {
+		keyframe = isKeyframe(b.mimeType, data[offset:])
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return io.ErrClosedPipe
+	}
+	b.packets = append(b.packets, replayPacket{arrival: now, data: data, keyframe: keyframe, timestamp: header.Timestamp})
+	for b.head < len(b.packets) && now.Sub(b.packets[b.head].arrival) > b.window {
+		b.packets[b.head] = replayPacket{}
+		b.head++
+		b.first++
+	}
+	if b.head > len(b.packets)/2 {
+		n := copy(b.packets, b.packets[b.head:])
+		for i := n; i < len(b.packets); i++ {
+			b.packets[i] = replayPacket{}
+		}
+		b.packets, b.head = b.packets[:n], 0
+	}
+	close(b.notify)
+	b.notify = make(chan struct{})
+	return nil
+}
+
+func (b *replayBuffer) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.notify)
+	}
+	return nil
+}
+
+// indexAt returns the absolute index of the last keyframe packet received
+// at or before t, or of the first packet received after t when the window
+// has no keyframe before it
+func (b *replayBuffer) indexAt(t time.Time) uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	packets := b.packets[b.head:]
+	i := 0
+	for i < len(packets) && packets[i].arrival.Before(t) {
+		i++
+	}
+	for k := i; k >= 0; k-- {
+		if k < len(packets) && packets[k].keyframe && !packets[k].arrival.After(t) {
+			// The parameter sets of H264 come in packets of their own
+			// before the IDR slice
+			for k > 0 && packets[k-1].keyframe && packets[k-1].timestamp == packets[k].timestamp {
+				k--
+			}
+			return b.first + uint64(k)
+		}
+	}
+	return b.first + uint64(i)
+}
+
+// get returns the packet at cursor, moving the cursor forward if that packet
+// has already been trimmed. When no packet is available yet it returns a
+// channel closed on the next write.
+func (b *replayBuffer) get(cursor uint64) (replayPacket, uint64, <-chan struct{}, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if cursor < b.first {
+		cursor = b.first
+	}
+	if i := cursor - b.first; i < uint64(len(b.packets)-b.head) {
+		return b.packets[b.head+int(i)], cursor, nil, nil
+	}
+	if b.closed {
+		return replayPacket{}, cursor, nil, io.EOF
+	}
+	return replayPacket{}, cursor, b.notify, nil
+}
+
+// play writes the buffered packets to track delayed by delay, preserving the
+// original pacing, until stop is closed or the source track goes away. It
+// starts from the keyframe before the delayed time, the packets up to that
+// time are written at once for the receiver to decode from it.
+func (b *replayBuffer) play(track *webrtc.TrackLocalStaticRTP, delay time.Duration, stop <-chan struct{}) {
+	cursor := b.indexAt(time.Now().Add(-delay))
+	for {
+		packet, c, notify, err := b.get(cursor)
+		if err != nil {
+			return
+		}
+		cursor = c
+		if notify != nil {
+			select {
+			case <-notify:
+				continue
+			case <-stop:
+				return
+			}
+		}
+		if wait := time.Until(packet.arrival.Add(delay)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+		if _, err := track.Write(packet.data); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			return
+		}
+		cursor++
+	}
+}
+
+// replaySession is a receiver watching a stream time-shifted, it owns
+// dedicated local tracks fed from the replay buffers.
+type replaySession struct {
+	tracks []*webrtc.TrackLocalStaticRTP
+	stop   chan struct{}
+}
+
+func replayStreamID(streamID string) string {
+	return streamID + "-replay"
+}
@@ -0,0 +1,246 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// senderReportInterval is how often sender reports are sent to receivers
+const senderReportInterval = time.Second
+
+// rtpClock tells the RTP timestamp a track is at, on the wall clock of the
+// hub, so that the sender reports of its audio and video map them to the
+// same instant like their publisher did
+type rtpClock interface {
+	rtpTime(now time.Time) (uint32, bool)
+}
+
+// sourceClock follows the sender reports of a publisher track
+type sourceClock struct {
+	lock      sync.Mutex
+	clockRate float64
+	reported  bool
+	rtp       uint32
+	at        time.Time
+}
+
+func newSourceClock(clockRate uint32) *sourceClock {
+	return &sourceClock{clockRate: float64(clockRate)}
+}
+
+// report records a sender report of the publisher received at now, the
+// transit time of the report is the same for audio and video
+func (c *sourceClock) report(report *rtcp.SenderReport, now time.Time) {
+	c.sync(report.RTPTime, now)
+}
+
+// sync records that the publisher sent rtpTime at
+func (c *sourceClock) sync(rtpTime uint32, at time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reported, c.rtp, c.at = true, rtpTime, at
+}
+
+func (c *sourceClock) rtpTime(now time.Time) (uint32, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.reported {
+		return 0, false
+	}
+	return c.rtp + uint32(now.Sub(c.at).Seconds()*c.clockRate), true
+}
+
+// trackClock is the clock of the track key sent to a receiver, through
+// selection for simulcast tracks. It must run on the loop.
+func (s *Broadcaster) trackClock(key string, selection *layerSelection) rtpClock {
+	if selection != nil {
+		return &selection.switcher
+	}
+	if continuity, ok := s.continuities[key]; ok {
+		return continuity
+	}
+	return nil
+}
+
+// trackReceiver finds the receiver of the publisher source is read from,
+// nil when there is none
+func trackReceiver(publisher PeerSenderState, source trackSource) *webrtc.RTPReceiver {
+	if publisher.PeerConn == nil {
+		return nil
+	}
+	for _, receiver := range publisher.PeerConn.GetReceivers() {
+		for _, track := range receiver.Tracks() {
+			if track == source {
+				return receiver
+			}
+		}
+	}
+	return nil
+}
+
+// readSenderReports feeds clock with the sender reports of source, read
+// from receiver, until it ends
+func readSenderReports(receiver *webrtc.RTPReceiver, source trackSource, clock *sourceClock) {
+	for {
+		var packets []rtcp.Packet
+		var err error
+		if source.RID() != "" {
+			packets, _, err = receiver.ReadSimulcastRTCP(source.RID())
+		} else {
+			packets, _, err = receiver.ReadRTCP()
+		}
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			if report, ok := packet.(*rtcp.SenderReport); ok && report.SSRC == uint32(source.SSRC()) {
+				clock.report(report, time.Now())
+			}
+		}
+	}
+}
+
+// SenderReports sends the sender reports of a receiver connection. The
+// tracks forwarded from publishers report the timing of their publisher,
+// the others are timed on the packets as they are sent.
+type SenderReports struct {
+	lock   sync.Mutex
+	clocks map[uint32]rtpClock
+}
+
+func NewSenderReports() *SenderReports {
+	return &SenderReports{clocks: make(map[uint32]rtpClock)}
+}
+
+// bind reports the streams of sender on clock
+func (r *SenderReports) bind(sender *webrtc.RTPSender, clock rtpClock) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, encoding := range sender.GetParameters().Encodings {
+		r.clocks[uint32(encoding.SSRC)] = clock
+	}
+}
+
+func (r *SenderReports) clock(ssrc uint32) rtpClock {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.clocks[ssrc]
+}
+
+func (r *SenderReports) forget(ssrc uint32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.clocks, ssrc)
+}
+
+// reportedStream counts what was sent on a stream for its sender reports
+type reportedStream struct {
+	lock      sync.Mutex
+	ssrc      uint32
+	clockRate float64
+	lastRTP   uint32
+	lastSent  time.Time
+	packets   uint32
+	octets    uint32
+}
+
+func (s *reportedStream) report(now time.Time, clock rtpClock) *rtcp.SenderReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rtpTime, ok := uint32(0), false
+	if clock != nil {
+		rtpTime, ok = clock.rtpTime(now)
+	}
+	if !ok {
+		rtpTime = s.lastRTP + uint32(now.Sub(s.lastSent).Seconds()*s.clockRate)
+	}
+	return &rtcp.SenderReport{
+		SSRC:        s.ssrc,
+		NTPTime:     ntpTime(now),
+		RTPTime:     rtpTime,
+		PacketCount: s.packets,
+		OctetCount:  s.octets,
+	}
+}
+
+// ntpTime returns the NTP timestamp of t
+func ntpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix()) + 2208988800
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// senderReportInterceptor sends the sender reports of the SenderReports
+// in place of the report interceptor of pion
+type senderReportInterceptor struct {
+	interceptor.NoOp
+	reports *SenderReports
+	streams sync.Map
+	close   chan struct{}
+	once    sync.Once
+}
+
+type senderReportInterceptorFactory struct {
+	reports *SenderReports
+}
+
+func (f *senderReportInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &senderReportInterceptor{reports: f.reports, close: make(chan struct{})}, nil
+}
+
+func (i *senderReportInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	go i.loop(writer)
+	return writer
+}
+
+func (i *senderReportInterceptor) loop(writer interceptor.RTCPWriter) {
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.close:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		i.streams.Range(func(_, value interface{}) bool {
+			stream := value.(*reportedStream)
+			if _, err := writer.Write([]rtcp.Packet{stream.report(now, i.reports.clock(stream.ssrc))}, interceptor.Attributes{}); err != nil {
+				zap.S().Debugw("Unable to send sender report", "ssrc", stream.ssrc, "error", err)
+			}
+			return true
+		})
+	}
+}
+
+func (i *senderReportInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	stream := &reportedStream{ssrc: info.SSRC, clockRate: float64(info.ClockRate)}
+	i.streams.Store(info.SSRC, stream)
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		stream.lock.Lock()
+		stream.lastRTP, stream.lastSent = header.Timestamp, time.Now()
+		stream.packets++
+		stream.octets += uint32(len(payload))
+		stream.lock.Unlock()
+		return writer.Write(header, payload, a)
+	})
+}
+
+func (i *senderReportInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.streams.Delete(info.SSRC)
+	i.reports.forget(info.SSRC)
+}
+
+func (i *senderReportInterceptor) Close() error {
+	i.once.Do(func() { close(i.close) })
+	return nil
+}
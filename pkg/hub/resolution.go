@@ -0,0 +1,229 @@
+package hub
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// resolutionProbe is a TrackSink reading the resolution of a video track
+// from its keyframes, VP8 and H264 only
+type resolutionProbe struct {
+	mimeType string
+	// size packs the width in the high and the height in the low 32 bits
+	size atomic.Uint64
+	// onChange is called when the resolution changes, off the loop
+	onChange func()
+	// packet is parsed in place for every packet
+	packet rtp.Packet
+}
+
+func newResolutionProbe(codec webrtc.RTPCodecCapability, onChange func()) *resolutionProbe {
+	return &resolutionProbe{mimeType: codec.MimeType, onChange: onChange}
+}
+
+func (p *resolutionProbe) WriteRTP(raw []byte) error {
+	// Sinks are written by the forwarding loop of their track only
+	packet := &p.packet
+	if err := packet.Unmarshal(raw); err != nil {
+		return nil
+	}
+	var width, height int
+	var ok bool
+	switch {
+	case strings.EqualFold(p.mimeType, webrtc.MimeTypeVP8):
+		width, height, ok = vp8Resolution(packet.Payload)
+	case strings.EqualFold(p.mimeType, webrtc.MimeTypeH264):
+		width, height, ok = h264Resolution(packet.Payload)
+	}
+	if !ok {
+		return nil
+	}
+	size := uint64(width)<<32 | uint64(height)
+	if p.size.Swap(size) != size && p.onChange != nil {
+		p.onChange()
+	}
+	return nil
+}
+
+func (p *resolutionProbe) Close() error {
+	return nil
+}
+
+// resolution returns the last resolution seen, zeros while unknown
+func (p *resolutionProbe) resolution() (int, int) {
+	size := p.size.Load()
+	return int(size >> 32), int(size & 0xFFFFFFFF)
+}
+
+// vp8Resolution reads the frame size of a keyframe starting in payload
+func vp8Resolution(payload []byte) (int, int, bool) {
+	if !isVP8Keyframe(payload) {
+		return 0, 0, false
+	}
+	offset, ok := vp8HeaderOffset(payload)
+	// Frame tag, start code then the 14 bit width and height
+	if !ok || len(payload) < offset+10 || payload[offset+3] != 0x9d || payload[offset+4] != 0x01 || payload[offset+5] != 0x2a {
+		return 0, 0, false
+	}
+	width := int(binary.LittleEndian.Uint16(payload[offset+6:]) & 0x3FFF)
+	height := int(binary.LittleEndian.Uint16(payload[offset+8:]) & 0x3FFF)
+	return width, height, width > 0 && height > 0
+}
+
+// h264Resolution reads the frame size from an SPS in payload
+func h264Resolution(payload []byte) (int, int, bool) {
+	if len(payload) < 1 {
+		return 0, 0, false
+	}
+	switch nalType := payload[0] & 0x1F; nalType {
+	case 7:
+		return parseH264SPS(payload)
+	case 24: // STAP-A
+		for offset := 1; offset+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[offset:]))
+			offset += 2
+			if offset+size > len(payload) {
+				break
+			}
+			if payload[offset]&0x1F == 7 {
+				return parseH264SPS(payload[offset : offset+size])
+			}
+			offset += size
+		}
+	}
+	return 0, 0, false
+}
+
+// parseH264SPS decodes the frame size of a sequence parameter set NAL unit
+func parseH264SPS(nal []byte) (int, int, bool) {
+	// Drop the emulation prevention bytes
+	rbsp := make([]byte, 0, len(nal))
+	for i := 1; i < len(nal); i++ {
+		if i >= 3 && nal[i] == 3 && nal[i-1] == 0 && nal[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, nal[i])
+	}
+	r := &bitReader{data: rbsp}
+	profile := r.bits(8)
+	r.bits(16) // constraint flags and level
+	r.ue()     // seq_parameter_set_id
+	chromaFormat := uint(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat = r.ue(); chromaFormat == 3 {
+			r.bits(1) // separate_colour_plane_flag
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.bits(1) // qpprime_y_zero_transform_bypass_flag
+		if r.bits(1) == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1)
+		r.se()
+		r.se()
+		for i := r.ue(); i > 0 && !r.failed; i-- {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+	widthMBs := r.ue() + 1
+	heightMapUnits := r.ue() + 1
+	frameMBsOnly := r.bits(1)
+	if frameMBsOnly == 0 {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+	var cropLeft, cropRight, cropTop, cropBottom uint
+	if r.bits(1) == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.failed {
+		return 0, 0, false
+	}
+	cropX, cropY := uint(1), 2-frameMBsOnly
+	if chromaFormat == 1 || chromaFormat == 2 {
+		cropX = 2
+	}
+	if chromaFormat == 1 {
+		cropY *= 2
+	}
+	width := int(widthMBs*16) - int((cropLeft+cropRight)*cropX)
+	height := int((2-frameMBsOnly)*heightMapUnits*16) - int((cropTop+cropBottom)*cropY)
+	return width, height, width > 0 && height > 0
+}
+
+// bitReader reads the exp-Golomb coded fields of H264 parameter sets,
+// failed is set once reading past the end
+type bitReader struct {
+	data   []byte
+	offset int
+	failed bool
+}
+
+func (r *bitReader) bits(n int) uint {
+	value := uint(0)
+	for i := 0; i < n; i++ {
+		if r.offset >= len(r.data)*8 {
+			r.failed = true
+			return 0
+		}
+		bit := (r.data[r.offset/8] >> (7 - r.offset%8)) & 1
+		value = value<<1 | uint(bit)
+		r.offset++
+	}
+	return value
+}
+
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.failed || zeros >= 31 {
+			r.failed = true
+			return 0
+		}
+		zeros++
+	}
+	return (1<<zeros - 1) + r.bits(zeros)
+}
+
+func (r *bitReader) se() int {
+	value := r.ue()
+	if value%2 == 1 {
+		return int(value+1) / 2
+	}
+	return -int(value / 2)
+}
@@ -0,0 +1,164 @@
+package hub
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// retransmitCacheSize is how many packets of each video track are kept for
+// the NACKs of the receivers, about a second of 4Mbps video
+const retransmitCacheSize = 512
+
+// retransmitCache keeps the last packets forwarded on a video track, shared
+// by all its receivers instead of a send buffer per receiver
+type retransmitCache struct {
+	lock  sync.Mutex
+	slots [retransmitCacheSize]retransmitSlot
+}
+
+type retransmitSlot struct {
+	seq   uint16
+	valid bool
+	raw   []byte
+}
+
+func (c *retransmitCache) WriteRTP(packet []byte) error {
+	if len(packet) < 12 {
+		return nil
+	}
+	seq := binary.BigEndian.Uint16(packet[2:4])
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	slot := &c.slots[seq%retransmitCacheSize]
+	slot.seq, slot.valid = seq, true
+	slot.raw = append(slot.raw[:0], packet...)
+	return nil
+}
+
+func (c *retransmitCache) Close() error {
+	return nil
+}
+
+// get returns a copy of the packet seq, if still cached
+func (c *retransmitCache) get(seq uint16) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	slot := c.slots[seq%retransmitCacheSize]
+	if !slot.valid || slot.seq != seq {
+		return nil, false
+	}
+	return append([]byte(nil), slot.raw...), true
+}
+
+// Retransmitter answers the NACKs of a receiver from the caches of the
+// tracks it gets, writing to the streams its interceptor captured
+type Retransmitter struct {
+	lock    sync.Mutex
+	streams map[uint32]retransmitStream
+
+	retransmitted atomic.Uint64
+}
+
+type retransmitStream struct {
+	writer      interceptor.RTPWriter
+	payloadType uint8
+}
+
+func NewRetransmitter() *Retransmitter {
+	return &Retransmitter{streams: make(map[uint32]retransmitStream)}
+}
+
+// Retransmitted counts the packets resent to the receiver
+func (r *Retransmitter) Retransmitted() uint64 {
+	return r.retransmitted.Load()
+}
+
+// resend writes the cached packet raw to the stream ssrc, with the SSRC and
+// the payload type of that stream and the offsets of a layer selection
+func (r *Retransmitter) resend(ssrc uint32, raw []byte, seqOffset uint16, tsOffset uint32) error {
+	r.lock.Lock()
+	stream, ok := r.streams[ssrc]
+	r.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(raw); err != nil {
+		return err
+	}
+	packet.SSRC = ssrc
+	packet.PayloadType = stream.payloadType
+	packet.SequenceNumber += seqOffset
+	packet.Timestamp += tsOffset
+	if _, err := stream.writer.Write(&packet.Header, packet.Payload, nil); err != nil {
+		return err
+	}
+	r.retransmitted.Add(1)
+	return nil
+}
+
+// retransmit answers nack with the packets of the track key still cached,
+// those of a layer selection come from the layer it sends
+func (s *Broadcaster) retransmit(retransmitter *Retransmitter, key string, selection *layerSelection, nack *rtcp.TransportLayerNack) {
+	for _, pair := range nack.Nacks {
+		for _, seq := range pair.PacketList() {
+			source, original := key, seq
+			var seqOffset uint16
+			var tsOffset uint32
+			if selection != nil {
+				var ok bool
+				// Packets sent before the last switch are lost for good
+				if source, original, seqOffset, tsOffset, ok = selection.source(seq); !ok {
+					continue
+				}
+			}
+			s.sinkLock.RLock()
+			cache, ok := s.retransmits[source]
+			s.sinkLock.RUnlock()
+			if !ok {
+				continue
+			}
+			raw, ok := cache.get(original)
+			if !ok {
+				continue
+			}
+			if err := retransmitter.resend(nack.MediaSSRC, raw, seqOffset, tsOffset); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// retransmitInterceptor captures the local streams of a receiver connection
+// for its Retransmitter, it comes last in the chain so that resent packets
+// go through the other interceptors
+type retransmitInterceptor struct {
+	interceptor.NoOp
+	retransmitter *Retransmitter
+}
+
+type retransmitInterceptorFactory struct {
+	retransmitter *Retransmitter
+}
+
+func (f *retransmitInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &retransmitInterceptor{retransmitter: f.retransmitter}, nil
+}
+
+func (i *retransmitInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	i.retransmitter.lock.Lock()
+	defer i.retransmitter.lock.Unlock()
+	i.retransmitter.streams[info.SSRC] = retransmitStream{writer: writer, payloadType: info.PayloadType}
+	return writer
+}
+
+func (i *retransmitInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.retransmitter.lock.Lock()
+	defer i.retransmitter.lock.Unlock()
+	delete(i.retransmitter.streams, info.SSRC)
+}
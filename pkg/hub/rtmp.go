@@ -0,0 +1,684 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// rtmpHandshakeSize is the size of the C1, C2, S1 and S2 handshake packets
+const rtmpHandshakeSize = 1536
+
+// rtmpChunkSize is the chunk size of the messages sent
+const rtmpChunkSize = 4096
+
+// rtmpDialTimeout bounds the publishing of the stream without deadline
+const rtmpDialTimeout = 10 * time.Second
+
+// The default ports of RTMP and RTMPS
+const (
+	rtmpDefaultPort  = "1935"
+	rtmpsDefaultPort = "443"
+)
+
+// The RTMP message types, user control events and chunk streams used
+const (
+	rtmpSetChunkSize     = 1
+	rtmpAcknowledgement  = 3
+	rtmpUserControl      = 4
+	rtmpWindowAckSize    = 5
+	rtmpSetPeerBandwidth = 6
+	rtmpAudio            = 8
+	rtmpVideo            = 9
+	rtmpCommandAMF3      = 17
+	rtmpDataAMF0         = 18
+	rtmpCommandAMF0      = 20
+	rtmpPingRequest      = 6
+	rtmpPingResponse     = 7
+	rtmpControlChunk     = 2
+	rtmpCommandChunk     = 3
+	rtmpAudioChunk       = 4
+	rtmpVideoChunk       = 6
+)
+
+// The first bytes of the FLV tags, legacy AVC and Enhanced RTMP
+const (
+	rtmpAVCCodecID    = 7
+	rtmpAVCKeyframe   = 0x17
+	rtmpAVCInterframe = 0x27
+	rtmpAVCSequence   = 0
+	rtmpAVCNALU       = 1
+	rtmpExVideoHeader = 0x80
+	rtmpExAudioHeader = 0x90
+	rtmpExKeyframe    = 1 << 4
+	rtmpExInterframe  = 2 << 4
+	rtmpSequenceStart = 0
+	rtmpCodedFrames   = 1
+	rtmpCodedFramesX  = 3
+)
+
+// rtmpTarget splits an RTMP URL into the tcUrl of its application and the
+// stream key, the last segment of its path with the query
+func rtmpTarget(rawURL string) (*url.URL, string, string, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if target.Scheme != "rtmp" && target.Scheme != "rtmps" {
+		return nil, "", "", fmt.Errorf("unsupported scheme %q, rtmp or rtmps expected", target.Scheme)
+	}
+	path := strings.Trim(target.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	if slash < 0 {
+		return nil, "", "", errors.New("the URL has no application and stream key")
+	}
+	app, key := path[:slash], path[slash+1:]
+	if target.RawQuery != "" {
+		key += "?" + target.RawQuery
+	}
+	return target, app, key, nil
+}
+
+// RedactRTMPURL hides the stream key of an RTMP URL
+func RedactRTMPURL(rawURL string) string {
+	target, app, _, err := rtmpTarget(rawURL)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s://%s/%s/***", target.Scheme, target.Host, app)
+}
+
+// rtmpWriter sends the messages of a connection, of the client or of the
+// server
+type rtmpWriter struct {
+	lock   sync.Mutex
+	writer *bufio.Writer
+	// err is why the connection failed, guarded by lock
+	err error
+}
+
+// rtmpConn is an RTMP client connection publishing a stream
+type rtmpConn struct {
+	rtmpWriter
+	conn     net.Conn
+	reader   *rtmpReader
+	streamID uint32
+	once     sync.Once
+}
+
+// dialRTMP connects to the RTMP URL and publishes its stream key, the
+// server answers until ctx is done
+func dialRTMP(ctx context.Context, rawURL string) (*rtmpConn, error) {
+	target, app, key, err := rtmpTarget(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := target.Host
+	if target.Port() == "" {
+		port := rtmpDefaultPort
+		if target.Scheme == "rtmps" {
+			port = rtmpsDefaultPort
+		}
+		host = net.JoinHostPort(target.Hostname(), port)
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme == "rtmps" {
+		conn = tls.Client(conn, &tls.Config{ServerName: target.Hostname()})
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(rtmpDialTimeout)
+	}
+	conn.SetDeadline(deadline)
+	c := &rtmpConn{conn: conn, rtmpWriter: rtmpWriter{writer: bufio.NewWriter(conn)}, reader: newRTMPReader(conn)}
+	if err := c.publish(target, app, key); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	go c.readLoop()
+	return c, nil
+}
+
+// publish runs the handshake, connects to app and publishes key
+func (c *rtmpConn) publish(target *url.URL, app string, key string) error {
+	c1 := make([]byte, 1+rtmpHandshakeSize)
+	c1[0] = 3
+	if _, err := rand.Read(c1[9:]); err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(c1); err != nil {
+		return err
+	}
+	s := make([]byte, 1+2*rtmpHandshakeSize)
+	if _, err := io.ReadFull(c.reader.reader, s); err != nil {
+		return err
+	}
+	if s[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %d", s[0])
+	}
+	// C2 echoes S1
+	if _, err := c.conn.Write(s[1 : 1+rtmpHandshakeSize]); err != nil {
+		return err
+	}
+	if err := c.writeMessage(rtmpControlChunk, rtmpSetChunkSize, 0, 0, u32(rtmpChunkSize)); err != nil {
+		return err
+	}
+	tcURL := fmt.Sprintf("%s://%s/%s", target.Scheme, target.Host, app)
+	if err := c.command(0, "connect", 1, amf0Object{
+		"app":      app,
+		"type":     "nonprivate",
+		"flashVer": "FMLE/3.0 (compatible; webrtc-hub)",
+		"tcUrl":    tcURL,
+		// Enhanced RTMP, for VP9 and Opus
+		"fourCcList": []interface{}{"avc1", "vp09", "Opus"},
+	}); err != nil {
+		return err
+	}
+	if _, err := c.await(1); err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	c.command(0, "releaseStream", 2, nil, key)
+	c.command(0, "FCPublish", 3, nil, key)
+	if err := c.command(0, "createStream", 4, nil); err != nil {
+		return err
+	}
+	values, err := c.await(4)
+	if err != nil {
+		return fmt.Errorf("createStream: %w", err)
+	}
+	if len(values) < 4 {
+		return errors.New("createStream: no stream ID")
+	}
+	streamID, ok := values[3].(float64)
+	if !ok {
+		return errors.New("createStream: no stream ID")
+	}
+	c.streamID = uint32(streamID)
+	if err := c.command(c.streamID, "publish", 5, nil, key, "live"); err != nil {
+		return err
+	}
+	for {
+		message, err := c.reader.readMessage()
+		if err != nil {
+			return err
+		}
+		name, values := c.handle(message)
+		if name != "onStatus" || len(values) < 4 {
+			continue
+		}
+		status, _ := values[3].(amf0Object)
+		code, _ := status["code"].(string)
+		switch {
+		case code == "NetStream.Publish.Start":
+			return nil
+		case status["level"] == "error" || strings.HasSuffix(code, "BadName") || strings.HasSuffix(code, "Failed"):
+			return fmt.Errorf("publish: %s %v", code, status["description"])
+		}
+	}
+}
+
+// await reads the messages until the result of the command txn, returning
+// its values
+func (c *rtmpConn) await(txn float64) ([]interface{}, error) {
+	for {
+		message, err := c.reader.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		name, values := c.handle(message)
+		if len(values) < 2 || values[1] != txn {
+			continue
+		}
+		switch name {
+		case "_result":
+			return values, nil
+		case "_error":
+			if len(values) > 3 {
+				if status, ok := values[3].(amf0Object); ok {
+					return nil, fmt.Errorf("%v %v", status["code"], status["description"])
+				}
+			}
+			return nil, errors.New("rejected by the server")
+		}
+	}
+}
+
+// handle answers the pings of the server and decodes its commands
+func (c *rtmpConn) handle(message rtmpMessage) (string, []interface{}) {
+	switch message.messageType {
+	case rtmpUserControl:
+		if len(message.payload) >= 6 && binary.BigEndian.Uint16(message.payload) == rtmpPingRequest {
+			response := append(u16(rtmpPingResponse), message.payload[2:6]...)
+			c.writeMessage(rtmpControlChunk, rtmpUserControl, 0, 0, response)
+		}
+	case rtmpCommandAMF3, rtmpCommandAMF0:
+		payload := message.payload
+		if message.messageType == rtmpCommandAMF3 && len(payload) > 0 {
+			payload = payload[1:]
+		}
+		values := amf0Decode(payload)
+		if len(values) > 0 {
+			name, _ := values[0].(string)
+			return name, values
+		}
+	}
+	return "", nil
+}
+
+// readLoop keeps answering the server once publishing
+func (c *rtmpConn) readLoop() {
+	for {
+		message, err := c.reader.readMessage()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.handle(message)
+	}
+}
+
+func (c *rtmpWriter) command(streamID uint32, name string, txn float64, values ...interface{}) error {
+	payload := amf0Encode(append([]interface{}{name, txn}, values...)...)
+	return c.writeMessage(rtmpCommandChunk, rtmpCommandAMF0, streamID, 0, payload)
+}
+
+// writeMessage sends a message in chunks of rtmpChunkSize, their headers
+// are never compressed
+func (c *rtmpWriter) writeMessage(chunkStream byte, messageType byte, streamID uint32, timestamp uint32, payload []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	header := make([]byte, 0, 16)
+	stamp := timestamp
+	if stamp >= 0xFFFFFF {
+		stamp = 0xFFFFFF
+	}
+	header = append(header, chunkStream,
+		byte(stamp>>16), byte(stamp>>8), byte(stamp),
+		byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)),
+		messageType)
+	header = binary.LittleEndian.AppendUint32(header, streamID)
+	if stamp == 0xFFFFFF {
+		header = binary.BigEndian.AppendUint32(header, timestamp)
+	}
+	c.writer.Write(header)
+	for offset := 0; ; {
+		end := offset + rtmpChunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		c.writer.Write(payload[offset:end])
+		if offset = end; offset >= len(payload) {
+			break
+		}
+		// The next chunk of the message
+		c.writer.WriteByte(0xC0 | chunkStream)
+		if stamp == 0xFFFFFF {
+			c.writer.Write(u32(timestamp))
+		}
+	}
+	if err := c.writer.Flush(); err != nil {
+		c.err = err
+		return err
+	}
+	return nil
+}
+
+// fail records why the connection failed and closes it
+func (c *rtmpConn) fail(err error) {
+	c.lock.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.lock.Unlock()
+	c.Close()
+}
+
+// failure is why the connection failed, nil while publishing
+func (c *rtmpConn) failure() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if errors.Is(c.err, net.ErrClosed) {
+		return nil
+	}
+	return c.err
+}
+
+// Close unpublishes the stream and closes the connection
+func (c *rtmpConn) Close() error {
+	c.once.Do(func() {
+		c.command(c.streamID, "FCUnpublish", 6, nil)
+		c.command(0, "deleteStream", 7, nil, float64(c.streamID))
+		c.conn.Close()
+	})
+	return nil
+}
+
+// accepts the codecs of legacy and Enhanced RTMP the hub forwards
+func (c *rtmpConn) accepts(mimeType string) bool {
+	return strings.EqualFold(mimeType, webrtc.MimeTypeH264) ||
+		strings.EqualFold(mimeType, webrtc.MimeTypeVP9) ||
+		strings.EqualFold(mimeType, webrtc.MimeTypeOpus)
+}
+
+// create sends the metadata and the sequence headers of the tracks
+func (c *rtmpConn) create(tracks []mediaTrack, date time.Time) (frameWriter, error) {
+	metadata := amf0ECMAArray{"duration": 0.0, "encoder": "webrtc-hub"}
+	for _, track := range tracks {
+		var err error
+		switch {
+		case strings.EqualFold(track.mimeType, webrtc.MimeTypeH264):
+			metadata["width"], metadata["height"], metadata["videocodecid"] = float64(track.width), float64(track.height), float64(rtmpAVCCodecID)
+			err = c.writeMessage(rtmpVideoChunk, rtmpVideo, c.streamID, 0, append([]byte{rtmpAVCKeyframe, rtmpAVCSequence, 0, 0, 0}, track.codecPrivate...))
+		case strings.EqualFold(track.mimeType, webrtc.MimeTypeVP9):
+			metadata["width"], metadata["height"], metadata["videocodecid"] = float64(track.width), float64(track.height), float64(binary.BigEndian.Uint32([]byte("vp09")))
+			err = c.writeMessage(rtmpVideoChunk, rtmpVideo, c.streamID, 0, append([]byte{rtmpExVideoHeader | rtmpExKeyframe | rtmpSequenceStart, 'v', 'p', '0', '9'}, vp9CodecConfiguration()...))
+		default:
+			metadata["audiocodecid"], metadata["audiosamplerate"], metadata["audiochannels"] = float64(binary.BigEndian.Uint32([]byte("Opus"))), float64(track.clockRate), float64(track.channels)
+			err = c.writeMessage(rtmpAudioChunk, rtmpAudio, c.streamID, 0, append([]byte{rtmpExAudioHeader | rtmpSequenceStart, 'O', 'p', 'u', 's'}, opusHead(track.channels, track.clockRate)...))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := c.writeMessage(rtmpAudioChunk, rtmpDataAMF0, c.streamID, 0, amf0Encode("@setDataFrame", "onMetaData", metadata)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// writeFrame sends a frame as an FLV tag, H264 as AVC and the others with
+// the FourCC of Enhanced RTMP
+func (c *rtmpConn) writeFrame(track mediaTrack, at time.Duration, keyframe bool, frame []byte) error {
+	timestamp := uint32(at.Milliseconds())
+	var tag []byte
+	switch {
+	case strings.EqualFold(track.mimeType, webrtc.MimeTypeH264):
+		frameType := byte(rtmpAVCInterframe)
+		if keyframe {
+			frameType = rtmpAVCKeyframe
+		}
+		tag = append([]byte{frameType, rtmpAVCNALU, 0, 0, 0}, frame...)
+	case strings.EqualFold(track.mimeType, webrtc.MimeTypeVP9):
+		frameType := byte(rtmpExInterframe)
+		if keyframe {
+			frameType = rtmpExKeyframe
+		}
+		tag = append([]byte{rtmpExVideoHeader | frameType | rtmpCodedFramesX, 'v', 'p', '0', '9'}, frame...)
+	default:
+		tag = append([]byte{rtmpExAudioHeader | rtmpCodedFrames, 'O', 'p', 'u', 's'}, frame...)
+		return c.writeMessage(rtmpAudioChunk, rtmpAudio, c.streamID, timestamp, tag)
+	}
+	return c.writeMessage(rtmpVideoChunk, rtmpVideo, c.streamID, timestamp, tag)
+}
+
+// rtmpMessage is a message reassembled from its chunks, timestamp is in
+// milliseconds
+type rtmpMessage struct {
+	messageType byte
+	streamID    uint32
+	timestamp   uint32
+	payload     []byte
+}
+
+// rtmpChunk is the state of a chunk stream of the peer
+type rtmpChunk struct {
+	length      uint32
+	messageType byte
+	streamID    uint32
+	timestamp   uint32
+	delta       uint32
+	extended    bool
+	payload     []byte
+}
+
+// rtmpReader reassembles the messages of the peer
+type rtmpReader struct {
+	reader    *bufio.Reader
+	chunkSize uint32
+	chunks    map[uint32]*rtmpChunk
+}
+
+func newRTMPReader(reader io.Reader) *rtmpReader {
+	return &rtmpReader{reader: bufio.NewReader(reader), chunkSize: 128, chunks: make(map[uint32]*rtmpChunk)}
+}
+
+func (r *rtmpReader) readMessage() (rtmpMessage, error) {
+	for {
+		first, err := r.reader.ReadByte()
+		if err != nil {
+			return rtmpMessage{}, err
+		}
+		format, id := first>>6, uint32(first&0x3F)
+		switch id {
+		case 0:
+			b, err := r.reader.ReadByte()
+			if err != nil {
+				return rtmpMessage{}, err
+			}
+			id = 64 + uint32(b)
+		case 1:
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(r.reader, b); err != nil {
+				return rtmpMessage{}, err
+			}
+			id = 64 + uint32(b[0]) + uint32(b[1])<<8
+		}
+		chunk, ok := r.chunks[id]
+		if !ok {
+			chunk = &rtmpChunk{}
+			r.chunks[id] = chunk
+		}
+		header := make([]byte, []int{11, 7, 3, 0}[format])
+		if _, err := io.ReadFull(r.reader, header); err != nil {
+			return rtmpMessage{}, err
+		}
+		var stamp uint32
+		if format < 3 {
+			stamp = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+			chunk.extended = stamp == 0xFFFFFF
+		}
+		if format < 2 {
+			chunk.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+			chunk.messageType = header[6]
+		}
+		if format == 0 {
+			chunk.streamID = binary.LittleEndian.Uint32(header[7:])
+		}
+		if chunk.extended {
+			extended := make([]byte, 4)
+			if _, err := io.ReadFull(r.reader, extended); err != nil {
+				return rtmpMessage{}, err
+			}
+			stamp = binary.BigEndian.Uint32(extended)
+		}
+		// The first chunk of a message times it, absolutely or from the
+		// previous message of the chunk stream
+		switch {
+		case format == 0:
+			chunk.timestamp, chunk.delta = stamp, 0
+		case format < 3:
+			chunk.delta = stamp
+			chunk.timestamp += stamp
+		case len(chunk.payload) == 0:
+			chunk.timestamp += chunk.delta
+		}
+		size := chunk.length - uint32(len(chunk.payload))
+		if size > r.chunkSize {
+			size = r.chunkSize
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r.reader, data); err != nil {
+			return rtmpMessage{}, err
+		}
+		chunk.payload = append(chunk.payload, data...)
+		if uint32(len(chunk.payload)) < chunk.length {
+			continue
+		}
+		message := rtmpMessage{messageType: chunk.messageType, streamID: chunk.streamID, timestamp: chunk.timestamp, payload: chunk.payload}
+		chunk.payload = nil
+		if message.messageType == rtmpSetChunkSize && len(message.payload) >= 4 {
+			r.chunkSize = binary.BigEndian.Uint32(message.payload) & 0x7FFFFFFF
+		}
+		return message, nil
+	}
+}
+
+// amf0Object and amf0ECMAArray are the AMF0 objects and associative arrays
+type (
+	amf0Object    map[string]interface{}
+	amf0ECMAArray map[string]interface{}
+)
+
+// amf0Encode serializes numbers, booleans, strings, nil, objects and
+// strict arrays
+func amf0Encode(values ...interface{}) []byte {
+	data := []byte{}
+	properties := func(object map[string]interface{}) {
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			data = append(data, u16(uint16(len(name)))...)
+			data = append(data, name...)
+			data = append(data, amf0Encode(object[name])...)
+		}
+		data = append(data, 0, 0, 9)
+	}
+	for _, value := range values {
+		switch value := value.(type) {
+		case float64:
+			data = append(data, 0)
+			data = append(data, u64(math.Float64bits(value))...)
+		case bool:
+			data = append(data, 1, 0)
+			if value {
+				data[len(data)-1] = 1
+			}
+		case string:
+			data = append(data, 2)
+			data = append(data, u16(uint16(len(value)))...)
+			data = append(data, value...)
+		case amf0Object:
+			data = append(data, 3)
+			properties(value)
+		case amf0ECMAArray:
+			data = append(data, 8)
+			data = append(data, u32(uint32(len(value)))...)
+			properties(value)
+		case []interface{}:
+			data = append(data, 0x0A)
+			data = append(data, u32(uint32(len(value)))...)
+			data = append(data, amf0Encode(value...)...)
+		default:
+			data = append(data, 5)
+		}
+	}
+	return data
+}
+
+// amf0Decode parses the values of a command, it stops at the first it
+// does not know
+func amf0Decode(data []byte) []interface{} {
+	values := []interface{}{}
+	for len(data) > 0 {
+		value, rest, ok := amf0DecodeValue(data)
+		if !ok {
+			break
+		}
+		values, data = append(values, value), rest
+	}
+	return values
+}
+
+func amf0DecodeValue(data []byte) (interface{}, []byte, bool) {
+	if len(data) == 0 {
+		return nil, nil, false
+	}
+	marker, data := data[0], data[1:]
+	switch marker {
+	case 0:
+		if len(data) < 8 {
+			return nil, nil, false
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], true
+	case 1:
+		if len(data) < 1 {
+			return nil, nil, false
+		}
+		return data[0] != 0, data[1:], true
+	case 2:
+		if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+			return nil, nil, false
+		}
+		size := 2 + int(binary.BigEndian.Uint16(data))
+		return string(data[2:size]), data[size:], true
+	case 3, 8:
+		if marker == 8 {
+			if len(data) < 4 {
+				return nil, nil, false
+			}
+			data = data[4:]
+		}
+		object := amf0Object{}
+		for {
+			if len(data) < 3 {
+				return nil, nil, false
+			}
+			size := int(binary.BigEndian.Uint16(data))
+			if size == 0 && data[2] == 9 {
+				return object, data[3:], true
+			}
+			if len(data) < 2+size {
+				return nil, nil, false
+			}
+			name := string(data[2 : 2+size])
+			value, rest, ok := amf0DecodeValue(data[2+size:])
+			if !ok {
+				return nil, nil, false
+			}
+			object[name], data = value, rest
+		}
+	case 5, 6:
+		return nil, data, true
+	case 0x0A:
+		if len(data) < 4 {
+			return nil, nil, false
+		}
+		count := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		array := []interface{}{}
+		for i := uint32(0); i < count; i++ {
+			value, rest, ok := amf0DecodeValue(data)
+			if !ok {
+				return nil, nil, false
+			}
+			array, data = append(array, value), rest
+		}
+		return array, data, true
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,496 @@
+package hub
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// rtmpIngestTimeout drops the encoders silent for that long
+const rtmpIngestTimeout = 30 * time.Second
+
+// rtmpWindowSize is the acknowledgement window and the bandwidth told to
+// the encoders
+const rtmpWindowSize = 2500000
+
+// rtmpStreamID is the message stream created for the encoders to publish
+const rtmpStreamID = 1
+
+// The FLV audio formats and AAC packets used
+const (
+	rtmpAACFormat   = 10
+	rtmpAACSequence = 0
+	rtmpAACRaw      = 1
+)
+
+// AudioTranscoder makes Opus of the audio the ingests carry in codecs
+// the WebRTC receivers do not play
+type AudioTranscoder interface {
+	// NewAACTranscoder takes ADTS framed AAC, output is called with its
+	// Opus packets of 20ms at 48kHz, in order
+	NewAACTranscoder(output func(packet []byte)) (io.WriteCloser, error)
+}
+
+// RTMPServer takes the streams of the RTMP encoders, such as OBS, as
+// ingest tracks forwarded with those of the WebRTC publishers. H264 and,
+// with Enhanced RTMP, VP9 and Opus are forwarded as they come, AAC is
+// transcoded to Opus. The encoders must not send B-frames, which WebRTC
+// does not carry.
+type RTMPServer struct {
+	// lookup finds the stream published with a stream key
+	lookup func(key string) (*Broadcaster, string, bool)
+	// authorize checks the token of the stream key, nil accepts any
+	authorize  func(token string) bool
+	transcoder AudioTranscoder
+
+	lock     sync.Mutex
+	listener net.Listener
+	conns    map[*rtmpIngest]bool
+	closed   bool
+}
+
+// NewRTMPServer takes the streams lookup finds from the stream keys, sent
+// as {key}?token={token} and published once authorize accepts the token.
+// The AAC audio is transcoded with transcoder.
+func NewRTMPServer(lookup func(key string) (b *Broadcaster, streamID string, ok bool), authorize func(token string) bool, transcoder AudioTranscoder) *RTMPServer {
+	return &RTMPServer{lookup: lookup, authorize: authorize, transcoder: transcoder, conns: make(map[*rtmpIngest]bool)}
+}
+
+// ingestKeyToken splits the token off a stream key sent as
+// {key}?token={token}
+func ingestKeyToken(key string) (string, string) {
+	key, query, _ := strings.Cut(key, "?")
+	values, _ := url.ParseQuery(query)
+	return key, values.Get("token")
+}
+
+// Serve accepts the encoders on listener until the server is closed
+func (r *RTMPServer) Serve(listener net.Listener) error {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return net.ErrClosed
+	}
+	r.listener = listener
+	r.lock.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if r.closed {
+				return nil
+			}
+			return err
+		}
+		c := &rtmpIngest{server: r, conn: conn, rtmpWriter: rtmpWriter{writer: bufio.NewWriter(conn)}}
+		c.reader = newRTMPReader(c)
+		r.lock.Lock()
+		r.conns[c] = true
+		r.lock.Unlock()
+		go c.serve()
+	}
+}
+
+// Close stops accepting encoders and ends their streams
+func (r *RTMPServer) Close() error {
+	r.lock.Lock()
+	r.closed = true
+	if r.listener != nil {
+		r.listener.Close()
+	}
+	conns := r.conns
+	r.conns = make(map[*rtmpIngest]bool)
+	r.lock.Unlock()
+	for c := range conns {
+		c.conn.Close()
+	}
+	return nil
+}
+
+// rtmpIngest is the connection of an encoder, it publishes at most one
+// stream
+type rtmpIngest struct {
+	rtmpWriter
+	server *RTMPServer
+	conn   net.Conn
+	reader *rtmpReader
+	// received counts the bytes read, acknowledged every window of the
+	// encoder
+	received, acknowledged uint64
+	window                 uint64
+
+	broadcaster *Broadcaster
+	streamID    string
+	// start is the wall clock of the timestamp 0 of the encoder, shared by
+	// its tracks for them to stay in sync
+	start        time.Time
+	video, audio *packetizedTrack
+	// avcC and aac are the sequence headers of the H264 video and of the
+	// AAC audio
+	avcC, aac []byte
+}
+
+// Read reads from the connection, counting the bytes to acknowledge
+func (c *rtmpIngest) Read(p []byte) (int, error) {
+	c.conn.SetReadDeadline(time.Now().Add(rtmpIngestTimeout))
+	n, err := c.conn.Read(p)
+	c.received += uint64(n)
+	return n, err
+}
+
+func (c *rtmpIngest) serve() {
+	logger := zap.S().With("remoteAddr", c.conn.RemoteAddr().String(), "transport", "rtmp")
+	defer func() {
+		c.unpublish()
+		c.conn.Close()
+		c.server.lock.Lock()
+		delete(c.server.conns, c)
+		c.server.lock.Unlock()
+	}()
+	if err := c.handshake(); err != nil {
+		logger.Debugw("RTMP handshake failed", "error", err)
+		return
+	}
+	for {
+		message, err := c.reader.readMessage()
+		if err != nil {
+			if c.broadcaster != nil {
+				logger.Infow("RTMP stream ended", "streamID", c.streamID, "error", err)
+			}
+			return
+		}
+		if err := c.handle(message, logger); err != nil {
+			if c.broadcaster != nil {
+				logger.Infow("RTMP stream ended", "streamID", c.streamID, "error", err)
+			}
+			return
+		}
+		if c.window > 0 && c.received-c.acknowledged >= c.window {
+			c.acknowledged = c.received
+			if err := c.writeMessage(rtmpControlChunk, rtmpAcknowledgement, 0, 0, u32(uint32(c.received))); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handshake reads C0 and C1, sends S0, S1 and S2 and reads C2
+func (c *rtmpIngest) handshake() error {
+	c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(c.reader.reader, c1); err != nil {
+		return err
+	}
+	if c1[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %d", c1[0])
+	}
+	s := make([]byte, 1+2*rtmpHandshakeSize)
+	s[0] = 3
+	if _, err := rand.Read(s[9 : 1+rtmpHandshakeSize]); err != nil {
+		return err
+	}
+	// S2 echoes C1
+	copy(s[1+rtmpHandshakeSize:], c1[1:])
+	if _, err := c.conn.Write(s); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(c.reader.reader, make([]byte, rtmpHandshakeSize))
+	return err
+}
+
+// handle answers the commands and ingests the media of the encoder
+func (c *rtmpIngest) handle(message rtmpMessage, logger *zap.SugaredLogger) error {
+	switch message.messageType {
+	case rtmpWindowAckSize:
+		if len(message.payload) >= 4 {
+			c.window = uint64(binary.BigEndian.Uint32(message.payload))
+		}
+	case rtmpCommandAMF3, rtmpCommandAMF0:
+		payload := message.payload
+		if message.messageType == rtmpCommandAMF3 && len(payload) > 0 {
+			payload = payload[1:]
+		}
+		values := amf0Decode(payload)
+		if len(values) < 2 {
+			return nil
+		}
+		name, _ := values[0].(string)
+		txn, _ := values[1].(float64)
+		return c.answer(name, txn, values[2:], logger)
+	case rtmpVideo:
+		if c.broadcaster != nil {
+			return c.ingestVideo(message.timestamp, message.payload)
+		}
+	case rtmpAudio:
+		if c.broadcaster != nil {
+			return c.ingestAudio(message.timestamp, message.payload)
+		}
+	}
+	return nil
+}
+
+// answer replies to a command of the encoder, the connection is closed on
+// error
+func (c *rtmpIngest) answer(name string, txn float64, values []interface{}, logger *zap.SugaredLogger) error {
+	switch name {
+	case "connect":
+		if err := c.writeMessage(rtmpControlChunk, rtmpWindowAckSize, 0, 0, u32(rtmpWindowSize)); err != nil {
+			return err
+		}
+		// Dynamic limit
+		if err := c.writeMessage(rtmpControlChunk, rtmpSetPeerBandwidth, 0, 0, append(u32(rtmpWindowSize), 2)); err != nil {
+			return err
+		}
+		if err := c.writeMessage(rtmpControlChunk, rtmpSetChunkSize, 0, 0, u32(rtmpChunkSize)); err != nil {
+			return err
+		}
+		return c.command(0, "_result", txn, amf0Object{
+			"fmsVer":       "FMS/3,0,1,123",
+			"capabilities": 31.0,
+			// Enhanced RTMP, for VP9 and Opus
+			"fourCcList": []interface{}{"avc1", "vp09", "Opus"},
+		}, amf0Object{
+			"level":          "status",
+			"code":           "NetConnection.Connect.Success",
+			"description":    "Connection succeeded.",
+			"objectEncoding": 0.0,
+		})
+	case "releaseStream", "FCPublish":
+		return c.command(0, "_result", txn, nil)
+	case "createStream":
+		return c.command(0, "_result", txn, nil, float64(rtmpStreamID))
+	case "publish":
+		key := ""
+		if len(values) > 1 {
+			key, _ = values[1].(string)
+		}
+		// The token is not logged
+		key, token := ingestKeyToken(key)
+		if err := c.publish(key, token); err != nil {
+			logger.Infow("RTMP publish rejected", "key", key, "error", err)
+			c.status("error", "NetStream.Publish.BadName", err.Error())
+			return err
+		}
+		logger.Infow("RTMP stream published", "streamID", c.streamID)
+		return c.status("status", "NetStream.Publish.Start", c.streamID+" is published")
+	case "FCUnpublish", "closeStream", "deleteStream":
+		return io.EOF
+	}
+	return nil
+}
+
+// status sends an onStatus event of the stream
+func (c *rtmpIngest) status(level string, code string, description string) error {
+	return c.command(rtmpStreamID, "onStatus", 0, nil, amf0Object{
+		"level":       level,
+		"code":        code,
+		"description": description,
+	})
+}
+
+// publish starts ingesting the stream of key once its token is accepted
+func (c *rtmpIngest) publish(key string, token string) error {
+	if c.broadcaster != nil {
+		return errors.New("a stream is already published")
+	}
+	if c.server.authorize != nil && !c.server.authorize(token) {
+		return errors.New("invalid token")
+	}
+	b, streamID, ok := c.server.lookup(key)
+	if !ok {
+		return errors.New("unknown stream key")
+	}
+	if err := b.acceptsIngest(); err != nil {
+		return err
+	}
+	c.broadcaster, c.streamID, c.start = b, streamID, time.Now()
+	return nil
+}
+
+// unpublish ends the tracks of the stream
+func (c *rtmpIngest) unpublish() {
+	for _, track := range []*packetizedTrack{c.video, c.audio} {
+		if track != nil {
+			track.Close()
+		}
+	}
+}
+
+// ingestVideo forwards the H264 frames as Annex B, with the parameter sets
+// on the keyframes, and the VP9 frames of Enhanced RTMP
+func (c *rtmpIngest) ingestVideo(timestamp uint32, tag []byte) error {
+	if len(tag) < 5 {
+		return nil
+	}
+	mimeType, sequence, keyframe := webrtc.MimeTypeH264, false, tag[0]>>4 == 1
+	var data []byte
+	var cts int32
+	if tag[0]&rtmpExVideoHeader != 0 {
+		keyframe = tag[0]&0x70 == rtmpExKeyframe
+		switch string(tag[1:5]) {
+		case "vp09":
+			mimeType = webrtc.MimeTypeVP9
+		case "avc1":
+		default:
+			return fmt.Errorf("unsupported video codec %q", tag[1:5])
+		}
+		data = tag[5:]
+		switch tag[0] & 0x0F {
+		case rtmpSequenceStart:
+			sequence = true
+		case rtmpCodedFrames:
+			if mimeType == webrtc.MimeTypeH264 {
+				if len(data) < 3 {
+					return nil
+				}
+				cts, data = int32(uint32(data[0])<<24|uint32(data[1])<<16|uint32(data[2])<<8)>>8, data[3:]
+			}
+		case rtmpCodedFramesX:
+		default:
+			return nil
+		}
+	} else {
+		if tag[0]&0x0F != rtmpAVCCodecID {
+			return fmt.Errorf("unsupported video codec %d", tag[0]&0x0F)
+		}
+		switch tag[1] {
+		case rtmpAVCSequence:
+			sequence = true
+		case rtmpAVCNALU:
+		default:
+			return nil
+		}
+		cts, data = int32(uint32(tag[2])<<24|uint32(tag[3])<<16|uint32(tag[4])<<8)>>8, tag[5:]
+	}
+
+	if mimeType == webrtc.MimeTypeH264 {
+		if sequence {
+			c.avcC = append([]byte(nil), data...)
+			return nil
+		}
+		if len(c.avcC) < 6 {
+			// No parameter sets to start from
+			return nil
+		}
+		data = c.annexB(data, keyframe)
+	} else if sequence {
+		return nil
+	}
+
+	if c.video == nil {
+		if !keyframe {
+			return nil
+		}
+		codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"}
+		var payloader rtp.Payloader = &codecs.VP9Payloader{}
+		if mimeType == webrtc.MimeTypeH264 {
+			codec, payloader = ingestH264Codec(c.avcC[1:4]), &codecs.H264Payloader{}
+		}
+		var err error
+		if c.video, err = c.broadcaster.addPacketizedTrack(codec, "video", c.streamID, payloader); err != nil {
+			return err
+		}
+	}
+	pts := int64(timestamp) + int64(cts)
+	return c.video.write(data, keyframe, uint32(pts*90), c.start.Add(time.Duration(pts)*time.Millisecond))
+}
+
+// annexB converts an H264 frame of the encoder, the keyframes get the
+// parameter sets of its sequence header
+func (c *rtmpIngest) annexB(frame []byte, keyframe bool) []byte {
+	data := []byte{}
+	if keyframe {
+		data = avcParameterSets(c.avcC)
+	}
+	lengthSize := int(c.avcC[4]&0x03) + 1
+	for offset := 0; offset+lengthSize <= len(frame); {
+		size := 0
+		for _, b := range frame[offset : offset+lengthSize] {
+			size = size<<8 | int(b)
+		}
+		offset += lengthSize
+		if size == 0 || offset+size > len(frame) {
+			break
+		}
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, frame[offset:offset+size]...)
+		offset += size
+	}
+	return data
+}
+
+// ingestAudio forwards the Opus frames of Enhanced RTMP, the AAC frames
+// are transcoded
+func (c *rtmpIngest) ingestAudio(timestamp uint32, tag []byte) error {
+	if len(tag) < 2 {
+		return nil
+	}
+	if tag[0]&0xF0 == rtmpExAudioHeader {
+		if len(tag) < 5 || string(tag[1:5]) != "Opus" {
+			return fmt.Errorf("unsupported audio codec %q", tag[1:])
+		}
+		if tag[0]&0x0F != rtmpCodedFrames {
+			return nil
+		}
+		if c.audio == nil {
+			var err error
+			if c.audio, err = c.broadcaster.addPacketizedTrack(ingestOpusCodec(), "audio", c.streamID, &codecs.OpusPayloader{}); err != nil {
+				return err
+			}
+		}
+		return c.audio.write(tag[5:], true, timestamp*48, c.start.Add(time.Duration(timestamp)*time.Millisecond))
+	}
+	if tag[0]>>4 != rtmpAACFormat {
+		return fmt.Errorf("unsupported audio format %d", tag[0]>>4)
+	}
+	switch tag[1] {
+	case rtmpAACSequence:
+		c.aac = append([]byte(nil), tag[2:]...)
+		return nil
+	case rtmpAACRaw:
+	default:
+		return nil
+	}
+	if len(c.aac) < 2 {
+		return nil
+	}
+	if c.audio == nil {
+		var err error
+		if c.audio, err = c.broadcaster.addTranscodedTrack(c.server.transcoder, "audio", c.streamID, timestamp*48, c.start.Add(time.Duration(timestamp)*time.Millisecond)); err != nil {
+			return err
+		}
+	}
+	_, err := c.audio.transcoder.Write(adtsFrame(c.aac, tag[2:]))
+	return err
+}
+
+// adtsFrame frames a raw AAC frame with the ADTS header of its
+// AudioSpecificConfig
+func adtsFrame(config []byte, frame []byte) []byte {
+	profile := config[0]>>3 - 1
+	frequency := (config[0]&0x07)<<1 | config[1]>>7
+	channels := config[1] >> 3 & 0x0F
+	size := 7 + len(frame)
+	header := []byte{
+		0xFF, 0xF1,
+		profile<<6 | frequency<<2 | channels>>2,
+		channels<<6 | byte(size>>11),
+		byte(size >> 3),
+		byte(size<<5) | 0x1F,
+		0xFC,
+	}
+	return append(header, frame...)
+}
@@ -0,0 +1,266 @@
+package hub
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"go.uber.org/zap"
+)
+
+// rtpIngestTimeout is how long the streams of an RTP ingest may stay
+// silent, they end after it
+const rtpIngestTimeout = 10 * time.Second
+
+// rtpIngestMTU bounds the UDP datagrams read by the RTP ingests
+const rtpIngestMTU = 1500
+
+// RTPIngest takes the RTP streams an SDP description announces on its UDP
+// ports, e.g. written by ffmpeg -f rtp -sdp_file, without any signaling.
+// They are forwarded with the stream key of the ingest while packets come.
+type RTPIngest struct {
+	key        string
+	lookup     func(key string) (*Broadcaster, string, bool)
+	transcoder AudioTranscoder
+	medias     []rtpIngestMedia
+}
+
+// rtpIngestMedia is a media of the description and the ports it is sent
+// to, rtcp is nil when RTCP is muxed with RTP
+type rtpIngestMedia struct {
+	description *sdp.MediaDescription
+	rtp         *net.UDPAddr
+	rtcp        *net.UDPAddr
+}
+
+// NewRTPIngest listens for the video and audio of description, forwarded
+// as the stream found by lookup with key
+func NewRTPIngest(description []byte, key string, lookup func(key string) (*Broadcaster, string, bool), transcoder AudioTranscoder) (*RTPIngest, error) {
+	session := &sdp.SessionDescription{}
+	if err := session.Unmarshal(description); err != nil {
+		return nil, err
+	}
+	i := &RTPIngest{key: key, lookup: lookup, transcoder: transcoder}
+	kinds := map[string]bool{}
+	for _, media := range session.MediaDescriptions {
+		kind := media.MediaName.Media
+		if kind != "video" && kind != "audio" {
+			continue
+		}
+		if kinds[kind] {
+			return nil, fmt.Errorf("a single %s media is supported", kind)
+		}
+		if _, ok := newDescribedTrack(media); !ok {
+			return nil, fmt.Errorf("%s: unsupported codec", kind)
+		}
+		connection := media.ConnectionInformation
+		if connection == nil {
+			connection = session.ConnectionInformation
+		}
+		ip := net.IPv4zero
+		if connection != nil && connection.Address != nil {
+			// The TTL of the multicast addresses is dropped
+			address, _, _ := strings.Cut(connection.Address.Address, "/")
+			if ip = net.ParseIP(address); ip == nil {
+				return nil, fmt.Errorf("%s: invalid address %q", kind, connection.Address.Address)
+			}
+		}
+		port := media.MediaName.Port.Value
+		if port <= 0 {
+			return nil, fmt.Errorf("%s: invalid port %d", kind, port)
+		}
+		m := rtpIngestMedia{description: media, rtp: &net.UDPAddr{IP: ip, Port: port}}
+		if _, ok := media.Attribute("rtcp-mux"); !ok {
+			rtcpPort := port + 1
+			if value, ok := media.Attribute("rtcp"); ok {
+				field, _, _ := strings.Cut(value, " ")
+				if rtcpPort, _ = strconv.Atoi(field); rtcpPort <= 0 {
+					return nil, fmt.Errorf("%s: invalid RTCP port %q", kind, value)
+				}
+			}
+			m.rtcp = &net.UDPAddr{IP: ip, Port: rtcpPort}
+		}
+		kinds[kind] = true
+		i.medias = append(i.medias, m)
+	}
+	if len(i.medias) == 0 {
+		return nil, errors.New("no video nor audio media")
+	}
+	return i, nil
+}
+
+// Addresses lists the UDP addresses the ingest listens on
+func (i *RTPIngest) Addresses() []string {
+	addresses := []string{}
+	for _, media := range i.medias {
+		addresses = append(addresses, media.rtp.String())
+		if media.rtcp != nil {
+			addresses = append(addresses, media.rtcp.String())
+		}
+	}
+	return addresses
+}
+
+// rtpIngestPacket is a datagram of a port of the ingest
+type rtpIngestPacket struct {
+	media int
+	rtcp  bool
+	data  []byte
+}
+
+// rtpIngestSession is the stream forwarded while the packets come, the
+// tracks are those of the medias
+type rtpIngestSession struct {
+	tracks []*describedTrack
+	ssrcs  []uint32
+	clock  reportClock
+	// rejected streams are dropped until they stop
+	rejected bool
+}
+
+// Serve forwards the streams until ctx is done
+func (i *RTPIngest) Serve(ctx context.Context) error {
+	conns := []*net.UDPConn{}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	listen := func(address *net.UDPAddr) (*net.UDPConn, error) {
+		if address.IP.IsMulticast() {
+			return net.ListenMulticastUDP("udp", nil, address)
+		}
+		return net.ListenUDP("udp", address)
+	}
+	packets := make(chan rtpIngestPacket, ingestQueue)
+	for index, media := range i.medias {
+		for _, address := range []*net.UDPAddr{media.rtp, media.rtcp} {
+			if address == nil {
+				continue
+			}
+			conn, err := listen(address)
+			if err != nil {
+				return err
+			}
+			conns = append(conns, conn)
+			go i.read(ctx, conn, index, address == media.rtcp, packets)
+		}
+	}
+
+	logger := zap.S().With("key", i.key, "transport", "rtp")
+	var session *rtpIngestSession
+	end := func() {
+		if session != nil {
+			for _, track := range session.tracks {
+				track.close()
+			}
+			if !session.rejected {
+				logger.Infow("RTP ingest ended")
+			}
+			session = nil
+		}
+	}
+	defer end()
+	silence := time.NewTimer(rtpIngestTimeout)
+	defer silence.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-silence.C:
+			end()
+			continue
+		case packet := <-packets:
+			// RTCP muxed with RTP has the payload types 64 to 95 once the
+			// marker bit is dropped
+			if !packet.rtcp && len(packet.data) > 1 && packet.data[1]&0x7F >= 64 && packet.data[1]&0x7F < 96 {
+				packet.rtcp = true
+			}
+			if packet.rtcp {
+				if session != nil && !session.rejected {
+					session.clock.report(session.tracks[packet.media], packet.data)
+				}
+				continue
+			}
+			if len(packet.data) < 12 || packet.data[0]>>6 != 2 {
+				continue
+			}
+			if !silence.Stop() {
+				select {
+				case <-silence.C:
+				default:
+				}
+			}
+			silence.Reset(rtpIngestTimeout)
+			ssrc := binary.BigEndian.Uint32(packet.data[8:])
+			if session != nil && session.ssrcs[packet.media] != 0 && session.ssrcs[packet.media] != ssrc {
+				// The sender was restarted
+				end()
+			}
+			if session == nil {
+				var err error
+				if session, err = i.start(); err != nil {
+					logger.Warnw("RTP ingest rejected", "error", err)
+					session = &rtpIngestSession{rejected: true}
+				} else {
+					logger.Infow("RTP ingest started")
+				}
+			}
+			if session.rejected {
+				continue
+			}
+			session.ssrcs[packet.media] = ssrc
+			if err := session.tracks[packet.media].forward(packet.data); err != nil {
+				logger.Warnw("RTP ingest failed", "error", err)
+				end()
+			}
+		}
+	}
+}
+
+// start forwards the tracks of the medias as the stream of the key
+func (i *RTPIngest) start() (*rtpIngestSession, error) {
+	// The room is looked up on every stream as it is reaped in between
+	broadcaster, streamID, ok := i.lookup(i.key)
+	if !ok {
+		return nil, errors.New("invalid stream key")
+	}
+	if err := broadcaster.acceptsIngest(); err != nil {
+		return nil, err
+	}
+	session := &rtpIngestSession{ssrcs: make([]uint32, len(i.medias))}
+	for _, media := range i.medias {
+		// Validated by NewRTPIngest
+		track, _ := newDescribedTrack(media.description)
+		session.tracks = append(session.tracks, track)
+		if err := track.start(broadcaster, streamID, i.transcoder); err != nil {
+			for _, track := range session.tracks {
+				track.close()
+			}
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// read queues the datagrams of conn until it is closed
+func (i *RTPIngest) read(ctx context.Context, conn *net.UDPConn, media int, rtcp bool, packets chan<- rtpIngestPacket) {
+	buffer := make([]byte, rtpIngestMTU)
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case packets <- rtpIngestPacket{media: media, rtcp: rtcp, data: append([]byte(nil), buffer[:n]...)}:
+		}
+	}
+}
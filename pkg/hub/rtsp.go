@@ -0,0 +1,660 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// rtspSessionTimeout is how long a client may stay silent, it sends a
+// keepalive request before
+const rtspSessionTimeout = 60 * time.Second
+
+// rtspWriteTimeout drops the clients not reading their interleaved packets
+const rtspWriteTimeout = 5 * time.Second
+
+// rtspPayloadType is the dynamic payload type of the first track described,
+// the next ones follow
+const rtspPayloadType = 96
+
+// rtspMethods are the methods the server answers
+const rtspMethods = "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"
+
+var rtspStatusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	403: "Forbidden",
+	404: "Not Found",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	461: "Unsupported Transport",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+}
+
+// RTSPServer serves the live streams of the hub to RTSP clients, such as
+// players, video recorders and analytics boxes. The RTP packets forwarded
+// to the receivers are sent as they are, interleaved on the connection or
+// over UDP, with their payload type renumbered after the description.
+type RTSPServer struct {
+	// lookup finds the stream at a path of the URLs
+	lookup func(path string) (*Broadcaster, string, bool)
+
+	lock     sync.Mutex
+	listener net.Listener
+	conns    map[*rtspConn]bool
+	closed   bool
+}
+
+// NewRTSPServer serves the streams lookup finds from the path of the URLs,
+// rtsp://host:port/{path}
+func NewRTSPServer(lookup func(path string) (b *Broadcaster, streamID string, ok bool)) *RTSPServer {
+	return &RTSPServer{lookup: lookup, conns: make(map[*rtspConn]bool)}
+}
+
+// Serve accepts the clients on listener until the server is closed
+func (r *RTSPServer) Serve(listener net.Listener) error {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return net.ErrClosed
+	}
+	r.listener = listener
+	r.lock.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if r.closed {
+				return nil
+			}
+			return err
+		}
+		c := &rtspConn{server: r, conn: conn}
+		r.lock.Lock()
+		r.conns[c] = true
+		r.lock.Unlock()
+		go c.serve()
+	}
+}
+
+// Close stops accepting clients and ends the sessions
+func (r *RTSPServer) Close() error {
+	r.lock.Lock()
+	r.closed = true
+	if r.listener != nil {
+		r.listener.Close()
+	}
+	conns := r.conns
+	r.conns = make(map[*rtspConn]bool)
+	r.lock.Unlock()
+	for c := range conns {
+		c.conn.Close()
+	}
+	return nil
+}
+
+// streamMedia is a track of a stream described in SDP to the RTSP clients
+// and the pipe egresses
+type streamMedia struct {
+	key   string
+	codec webrtc.RTPCodecCapability
+}
+
+// streamMedia returns the tracks of streamID, without the spare simulcast
+// layers
+func (s *Broadcaster) streamMedia(streamID string) ([]streamMedia, error) {
+	medias := []streamMedia{}
+	opaque := false
+	if !s.do(func() {
+		if opaque = s.opaque(); opaque {
+			return
+		}
+		for _, key := range s.streamKeys(streamID) {
+			if track, ok := s.senders[key].(*webrtc.TrackLocalStaticRTP); ok {
+				medias = append(medias, streamMedia{key: key, codec: track.Codec()})
+			}
+		}
+	}) {
+		return nil, errClosed
+	}
+	if opaque {
+		return nil, errors.New("end-to-end encrypted media cannot be sent as RTP")
+	}
+	if len(medias) == 0 {
+		return nil, ErrUnknownStream
+	}
+	return medias, nil
+}
+
+// playRTSP attaches the tracks of the session and asks their publishers
+// for a keyframe, it must run on the loop
+func (s *Broadcaster) playRTSP(session *rtspSession) error {
+	for _, track := range session.tracks {
+		if _, ok := s.senders[track.key]; !ok {
+			return ErrUnknownStream
+		}
+	}
+	s.sinkLock.Lock()
+	for _, track := range session.tracks {
+		track.clock = s.trackClock(track.key, nil)
+		if _, ok := s.sinks[track.key]; !ok {
+			s.sinks[track.key] = make(map[TrackSink]bool)
+		}
+		s.sinks[track.key][track] = true
+	}
+	s.sinkLock.Unlock()
+	for _, track := range session.tracks {
+		s.requestKeyframe(track.key, keyframeSubscriber)
+	}
+	return nil
+}
+
+// rtspConn is the connection of a client, it holds at most one session
+type rtspConn struct {
+	server    *RTSPServer
+	conn      net.Conn
+	writeLock sync.Mutex
+	session   *rtspSession
+}
+
+// rtspRequest is a request of a client
+type rtspRequest struct {
+	method string
+	url    *url.URL
+	header textproto.MIMEHeader
+	cseq   string
+}
+
+func (c *rtspConn) serve() {
+	logger := zap.S().With("remoteAddr", c.conn.RemoteAddr().String(), "transport", "rtsp")
+	defer func() {
+		if c.session != nil {
+			c.session.close()
+		}
+		c.conn.Close()
+		c.server.lock.Lock()
+		delete(c.server.conns, c)
+		c.server.lock.Unlock()
+	}()
+	reader := bufio.NewReader(c.conn)
+	text := textproto.NewReader(reader)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(rtspSessionTimeout))
+		first, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		if first[0] == '$' {
+			// The RTCP receiver reports of an interleaved client
+			frame := make([]byte, 4)
+			if _, err := io.ReadFull(reader, frame); err != nil {
+				return
+			}
+			if _, err := reader.Discard(int(binary.BigEndian.Uint16(frame[2:]))); err != nil {
+				return
+			}
+			continue
+		}
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !strings.HasPrefix(fields[2], "RTSP/1.") {
+			logger.Infow("Invalid RTSP request", "line", line)
+			return
+		}
+		header, err := text.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		if length := header.Get("Content-Length"); length != "" {
+			size, err := strconv.Atoi(length)
+			if err != nil || size < 0 {
+				return
+			}
+			if _, err := reader.Discard(size); err != nil {
+				return
+			}
+		}
+		request := rtspRequest{method: fields[0], header: header, cseq: header.Get("CSeq")}
+		if request.url, err = url.Parse(fields[1]); err != nil {
+			if c.respond(request, 400, nil, nil) != nil {
+				return
+			}
+			continue
+		}
+		if err := c.handle(request, logger); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a request, the connection is closed on error
+func (c *rtspConn) handle(request rtspRequest, logger *zap.SugaredLogger) error {
+	switch request.method {
+	case "OPTIONS":
+		return c.respond(request, 200, []string{"Public", rtspMethods}, nil)
+	case "DESCRIBE":
+		return c.describe(request)
+	case "SETUP":
+		return c.setup(request)
+	case "PLAY":
+		return c.play(request, logger)
+	case "TEARDOWN":
+		if !c.hasSession(request) {
+			return c.respond(request, 454, nil, nil)
+		}
+		c.session.close()
+		c.session = nil
+		return c.respond(request, 200, nil, nil)
+	case "GET_PARAMETER":
+		// The keepalive of the clients
+		return c.respond(request, 200, c.sessionHeader(), nil)
+	}
+	return c.respond(request, 501, []string{"Public", rtspMethods}, nil)
+}
+
+// describe answers the SDP of a stream, its tracks are set up at
+// trackID=N below the URL
+func (c *rtspConn) describe(request rtspRequest) error {
+	b, streamID, ok := c.server.lookup(strings.Trim(request.url.Path, "/"))
+	if !ok {
+		return c.respond(request, 404, nil, nil)
+	}
+	medias, err := b.streamMedia(streamID)
+	if errors.Is(err, ErrUnknownStream) || errors.Is(err, errClosed) {
+		return c.respond(request, 404, nil, nil)
+	} else if err != nil {
+		return c.respond(request, 403, nil, nil)
+	}
+	host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	family := "IP4"
+	if strings.Contains(host, ":") {
+		family = "IP6"
+	}
+	sdp := &strings.Builder{}
+	fmt.Fprintf(sdp, "v=0\r\no=- %d 1 IN %s %s\r\ns=%s\r\nc=IN %s %s\r\nt=0 0\r\na=control:*\r\n",
+		time.Now().Unix(), family, host, streamID, family, host)
+	for i, media := range medias {
+		writeSDPMedia(sdp, media.codec, rtspPayloadType+i, 0)
+		fmt.Fprintf(sdp, "a=control:trackID=%d\r\n", i)
+	}
+	base := *request.url
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return c.respond(request, 200, []string{"Content-Base", base.String(), "Content-Type", "application/sdp"}, []byte(sdp.String()))
+}
+
+// writeSDPMedia describes a track sent with payloadType to port
+func writeSDPMedia(sdp *strings.Builder, codec webrtc.RTPCodecCapability, payloadType int, port int) {
+	kind, encoding, _ := strings.Cut(codec.MimeType, "/")
+	fmt.Fprintf(sdp, "m=%s %d RTP/AVP %d\r\n", kind, port, payloadType)
+	if codec.Channels > 0 {
+		fmt.Fprintf(sdp, "a=rtpmap:%d %s/%d/%d\r\n", payloadType, encoding, codec.ClockRate, codec.Channels)
+	} else {
+		fmt.Fprintf(sdp, "a=rtpmap:%d %s/%d\r\n", payloadType, encoding, codec.ClockRate)
+	}
+	if codec.SDPFmtpLine != "" {
+		fmt.Fprintf(sdp, "a=fmtp:%d %s\r\n", payloadType, codec.SDPFmtpLine)
+	}
+}
+
+// setup adds the track of the URL to the session of the connection,
+// opening it on the first track
+func (c *rtspConn) setup(request rtspRequest) error {
+	path := strings.Trim(request.url.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	if slash < 0 || !strings.HasPrefix(path[slash+1:], "trackID=") {
+		return c.respond(request, 404, nil, nil)
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(path[slash+1:], "trackID="))
+	if err != nil {
+		return c.respond(request, 404, nil, nil)
+	}
+	b, streamID, ok := c.server.lookup(path[:slash])
+	if !ok {
+		return c.respond(request, 404, nil, nil)
+	}
+	if c.session != nil {
+		if !c.hasSession(request) {
+			return c.respond(request, 454, nil, nil)
+		}
+		if c.session.broadcaster != b || c.session.streamID != streamID || c.session.playing {
+			return c.respond(request, 455, nil, nil)
+		}
+	}
+	medias, err := b.streamMedia(streamID)
+	if err != nil || index < 0 || index >= len(medias) {
+		return c.respond(request, 404, nil, nil)
+	}
+	media := medias[index]
+	if c.session != nil {
+		for _, track := range c.session.tracks {
+			if track.key == media.key {
+				return c.respond(request, 455, nil, nil)
+			}
+		}
+	}
+	session := c.session
+	if session == nil {
+		session = newRTSPSession(c, b, streamID)
+	}
+	track := &rtspTrack{key: media.key, payloadType: uint8(rtspPayloadType + index), session: session, done: make(chan struct{})}
+	track.stream.clockRate = float64(media.codec.ClockRate)
+	transport, ok := c.transport(request.header.Get("Transport"), track, len(session.tracks))
+	if !ok {
+		return c.respond(request, 461, nil, nil)
+	}
+	c.session = session
+	session.tracks = append(session.tracks, track)
+	return c.respond(request, 200, append([]string{"Transport", transport}, c.sessionHeader()...), nil)
+}
+
+// transport picks the first transport of the client the server supports,
+// interleaved on the connection or unicast UDP, for the track set up after
+// count others
+func (c *rtspConn) transport(header string, track *rtspTrack, count int) (string, bool) {
+	for _, spec := range strings.Split(header, ",") {
+		parameters := strings.Split(strings.TrimSpace(spec), ";")
+		values := map[string]string{}
+		for _, parameter := range parameters[1:] {
+			name, value, _ := strings.Cut(parameter, "=")
+			values[strings.ToLower(name)] = value
+		}
+		if _, multicast := values["multicast"]; multicast {
+			continue
+		}
+		switch strings.ToUpper(parameters[0]) {
+		case "RTP/AVP/TCP":
+			channel := 2 * count
+			if interleaved, ok := values["interleaved"]; ok {
+				first, _, _ := strings.Cut(interleaved, "-")
+				parsed, err := strconv.Atoi(first)
+				if err != nil || parsed < 0 || parsed > 254 {
+					continue
+				}
+				channel = parsed
+			}
+			track.channel = channel
+			return fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1), true
+		case "RTP/AVP", "RTP/AVP/UDP":
+			first, second, _ := strings.Cut(values["client_port"], "-")
+			rtpPort, err := strconv.Atoi(first)
+			if err != nil || rtpPort <= 0 || rtpPort > 0xFFFF {
+				continue
+			}
+			rtcpPort := rtpPort + 1
+			if parsed, err := strconv.Atoi(second); err == nil && parsed > 0 && parsed <= 0xFFFF {
+				rtcpPort = parsed
+			}
+			address, ok := c.conn.RemoteAddr().(*net.TCPAddr)
+			if !ok {
+				continue
+			}
+			if track.rtp, err = net.ListenUDP("udp", nil); err != nil {
+				continue
+			}
+			if track.rtcp, err = net.ListenUDP("udp", nil); err != nil {
+				track.rtp.Close()
+				continue
+			}
+			track.channel = -1
+			track.rtpPeer = &net.UDPAddr{IP: address.IP, Port: rtpPort, Zone: address.Zone}
+			track.rtcpPeer = &net.UDPAddr{IP: address.IP, Port: rtcpPort, Zone: address.Zone}
+			return fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d", rtpPort, rtcpPort,
+				track.rtp.LocalAddr().(*net.UDPAddr).Port, track.rtcp.LocalAddr().(*net.UDPAddr).Port), true
+		}
+	}
+	return "", false
+}
+
+// play starts sending the tracks set up
+func (c *rtspConn) play(request rtspRequest, logger *zap.SugaredLogger) error {
+	if !c.hasSession(request) {
+		return c.respond(request, 454, nil, nil)
+	}
+	session := c.session
+	if session.playing {
+		return c.respond(request, 200, c.sessionHeader(), nil)
+	}
+	err := errClosed
+	session.broadcaster.do(func() { err = session.broadcaster.playRTSP(session) })
+	if err != nil {
+		return c.respond(request, 404, nil, nil)
+	}
+	session.playing = true
+	logger.Infow("RTSP client playing", "streamID", session.streamID, "tracks", len(session.tracks))
+	// The packets queued meanwhile follow the response
+	err = c.respond(request, 200, append([]string{"Range", "npt=0.000-"}, c.sessionHeader()...), nil)
+	go session.run()
+	return err
+}
+
+// hasSession tells whether the request is for the session of the
+// connection
+func (c *rtspConn) hasSession(request rtspRequest) bool {
+	if c.session == nil {
+		return false
+	}
+	id, _, _ := strings.Cut(request.header.Get("Session"), ";")
+	return strings.TrimSpace(id) == c.session.id
+}
+
+func (c *rtspConn) sessionHeader() []string {
+	if c.session == nil {
+		return nil
+	}
+	return []string{"Session", fmt.Sprintf("%s;timeout=%d", c.session.id, int(rtspSessionTimeout.Seconds()))}
+}
+
+// respond writes a response with the header name and value pairs
+func (c *rtspConn) respond(request rtspRequest, status int, header []string, body []byte) error {
+	response := &strings.Builder{}
+	fmt.Fprintf(response, "RTSP/1.0 %d %s\r\nCSeq: %s\r\n", status, rtspStatusText[status], request.cseq)
+	for i := 0; i+1 < len(header); i += 2 {
+		fmt.Fprintf(response, "%s: %s\r\n", header[i], header[i+1])
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(response, "Content-Length: %d\r\n", len(body))
+	}
+	response.WriteString("\r\n")
+	response.Write(body)
+	return c.write([]byte(response.String()))
+}
+
+func (c *rtspConn) write(data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(rtspWriteTimeout))
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// rtspPacket is a packet of a track queued for the client
+type rtspPacket struct {
+	track *rtspTrack
+	rtcp  bool
+	data  []byte
+}
+
+// rtspSession sends the tracks of a stream to a client
+type rtspSession struct {
+	id          string
+	conn        *rtspConn
+	broadcaster *Broadcaster
+	streamID    string
+	// tracks and playing belong to the connection
+	tracks  []*rtspTrack
+	playing bool
+	packets chan rtspPacket
+	dropped atomic.Uint64
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newRTSPSession(conn *rtspConn, b *Broadcaster, streamID string) *rtspSession {
+	return &rtspSession{
+		id:          strings.ReplaceAll(uuid.New().String(), "-", "")[:16],
+		conn:        conn,
+		broadcaster: b,
+		streamID:    streamID,
+		packets:     make(chan rtspPacket, 512),
+		done:        make(chan struct{}),
+	}
+}
+
+// run sends the packets queued and the sender reports of the tracks until
+// the session is closed
+func (s *rtspSession) run() {
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case packet := <-s.packets:
+			if err := s.send(packet); err != nil {
+				zap.S().Infow("RTSP client not reachable", "streamID", s.streamID, "error", err)
+				s.conn.conn.Close()
+				return
+			}
+		case now := <-ticker.C:
+			for _, track := range s.tracks {
+				track.stream.lock.Lock()
+				sent := track.stream.packets > 0
+				track.stream.lock.Unlock()
+				if !sent {
+					continue
+				}
+				report, err := track.stream.report(now, track.clock).Marshal()
+				if err != nil {
+					continue
+				}
+				if err := s.send(rtspPacket{track: track, rtcp: true, data: report}); err != nil {
+					s.conn.conn.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// send writes a packet interleaved on the connection or over UDP
+func (s *rtspSession) send(packet rtspPacket) error {
+	track := packet.track
+	if track.channel < 0 {
+		socket, peer := track.rtp, track.rtpPeer
+		if packet.rtcp {
+			socket, peer = track.rtcp, track.rtcpPeer
+		}
+		// The client may not listen yet or anymore, UDP goes on regardless
+		socket.WriteToUDP(packet.data, peer)
+		return nil
+	}
+	channel := track.channel
+	if packet.rtcp {
+		channel++
+	}
+	frame := append([]byte{'$', byte(channel)}, u16(uint16(len(packet.data)))...)
+	return s.conn.write(append(frame, packet.data...))
+}
+
+// trackEnded closes the connection once the publisher removed every track
+// of the session
+func (s *rtspSession) trackEnded() {
+	for _, track := range s.tracks {
+		select {
+		case <-track.done:
+		default:
+			return
+		}
+	}
+	zap.S().Infow("RTSP stream ended", "streamID", s.streamID)
+	s.conn.conn.Close()
+}
+
+// close detaches the tracks and releases their sockets
+func (s *rtspSession) close() {
+	s.once.Do(func() {
+		close(s.done)
+		for _, track := range s.tracks {
+			s.broadcaster.RemoveSink(track.key, track)
+			if track.channel < 0 {
+				track.rtp.Close()
+				track.rtcp.Close()
+			}
+		}
+	})
+}
+
+// rtspTrack is a track of a session, the sink of its packets
+type rtspTrack struct {
+	key         string
+	payloadType uint8
+	session     *rtspSession
+	// channel is the interleaved channel of RTP, RTCP being the next one,
+	// -1 over UDP
+	channel           int
+	rtp, rtcp         *net.UDPConn
+	rtpPeer, rtcpPeer *net.UDPAddr
+	clock             rtpClock
+	stream            reportedStream
+	done              chan struct{}
+	once              sync.Once
+}
+
+func (t *rtspTrack) WriteRTP(packet []byte) error {
+	select {
+	case <-t.done:
+		return errors.New("RTSP track closed")
+	default:
+	}
+	if len(packet) < 12 {
+		return nil
+	}
+	p := make([]byte, len(packet))
+	copy(p, packet)
+	p[1] = p[1]&0x80 | t.payloadType
+	t.stream.lock.Lock()
+	t.stream.ssrc = binary.BigEndian.Uint32(p[8:])
+	t.stream.lastRTP, t.stream.lastSent = binary.BigEndian.Uint32(p[4:]), time.Now()
+	t.stream.packets++
+	t.stream.octets += uint32(len(p) - 12)
+	t.stream.lock.Unlock()
+	select {
+	case t.session.packets <- rtspPacket{track: t, data: p}:
+	default:
+		t.session.dropped.Add(1)
+	}
+	return nil
+}
+
+// Close is called once the publisher removed the track
+func (t *rtspTrack) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+		t.session.trackEnded()
+	})
+	return nil
+}
@@ -0,0 +1,415 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+// rtspPullTimeout bounds the requests and the silence of the cameras
+const rtspPullTimeout = 10 * time.Second
+
+// The default ports of RTSP and RTSPS
+const (
+	rtspDefaultPort  = "554"
+	rtspsDefaultPort = "322"
+)
+
+// rtspUserAgent is sent with the requests of the pulls
+const rtspUserAgent = "webrtc-hub"
+
+// RedactRTSPURL hides the password of an RTSP URL
+func RedactRTSPURL(rawURL string) string {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return target.Redacted()
+}
+
+// PullRTSP plays rawURL, an IP camera or any RTSP server, and forwards its
+// first video and audio tracks as streamID until ctx is done or the
+// session is lost. The RTP packets of H264, VP8, VP9, Opus and G.711 are
+// forwarded as they come, the H264 keyframes getting the parameter sets of
+// the description when they do not carry them. AAC is transcoded to Opus
+// with transcoder.
+func (s *Broadcaster) PullRTSP(ctx context.Context, rawURL string, streamID string, transcoder AudioTranscoder) error {
+	if err := s.acceptsIngest(); err != nil {
+		return err
+	}
+	c, err := dialRTSP(ctx, rawURL)
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-stop:
+		}
+	}()
+
+	tracks, err := c.play()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, track := range tracks {
+			track.close()
+		}
+	}()
+	for _, track := range tracks {
+		if err := track.start(s, streamID, transcoder); err != nil {
+			return err
+		}
+	}
+	go c.keepalive(stop)
+	err = c.receive(tracks)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// rtspClient is the connection of a pull to its RTSP server
+type rtspClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// target is the URL played, without its credentials
+	target *url.URL
+	user   *url.Userinfo
+	// authenticate is the WWW-Authenticate header of the server, once it
+	// asked for credentials
+	authenticate string
+
+	writeLock sync.Mutex
+	cseq      int
+	session   string
+	timeout   time.Duration
+	clock     reportClock
+}
+
+// dialRTSP connects to the server of rawURL
+func dialRTSP(ctx context.Context, rawURL string) (*rtspClient, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "rtsp" && target.Scheme != "rtsps" {
+		return nil, fmt.Errorf("unsupported scheme %q, rtsp or rtsps expected", target.Scheme)
+	}
+	host := target.Host
+	if target.Port() == "" {
+		port := rtspDefaultPort
+		if target.Scheme == "rtsps" {
+			port = rtspsDefaultPort
+		}
+		host = net.JoinHostPort(target.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: rtspPullTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme == "rtsps" {
+		conn = tls.Client(conn, &tls.Config{ServerName: target.Hostname()})
+	}
+	c := &rtspClient{conn: conn, reader: bufio.NewReader(conn), user: target.User, timeout: rtspSessionTimeout}
+	target.User = nil
+	c.target = target
+	return c, nil
+}
+
+// rtspResponse is a response of the server
+type rtspResponse struct {
+	status int
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// request sends a request and reads its response, once more with the
+// credentials of the URL when the server asks for them
+func (c *rtspClient) request(method string, uri string, header ...string) (rtspResponse, error) {
+	c.conn.SetDeadline(time.Now().Add(rtspPullTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	for {
+		if err := c.send(method, uri, header...); err != nil {
+			return rtspResponse{}, err
+		}
+		response, err := c.readResponse()
+		if err != nil {
+			return rtspResponse{}, err
+		}
+		if response.status != 401 || c.user == nil || c.authenticate != "" {
+			if response.status != 200 {
+				return response, fmt.Errorf("%s: status %d", method, response.status)
+			}
+			return response, nil
+		}
+		c.authenticate = response.header.Get("WWW-Authenticate")
+		for _, challenge := range response.header.Values("WWW-Authenticate") {
+			// Digest is preferred over Basic
+			if strings.HasPrefix(challenge, "Digest ") {
+				c.authenticate = challenge
+			}
+		}
+		if c.authenticate == "" {
+			return response, fmt.Errorf("%s: status 401", method)
+		}
+	}
+}
+
+// send writes a request without waiting for its response
+func (c *rtspClient) send(method string, uri string, header ...string) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.cseq++
+	request := &strings.Builder{}
+	fmt.Fprintf(request, "%s %s RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: %s\r\n", method, uri, c.cseq, rtspUserAgent)
+	if c.session != "" {
+		fmt.Fprintf(request, "Session: %s\r\n", c.session)
+	}
+	if authorization := c.authorization(method, uri); authorization != "" {
+		fmt.Fprintf(request, "Authorization: %s\r\n", authorization)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		fmt.Fprintf(request, "%s: %s\r\n", header[i], header[i+1])
+	}
+	request.WriteString("\r\n")
+	_, err := io.WriteString(c.conn, request.String())
+	return err
+}
+
+// authorization answers the challenge of the server, empty before it
+func (c *rtspClient) authorization(method string, uri string) string {
+	if c.authenticate == "" || c.user == nil {
+		return ""
+	}
+	password, _ := c.user.Password()
+	if !strings.HasPrefix(c.authenticate, "Digest ") {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.user.Username()+":"+password))
+	}
+	params := map[string]string{}
+	for _, param := range strings.Split(strings.TrimPrefix(c.authenticate, "Digest "), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		params[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	digest := func(value string) string {
+		sum := md5.Sum([]byte(value))
+		return hex.EncodeToString(sum[:])
+	}
+	response := digest(digest(c.user.Username()+":"+params["realm"]+":"+password) + ":" + params["nonce"] + ":" + digest(method+":"+uri))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		c.user.Username(), params["realm"], params["nonce"], uri, response)
+}
+
+// readResponse reads the next response, skipping the interleaved packets
+// before it
+func (c *rtspClient) readResponse() (rtspResponse, error) {
+	for {
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return rtspResponse{}, err
+		}
+		if first[0] != '$' {
+			break
+		}
+		if _, _, err := c.readInterleaved(); err != nil {
+			return rtspResponse{}, err
+		}
+	}
+	text := textproto.NewReader(c.reader)
+	line, err := text.ReadLine()
+	if err != nil {
+		return rtspResponse{}, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "RTSP/1.") {
+		return rtspResponse{}, fmt.Errorf("invalid RTSP response %q", line)
+	}
+	response := rtspResponse{}
+	if response.status, err = strconv.Atoi(fields[1]); err != nil {
+		return rtspResponse{}, fmt.Errorf("invalid RTSP response %q", line)
+	}
+	if response.header, err = text.ReadMIMEHeader(); err != nil {
+		return rtspResponse{}, err
+	}
+	if length := response.header.Get("Content-Length"); length != "" {
+		size, err := strconv.Atoi(length)
+		if err != nil || size < 0 {
+			return rtspResponse{}, errors.New("invalid Content-Length")
+		}
+		response.body = make([]byte, size)
+		if _, err := io.ReadFull(c.reader, response.body); err != nil {
+			return rtspResponse{}, err
+		}
+	}
+	return response, nil
+}
+
+// readInterleaved reads a packet interleaved on the connection
+func (c *rtspClient) readInterleaved() (byte, []byte, error) {
+	frame := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, frame); err != nil {
+		return 0, nil, err
+	}
+	packet := make([]byte, binary.BigEndian.Uint16(frame[2:]))
+	_, err := io.ReadFull(c.reader, packet)
+	return frame[1], packet, err
+}
+
+// play describes the stream, sets its first video and audio tracks up
+// interleaved on the connection and plays them
+func (c *rtspClient) play() ([]*describedTrack, error) {
+	response, err := c.request("DESCRIBE", c.target.String(), "Accept", "application/sdp")
+	if err != nil {
+		return nil, err
+	}
+	base := c.target
+	for _, name := range []string{"Content-Base", "Content-Location"} {
+		if value := response.header.Get(name); value != "" {
+			if parsed, err := url.Parse(value); err == nil {
+				parsed.User = nil
+				base = parsed
+				break
+			}
+		}
+	}
+	description := &sdp.SessionDescription{}
+	if err := description.Unmarshal(response.body); err != nil {
+		return nil, fmt.Errorf("DESCRIBE: %w", err)
+	}
+	tracks := []*describedTrack{}
+	kinds := map[string]bool{}
+	for _, media := range description.MediaDescriptions {
+		kind := media.MediaName.Media
+		if (kind != "video" && kind != "audio") || kinds[kind] {
+			continue
+		}
+		track, ok := newDescribedTrack(media)
+		if !ok {
+			continue
+		}
+		control, _ := media.Attribute("control")
+		uri := rtspControlURL(base, control)
+		channel := 2 * len(tracks)
+		transport := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1)
+		response, err := c.request("SETUP", uri, "Transport", transport)
+		if err != nil {
+			return nil, err
+		}
+		if c.session == "" {
+			session := strings.Split(response.header.Get("Session"), ";")
+			c.session = strings.TrimSpace(session[0])
+			for _, param := range session[1:] {
+				if name, value, _ := strings.Cut(strings.TrimSpace(param), "="); name == "timeout" {
+					if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+						c.timeout = time.Duration(seconds) * time.Second
+					}
+				}
+			}
+		}
+		track.channel = byte(channel)
+		// The server may pick its own channels
+		if _, interleaved, ok := strings.Cut(response.header.Get("Transport"), "interleaved="); ok {
+			first, _, _ := strings.Cut(interleaved, "-")
+			if number, err := strconv.Atoi(strings.TrimRight(first, ";")); err == nil {
+				track.channel = byte(number)
+			}
+		}
+		kinds[kind] = true
+		tracks = append(tracks, track)
+	}
+	if len(tracks) == 0 {
+		return nil, errors.New("no track of the stream can be forwarded")
+	}
+	control, _ := description.Attribute("control")
+	if _, err := c.request("PLAY", rtspControlURL(base, control), "Range", "npt=0.000-"); err != nil {
+		return nil, err
+	}
+	return tracks, nil
+}
+
+// rtspControlURL resolves the control attribute of the description against
+// the base URL
+func rtspControlURL(base *url.URL, control string) string {
+	if control == "" || control == "*" {
+		return base.String()
+	}
+	if strings.HasPrefix(control, "rtsp://") || strings.HasPrefix(control, "rtsps://") {
+		return control
+	}
+	resolved := *base
+	if !strings.HasSuffix(resolved.Path, "/") {
+		resolved.Path += "/"
+	}
+	return resolved.ResolveReference(&url.URL{Path: control}).String()
+}
+
+// keepalive refreshes the session until stop is closed, the responses are
+// skipped by receive
+func (c *rtspClient) keepalive(stop chan struct{}) {
+	ticker := time.NewTicker(c.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if c.send("OPTIONS", c.target.String()) != nil {
+			return
+		}
+	}
+}
+
+// receive forwards the packets of the tracks until the connection fails
+func (c *rtspClient) receive(tracks []*describedTrack) error {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(rtspPullTimeout))
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return err
+		}
+		if first[0] != '$' {
+			// A keepalive response
+			if _, err := c.readResponse(); err != nil {
+				return err
+			}
+			continue
+		}
+		channel, packet, err := c.readInterleaved()
+		if err != nil {
+			return err
+		}
+		for _, track := range tracks {
+			switch channel {
+			case track.channel:
+				if err := track.forward(packet); err != nil {
+					return err
+				}
+			case track.channel + 1:
+				c.clock.report(track, packet)
+			}
+		}
+	}
+}
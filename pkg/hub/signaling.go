@@ -0,0 +1,382 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+// Message is a receiver signaling message, Data holds a JSON document
+// encoded as a string
+type Message struct {
+	Event string `json:"event"`
+	Data  string `json:"data"`
+}
+
+// Signaler carries the receiver signaling messages, over a websocket or
+// any other bidirectional transport
+type Signaler interface {
+	Send(ctx context.Context, message Message) error
+	Receive(ctx context.Context) (Message, error)
+	// Close ends the signaling, code follows the websocket close codes
+	Close(code websocket.StatusCode, reason string) error
+}
+
+// SendEvent encodes data as JSON and sends it as event
+func SendEvent(ctx context.Context, s Signaler, event string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.Send(ctx, Message{Event: event, Data: string(encoded)})
+}
+
+// ErrSignalingClosed is returned when sending over a closed queued signaler
+var ErrSignalingClosed = errors.New("signaling closed")
+
+// ErrSignalingStalled is returned when the queue of a queued signaler is
+// full, the signaling is then closed
+var ErrSignalingStalled = errors.New("signaling stalled")
+
+// queuedSignaler writes the messages of every sender in order from a
+// single goroutine
+type queuedSignaler struct {
+	Signaler
+	queue        chan Message
+	writeTimeout time.Duration
+	closing      chan struct{}
+	flushed      chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewQueuedSignaler serializes the writes to s, which the Broadcaster and
+// the ICE callbacks otherwise make concurrently. Send never blocks, as the
+// Broadcaster sends from its loop: once size messages are pending the peer
+// is stalled, the message is dropped and the signaling closed. A message
+// not written within writeTimeout closes it too, and Close flushes the
+// pending messages for as long.
+func NewQueuedSignaler(s Signaler, size int, writeTimeout time.Duration) Signaler {
+	q := &queuedSignaler{
+		Signaler:     s,
+		queue:        make(chan Message, size),
+		writeTimeout: writeTimeout,
+		closing:      make(chan struct{}),
+		flushed:      make(chan struct{}),
+	}
+	go q.write()
+	return q
+}
+
+func (q *queuedSignaler) Send(ctx context.Context, message Message) error {
+	select {
+	case <-q.closing:
+		return ErrSignalingClosed
+	default:
+	}
+	select {
+	case q.queue <- message:
+		return nil
+	default:
+	}
+	zap.S().Warnw("Closing stalled signaling", "event", message.Event, "pending", len(q.queue))
+	// Closing a websocket waits for the peer, which is stalled
+	go q.shutdown(websocket.StatusPolicyViolation, "signaling stalled", false)
+	return ErrSignalingStalled
+}
+
+// Pending counts the messages waiting to be written
+func (q *queuedSignaler) Pending() int {
+	return len(q.queue)
+}
+
+func (q *queuedSignaler) write() {
+	defer close(q.flushed)
+	for {
+		select {
+		case message := <-q.queue:
+			if !q.send(message) {
+				return
+			}
+		case <-q.closing:
+			for {
+				select {
+				case message := <-q.queue:
+					if !q.send(message) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *queuedSignaler) send(message Message) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), q.writeTimeout)
+	defer cancel()
+	if err := q.Signaler.Send(ctx, message); err != nil {
+		zap.S().Warnw("Closing stalled signaling", "event", message.Event, "error", err)
+		q.shutdown(websocket.StatusPolicyViolation, "signaling stalled", false)
+		return false
+	}
+	return true
+}
+
+func (q *queuedSignaler) Close(code websocket.StatusCode, reason string) error {
+	return q.shutdown(code, reason, true)
+}
+
+func (q *queuedSignaler) shutdown(code websocket.StatusCode, reason string, flush bool) error {
+	err := ErrSignalingClosed
+	q.closeOnce.Do(func() {
+		close(q.closing)
+		if flush {
+			select {
+			case <-q.flushed:
+			case <-time.After(q.writeTimeout):
+			}
+		}
+		err = q.Signaler.Close(code, reason)
+	})
+	return err
+}
+
+// wsSignaler sends one message per websocket frame, in the schema of the
+// negotiated subprotocol
+type wsSignaler struct {
+	conn  *websocket.Conn
+	codec wireCodec
+}
+
+// NewWebSocketSignaler signals over a websocket accepted with Subprotocols
+func NewWebSocketSignaler(conn *websocket.Conn) Signaler {
+	return &wsSignaler{conn: conn, codec: codecFor(conn.Subprotocol())}
+}
+
+func (s *wsSignaler) Send(ctx context.Context, message Message) error {
+	raw, err := s.codec.encode(message)
+	if err != nil {
+		return err
+	}
+	return s.conn.Write(ctx, s.codec.messageType(), raw)
+}
+
+func (s *wsSignaler) Receive(ctx context.Context) (Message, error) {
+	_, raw, err := s.conn.Read(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	return s.codec.decode(raw)
+}
+
+func (s *wsSignaler) Close(code websocket.StatusCode, reason string) error {
+	return s.conn.Close(code, reason)
+}
+
+// streamSignaler sends newline delimited JSON messages over a byte stream
+type streamSignaler struct {
+	stream    io.ReadWriteCloser
+	reader    *bufio.Reader
+	maxSize   int
+	writeLock sync.Mutex
+}
+
+// NewStreamSignaler signals over a byte stream such as a QUIC or
+// WebTransport stream. Lines longer than maxSize are refused, and the
+// stream is closed when the context of a Receive is done.
+func NewStreamSignaler(stream io.ReadWriteCloser, maxSize int) Signaler {
+	return &streamSignaler{stream: stream, reader: bufio.NewReader(stream), maxSize: maxSize}
+}
+
+func (s *streamSignaler) Send(ctx context.Context, message Message) error {
+	raw, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_, err = s.stream.Write(append(raw, '\n'))
+	return err
+}
+
+func (s *streamSignaler) Receive(ctx context.Context) (Message, error) {
+	// The reads of the stream do not take a context
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.stream.Close()
+		case <-stop:
+		}
+	}()
+	message := Message{}
+	line, err := s.readLine()
+	if ctx.Err() != nil {
+		return message, ctx.Err()
+	}
+	if err != nil {
+		return message, err
+	}
+	err = json.Unmarshal(line, &message)
+	return message, err
+}
+
+// readLine reads up to the next newline, failing as soon as the line
+// outgrows maxSize rather than once it is whole
+func (s *streamSignaler) readLine() ([]byte, error) {
+	line := []byte{}
+	for {
+		chunk, err := s.reader.ReadSlice('\n')
+		// The newline does not count
+		if len(line)+len(chunk) > s.maxSize+1 {
+			return nil, ErrFrameTooLarge
+		}
+		line = append(line, chunk...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
+		}
+	}
+}
+
+func (s *streamSignaler) Close(_ websocket.StatusCode, _ string) error {
+	return s.stream.Close()
+}
+
+// ErrFrameTooLarge is returned when receiving a gRPC frame or a stream line
+// over the size limit
+var ErrFrameTooLarge = errors.New("signaling frame too large")
+
+// grpcSignaler exchanges the protobuf messages of signaling.proto in the
+// length prefixed frames of a gRPC stream
+type grpcSignaler struct {
+	reader    *bufio.Reader
+	writer    io.Writer
+	flush     func()
+	close     func() error
+	maxSize   int
+	writeLock sync.Mutex
+	codec     protoCodec
+}
+
+// NewGRPCSignaler signals over the request and response bodies of a gRPC
+// streaming call. flush pushes the written frames to the client and close
+// ends the request stream, the status trailers are left to the caller.
+// Frames larger than maxSize are refused.
+func NewGRPCSignaler(request io.Reader, response io.Writer, flush func(), close func() error, maxSize int) Signaler {
+	return &grpcSignaler{
+		reader:  bufio.NewReader(request),
+		writer:  response,
+		flush:   flush,
+		close:   close,
+		maxSize: maxSize,
+	}
+}
+
+func (s *grpcSignaler) Send(ctx context.Context, message Message) error {
+	raw, err := s.codec.encode(message)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 5, 5+len(raw))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(raw)))
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if _, err := s.writer.Write(append(frame, raw...)); err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+func (s *grpcSignaler) Receive(ctx context.Context) (Message, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(s.reader, header); err != nil {
+		return Message{}, err
+	}
+	if header[0] != 0 {
+		return Message{}, errors.New("compressed signaling frames are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if uint64(size) > uint64(s.maxSize) {
+		return Message{}, ErrFrameTooLarge
+	}
+	raw := make([]byte, size)
+	if _, err := io.ReadFull(s.reader, raw); err != nil {
+		return Message{}, err
+	}
+	return s.codec.decode(raw)
+}
+
+func (s *grpcSignaler) Close(_ websocket.StatusCode, _ string) error {
+	return s.close()
+}
+
+// dataChannelSignaler sends one JSON message per data channel message, for
+// the renegotiations of an established connection
+type dataChannelSignaler struct {
+	channel   *webrtc.DataChannel
+	messages  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDataChannelSignaler signals over a reliable data channel, Send fails
+// until it is open
+func NewDataChannelSignaler(channel *webrtc.DataChannel) Signaler {
+	s := &dataChannelSignaler{
+		channel:  channel,
+		messages: make(chan []byte, 16),
+		closed:   make(chan struct{}),
+	}
+	channel.OnMessage(func(message webrtc.DataChannelMessage) {
+		select {
+		case s.messages <- message.Data:
+		case <-s.closed:
+		}
+	})
+	channel.OnClose(func() {
+		s.closeOnce.Do(func() {
+			close(s.closed)
+		})
+	})
+	return s
+}
+
+func (s *dataChannelSignaler) Send(ctx context.Context, message Message) error {
+	if s.channel.ReadyState() != webrtc.DataChannelStateOpen {
+		return ErrSignalingClosed
+	}
+	raw, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return s.channel.SendText(string(raw))
+}
+
+func (s *dataChannelSignaler) Receive(ctx context.Context) (Message, error) {
+	message := Message{}
+	select {
+	case raw := <-s.messages:
+		err := json.Unmarshal(raw, &message)
+		return message, err
+	case <-s.closed:
+		return message, io.EOF
+	case <-ctx.Done():
+		return message, ctx.Err()
+	}
+}
+
+func (s *dataChannelSignaler) Close(_ websocket.StatusCode, _ string) error {
+	return s.channel.Close()
+}
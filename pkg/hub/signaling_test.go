@@ -0,0 +1,112 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestStreamSignalerReceive(t *testing.T) {
+	tests := []struct {
+		name    string
+		written string
+		want    Message
+		err     error
+	}{
+		{
+			name:    "message",
+			written: `{"event":"answer","data":"{}"}` + "\n",
+			want:    Message{Event: "answer", Data: "{}"},
+		},
+		{
+			name:    "line over the limit",
+			written: `{"event":"answer","data":"` + strings.Repeat("a", 8192) + `"}` + "\n",
+			err:     ErrFrameTooLarge,
+		},
+		{
+			name:    "endless line",
+			written: strings.Repeat("a", 64*1024),
+			err:     ErrFrameTooLarge,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			signaler := NewStreamSignaler(server, 1024)
+			defer signaler.Close(0, "")
+			go client.Write([]byte(test.written))
+			message, err := signaler.Receive(context.Background())
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if message != test.want {
+				t.Errorf("message %+v, want %+v", message, test.want)
+			}
+		})
+	}
+}
+
+func TestStreamSignalerReceiveContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	signaler := NewStreamSignaler(server, 1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// The client stays silent
+	if _, err := signaler.Receive(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// stalledSignaler never completes a write until it is closed
+type stalledSignaler struct {
+	closed chan struct{}
+}
+
+func (s *stalledSignaler) Send(ctx context.Context, message Message) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.closed:
+		return ErrSignalingClosed
+	}
+}
+
+func (s *stalledSignaler) Receive(ctx context.Context) (Message, error) {
+	<-s.closed
+	return Message{}, ErrSignalingClosed
+}
+
+func (s *stalledSignaler) Close(code websocket.StatusCode, reason string) error {
+	close(s.closed)
+	return nil
+}
+
+func TestQueuedSignalerStalled(t *testing.T) {
+	stalled := &stalledSignaler{closed: make(chan struct{})}
+	const size = 4
+	signaler := NewQueuedSignaler(stalled, size, time.Minute)
+	var err error
+	start := time.Now()
+	// One message is being written, size are queued
+	for i := 0; i < size+2 && err == nil; i++ {
+		err = signaler.Send(context.Background(), Message{Event: "offer"})
+	}
+	if !errors.Is(err, ErrSignalingStalled) {
+		t.Fatalf("error %v, want %v", err, ErrSignalingStalled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Send blocked for %v", elapsed)
+	}
+	select {
+	case <-stalled.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("the stalled signaling was not closed")
+	}
+}
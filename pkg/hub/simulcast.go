@@ -0,0 +1,60 @@
+package hub
+
+import "github.com/pion/webrtc/v4"
+
+// Header extensions browsers use to tag simulcast layers
+var simulcastExtensions = []string{
+	"urn:ietf:params:rtp-hdrext:sdes:mid",
+	"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+	"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+}
+
+// SimulcastLayer describes one spatial layer of a simulcast publication,
+// each layer is forwarded on its own local track
+type SimulcastLayer struct {
+	// TrackID is the publisher track the layer belongs to
+	TrackID string `json:"trackID"`
+	RID     string `json:"rid"`
+	// Index is the position of the layer in the publisher offer
+	Index int `json:"index"`
+}
+
+func registerSimulcastExtensions(m *webrtc.MediaEngine) error {
+	for _, uri := range simulcastExtensions {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSpareLayer tells whether the track is a simulcast layer that is not
+// forwarded by default because a preferred layer of the same publisher
+// track exists, it must run on the loop
+func (s *Broadcaster) isSpareLayer(key string) bool {
+	layer, ok := s.layers[key]
+	if !ok {
+		return false
+	}
+	streamID := s.senders[key].StreamID()
+	for other, otherLayer := range s.layers {
+		if other == key || otherLayer.TrackID != layer.TrackID || s.senders[other].StreamID() != streamID {
+			continue
+		}
+		if otherLayer.Index < layer.Index {
+			return true
+		}
+	}
+	return false
+}
+
+// SimulcastLayers returns the layers of the simulcast tracks keyed by track
+func (s *Broadcaster) SimulcastLayers() map[string]SimulcastLayer {
+	layers := make(map[string]SimulcastLayer)
+	s.do(func() {
+		for key, layer := range s.layers {
+			layers[key] = layer
+		}
+	})
+	return layers
+}
@@ -0,0 +1,161 @@
+package hub
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+// SlowReceiverPolicy is what happens to a receiver that stays slow
+type SlowReceiverPolicy string
+
+const (
+	// SlowReceiverDropVideo stops sending video, the audio goes on
+	SlowReceiverDropVideo SlowReceiverPolicy = "drop-video"
+	// SlowReceiverDowngrade sends the lowest simulcast layer of every track
+	SlowReceiverDowngrade SlowReceiverPolicy = "downgrade"
+	// SlowReceiverDisconnect closes the receiver, telling it why
+	SlowReceiverDisconnect SlowReceiverPolicy = "disconnect"
+)
+
+// slowReceiverReason is sent to the receivers disconnected for being slow
+const slowReceiverReason = "receiver too slow"
+
+// ParseSlowReceiverPolicy checks name is a known policy
+func ParseSlowReceiverPolicy(name string) (SlowReceiverPolicy, error) {
+	switch policy := SlowReceiverPolicy(name); policy {
+	case SlowReceiverDropVideo, SlowReceiverDowngrade, SlowReceiverDisconnect:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown slow receiver policy %q", name)
+}
+
+// SlowReceiverOptions tell when a receiver is slow and what is done about it
+type SlowReceiverOptions struct {
+	Policy SlowReceiverPolicy
+	// MaxLoss is the fraction of packets the receiver may report lost
+	MaxLoss float64
+	// MaxQueue is how many signaling messages may wait for the receiver
+	MaxQueue int
+	// MaxWriteFailures is how many packets per check may fail to be sent
+	MaxWriteFailures uint64
+	// After is how long a receiver stays slow before the policy applies,
+	// and how long it must keep up before it is lifted
+	After time.Duration
+}
+
+// pendingSignaler is implemented by the signalers queueing their messages
+type pendingSignaler interface {
+	Pending() int
+}
+
+// slowness follows a receiver for the slow receiver policy
+type slowness struct {
+	// since is when the receiver last changed between keeping up and not
+	since time.Time
+	// lagging is set while the receiver does not keep up
+	lagging bool
+	// applied is set while the policy applies to the receiver
+	applied       bool
+	writeFailures uint64
+}
+
+// EnableSlowReceiverPolicy checks the receivers every interval and applies
+// the policy of options to those that stay slow, instead of letting them
+// hold the whole hub back
+func (s *Broadcaster) EnableSlowReceiverPolicy(options SlowReceiverOptions, interval time.Duration) {
+	s.do(func() {
+		s.slowReceivers = &options
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.closed:
+				return
+			case <-ticker.C:
+			}
+			s.do(s.checkSlowReceivers)
+		}
+	}()
+}
+
+// isLagging tells whether the receiver failed to keep up since the last
+// check, it must run on the loop and the caller stores the receiver back
+func (s *Broadcaster) isLagging(receiver *ReceiverState) bool {
+	options := s.slowReceivers
+	lagging := false
+	if receiver.Repair != nil && options.MaxLoss > 0 && receiver.Repair.Stats().Loss > options.MaxLoss {
+		lagging = true
+	}
+	if pending, ok := receiver.Signaler.(pendingSignaler); ok && options.MaxQueue > 0 && pending.Pending() > options.MaxQueue {
+		lagging = true
+	}
+	if receiver.Stats != nil {
+		failures := receiver.Stats.WriteFailures()
+		if failures-receiver.slowness.writeFailures > options.MaxWriteFailures {
+			lagging = true
+		}
+		receiver.slowness.writeFailures = failures
+	}
+	return lagging
+}
+
+// checkSlowReceivers applies the policy to the receivers lagging for long
+// enough and lifts it from those keeping up again, it must run on the loop
+func (s *Broadcaster) checkSlowReceivers() {
+	now := time.Now()
+	for u, receiver := range s.receivers {
+		lagging := s.isLagging(&receiver)
+		if lagging != receiver.slowness.lagging {
+			receiver.slowness.lagging, receiver.slowness.since = lagging, now
+		}
+		s.receivers[u] = receiver
+		if now.Sub(receiver.slowness.since) < s.slowReceivers.After || lagging == receiver.slowness.applied {
+			continue
+		}
+		if lagging && s.slowReceivers.Policy == SlowReceiverDisconnect {
+			zap.S().Infow("Disconnecting slow receiver", "receiver", u)
+			s.closeReceiver(u, websocket.StatusTryAgainLater, slowReceiverReason)
+			continue
+		}
+		zap.S().Infow("Slow receiver policy changed", "receiver", u, "policy", s.slowReceivers.Policy, "applied", lagging)
+		receiver.slowness.applied = lagging
+		s.receivers[u] = receiver
+		switch s.slowReceivers.Policy {
+		case SlowReceiverDropVideo:
+			s.scheduleRebalance()
+		case SlowReceiverDowngrade:
+			s.adaptReceiverLayers(receiver)
+		}
+	}
+}
+
+// dropSlowVideo takes the video away from the receivers the drop-video
+// policy applies to, it must run on the loop
+func (s *Broadcaster) dropSlowVideo(match map[uuid.UUID]map[string]bool) {
+	if s.slowReceivers == nil || s.slowReceivers.Policy != SlowReceiverDropVideo {
+		return
+	}
+	for u, keys := range match {
+		if !s.receivers[u].slowness.applied {
+			continue
+		}
+		for key := range keys {
+			if sender, ok := s.senders[key]; ok && sender.Kind() == webrtc.RTPCodecTypeVideo {
+				delete(keys, key)
+			}
+		}
+	}
+}
+
+// downgraded tells whether the receiver gets the lowest layers only, it
+// must run on the loop
+func (s *Broadcaster) downgraded(receiver ReceiverState) bool {
+	return s.slowReceivers != nil && s.slowReceivers.Policy == SlowReceiverDowngrade && receiver.slowness.applied
+}
@@ -0,0 +1,158 @@
+package hub
+
+import (
+	"errors"
+	"image"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// ErrNoKeyframe is returned for the streams no video keyframe was received
+// of yet
+var ErrNoKeyframe = errors.New("no keyframe received yet")
+
+// KeyframeDecoder decodes the keyframes of the video tracks into pictures,
+// H264 in Annex B and VP8 or VP9 as their RTP payloads depacketize
+type KeyframeDecoder interface {
+	DecodeKeyframe(mimeType string, frame []byte) (image.Image, error)
+}
+
+// Snapshot is the picture of the last keyframe of a stream
+type Snapshot struct {
+	Image image.Image
+	// Received is when the keyframe was
+	Received time.Time
+}
+
+// keyframeCache is a TrackSink keeping the last keyframe of a video track,
+// only the packets of the keyframes are depacketized
+type keyframeCache struct {
+	mimeType string
+	// packet is parsed in place for every packet
+	packet rtp.Packet
+	// The keyframe being assembled, up to the packet with the marker bit
+	assembling   bool
+	timestamp    uint32
+	next         uint16
+	depacketizer rtp.Depacketizer
+	data         []byte
+
+	lock     sync.Mutex
+	frame    []byte
+	received time.Time
+}
+
+// newKeyframeCache returns nil for the codecs without a depacketizer
+func newKeyframeCache(mimeType string) *keyframeCache {
+	c := &keyframeCache{mimeType: mimeType}
+	if c.newDepacketizer() == nil {
+		return nil
+	}
+	return c
+}
+
+func (c *keyframeCache) newDepacketizer() rtp.Depacketizer {
+	switch {
+	case strings.EqualFold(c.mimeType, webrtc.MimeTypeVP8):
+		return &codecs.VP8Packet{}
+	case strings.EqualFold(c.mimeType, webrtc.MimeTypeVP9):
+		return &codecs.VP9Packet{}
+	case strings.EqualFold(c.mimeType, webrtc.MimeTypeH264):
+		return &codecs.H264Packet{}
+	}
+	return nil
+}
+
+func (c *keyframeCache) WriteRTP(raw []byte) error {
+	// Sinks are written by the forwarding loop of their track only
+	packet := &c.packet
+	if err := packet.Unmarshal(raw); err != nil {
+		return nil
+	}
+	if (!c.assembling || packet.Timestamp != c.timestamp) && isKeyframe(c.mimeType, packet.Payload) {
+		c.assembling, c.timestamp, c.next = true, packet.Timestamp, packet.SequenceNumber
+		c.depacketizer, c.data = c.newDepacketizer(), nil
+	}
+	if !c.assembling {
+		return nil
+	}
+	if packet.Timestamp != c.timestamp || packet.SequenceNumber != c.next {
+		// A packet of the keyframe is lost or late
+		c.assembling = false
+		return nil
+	}
+	c.next++
+	data, err := c.depacketizer.Unmarshal(packet.Payload)
+	if err != nil {
+		c.assembling = false
+		return nil
+	}
+	c.data = append(c.data, data...)
+	if packet.Marker {
+		c.assembling = false
+		c.lock.Lock()
+		c.frame, c.received = c.data, time.Now()
+		c.lock.Unlock()
+	}
+	return nil
+}
+
+func (c *keyframeCache) Close() error {
+	return nil
+}
+
+// keyframe returns the last keyframe assembled, nil before the first one
+func (c *keyframeCache) keyframe() ([]byte, time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.frame, c.received
+}
+
+// EnableSnapshots keeps the last keyframe of every new VP8, VP9 or H264
+// track for Snapshot to decode with decoder
+func (s *Broadcaster) EnableSnapshots(decoder KeyframeDecoder) {
+	s.do(func() {
+		s.snapshotDecoder = decoder
+	})
+}
+
+// Snapshot decodes the last keyframe of the first video track of streamID
+func (s *Broadcaster) Snapshot(streamID string) (Snapshot, error) {
+	var decoder KeyframeDecoder
+	var cache *keyframeCache
+	published := false
+	if !s.do(func() {
+		decoder = s.snapshotDecoder
+		for _, key := range s.streamKeys(streamID) {
+			published = true
+			if cache = s.keyframeCaches[key]; cache != nil {
+				return
+			}
+		}
+	}) {
+		return Snapshot{}, errClosed
+	}
+	if decoder == nil {
+		return Snapshot{}, errors.New("snapshots are not enabled")
+	}
+	if !published {
+		return Snapshot{}, ErrUnknownStream
+	}
+	if cache == nil {
+		return Snapshot{}, ErrNoKeyframe
+	}
+	frame, received := cache.keyframe()
+	if frame == nil {
+		return Snapshot{}, ErrNoKeyframe
+	}
+	picture, err := decoder.DecodeKeyframe(cache.mimeType, frame)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{Image: picture, Received: received}, nil
+}
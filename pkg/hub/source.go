@@ -0,0 +1,229 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// trackSource is a track the senders forward, the remote track of a
+// publisher or an IngestTrack
+type trackSource interface {
+	ID() string
+	StreamID() string
+	RID() string
+	Kind() webrtc.RTPCodecType
+	SSRC() webrtc.SSRC
+	Codec() webrtc.RTPCodecParameters
+	Read(b []byte) (int, interceptor.Attributes, error)
+}
+
+// ingestMTU is the size of the RTP packets made of the ingested frames
+const ingestMTU = 1200
+
+// ingestQueue is the packets an IngestTrack holds until they are
+// forwarded, its writer blocks once it is full
+const ingestQueue = 256
+
+// errIngestClosed is returned by the writes to a closed IngestTrack
+var errIngestClosed = errors.New("ingest track closed")
+
+// IngestTrack is a track published from outside of WebRTC, e.g. demuxed
+// from RTMP, its RTP packets are written to it. It is forwarded like the
+// tracks of the WebRTC publishers once added with AddIngestSender.
+type IngestTrack struct {
+	id       string
+	streamID string
+	codec    webrtc.RTPCodecParameters
+	ssrc     webrtc.SSRC
+	// clock maps the timestamps to the wall clock of the publisher, for
+	// the tracks of a stream to stay in sync
+	clock *sourceClock
+
+	packets chan []byte
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewIngestTrack makes a track of codec, it is given an SSRC of its own
+func NewIngestTrack(codec webrtc.RTPCodecCapability, id string, streamID string) *IngestTrack {
+	return &IngestTrack{
+		id:       id,
+		streamID: streamID,
+		codec:    webrtc.RTPCodecParameters{RTPCodecCapability: codec},
+		ssrc:     webrtc.SSRC(rand.Uint32()),
+		clock:    newSourceClock(codec.ClockRate),
+		packets:  make(chan []byte, ingestQueue),
+		done:     make(chan struct{}),
+	}
+}
+
+func (t *IngestTrack) ID() string                       { return t.id }
+func (t *IngestTrack) StreamID() string                 { return t.streamID }
+func (t *IngestTrack) RID() string                      { return "" }
+func (t *IngestTrack) SSRC() webrtc.SSRC                { return t.ssrc }
+func (t *IngestTrack) Codec() webrtc.RTPCodecParameters { return t.codec }
+
+func (t *IngestTrack) Kind() webrtc.RTPCodecType {
+	if (mediaTrack{mimeType: t.codec.MimeType}).video() {
+		return webrtc.RTPCodecTypeVideo
+	}
+	return webrtc.RTPCodecTypeAudio
+}
+
+// WriteRTP queues packet, its payload type and SSRC are set. The publisher
+// sent it at, on a wall clock shared by the tracks of its stream. It
+// blocks while the queue is full.
+func (t *IngestTrack) WriteRTP(packet *rtp.Packet, at time.Time) error {
+	packet.PayloadType = uint8(t.codec.PayloadType)
+	packet.SSRC = uint32(t.ssrc)
+	raw, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	t.clock.sync(packet.Timestamp, at)
+	select {
+	case <-t.done:
+		return errIngestClosed
+	case t.packets <- raw:
+		return nil
+	}
+}
+
+// Read returns the next packet, io.EOF once the track is closed
+func (t *IngestTrack) Read(b []byte) (int, interceptor.Attributes, error) {
+	select {
+	case <-t.done:
+		return 0, nil, io.EOF
+	case raw := <-t.packets:
+		if len(raw) > len(b) {
+			return 0, nil, io.ErrShortBuffer
+		}
+		return copy(b, raw), nil, nil
+	}
+}
+
+// Close ends the track, its sender is detached like those of the
+// publishers leaving
+func (t *IngestTrack) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+// acceptsIngest tells why the streams ingested cannot be published, nil
+// when they can
+func (s *Broadcaster) acceptsIngest() error {
+	if s.Draining() {
+		return errors.New("the hub is draining")
+	}
+	if s.opaque() {
+		return errors.New("the room carries end-to-end encrypted media")
+	}
+	return nil
+}
+
+// AddIngestSender forwards t until it is closed, it returns nil once the
+// Broadcaster is closed
+func (s *Broadcaster) AddIngestSender(t *IngestTrack) *webrtc.TrackLocalStaticRTP {
+	return s.addSender(uuid.Nil, t, nil)
+}
+
+// ingestOpusCodec is the codec of the Opus audio of the ingests
+func ingestOpusCodec() webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: DefaultOpusFmtp}
+}
+
+// ingestH264Codec is the codec of the H264 video of the ingests, profile
+// is the profile, compatibility and level of its SPS
+func ingestH264Codec(profile []byte) webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: fmt.Sprintf("level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=%02x%02x%02x", profile[0], profile[1], profile[2]),
+	}
+}
+
+// packetizedTrack packetizes the frames of an ingest track
+type packetizedTrack struct {
+	track     *IngestTrack
+	payloader rtp.Payloader
+	video     bool
+	sequence  uint16
+	// transcoder makes the Opus of the audio in other codecs
+	transcoder io.WriteCloser
+}
+
+// addPacketizedTrack forwards a track of streamID, its frames are
+// packetized by payloader
+func (s *Broadcaster) addPacketizedTrack(codec webrtc.RTPCodecCapability, id string, streamID string, payloader rtp.Payloader) (*packetizedTrack, error) {
+	track := NewIngestTrack(codec, id, streamID)
+	if s.AddIngestSender(track) == nil {
+		return nil, errClosed
+	}
+	return &packetizedTrack{track: track, payloader: payloader, video: track.Kind() == webrtc.RTPCodecTypeVideo}, nil
+}
+
+// addTranscodedTrack forwards the Opus transcode of the AAC audio of
+// streamID, written to the transcoder of the track. Its first frame has
+// the timestamp at 48kHz and was sent at, the Opus packets count from it.
+func (s *Broadcaster) addTranscodedTrack(transcoder AudioTranscoder, id string, streamID string, timestamp uint32, at time.Time) (*packetizedTrack, error) {
+	track, err := s.addPacketizedTrack(ingestOpusCodec(), id, streamID, &codecs.OpusPayloader{})
+	if err != nil {
+		return nil, err
+	}
+	packets := uint32(0)
+	if track.transcoder, err = transcoder.NewAACTranscoder(func(packet []byte) {
+		track.write(packet, true, timestamp+packets*960, at.Add(time.Duration(packets)*20*time.Millisecond))
+		packets++
+	}); err != nil {
+		track.Close()
+		return nil, err
+	}
+	return track, nil
+}
+
+// write sends frame as RTP packets of timestamp, the publisher sent it at
+func (t *packetizedTrack) write(frame []byte, keyframe bool, timestamp uint32, at time.Time) error {
+	payloads := t.payloader.Payload(ingestMTU, frame)
+	for i, payload := range payloads {
+		if _, ok := t.payloader.(*codecs.VP9Payloader); ok {
+			// Non-flexible mode, the frames reference the previous one
+			// unless they are keyframes
+			payload[0] &^= 0x10
+			if !keyframe {
+				payload[0] |= 0x40
+			}
+		}
+		packet := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         t.video && i == len(payloads)-1,
+				SequenceNumber: t.sequence,
+				Timestamp:      timestamp,
+			},
+			Payload: payload,
+		}
+		t.sequence++
+		if err := t.track.WriteRTP(packet, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close ends the track, after the transcoder
+func (t *packetizedTrack) Close() error {
+	if t.transcoder != nil {
+		t.transcoder.Close()
+	}
+	return t.track.Close()
+}
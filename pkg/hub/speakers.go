@@ -0,0 +1,230 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// audioLevelExtension carries the client-to-mixer audio level of packets
+// (RFC 6464)
+const audioLevelExtension = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+
+const (
+	// speakerMaxLevel is the loudest smoothed level, in -dBov, of a silent
+	// track
+	speakerMaxLevel = 60
+	// speakerSilence is how long a track sending no packets, as with Opus
+	// DTX, keeps its last level
+	speakerSilence = time.Second
+	// speakerHysteresis is by how many dB another stream must be louder to
+	// take over the dominant speaker
+	speakerHysteresis = 3
+	// audioLevelSmoothing weighs the level of every packet in the smoothed one
+	audioLevelSmoothing = 0.05
+)
+
+// SpeakerLevel is the smoothed audio level of a stream in -dBov, 0 is the
+// loudest and 127 silence
+type SpeakerLevel struct {
+	StreamID string  `json:"streamID"`
+	Level    float64 `json:"level"`
+}
+
+// ActiveSpeakers is sent in active-speaker events to every receiver and on
+// the room event stream when the speaking streams change
+type ActiveSpeakers struct {
+	// Dominant is the stream of the dominant speaker, empty when nobody speaks
+	Dominant string `json:"streamID"`
+	// Ranking lists the speaking streams, the loudest first
+	Ranking []SpeakerLevel `json:"ranking"`
+}
+
+// speakerState is the active speaker detection of a room
+type speakerState struct {
+	// prioritize keeps the active speakers when trimming receivers to
+	// their MaxTracks
+	prioritize bool
+	current    ActiveSpeakers
+	// ranks are the 1-based positions of the speaking streams
+	ranks map[string]int
+}
+
+// audioLevelMeter is a TrackSink smoothing the audio level extension of a
+// track, it is written by the forwarding loop of its track only
+type audioLevelMeter struct {
+	extensionID uint8
+	header      rtp.Header
+
+	lock       sync.Mutex
+	level      float64
+	lastPacket time.Time
+}
+
+func newAudioLevelMeter(extensionID uint8) *audioLevelMeter {
+	return &audioLevelMeter{extensionID: extensionID, level: 127}
+}
+
+func (m *audioLevelMeter) WriteRTP(packet []byte) error {
+	if _, err := m.header.Unmarshal(packet); err != nil {
+		return nil
+	}
+	extension := m.header.GetExtension(m.extensionID)
+	if len(extension) < 1 {
+		return nil
+	}
+	level := float64(extension[0] & 0x7F)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.level += audioLevelSmoothing * (level - m.level)
+	m.lastPacket = time.Now()
+	return nil
+}
+
+func (m *audioLevelMeter) Close() error {
+	return nil
+}
+
+// smoothedLevel is the level of the track, silence once it stopped sending
+func (m *audioLevelMeter) smoothedLevel(now time.Time) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if now.Sub(m.lastPacket) > speakerSilence {
+		return 127
+	}
+	return m.level
+}
+
+// audioLevelExtensionID finds the audio level extension negotiated for the
+// track source of the publisher, 0 when there is none. It must run on the
+// loop.
+func (s *Broadcaster) audioLevelExtensionID(publisher PeerSenderState, source trackSource) uint8 {
+	receiver := trackReceiver(publisher, source)
+	if receiver == nil || source.Kind() != webrtc.RTPCodecTypeAudio {
+		return 0
+	}
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == audioLevelExtension {
+			return uint8(extension.ID)
+		}
+	}
+	return 0
+}
+
+// EnableActiveSpeakers ranks the streams by the audio levels their
+// publishers report every interval, the changes are sent as active-speaker
+// events. With prioritize, the receivers trimmed to their MaxTracks keep
+// the streams of the active speakers.
+func (s *Broadcaster) EnableActiveSpeakers(interval time.Duration, prioritize bool) {
+	s.do(func() {
+		s.speakers.prioritize = prioritize
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.closed:
+				return
+			case <-ticker.C:
+			}
+			s.do(s.rankSpeakers)
+		}
+	}()
+}
+
+// ActiveSpeakers returns the last ranking of the speaking streams
+func (s *Broadcaster) ActiveSpeakers() ActiveSpeakers {
+	speakers := ActiveSpeakers{Ranking: []SpeakerLevel{}}
+	s.do(func() {
+		speakers.Dominant = s.speakers.current.Dominant
+		speakers.Ranking = append(speakers.Ranking, s.speakers.current.Ranking...)
+	})
+	return speakers
+}
+
+// quietness orders the streams from the silent ones to the loudest
+// speaker, it must run on the loop
+func (s *Broadcaster) quietness(streamID string) int {
+	if rank, ok := s.speakers.ranks[streamID]; ok {
+		return rank
+	}
+	return math.MaxInt
+}
+
+// rankSpeakers ranks the streams by their loudest audio track and sends an
+// active-speaker event when the speaking streams changed, it must run on
+// the loop
+func (s *Broadcaster) rankSpeakers() {
+	now := time.Now()
+	levels := make(map[string]float64)
+	for key, meter := range s.audioLevels {
+		sender, ok := s.senders[key]
+		if !ok {
+			continue
+		}
+		level := meter.smoothedLevel(now)
+		if current, ok := levels[sender.StreamID()]; level < speakerMaxLevel && (!ok || level < current) {
+			levels[sender.StreamID()] = level
+		}
+	}
+	ranking := make([]SpeakerLevel, 0, len(levels))
+	for streamID, level := range levels {
+		ranking = append(ranking, SpeakerLevel{StreamID: streamID, Level: math.Round(level*10) / 10})
+	}
+	sort.Slice(ranking, func(i, j int) bool {
+		if ranking[i].Level != ranking[j].Level {
+			return ranking[i].Level < ranking[j].Level
+		}
+		return ranking[i].StreamID < ranking[j].StreamID
+	})
+
+	// The dominant speaker stays until it stops or is clearly outspoken
+	dominant := s.speakers.current.Dominant
+	if level, speaking := levels[dominant]; !speaking {
+		dominant = ""
+		if len(ranking) > 0 {
+			dominant = ranking[0].StreamID
+		}
+	} else if len(ranking) > 0 && ranking[0].Level+speakerHysteresis < level {
+		dominant = ranking[0].StreamID
+	}
+
+	changed := dominant != s.speakers.current.Dominant || len(ranking) != len(s.speakers.current.Ranking)
+	for i := 0; !changed && i < len(ranking); i++ {
+		changed = ranking[i].StreamID != s.speakers.current.Ranking[i].StreamID
+	}
+	s.speakers.current = ActiveSpeakers{Dominant: dominant, Ranking: ranking}
+	s.compositeSpeaker(dominant)
+	if !changed {
+		return
+	}
+	s.speakers.ranks = make(map[string]int, len(ranking))
+	for i, speaker := range ranking {
+		s.speakers.ranks[speaker.StreamID] = i + 1
+	}
+	if s.speakers.prioritize {
+		s.scheduleRebalance()
+	}
+
+	encoded, err := json.Marshal(s.speakers.current)
+	if err != nil {
+		zap.S().Errorw("Unable to encode active speakers", "error", err)
+		return
+	}
+	s.events.Publish("active-speaker", string(encoded))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for u, receiver := range s.receivers {
+		if err := receiver.Signaler.Send(ctx, Message{Event: "active-speaker", Data: string(encoded)}); err != nil {
+			zap.S().Debugw("Unable to send active speakers", "receiver", u, "error", err)
+		}
+	}
+}
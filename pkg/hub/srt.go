@@ -0,0 +1,537 @@
+package hub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// srtPayloadSize carries seven TS packets per SRT packet
+const srtPayloadSize = 7 * tsPacketSize
+
+// srtDefaultLatency is the TSBPD latency of the SRT connections without
+// one in their URL
+const srtDefaultLatency = 120 * time.Millisecond
+
+// srtIdleTimeout drops the peers not heard of for that long
+const srtIdleTimeout = 5 * time.Second
+
+// srtKeepaliveInterval is how often the idle connections are kept alive
+const srtKeepaliveInterval = time.Second
+
+// srtHandshakeRetry is how often a handshake is sent again without answer
+const srtHandshakeRetry = 250 * time.Millisecond
+
+// The SRT control packets and handshake fields used
+const (
+	srtControlHandshake = 0
+	srtControlKeepalive = 1
+	srtControlACK       = 2
+	srtControlNAK       = 3
+	srtControlShutdown  = 5
+	srtControlACKACK    = 6
+	srtInduction        = 1
+	srtConclusion       = 0xFFFFFFFF
+	srtMagic            = 0x4A17
+	srtExtHSREQ         = 1
+	srtExtHSRSP         = 2
+	srtExtSID           = 5
+	srtExtFlagHSREQ     = 0x1
+	srtExtFlagConfig    = 0x4
+	srtVersion          = 0x00010401
+	// TSBPD sending and receiving, crypt, too late packet drop, periodic
+	// NAK and retransmission flag
+	srtFlags      = 0x3F
+	srtMTU        = 1500
+	srtFlowWindow = 8192
+	// srtRetransmitted flags the data packets sent again
+	srtRetransmitted = 0x04000000
+	srtSoloPacket    = 0xC0000000
+)
+
+// srtOptions are the query parameters of an SRT URL
+type srtOptions struct {
+	address  string
+	listener bool
+	latency  time.Duration
+	streamID string
+}
+
+// parseSRTURL reads srt://host:port?mode=caller|listener&latency=ms&streamid=,
+// the callers connect to host:port and the listeners wait on it
+func parseSRTURL(rawURL string) (srtOptions, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return srtOptions{}, err
+	}
+	if target.Scheme != "srt" {
+		return srtOptions{}, fmt.Errorf("unsupported scheme %q, srt expected", target.Scheme)
+	}
+	if target.Port() == "" {
+		return srtOptions{}, errors.New("the URL has no port")
+	}
+	query := target.Query()
+	options := srtOptions{address: target.Host, latency: srtDefaultLatency, streamID: query.Get("streamid")}
+	switch query.Get("mode") {
+	case "", "caller":
+	case "listener":
+		options.listener = true
+	default:
+		return srtOptions{}, fmt.Errorf("unknown mode %q, caller or listener expected", query.Get("mode"))
+	}
+	if latency := query.Get("latency"); latency != "" {
+		ms, err := strconv.Atoi(latency)
+		if err != nil || ms < 0 || ms > 0xFFFF {
+			return srtOptions{}, fmt.Errorf("invalid latency %q in milliseconds", latency)
+		}
+		options.latency = time.Duration(ms) * time.Millisecond
+	}
+	if query.Get("passphrase") != "" {
+		return srtOptions{}, errors.New("encrypted SRT is not supported")
+	}
+	if len(options.streamID) > 512 {
+		return srtOptions{}, errors.New("the streamid is longer than 512 bytes")
+	}
+	return options, nil
+}
+
+// RedactSRTURL hides the stream ID of an SRT URL, it may hold credentials
+func RedactSRTURL(rawURL string) string {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	query := target.Query()
+	if query.Has("streamid") {
+		query.Set("streamid", "***")
+	}
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+// srtPacket is a data packet kept for the retransmissions
+type srtPacket struct {
+	sequence uint32
+	sent     time.Time
+	data     []byte
+}
+
+// srtSocket sends a live stream over SRT, as a caller connected to its
+// peer or as a listener sending to the last caller that connected. The
+// packets the receiver reports lost are sent again until they are older
+// than the latency.
+type srtSocket struct {
+	options  srtOptions
+	conn     *net.UDPConn
+	socketID uint32
+	cookie   uint32
+	closed   chan struct{}
+	once     sync.Once
+
+	lock sync.Mutex
+	// peer is nil while a listener waits for a caller
+	peer       *net.UDPAddr
+	peerSocket uint32
+	start      time.Time
+	heard      time.Time
+	sequence   uint32
+	message    uint32
+	sent       []srtPacket
+	err        error
+}
+
+// dialSRT opens an SRT socket, a caller is connected once it returns
+func dialSRT(ctx context.Context, rawURL string) (*srtSocket, error) {
+	options, err := parseSRTURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &srtSocket{options: options, closed: make(chan struct{}), socketID: srtRandom() & 0x7FFFFFFF, cookie: srtRandom()}
+	if options.listener {
+		address, err := net.ResolveUDPAddr("udp", options.address)
+		if err != nil {
+			return nil, err
+		}
+		if s.conn, err = net.ListenUDP("udp", address); err != nil {
+			return nil, err
+		}
+	} else {
+		if s.conn, err = net.ListenUDP("udp", nil); err != nil {
+			return nil, err
+		}
+		if err := s.call(ctx); err != nil {
+			s.conn.Close()
+			return nil, err
+		}
+	}
+	go s.readLoop()
+	go s.keepalive()
+	return s, nil
+}
+
+func srtRandom() uint32 {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
+
+// call runs the induction and the conclusion of the caller handshake
+func (s *srtSocket) call(ctx context.Context) error {
+	address, err := net.ResolveUDPAddr("udp", s.options.address)
+	if err != nil {
+		return err
+	}
+	sequence := srtRandom() & 0x7FFFFFFF
+	induction := srtHandshake(4, 2, sequence, srtInduction, s.socketID, 0, nil)
+	response, err := s.exchange(ctx, address, 0, induction, srtInduction)
+	if err != nil {
+		return fmt.Errorf("induction: %w", err)
+	}
+	cookie := binary.BigEndian.Uint32(response[28:])
+	extensions, flags := srtHandshakeExtension(srtExtHSREQ, s.options.latency), uint16(srtExtFlagHSREQ)
+	if s.options.streamID != "" {
+		extensions, flags = append(extensions, srtStreamIDExtension(s.options.streamID)...), flags|srtExtFlagConfig
+	}
+	conclusion := srtHandshake(5, flags, sequence, srtConclusion, s.socketID, cookie, extensions)
+	if response, err = s.exchange(ctx, address, 0, conclusion, srtConclusion); err != nil {
+		return fmt.Errorf("conclusion: %w", err)
+	}
+	s.connect(address, binary.BigEndian.Uint32(response[24:]), sequence)
+	return nil
+}
+
+// exchange sends a handshake until its response of kind, returning its
+// content
+func (s *srtSocket) exchange(ctx context.Context, address *net.UDPAddr, peerSocket uint32, handshake []byte, kind uint32) ([]byte, error) {
+	packet := srtControl(srtControlHandshake, 0, 0, peerSocket, handshake)
+	buffer := make([]byte, srtMTU)
+	for {
+		if _, err := s.conn.WriteToUDP(packet, address); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(srtHandshakeRetry)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		s.conn.SetReadDeadline(deadline)
+		for {
+			n, from, err := s.conn.ReadFromUDP(buffer)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if !from.IP.Equal(address.IP) || from.Port != address.Port || n < 16+48 || binary.BigEndian.Uint32(buffer) != 0x80000000|srtControlHandshake<<16 {
+				continue
+			}
+			response := buffer[16:n]
+			switch kind := binary.BigEndian.Uint32(response[12:]); {
+			case kind == srtInduction || kind == srtConclusion:
+				s.conn.SetReadDeadline(time.Time{})
+				return append([]byte(nil), response...), nil
+			case kind >= 1000:
+				return nil, fmt.Errorf("rejected by the peer with code %d", kind)
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// connect starts sending to the peer from sequence
+func (s *srtSocket) connect(peer *net.UDPAddr, peerSocket uint32, sequence uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.peer, s.peerSocket, s.sequence = peer, peerSocket, sequence
+	s.start, s.heard, s.sent = time.Now(), time.Now(), nil
+}
+
+// srtHandshake is the content of a handshake packet
+func srtHandshake(version uint32, extension uint16, sequence uint32, kind uint32, socketID uint32, cookie uint32, extensions []byte) []byte {
+	handshake := u32(version)
+	handshake = append(handshake, u16(0)...)
+	handshake = append(handshake, u16(extension)...)
+	handshake = append(handshake, u32(sequence)...)
+	handshake = append(handshake, u32(srtMTU)...)
+	handshake = append(handshake, u32(srtFlowWindow)...)
+	handshake = append(handshake, u32(kind)...)
+	handshake = append(handshake, u32(socketID)...)
+	handshake = append(handshake, u32(cookie)...)
+	// The peer address is left out
+	handshake = append(handshake, make([]byte, 16)...)
+	return append(handshake, extensions...)
+}
+
+// srtHandshakeExtension is the HSREQ or HSRSP of a sender with latency
+func srtHandshakeExtension(kind uint16, latency time.Duration) []byte {
+	extension := append(u16(kind), u16(3)...)
+	extension = append(extension, u32(srtVersion)...)
+	extension = append(extension, u32(srtFlags)...)
+	ms := uint16(latency.Milliseconds())
+	return append(extension, append(u16(ms), u16(ms)...)...)
+}
+
+// srtStreamIDExtension carries the stream ID, its bytes reversed in each
+// 32 bits word
+func srtStreamIDExtension(streamID string) []byte {
+	padded := []byte(streamID)
+	for len(padded)%4 != 0 {
+		padded = append(padded, 0)
+	}
+	for i := 0; i < len(padded); i += 4 {
+		padded[i], padded[i+1], padded[i+2], padded[i+3] = padded[i+3], padded[i+2], padded[i+1], padded[i]
+	}
+	return append(append(u16(srtExtSID), u16(uint16(len(padded)/4))...), padded...)
+}
+
+// srtControl is a control packet
+func srtControl(kind uint16, info uint32, timestamp uint32, peerSocket uint32, content []byte) []byte {
+	packet := u32(0x80000000 | uint32(kind)<<16)
+	packet = append(packet, u32(info)...)
+	packet = append(packet, u32(timestamp)...)
+	packet = append(packet, u32(peerSocket)...)
+	return append(packet, content...)
+}
+
+// Write sends p in packets of srtPayloadSize, they are dropped while a
+// listener has no caller
+func (s *srtSocket) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.peer == nil {
+		return len(p), nil
+	}
+	now := time.Now()
+	// The receiver drops the packets older than the latency
+	expired := 0
+	for expired < len(s.sent) && now.Sub(s.sent[expired].sent) > s.options.latency+srtKeepaliveInterval {
+		expired++
+	}
+	s.sent = s.sent[expired:]
+	for offset := 0; offset < len(p); offset += srtPayloadSize {
+		end := offset + srtPayloadSize
+		if end > len(p) {
+			end = len(p)
+		}
+		packet := u32(s.sequence)
+		packet = append(packet, u32(srtSoloPacket|s.message)...)
+		packet = append(packet, u32(uint32(now.Sub(s.start).Microseconds()))...)
+		packet = append(packet, u32(s.peerSocket)...)
+		packet = append(packet, p[offset:end]...)
+		if _, err := s.conn.WriteToUDP(packet, s.peer); err != nil {
+			s.err = err
+			return offset, err
+		}
+		s.sent = append(s.sent, srtPacket{sequence: s.sequence, sent: now, data: packet})
+		s.sequence = (s.sequence + 1) & 0x7FFFFFFF
+		s.message = (s.message + 1) & 0x03FFFFFF
+	}
+	return len(p), nil
+}
+
+// readLoop answers the handshakes of the callers of a listener and the
+// control packets of the peer
+func (s *srtSocket) readLoop() {
+	buffer := make([]byte, srtMTU)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if n < 16 || buffer[0]&0x80 == 0 {
+			continue
+		}
+		kind := binary.BigEndian.Uint16(buffer) & 0x7FFF
+		info := binary.BigEndian.Uint32(buffer[4:])
+		content := buffer[16:n]
+		if kind == srtControlHandshake && s.options.listener {
+			s.accept(from, content)
+			continue
+		}
+		s.lock.Lock()
+		if s.peer == nil || !from.IP.Equal(s.peer.IP) || from.Port != s.peer.Port {
+			s.lock.Unlock()
+			continue
+		}
+		s.heard = time.Now()
+		switch kind {
+		case srtControlACK:
+			if len(content) >= 4 {
+				acknowledged := binary.BigEndian.Uint32(content) & 0x7FFFFFFF
+				i := 0
+				for i < len(s.sent) && srtBefore(s.sent[i].sequence, acknowledged) {
+					i++
+				}
+				s.sent = s.sent[i:]
+			}
+			// Light ACKs are not acknowledged
+			if len(content) > 4 {
+				s.conn.WriteToUDP(srtControl(srtControlACKACK, info, s.timestamp(), s.peerSocket, nil), s.peer)
+			}
+		case srtControlNAK:
+			s.retransmit(content)
+		case srtControlShutdown:
+			zap.S().Infow("SRT peer shut down", "peer", s.peer.String())
+			if !s.options.listener {
+				s.err = errors.New("shut down by the peer")
+			}
+			s.peer = nil
+		}
+		s.lock.Unlock()
+	}
+}
+
+// accept answers the handshake of a caller, the last one to conclude gets
+// the stream
+func (s *srtSocket) accept(from *net.UDPAddr, handshake []byte) {
+	if len(handshake) < 48 {
+		return
+	}
+	sequence := binary.BigEndian.Uint32(handshake[8:])
+	kind := binary.BigEndian.Uint32(handshake[12:])
+	callerSocket := binary.BigEndian.Uint32(handshake[16:])
+	switch kind {
+	case srtInduction:
+		response := srtHandshake(5, srtMagic, sequence, srtInduction, s.socketID, s.cookie, nil)
+		s.conn.WriteToUDP(srtControl(srtControlHandshake, 0, 0, callerSocket, response), from)
+	case srtConclusion:
+		if binary.BigEndian.Uint32(handshake[20:]) != s.cookie {
+			return
+		}
+		response := srtHandshake(5, srtExtFlagHSREQ, sequence, srtConclusion, s.socketID, s.cookie, srtHandshakeExtension(srtExtHSRSP, s.options.latency))
+		s.conn.WriteToUDP(srtControl(srtControlHandshake, 0, 0, callerSocket, response), from)
+		s.lock.Lock()
+		reconcluded := s.peer != nil && s.peer.String() == from.String() && s.peerSocket == callerSocket
+		s.lock.Unlock()
+		if !reconcluded {
+			zap.S().Infow("SRT caller connected", "peer", from.String())
+			s.connect(from, callerSocket, sequence)
+		}
+	}
+}
+
+// retransmit sends again the packets of a loss report, it must be called
+// with the lock held
+func (s *srtSocket) retransmit(report []byte) {
+	for i := 0; i+4 <= len(report); i += 4 {
+		first := binary.BigEndian.Uint32(report[i:])
+		last := first
+		if first&0x80000000 != 0 && i+8 <= len(report) {
+			i += 4
+			first, last = first&0x7FFFFFFF, binary.BigEndian.Uint32(report[i:])&0x7FFFFFFF
+		}
+		for _, packet := range s.sent {
+			if !srtBefore(packet.sequence, first) && !srtBefore(last, packet.sequence) {
+				binary.BigEndian.PutUint32(packet.data[4:], binary.BigEndian.Uint32(packet.data[4:])|srtRetransmitted)
+				s.conn.WriteToUDP(packet.data, s.peer)
+			}
+		}
+	}
+}
+
+// keepalive keeps the idle connection open and drops the peers gone silent
+func (s *srtSocket) keepalive() {
+	ticker := time.NewTicker(srtKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		s.lock.Lock()
+		if s.peer != nil {
+			if time.Since(s.heard) > srtIdleTimeout {
+				zap.S().Infow("SRT peer timed out", "peer", s.peer.String())
+				if !s.options.listener {
+					s.err = errors.New("peer timed out")
+				}
+				s.peer = nil
+			} else {
+				s.conn.WriteToUDP(srtControl(srtControlKeepalive, 0, s.timestamp(), s.peerSocket, nil), s.peer)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// timestamp is the time of the connection, it must be called with the lock
+// held
+func (s *srtSocket) timestamp() uint32 {
+	return uint32(time.Since(s.start).Microseconds())
+}
+
+// srtBefore compares the sequence numbers of 31 bits, wrapping around
+func srtBefore(a, b uint32) bool {
+	return a != b && (b-a)&0x7FFFFFFF < 0x40000000
+}
+
+// fail records why the socket failed and closes it
+func (s *srtSocket) fail(err error) {
+	s.lock.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.lock.Unlock()
+	s.Close()
+}
+
+// failure is why the socket failed, nil while it sends
+func (s *srtSocket) failure() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if errors.Is(s.err, net.ErrClosed) {
+		return nil
+	}
+	return s.err
+}
+
+// Close tells the peer and closes the socket
+func (s *srtSocket) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+		s.lock.Lock()
+		if s.peer != nil {
+			s.conn.WriteToUDP(srtControl(srtControlShutdown, 0, s.timestamp(), s.peerSocket, u32(0)), s.peer)
+		}
+		s.lock.Unlock()
+		s.conn.Close()
+	})
+	return nil
+}
+
+// accepts the codecs MPEG-TS carries
+func (s *srtSocket) accepts(mimeType string) bool {
+	return tsAccepts(mimeType)
+}
+
+// create muxes the tracks into MPEG-TS sent over the socket
+func (s *srtSocket) create(tracks []mediaTrack, date time.Time) (frameWriter, error) {
+	return &srtWriter{tsWriter: newTSWriter(s, tracks), socket: s}, nil
+}
+
+// srtWriter closes its socket with the output
+type srtWriter struct {
+	*tsWriter
+	socket *srtSocket
+}
+
+func (w *srtWriter) Close() error {
+	return w.socket.Close()
+}
@@ -0,0 +1,612 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp/codecs"
+	"go.uber.org/zap"
+)
+
+// srtACKInterval is how often the callers get their packets acknowledged
+const srtACKInterval = 10 * time.Millisecond
+
+// srtNAKInterval is how often the packets still missing are reported
+const srtNAKInterval = 50 * time.Millisecond
+
+// srtCallerQueue is the packets a caller holds until they are demuxed,
+// those coming while it is full are dropped and reported lost
+const srtCallerQueue = 1024
+
+// srtRejectPeer is the handshake rejecting the callers, their stream is
+// not taken
+const srtRejectPeer = 1002
+
+// srtSequenceMask keeps the sequence numbers on 31 bits
+const srtSequenceMask = 0x7FFFFFFF
+
+// SRTServer takes the MPEG-TS streams of the SRT callers, such as the
+// hardware encoders in the field, as ingest tracks forwarded with those of
+// the WebRTC publishers. H264 and Opus are forwarded as they come, AAC is
+// transcoded to Opus. The packets lost are recovered within the latency
+// the callers ask for, at least srtDefaultLatency.
+type SRTServer struct {
+	// lookup finds the stream published with a stream ID
+	lookup func(streamID string) (*Broadcaster, string, bool)
+	// authorize checks the token of the stream ID, nil accepts any
+	authorize  func(token string) bool
+	transcoder AudioTranscoder
+	cookie     uint32
+
+	lock    sync.Mutex
+	conn    *net.UDPConn
+	callers map[uint32]*srtCaller
+	closed  bool
+}
+
+// NewSRTServer takes the streams lookup finds from the stream IDs of the
+// callers, published once authorize accepts their token. The AAC audio is
+// transcoded with transcoder.
+func NewSRTServer(lookup func(streamID string) (b *Broadcaster, name string, ok bool), authorize func(token string) bool, transcoder AudioTranscoder) *SRTServer {
+	return &SRTServer{lookup: lookup, authorize: authorize, transcoder: transcoder, cookie: srtRandom(), callers: make(map[uint32]*srtCaller)}
+}
+
+// Serve answers the callers on conn until the server is closed
+func (r *SRTServer) Serve(conn *net.UDPConn) error {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return net.ErrClosed
+	}
+	r.conn = conn
+	r.lock.Unlock()
+	buffer := make([]byte, srtMTU)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if r.closed {
+				return nil
+			}
+			return err
+		}
+		if n < 16 {
+			continue
+		}
+		destination := binary.BigEndian.Uint32(buffer[12:])
+		if destination == 0 {
+			if buffer[0]&0x80 != 0 && binary.BigEndian.Uint16(buffer)&0x7FFF == srtControlHandshake {
+				r.handshake(from, buffer[16:n])
+			}
+			continue
+		}
+		r.lock.Lock()
+		c, ok := r.callers[destination]
+		r.lock.Unlock()
+		if !ok || !from.IP.Equal(c.peer.IP) || from.Port != c.peer.Port {
+			continue
+		}
+		select {
+		case c.packets <- append([]byte(nil), buffer[:n]...):
+		default:
+		}
+	}
+}
+
+// Close stops answering the callers and ends their streams
+func (r *SRTServer) Close() error {
+	r.lock.Lock()
+	r.closed = true
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	callers := r.callers
+	r.callers = make(map[uint32]*srtCaller)
+	r.lock.Unlock()
+	for _, c := range callers {
+		c.close()
+	}
+	return nil
+}
+
+// handshake answers the induction and the conclusion of a caller, the
+// conclusions sent again get the same answer
+func (r *SRTServer) handshake(from *net.UDPAddr, handshake []byte) {
+	if len(handshake) < 48 {
+		return
+	}
+	sequence := binary.BigEndian.Uint32(handshake[8:]) & srtSequenceMask
+	kind := binary.BigEndian.Uint32(handshake[12:])
+	callerSocket := binary.BigEndian.Uint32(handshake[16:])
+	switch kind {
+	case srtInduction:
+		response := srtHandshake(5, srtMagic, sequence, srtInduction, 0, r.cookie, nil)
+		r.conn.WriteToUDP(srtControl(srtControlHandshake, 0, 0, callerSocket, response), from)
+		return
+	case srtConclusion:
+	default:
+		return
+	}
+	if binary.BigEndian.Uint32(handshake[20:]) != r.cookie {
+		return
+	}
+	r.lock.Lock()
+	var existing *srtCaller
+	for _, c := range r.callers {
+		if c.peerSocket == callerSocket && c.peer.String() == from.String() {
+			existing = c
+		}
+	}
+	r.lock.Unlock()
+	if existing != nil {
+		r.conn.WriteToUDP(existing.conclusion, from)
+		return
+	}
+
+	latency, streamID := srtDefaultLatency, ""
+	for extensions := handshake[48:]; len(extensions) >= 4; {
+		extension := binary.BigEndian.Uint16(extensions)
+		size := 4 * int(binary.BigEndian.Uint16(extensions[2:]))
+		if 4+size > len(extensions) {
+			break
+		}
+		content := extensions[4 : 4+size]
+		extensions = extensions[4+size:]
+		switch {
+		case extension == srtExtHSREQ && size >= 12:
+			// The TSBPD delays the caller asks for
+			for _, offset := range []int{8, 10} {
+				if delay := time.Duration(binary.BigEndian.Uint16(content[offset:])) * time.Millisecond; delay > latency {
+					latency = delay
+				}
+			}
+		case extension == srtExtSID:
+			streamID = srtStreamID(content)
+		}
+	}
+	logger := zap.S().With("peer", from.String(), "transport", "srt")
+	// The token is not logged
+	key, token, err := srtStreamKey(streamID)
+	var b *Broadcaster
+	var name string
+	if err == nil {
+		b, name, err = r.publish(key, token)
+	}
+	if err != nil {
+		logger.Infow("SRT caller rejected", "key", key, "error", err)
+		response := srtHandshake(5, 0, sequence, srtRejectPeer, 0, r.cookie, nil)
+		r.conn.WriteToUDP(srtControl(srtControlHandshake, 0, 0, callerSocket, response), from)
+		return
+	}
+	c := &srtCaller{
+		server:      r,
+		conn:        r.conn,
+		peer:        from,
+		socketID:    srtRandom() & srtSequenceMask,
+		peerSocket:  callerSocket,
+		latency:     latency,
+		packets:     make(chan []byte, srtCallerQueue),
+		closed:      make(chan struct{}),
+		broadcaster: b,
+		streamID:    name,
+		next:        sequence,
+		highest:     (sequence - 1) & srtSequenceMask,
+		pending:     make(map[uint32]srtPending),
+		start:       time.Now(),
+		logger:      logger.With("streamID", name),
+	}
+	c.demuxer = newTSReader(c.media)
+	response := srtHandshake(5, srtExtFlagHSREQ, sequence, srtConclusion, c.socketID, r.cookie, srtHandshakeExtension(srtExtHSRSP, latency))
+	c.conclusion = srtControl(srtControlHandshake, 0, 0, callerSocket, response)
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return
+	}
+	r.callers[c.socketID] = c
+	r.lock.Unlock()
+	r.conn.WriteToUDP(c.conclusion, from)
+	c.logger.Infow("SRT stream published", "latency", latency)
+	go c.run()
+}
+
+// srtStreamKey reads the stream key and the token of a caller, in the
+// access control syntax #!::r={key},m=publish,token={token} or as
+// {key}?token={token}
+func srtStreamKey(streamID string) (string, string, error) {
+	if !strings.HasPrefix(streamID, "#!::") {
+		key, token := ingestKeyToken(streamID)
+		return key, token, nil
+	}
+	key, token := "", ""
+	for _, pair := range strings.Split(streamID[4:], ",") {
+		name, value, _ := strings.Cut(pair, "=")
+		switch {
+		case name == "r":
+			key = value
+		case name == "token":
+			token = value
+		case name == "m" && value != "publish":
+			return key, "", errors.New("only publishing is supported")
+		}
+	}
+	return key, token, nil
+}
+
+// publish finds the stream of key once its token is accepted
+func (r *SRTServer) publish(key string, token string) (*Broadcaster, string, error) {
+	if r.authorize != nil && !r.authorize(token) {
+		return nil, "", errors.New("invalid token")
+	}
+	b, name, ok := r.lookup(key)
+	if !ok {
+		return nil, "", errors.New("unknown stream ID")
+	}
+	if err := b.acceptsIngest(); err != nil {
+		return nil, "", err
+	}
+	return b, name, nil
+}
+
+// srtStreamID decodes the stream ID extension, its bytes reversed in each
+// 32 bits word
+func srtStreamID(content []byte) string {
+	decoded := make([]byte, len(content))
+	for i := 0; i+4 <= len(content); i += 4 {
+		decoded[i], decoded[i+1], decoded[i+2], decoded[i+3] = content[i+3], content[i+2], content[i+1], content[i]
+	}
+	return string(bytes.TrimRight(decoded, "\x00"))
+}
+
+// srtPending is a packet received ahead of one missing
+type srtPending struct {
+	arrived time.Time
+	data    []byte
+}
+
+// srtCaller receives the stream of a caller, its packets are handled by a
+// goroutine of its own
+type srtCaller struct {
+	server     *SRTServer
+	conn       *net.UDPConn
+	peer       *net.UDPAddr
+	socketID   uint32
+	peerSocket uint32
+	latency    time.Duration
+	// conclusion is the answer to the handshake, sent again when the
+	// caller did not get it
+	conclusion []byte
+	packets    chan []byte
+	closed     chan struct{}
+	once       sync.Once
+	logger     *zap.SugaredLogger
+
+	broadcaster *Broadcaster
+	streamID    string
+	// next is the sequence number of the next packet to demux, highest the
+	// highest one received
+	next, highest uint32
+	pending       map[uint32]srtPending
+	start         time.Time
+	heard         time.Time
+	received      bool
+	acks          uint32
+	reported      time.Time
+
+	demuxer *tsReader
+	// base is the PTS the RTP timestamps count from, sent at wall
+	base         uint64
+	wall         time.Time
+	video, audio *packetizedTrack
+	// opus is the timestamp of the next Opus packet of the PES
+	opus uint32
+}
+
+// run handles the packets of the caller until it leaves or times out
+func (c *srtCaller) run() {
+	defer func() {
+		for _, track := range []*packetizedTrack{c.video, c.audio} {
+			if track != nil {
+				track.Close()
+			}
+		}
+		c.server.lock.Lock()
+		delete(c.server.callers, c.socketID)
+		c.server.lock.Unlock()
+	}()
+	ticker := time.NewTicker(srtACKInterval)
+	defer ticker.Stop()
+	c.heard = time.Now()
+	for {
+		select {
+		case <-c.closed:
+			c.conn.WriteToUDP(srtControl(srtControlShutdown, 0, c.timestamp(), c.peerSocket, u32(0)), c.peer)
+			return
+		case packet := <-c.packets:
+			c.heard = time.Now()
+			if packet[0]&0x80 == 0 {
+				if err := c.data(packet); err != nil {
+					c.logger.Infow("SRT stream ended", "error", err)
+					c.close()
+				}
+			} else if binary.BigEndian.Uint16(packet)&0x7FFF == srtControlShutdown {
+				c.logger.Infow("SRT stream ended", "reason", "shut down by the caller")
+				return
+			}
+		case now := <-ticker.C:
+			if now.Sub(c.heard) > srtIdleTimeout {
+				c.logger.Infow("SRT stream ended", "reason", "caller timed out")
+				return
+			}
+			if err := c.skipLost(now); err != nil {
+				c.logger.Infow("SRT stream ended", "error", err)
+				c.close()
+				continue
+			}
+			c.acknowledge()
+			if len(c.pending) > 0 && now.Sub(c.reported) >= srtNAKInterval {
+				c.reportLost(c.next, c.highest)
+			}
+		}
+	}
+}
+
+// data takes a data packet, the packets are demuxed in order
+func (c *srtCaller) data(packet []byte) error {
+	sequence := binary.BigEndian.Uint32(packet) & srtSequenceMask
+	if srtBefore(sequence, c.next) {
+		// Sent again or given up on
+		return nil
+	}
+	c.received = true
+	c.pending[sequence] = srtPending{arrived: time.Now(), data: packet[16:]}
+	if srtBefore(c.highest, sequence) {
+		if first := (c.highest + 1) & srtSequenceMask; first != sequence {
+			c.reportLost(first, (sequence-1)&srtSequenceMask)
+		}
+		c.highest = sequence
+	}
+	return c.drain()
+}
+
+// drain demuxes the packets following each other from next
+func (c *srtCaller) drain() error {
+	for {
+		packet, ok := c.pending[c.next]
+		if !ok {
+			return nil
+		}
+		delete(c.pending, c.next)
+		c.next = (c.next + 1) & srtSequenceMask
+		if _, err := c.demuxer.Write(packet.data); err != nil {
+			return err
+		}
+	}
+}
+
+// skipLost gives up on the packets missing before those waiting for longer
+// than the latency
+func (c *srtCaller) skipLost(now time.Time) error {
+	var oldest *uint32
+	for sequence, packet := range c.pending {
+		if now.Sub(packet.arrived) <= c.latency {
+			continue
+		}
+		if sequence := sequence; oldest == nil || srtBefore(sequence, *oldest) {
+			oldest = &sequence
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	c.next = *oldest
+	return c.drain()
+}
+
+// acknowledge sends a full ACK of the packets received in order
+func (c *srtCaller) acknowledge() {
+	if !c.received {
+		return
+	}
+	c.received = false
+	c.acks++
+	// Last acknowledged, RTT and its variance, available buffer, receiving
+	// rate, link capacity and receiving rate in bytes are not measured
+	content := u32(c.next)
+	content = append(content, u32(100000)...)
+	content = append(content, u32(50000)...)
+	content = append(content, u32(srtFlowWindow)...)
+	content = append(content, make([]byte, 12)...)
+	c.conn.WriteToUDP(srtControl(srtControlACK, c.acks, c.timestamp(), c.peerSocket, content), c.peer)
+}
+
+// reportLost sends a NAK of the packets missing from first to last
+func (c *srtCaller) reportLost(first uint32, last uint32) {
+	c.reported = time.Now()
+	report := []byte{}
+	for sequence := first; !srtBefore(last, sequence) && len(report) < srtMTU-32; {
+		if _, ok := c.pending[sequence]; ok {
+			sequence = (sequence + 1) & srtSequenceMask
+			continue
+		}
+		end := sequence
+		for next := (end + 1) & srtSequenceMask; !srtBefore(last, next); next = (next + 1) & srtSequenceMask {
+			if _, ok := c.pending[next]; ok {
+				break
+			}
+			end = next
+		}
+		if end == sequence {
+			report = append(report, u32(sequence)...)
+		} else {
+			report = append(report, u32(sequence|0x80000000)...)
+			report = append(report, u32(end)...)
+		}
+		sequence = (end + 1) & srtSequenceMask
+	}
+	if len(report) > 0 {
+		c.conn.WriteToUDP(srtControl(srtControlNAK, 0, c.timestamp(), c.peerSocket, report), c.peer)
+	}
+}
+
+// media forwards a PES of the stream, timed from the first one
+func (c *srtCaller) media(streamType byte, pts uint64, data []byte) error {
+	if c.wall.IsZero() {
+		c.base, c.wall = pts, time.Now()
+	}
+	ticks := tsTicks(pts, c.base)
+	at := c.wall.Add(time.Duration(ticks) * time.Second / 90000)
+	var err error
+	switch streamType {
+	case tsStreamH264:
+		keyframe, sps := false, []byte(nil)
+		for _, nal := range h264NALUnits(data) {
+			switch nal[0] & 0x1F {
+			case 5:
+				keyframe = true
+			case 7:
+				sps = nal
+			}
+		}
+		if c.video == nil {
+			if !keyframe || len(sps) < 4 {
+				return nil
+			}
+			if c.video, err = c.broadcaster.addPacketizedTrack(ingestH264Codec(sps[1:4]), "video", c.streamID, &codecs.H264Payloader{}); err != nil {
+				return err
+			}
+		}
+		return c.video.write(data, keyframe, uint32(ticks), at)
+	case tsStreamAAC:
+		if c.audio == nil {
+			if c.audio, err = c.broadcaster.addTranscodedTrack(c.server.transcoder, "audio", c.streamID, uint32(ticks*48000/90000), at); err != nil {
+				return err
+			}
+		}
+		if c.audio.transcoder == nil {
+			return errors.New("the stream carries both AAC and Opus")
+		}
+		_, err := c.audio.transcoder.Write(data)
+		return err
+	}
+	if c.audio == nil {
+		if c.audio, err = c.broadcaster.addPacketizedTrack(ingestOpusCodec(), "audio", c.streamID, &codecs.OpusPayloader{}); err != nil {
+			return err
+		}
+	}
+	if c.audio.transcoder != nil {
+		return errors.New("the stream carries both AAC and Opus")
+	}
+	// The packets of the PES follow each other from its PTS
+	c.opus = uint32(ticks * 48000 / 90000)
+	for _, packet := range tsOpusPackets(data) {
+		if err := c.audio.write(packet, true, c.opus, c.wall.Add(time.Duration(int32(c.opus))*time.Second/48000)); err != nil {
+			return err
+		}
+		c.opus += opusPacketSamples(packet)
+	}
+	return nil
+}
+
+// timestamp is the time of the connection in microseconds
+func (c *srtCaller) timestamp() uint32 {
+	return uint32(time.Since(c.start).Microseconds())
+}
+
+// close ends the stream, the caller is told
+func (c *srtCaller) close() {
+	c.once.Do(func() { close(c.closed) })
+}
+
+// h264NALUnits splits an access unit in Annex B
+func h264NALUnits(data []byte) [][]byte {
+	nals := [][]byte{}
+	start := -1
+	for i := 0; i+3 <= len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nals = append(nals, bytes.TrimRight(data[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nals = append(nals, data[start:])
+	}
+	filtered := nals[:0]
+	for _, nal := range nals {
+		if len(nal) > 0 {
+			filtered = append(filtered, nal)
+		}
+	}
+	return filtered
+}
+
+// tsOpusPackets splits the Opus access units of a PES, each after its
+// control header
+func tsOpusPackets(data []byte) [][]byte {
+	packets := [][]byte{}
+	for len(data) >= 2 && data[0] == 0x7F && data[1]&0xE0 == 0xE0 {
+		flags, offset, size := data[1], 2, 0
+		for offset < len(data) {
+			b := data[offset]
+			offset++
+			size += int(b)
+			if b != 0xFF {
+				break
+			}
+		}
+		// The start and end trims
+		if flags&0x10 != 0 {
+			offset += 2
+		}
+		if flags&0x08 != 0 {
+			offset += 2
+		}
+		if flags&0x04 != 0 && offset < len(data) {
+			offset += 1 + int(data[offset])
+		}
+		if offset+size > len(data) {
+			break
+		}
+		packets = append(packets, data[offset:offset+size])
+		data = data[offset+size:]
+	}
+	return packets
+}
+
+// opusPacketSamples is the duration of an Opus packet at 48kHz, from its
+// TOC
+func opusPacketSamples(packet []byte) uint32 {
+	if len(packet) == 0 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var frame uint32
+	switch {
+	case config < 12:
+		frame = []uint32{480, 960, 1920, 2880}[config&0x03]
+	case config < 16:
+		frame = []uint32{480, 960}[config&0x01]
+	default:
+		frame = []uint32{120, 240, 480, 960}[config&0x03]
+	}
+	switch packet[0] & 0x03 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	}
+	if len(packet) < 2 {
+		return 0
+	}
+	return uint32(packet[1]&0x3F) * frame
+}
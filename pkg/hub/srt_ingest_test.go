@@ -0,0 +1,29 @@
+package hub
+
+import "testing"
+
+func TestSRTStreamKey(t *testing.T) {
+	tests := []struct {
+		streamID string
+		key      string
+		token    string
+		fails    bool
+	}{
+		{streamID: "stream", key: "stream"},
+		{streamID: "room/stream?token=secret", key: "room/stream", token: "secret"},
+		{streamID: "#!::r=room/stream,m=publish", key: "room/stream"},
+		{streamID: "#!::r=room/stream,m=publish,token=secret", key: "room/stream", token: "secret"},
+		{streamID: "#!::token=secret,r=stream", key: "stream", token: "secret"},
+		{streamID: "#!::r=stream,m=request,token=secret", key: "stream", fails: true},
+	}
+	for _, test := range tests {
+		key, token, err := srtStreamKey(test.streamID)
+		if (err != nil) != test.fails {
+			t.Errorf("%q: error %v", test.streamID, err)
+			continue
+		}
+		if err == nil && (key != test.key || token != test.token) {
+			t.Errorf("%q: key %q and token %q, want %q and %q", test.streamID, key, token, test.key, test.token)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package hub
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Stats are the rolling statistics of the tracks of a room, as forwarded
+// from their publishers and as sent to every receiver
+type Stats struct {
+	Tracks    []TrackStats    `json:"tracks"`
+	Receivers []ReceiverStats `json:"receivers"`
+}
+
+// TrackStats describe a published track as the hub receives it
+type TrackStats struct {
+	Room     string `json:"room,omitempty"`
+	Key      string `json:"track"`
+	StreamID string `json:"streamID"`
+	Kind     string `json:"kind"`
+	Codec    string `json:"codec,omitempty"`
+	// Bitrate is in bits per second and PacketRate in packets per second
+	Bitrate     float64 `json:"bitrateBps"`
+	PacketRate  float64 `json:"packetRate"`
+	Packets     uint64  `json:"packets"`
+	PacketsLost uint64  `json:"packetsLost"`
+	// Loss is the fraction of the packets lost over the last second
+	Loss   float64 `json:"loss"`
+	Jitter float64 `json:"jitterMs"`
+	// KeyframeRequests are the keyframes requested from the publisher of a
+	// video track
+	KeyframeRequests *KeyframeRequests `json:"keyframeRequests,omitempty"`
+}
+
+// ReceiverStats describe the tracks sent to a receiver
+type ReceiverStats struct {
+	Room   string     `json:"room,omitempty"`
+	ID     uuid.UUID  `json:"id"`
+	Tracks []LegStats `json:"tracks"`
+}
+
+// LegStats describe a track sent to a receiver, the loss, jitter and RTT
+// come from the reports of the receiver
+type LegStats struct {
+	Key         string  `json:"track"`
+	SSRC        uint32  `json:"ssrc"`
+	Bitrate     float64 `json:"bitrateBps"`
+	PacketRate  float64 `json:"packetRate"`
+	Packets     uint64  `json:"packets"`
+	PacketsLost int64   `json:"packetsLost"`
+	Loss        float64 `json:"loss"`
+	Jitter      float64 `json:"jitterMs"`
+	RTT         float64 `json:"rttMs"`
+	NACKs       uint32  `json:"nacks"`
+	PLIs        uint32  `json:"plis"`
+}
+
+// statsMeter is a TrackSink counting the packets, losses and jitter of a
+// track, it is written by the forwarding loop of its track only
+type statsMeter struct {
+	clockRate float64
+
+	lock      sync.Mutex
+	started   bool
+	highest   uint64
+	first     uint64
+	packets   uint64
+	lastTS    uint32
+	lastAt    time.Time
+	jitter    float64
+	rate      float64
+	loss      float64
+	lastCount uint64
+	lastSeen  uint64
+	lastRun   time.Time
+}
+
+func newStatsMeter(clockRate uint32) *statsMeter {
+	return &statsMeter{clockRate: float64(clockRate), lastRun: time.Now()}
+}
+
+func (m *statsMeter) WriteRTP(packet []byte) error {
+	if len(packet) < 12 {
+		return nil
+	}
+	now := time.Now()
+	seq := binary.BigEndian.Uint16(packet[2:4])
+	timestamp := binary.BigEndian.Uint32(packet[4:8])
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.packets++
+	if !m.started {
+		m.started = true
+		m.highest, m.first = uint64(seq), uint64(seq)
+		m.lastTS, m.lastAt = timestamp, now
+		return nil
+	}
+	// Sequence numbers are unwrapped around the highest one seen
+	extended := m.highest&^0xFFFF | uint64(seq)
+	switch {
+	case extended+0x8000 < m.highest:
+		extended += 0x10000
+	case extended > m.highest+0x8000 && extended >= 0x10000:
+		extended -= 0x10000
+	}
+	if extended > m.highest {
+		m.highest = extended
+	}
+	// Interarrival jitter of RFC 3550, in units of the clock of the track
+	transit := now.Sub(m.lastAt).Seconds()*m.clockRate - float64(int32(timestamp-m.lastTS))
+	m.jitter += (math.Abs(transit) - m.jitter) / 16
+	m.lastTS, m.lastAt = timestamp, now
+	return nil
+}
+
+func (m *statsMeter) Close() error {
+	return nil
+}
+
+// lost counts the packets expected but not received, it must be called
+// with the lock held
+func (m *statsMeter) lost() uint64 {
+	expected := m.highest - m.first + 1
+	if !m.started || m.packets >= expected {
+		return 0
+	}
+	return expected - m.packets
+}
+
+// sample updates the packet rate and the loss of the last interval
+func (m *statsMeter) sample(now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	elapsed := now.Sub(m.lastRun).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	received := m.packets - m.lastCount
+	expected := m.highest - m.lastSeen
+	m.rate = float64(received) / elapsed
+	m.loss = 0
+	if m.lastCount != 0 && expected > received {
+		m.loss = float64(expected-received) / float64(expected)
+	}
+	m.lastCount, m.lastSeen, m.lastRun = m.packets, m.highest, now
+}
+
+func (m *statsMeter) fill(stats *TrackStats) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stats.PacketRate = math.Round(m.rate*10) / 10
+	stats.Packets = m.packets
+	stats.PacketsLost = m.lost()
+	stats.Loss = m.loss
+	if m.clockRate > 0 {
+		stats.Jitter = math.Round(m.jitter/m.clockRate*1e4) / 10
+	}
+}
+
+// ConnectionStats holds the stats interceptor of a receiver connection and
+// the rates measured from it
+type ConnectionStats struct {
+	lock   sync.Mutex
+	getter stats.Getter
+	rates  map[uint32]*legRate
+	// writeFailures counts the packets the connection failed to send
+	writeFailures atomic.Uint64
+}
+
+// legRate measures the rates of a stream from its counters
+type legRate struct {
+	bytes, packets      uint64
+	at                  time.Time
+	bitrate, packetRate float64
+}
+
+func NewConnectionStats() *ConnectionStats {
+	return &ConnectionStats{rates: make(map[uint32]*legRate)}
+}
+
+// WriteFailures counts the packets the connection failed to send
+func (c *ConnectionStats) WriteFailures() uint64 {
+	return c.writeFailures.Load()
+}
+
+func (c *ConnectionStats) setGetter(getter stats.Getter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.getter = getter
+}
+
+// sample updates the rates of the streams ssrcs, the others are forgotten
+func (c *ConnectionStats) sample(now time.Time, ssrcs []uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.getter == nil {
+		return
+	}
+	rates := make(map[uint32]*legRate, len(ssrcs))
+	for _, ssrc := range ssrcs {
+		current := c.getter.Get(ssrc)
+		if current == nil {
+			continue
+		}
+		bytes, packets := current.OutboundRTPStreamStats.BytesSent, current.OutboundRTPStreamStats.PacketsSent
+		rate, ok := c.rates[ssrc]
+		if !ok {
+			rate = &legRate{}
+		} else if elapsed := now.Sub(rate.at).Seconds(); elapsed > 0 {
+			rate.bitrate = float64(bytes-rate.bytes) * 8 / elapsed
+			rate.packetRate = float64(packets-rate.packets) / elapsed
+		}
+		rate.bytes, rate.packets, rate.at = bytes, packets, now
+		rates[ssrc] = rate
+	}
+	c.rates = rates
+}
+
+// leg describes the stream ssrc sending the track key
+func (c *ConnectionStats) leg(key string, ssrc uint32) (LegStats, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.getter == nil {
+		return LegStats{}, false
+	}
+	current := c.getter.Get(ssrc)
+	if current == nil {
+		return LegStats{}, false
+	}
+	leg := LegStats{
+		Key:         key,
+		SSRC:        ssrc,
+		Packets:     current.OutboundRTPStreamStats.PacketsSent,
+		PacketsLost: current.RemoteInboundRTPStreamStats.PacketsLost,
+		Loss:        current.FractionLost,
+		Jitter:      math.Round(current.RemoteInboundRTPStreamStats.Jitter*1e4) / 10,
+		RTT:         float64(current.RemoteInboundRTPStreamStats.RoundTripTime) / float64(time.Millisecond),
+		NACKs:       current.OutboundRTPStreamStats.NACKCount,
+		PLIs:        current.OutboundRTPStreamStats.PLICount,
+	}
+	if rate, ok := c.rates[ssrc]; ok {
+		leg.Bitrate, leg.PacketRate = math.Round(rate.bitrate), math.Round(rate.packetRate*10)/10
+	}
+	return leg, true
+}
+
+// registerConnectionStats records the stats of the streams of connections
+// into monitor
+func registerConnectionStats(i *interceptor.Registry, monitor *ConnectionStats) error {
+	factory, err := stats.NewInterceptor()
+	if err != nil {
+		return err
+	}
+	factory.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+		monitor.setGetter(getter)
+	})
+	i.Add(factory)
+	i.Add(&writeFailureInterceptorFactory{monitor: monitor})
+	return nil
+}
+
+// writeFailureInterceptor counts the packets its connection fails to send
+type writeFailureInterceptor struct {
+	interceptor.NoOp
+	monitor *ConnectionStats
+}
+
+type writeFailureInterceptorFactory struct {
+	monitor *ConnectionStats
+}
+
+func (f *writeFailureInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &writeFailureInterceptor{monitor: f.monitor}, nil
+}
+
+func (i *writeFailureInterceptor) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, a)
+		if err != nil {
+			i.monitor.writeFailures.Add(1)
+		}
+		return n, err
+	})
+}
+
+// senderSSRCs maps the streams the receiver is sent to their track, it must
+// run on the loop
+func senderSSRCs(receiver ReceiverState) map[uint32]string {
+	ssrcs := make(map[uint32]string)
+	for _, sender := range receiver.Connection.GetSenders() {
+		track := sender.Track()
+		if track == nil {
+			continue
+		}
+		for _, encoding := range sender.GetParameters().Encodings {
+			ssrcs[uint32(encoding.SSRC)] = track.StreamID() + track.ID()
+		}
+	}
+	return ssrcs
+}
+
+// sampleStats measures the rates of the tracks and of the streams sent to
+// the receivers, it must run on the loop
+func (s *Broadcaster) sampleStats(now time.Time) {
+	for _, meter := range s.stats {
+		meter.sample(now)
+	}
+	for _, receiver := range s.receivers {
+		if receiver.Stats == nil {
+			continue
+		}
+		ssrcs := []uint32{}
+		for ssrc := range senderSSRCs(receiver) {
+			ssrcs = append(ssrcs, ssrc)
+		}
+		receiver.Stats.sample(now, ssrcs)
+	}
+}
+
+// Stats returns the statistics of the tracks and of the receivers
+func (s *Broadcaster) Stats() Stats {
+	result := Stats{Tracks: []TrackStats{}, Receivers: []ReceiverStats{}}
+	s.do(func() {
+		for key, sender := range s.senders {
+			track := TrackStats{
+				Key:      key,
+				StreamID: sender.StreamID(),
+				Kind:     sender.Kind().String(),
+				Bitrate:  math.Round(s.trackBitrate(key)),
+			}
+			if local, ok := sender.(*webrtc.TrackLocalStaticRTP); ok {
+				track.Codec = local.Codec().MimeType
+			}
+			if meter, ok := s.stats[key]; ok {
+				meter.fill(&track)
+			}
+			if requests, ok := s.keyframes.stats(key); ok {
+				track.KeyframeRequests = &requests
+			}
+			result.Tracks = append(result.Tracks, track)
+		}
+		for u, receiver := range s.receivers {
+			legs := ReceiverStats{ID: u, Tracks: []LegStats{}}
+			if receiver.Stats != nil {
+				for ssrc, key := range senderSSRCs(receiver) {
+					if leg, ok := receiver.Stats.leg(key, ssrc); ok {
+						legs.Tracks = append(legs.Tracks, leg)
+					}
+				}
+			}
+			sort.Slice(legs.Tracks, func(i, j int) bool { return legs.Tracks[i].Key < legs.Tracks[j].Key })
+			result.Receivers = append(result.Receivers, legs)
+		}
+	})
+	sort.Slice(result.Tracks, func(i, j int) bool { return result.Tracks[i].Key < result.Tracks[j].Key })
+	return result
+}
@@ -0,0 +1,75 @@
+package hub
+
+import (
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Subscribe sends the tracks of streamID to the receiver. A receiver with
+// subscriptions gets exactly the streams it subscribed to, the distribution
+// only spreads the tracks over the receivers without any.
+func (s *Broadcaster) Subscribe(id uuid.UUID, streamID string) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		if receiver.subscriptions == nil {
+			receiver.subscriptions = make(map[string]bool)
+		}
+		receiver.subscriptions[streamID] = true
+		s.receivers[id] = receiver
+		s.scheduleRebalance()
+		err = nil
+	})
+	return err
+}
+
+// Unsubscribe stops sending streamID to the receiver, it goes back to the
+// distribution once its last subscription is gone
+func (s *Broadcaster) Unsubscribe(id uuid.UUID, streamID string) error {
+	err := errClosed
+	s.do(func() {
+		receiver, ok := s.receivers[id]
+		if !ok {
+			err = ErrUnknownReceiver
+			return
+		}
+		delete(receiver.subscriptions, streamID)
+		s.scheduleRebalance()
+		err = nil
+	})
+	return err
+}
+
+// subscriptionList returns the streams the receiver subscribed to, sorted
+func (r ReceiverState) subscriptionList() []string {
+	streams := make([]string, 0, len(r.subscriptions))
+	for streamID := range r.subscriptions {
+		streams = append(streams, streamID)
+	}
+	sort.Strings(streams)
+	return streams
+}
+
+// subscribedTracks assigns the receivers with subscriptions the tracks of
+// the streams they subscribed to, it must run on the loop
+func (s *Broadcaster) subscribedTracks(tracks []Track) map[uuid.UUID]map[string]bool {
+	match := make(map[uuid.UUID]map[string]bool)
+	for u, receiver := range s.receivers {
+		if len(receiver.subscriptions) == 0 {
+			continue
+		}
+		keys := make(map[string]bool)
+		for _, track := range tracks {
+			if receiver.subscriptions[track.StreamID] {
+				keys[track.Key] = true
+			}
+		}
+		match[u] = keys
+	}
+	return match
+}
@@ -0,0 +1,116 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// switchTimeout bounds the wait for a keyframe of the new source, for
+// publishers ignoring PLIs
+const switchTimeout = 2 * time.Second
+
+// switcher rewrites the packets of its active source into its track. The
+// sequence numbers and timestamps go on across switches, which happen on
+// keyframes, so that decoders see a single continuous stream.
+type switcher struct {
+	lock         sync.Mutex
+	track        *webrtc.TrackLocalStaticRTP
+	active       string
+	pending      string
+	pendingSince time.Time
+
+	// opaque switches right away, the payloads cannot be read for keyframes
+	opaque bool
+
+	munger rtpMunger
+	// clock times the active source
+	clock rtpClock
+	// packet is parsed in place for every packet written
+	packet rtp.Packet
+}
+
+// switchTo puts key on air at its next keyframe
+func (w *switcher) switchTo(key string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if key == w.active {
+		w.pending = ""
+		return
+	}
+	w.pending = key
+	w.pendingSince = time.Now()
+}
+
+func (w *switcher) state() (string, string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.active, w.pending
+}
+
+func (w *switcher) write(key string, mimeType string, clock rtpClock, raw []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if key != w.active && key != w.pending {
+		return
+	}
+	packet := &w.packet
+	if err := packet.Unmarshal(raw); err != nil {
+		return
+	}
+	if key == w.pending {
+		if !w.opaque && !isKeyframe(mimeType, packet.Payload) && time.Since(w.pendingSince) < switchTimeout {
+			return
+		}
+		// Continue the sequence numbers and timestamps of the previous source
+		w.active, w.pending, w.clock = key, "", clock
+		w.munger.rebase(packet, w.track.Codec().ClockRate, time.Now())
+	}
+	w.munger.rewrite(packet, time.Now())
+	if err := w.track.WriteRTP(packet); err != nil {
+		zap.S().Debugw("Unable to write switched track", "track", w.track.ID(), "error", err)
+	}
+}
+
+// rtpTime maps the clock of the active source into the rewritten timestamps
+func (w *switcher) rtpTime(now time.Time) (uint32, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.clock == nil {
+		return 0, false
+	}
+	rtpTime, ok := w.clock.rtpTime(now)
+	return rtpTime + w.munger.tsOffset, ok
+}
+
+// source maps a sequence number written since the last switch back to the
+// active source, along with the offsets it was rewritten with
+func (w *switcher) source(seq uint16) (string, uint16, uint16, uint32, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	original, ok := w.munger.original(seq)
+	if w.active == "" || !ok {
+		return "", 0, 0, 0, false
+	}
+	return w.active, original, w.munger.seqOffset, w.munger.tsOffset, true
+}
+
+// switcherSink feeds the packets of one source track to a switcher
+type switcherSink struct {
+	switcher *switcher
+	key      string
+	mimeType string
+	clock    rtpClock
+}
+
+func (s *switcherSink) WriteRTP(packet []byte) error {
+	s.switcher.write(s.key, s.mimeType, s.clock, packet)
+	return nil
+}
+
+func (s *switcherSink) Close() error {
+	return nil
+}
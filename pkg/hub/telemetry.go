@@ -0,0 +1,137 @@
+package hub
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// TelemetryPingInterval is how often receivers get pinged over their
+// telemetry data channel
+const TelemetryPingInterval = 3 * time.Second
+
+// The types of the telemetry messages
+const (
+	// TelemetryPing is sent by the hub, receivers echo its timestamp
+	TelemetryPing = "ping"
+	TelemetryPong = "pong"
+	// TelemetryStats carries the getStats summary of a receiver
+	TelemetryStats = "stats"
+)
+
+// TelemetryMessage is sent as JSON over the "ping" data channel of receivers
+type TelemetryMessage struct {
+	Type string `json:"type"`
+	// Timestamp of pings and pongs, in milliseconds since the epoch
+	Timestamp int64            `json:"ts,omitempty"`
+	Stats     *TelemetryReport `json:"stats,omitempty"`
+}
+
+// TelemetryReport summarizes the inbound RTP stats of a receiver
+type TelemetryReport struct {
+	// Jitter is the worst of the tracks, in seconds
+	Jitter          float64 `json:"jitter"`
+	PacketsLost     int64   `json:"packetsLost"`
+	PacketsReceived int64   `json:"packetsReceived"`
+	// FramesPerSecond are the frames decoded over all the video tracks
+	FramesPerSecond float64 `json:"framesPerSecond"`
+}
+
+func (r TelemetryReport) valid() bool {
+	for _, v := range []float64{r.Jitter, r.FramesPerSecond} {
+		if math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+			return false
+		}
+	}
+	return r.PacketsReceived >= 0
+}
+
+// Telemetry aggregates what a receiver reports over its telemetry channel:
+// the RTT measured by the pings it echoes and its last stats summary
+type Telemetry struct {
+	lock       sync.Mutex
+	rtt        time.Duration
+	pongs      int
+	report     TelemetryReport
+	reportedAt time.Time
+}
+
+func NewTelemetry() *Telemetry {
+	return &Telemetry{}
+}
+
+type TelemetrySummary struct {
+	RTT   float64 `json:"rttMs"`
+	Pongs int     `json:"pongs"`
+	TelemetryReport
+	ReportedAt *time.Time `json:"reportedAt,omitempty"`
+}
+
+func (t *Telemetry) Summary() TelemetrySummary {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	summary := TelemetrySummary{
+		RTT:             float64(t.rtt) / float64(time.Millisecond),
+		Pongs:           t.pongs,
+		TelemetryReport: t.report,
+	}
+	if !t.reportedAt.IsZero() {
+		reportedAt := t.reportedAt
+		summary.ReportedAt = &reportedAt
+	}
+	return summary
+}
+
+// Serve pings over channel and collects the answers until it closes
+func (t *Telemetry) Serve(channel *webrtc.DataChannel) {
+	channel.OnMessage(func(raw webrtc.DataChannelMessage) {
+		message := TelemetryMessage{}
+		if err := json.Unmarshal(raw.Data, &message); err != nil {
+			return
+		}
+		t.handle(message, time.Now())
+	})
+	go func() {
+		ticker := time.NewTicker(TelemetryPingInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			raw, err := json.Marshal(TelemetryMessage{Type: TelemetryPing, Timestamp: now.UnixMilli()})
+			if err != nil {
+				zap.S().Errorw("Unable to encode ping", "error", err)
+				return
+			}
+			if err := channel.SendText(string(raw)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (t *Telemetry) handle(message TelemetryMessage, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch message.Type {
+	case TelemetryPong:
+		// Only the pongs of recent pings are trusted
+		rtt := now.Sub(time.UnixMilli(message.Timestamp))
+		if rtt < 0 || rtt > 10*TelemetryPingInterval {
+			return
+		}
+		if t.pongs == 0 {
+			t.rtt = rtt
+		} else {
+			t.rtt = (4*t.rtt + rtt) / 5
+		}
+		t.pongs++
+	case TelemetryStats:
+		if message.Stats == nil || !message.Stats.valid() {
+			return
+		}
+		t.report = *message.Stats
+		t.reportedAt = now
+	}
+}
@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// testToneDuration is the duration of the Opus packets of a TestPattern
+const testToneDuration = 20 * time.Millisecond
+
+// TestPattern is a synthetic stream looped by PublishTestPattern, VP8
+// frames at FrameRate starting with a keyframe and Opus packets of 20ms
+type TestPattern struct {
+	Frames    [][]byte
+	FrameRate int
+	Tone      [][]byte
+}
+
+// PublishTestPattern forwards pattern as streamID until ctx is done, in
+// real time
+func (s *Broadcaster) PublishTestPattern(ctx context.Context, streamID string, pattern *TestPattern) error {
+	if len(pattern.Frames) == 0 || len(pattern.Tone) == 0 || pattern.FrameRate <= 0 {
+		return errors.New("empty test pattern")
+	}
+	if err := s.acceptsIngest(); err != nil {
+		return err
+	}
+	video, err := s.addPacketizedTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", streamID, &codecs.VP8Payloader{EnablePictureID: true})
+	if err != nil {
+		return err
+	}
+	defer video.Close()
+	audio, err := s.addPacketizedTrack(ingestOpusCodec(), "audio", streamID, &codecs.OpusPayloader{})
+	if err != nil {
+		return err
+	}
+	defer audio.Close()
+
+	start := time.Now()
+	frames, packets := 0, 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+		now := time.Now()
+		for {
+			at := start.Add(time.Duration(frames) * time.Second / time.Duration(pattern.FrameRate))
+			if at.After(now) {
+				break
+			}
+			frame := pattern.Frames[frames%len(pattern.Frames)]
+			// The keyframes of VP8 have the bit 0 cleared
+			if err := video.write(frame, frame[0]&0x01 == 0, uint32(frames*90000/pattern.FrameRate), at); err != nil {
+				return err
+			}
+			frames++
+		}
+		for {
+			at := start.Add(time.Duration(packets) * testToneDuration)
+			if at.After(now) {
+				break
+			}
+			if err := audio.write(pattern.Tone[packets%len(pattern.Tone)], true, uint32(packets*960), at); err != nil {
+				return err
+			}
+			packets++
+		}
+		next := start.Add(time.Duration(packets) * testToneDuration)
+		if frame := start.Add(time.Duration(frames) * time.Second / time.Duration(pattern.FrameRate)); frame.Before(next) {
+			next = frame
+		}
+		timer.Reset(time.Until(next))
+	}
+}
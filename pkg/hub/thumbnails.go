@@ -0,0 +1,232 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// thumbnailQuality is the JPEG quality of the thumbnails
+const thumbnailQuality = 75
+
+// ErrThumbnailNotFound is returned for the thumbnails not kept
+var ErrThumbnailNotFound = errors.New("thumbnail not found")
+
+// ThumbnailOptions configure the thumbnails of the live streams
+type ThumbnailOptions struct {
+	// Interval is how often every stream gets a thumbnail, when it sent a
+	// new keyframe since the last one
+	Interval time.Duration
+	// Keep is how many thumbnails of each stream are kept
+	Keep int
+	// Dir keeps the thumbnails as files in a directory per stream, they
+	// are kept in memory when empty
+	Dir string
+}
+
+// Thumbnail describes a JPEG picture of a live stream
+type Thumbnail struct {
+	StreamID string `json:"streamID"`
+	// Sequence numbers the thumbnails of the stream from 1
+	Sequence uint64    `json:"sequence"`
+	Taken    time.Time `json:"taken"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Size     int       `json:"size"`
+}
+
+// storedThumbnail holds the picture of a thumbnail kept in memory
+type storedThumbnail struct {
+	Thumbnail
+	data []byte
+	// received is when the keyframe of the picture was
+	received time.Time
+}
+
+// thumbnailStore keeps the last thumbnails of the streams
+type thumbnailStore struct {
+	options ThumbnailOptions
+
+	lock     sync.Mutex
+	streams  map[string][]storedThumbnail
+	sequence map[string]uint64
+}
+
+// EnableThumbnails takes a thumbnail of every live stream at each
+// interval, from the snapshots it needs enabled. Those of the streams gone
+// are dropped.
+func (s *Broadcaster) EnableThumbnails(options ThumbnailOptions) {
+	store := &thumbnailStore{options: options, streams: make(map[string][]storedThumbnail), sequence: make(map[string]uint64)}
+	s.do(func() {
+		s.thumbnails = store
+	})
+	go func() {
+		ticker := time.NewTicker(options.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.closed:
+				store.retain(nil)
+				return
+			case <-ticker.C:
+			}
+			streams := s.Streams()
+			store.retain(streams)
+			for streamID := range streams {
+				snapshot, err := s.Snapshot(streamID)
+				if err != nil {
+					if !errors.Is(err, ErrNoKeyframe) && !errors.Is(err, ErrUnknownStream) {
+						zap.S().Infow("Unable to take a thumbnail", "streamID", streamID, "error", err)
+					}
+					continue
+				}
+				if err := store.add(streamID, snapshot); err != nil {
+					zap.S().Warnw("Unable to keep a thumbnail", "streamID", streamID, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Thumbnails lists the thumbnails kept, by stream then sequence
+func (s *Broadcaster) Thumbnails() []Thumbnail {
+	store := s.thumbnailStore()
+	thumbnails := []Thumbnail{}
+	if store == nil {
+		return thumbnails
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, stream := range store.streams {
+		for _, thumbnail := range stream {
+			thumbnails = append(thumbnails, thumbnail.Thumbnail)
+		}
+	}
+	sort.Slice(thumbnails, func(i, j int) bool {
+		if thumbnails[i].StreamID != thumbnails[j].StreamID {
+			return thumbnails[i].StreamID < thumbnails[j].StreamID
+		}
+		return thumbnails[i].Sequence < thumbnails[j].Sequence
+	})
+	return thumbnails
+}
+
+// ThumbnailImage returns the JPEG of a thumbnail of streamID, the last one
+// when sequence is 0
+func (s *Broadcaster) ThumbnailImage(streamID string, sequence uint64) (Thumbnail, []byte, error) {
+	store := s.thumbnailStore()
+	if store == nil {
+		return Thumbnail{}, nil, ErrThumbnailNotFound
+	}
+	store.lock.Lock()
+	stream := store.streams[streamID]
+	var thumbnail *storedThumbnail
+	for i := range stream {
+		if sequence == 0 || stream[i].Sequence == sequence {
+			thumbnail = &stream[i]
+		}
+	}
+	if thumbnail == nil {
+		store.lock.Unlock()
+		return Thumbnail{}, nil, ErrThumbnailNotFound
+	}
+	info, data := thumbnail.Thumbnail, thumbnail.data
+	store.lock.Unlock()
+	if data == nil {
+		var err error
+		if data, err = os.ReadFile(store.fileName(streamID, info.Sequence)); err != nil {
+			// Dropped meanwhile
+			return Thumbnail{}, nil, ErrThumbnailNotFound
+		}
+	}
+	return info, data, nil
+}
+
+func (s *Broadcaster) thumbnailStore() *thumbnailStore {
+	var store *thumbnailStore
+	s.do(func() { store = s.thumbnails })
+	return store
+}
+
+func (t *thumbnailStore) fileName(streamID string, sequence uint64) string {
+	return filepath.Join(t.options.Dir, sanitizeFileName(streamID), fmt.Sprintf("%d.jpg", sequence))
+}
+
+// add keeps the snapshot of streamID, unless it is the keyframe of the
+// last thumbnail, dropping the oldest ones past Keep
+func (t *thumbnailStore) add(streamID string, snapshot Snapshot) error {
+	t.lock.Lock()
+	stream := t.streams[streamID]
+	if len(stream) > 0 && stream[len(stream)-1].received.Equal(snapshot.Received) {
+		t.lock.Unlock()
+		return nil
+	}
+	t.sequence[streamID]++
+	sequence := t.sequence[streamID]
+	t.lock.Unlock()
+
+	picture := &bytes.Buffer{}
+	if err := jpeg.Encode(picture, snapshot.Image, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return err
+	}
+	bounds := snapshot.Image.Bounds()
+	thumbnail := storedThumbnail{
+		Thumbnail: Thumbnail{
+			StreamID: streamID,
+			Sequence: sequence,
+			Taken:    time.Now().UTC(),
+			Width:    bounds.Dx(),
+			Height:   bounds.Dy(),
+			Size:     picture.Len(),
+		},
+		received: snapshot.Received,
+	}
+	if t.options.Dir == "" {
+		thumbnail.data = picture.Bytes()
+	} else {
+		fileName := t.fileName(streamID, sequence)
+		if err := os.MkdirAll(filepath.Dir(fileName), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(fileName, picture.Bytes(), 0o644); err != nil {
+			return err
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	stream = append(t.streams[streamID], thumbnail)
+	for len(stream) > t.options.Keep {
+		if t.options.Dir != "" {
+			os.Remove(t.fileName(streamID, stream[0].Sequence))
+		}
+		stream = stream[1:]
+	}
+	t.streams[streamID] = stream
+	return nil
+}
+
+// retain drops the thumbnails of the streams not live anymore
+func (t *thumbnailStore) retain(live map[string][]webrtc.TrackLocal) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for streamID := range t.streams {
+		if _, ok := live[streamID]; ok {
+			continue
+		}
+		delete(t.streams, streamID)
+		delete(t.sequence, streamID)
+		if t.options.Dir != "" {
+			os.RemoveAll(filepath.Join(t.options.Dir, sanitizeFileName(streamID)))
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package hub
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// The Matroska elements written, the IDs keep their length marker
+const (
+	mkvEBML               = 0x1A45DFA3
+	mkvEBMLVersion        = 0x4286
+	mkvEBMLReadVersion    = 0x42F7
+	mkvEBMLMaxIDLength    = 0x42F2
+	mkvEBMLMaxSizeLength  = 0x42F3
+	mkvDocType            = 0x4282
+	mkvDocTypeVersion     = 0x4287
+	mkvDocTypeReadVersion = 0x4285
+	mkvSegment            = 0x18538067
+	mkvInfo               = 0x1549A966
+	mkvTimecodeScale      = 0x2AD7B1
+	mkvMuxingApp          = 0x4D80
+	mkvWritingApp         = 0x5741
+	mkvDateUTC            = 0x4461
+	mkvDuration           = 0x4489
+	mkvTracks             = 0x1654AE6B
+	mkvTrackEntry         = 0xAE
+	mkvTrackNumber        = 0xD7
+	mkvTrackUID           = 0x73C5
+	mkvTrackType          = 0x83
+	mkvCodecID            = 0x86
+	mkvCodecPrivate       = 0x63A2
+	mkvCodecDelay         = 0x56AA
+	mkvSeekPreRoll        = 0x56BB
+	mkvVideo              = 0xE0
+	mkvPixelWidth         = 0xB0
+	mkvPixelHeight        = 0xBA
+	mkvAudio              = 0xE1
+	mkvSamplingFrequency  = 0xB5
+	mkvChannels           = 0x9F
+	mkvCluster            = 0x1F43B675
+	mkvTimecode           = 0xE7
+	mkvSimpleBlock        = 0xA3
+)
+
+// mkvUnknownSize is the size of the segment and clusters, written live
+var mkvUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// mkvEpoch is the origin of the Matroska dates
+var mkvEpoch = time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// A cluster holds at most mkvClusterDuration, the relative timecodes of
+// its blocks are 16 bits
+const mkvClusterDuration = 5 * time.Second
+
+func appendEBMLID(buf []byte, id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return append(buf, byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<16:
+		return append(buf, byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<8:
+		return append(buf, byte(id>>8), byte(id))
+	}
+	return append(buf, byte(id))
+}
+
+// appendEBMLSize appends size on the fewest bytes, a size with all its
+// value bits set would mean unknown
+func appendEBMLSize(buf []byte, size uint64) []byte {
+	length := 1
+	for length < 8 && size >= 1<<(7*length)-1 {
+		length++
+	}
+	size |= 1 << (7 * length)
+	for i := length - 1; i >= 0; i-- {
+		buf = append(buf, byte(size>>(8*i)))
+	}
+	return buf
+}
+
+func appendEBML(buf []byte, id uint32, data []byte) []byte {
+	buf = appendEBMLID(buf, id)
+	buf = appendEBMLSize(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendEBMLUint(buf []byte, id uint32, value uint64) []byte {
+	data := []byte{}
+	for shift := 56; shift > 0; shift -= 8 {
+		if value>>shift != 0 || len(data) > 0 {
+			data = append(data, byte(value>>shift))
+		}
+	}
+	return appendEBML(buf, id, append(data, byte(value)))
+}
+
+func appendEBMLFloat(buf []byte, id uint32, value float64) []byte {
+	return appendEBML(buf, id, binary.BigEndian.AppendUint64(nil, math.Float64bits(value)))
+}
+
+// webmContainer writes a stream to name in dir, as WebM or as Matroska
+// for H264 which WebM cannot hold
+type webmContainer struct {
+	dir  string
+	name string
+}
+
+func (c webmContainer) accepts(mimeType string) bool {
+	for _, accepted := range []string{webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, webrtc.MimeTypeH264, webrtc.MimeTypeOpus} {
+		if strings.EqualFold(mimeType, accepted) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c webmContainer) create(tracks []mediaTrack, date time.Time) (frameWriter, error) {
+	docType, extension := "webm", ".webm"
+	for _, track := range tracks {
+		if strings.EqualFold(track.mimeType, webrtc.MimeTypeH264) {
+			docType, extension = "matroska", ".mkv"
+		}
+	}
+	return newWebMWriter(filepath.Join(c.dir, c.name+extension), docType, tracks, date)
+}
+
+func webmTrackEntry(t mediaTrack) []byte {
+	entry := appendEBMLUint(nil, mkvTrackNumber, uint64(t.number))
+	entry = appendEBMLUint(entry, mkvTrackUID, uint64(t.number))
+	switch {
+	case strings.EqualFold(t.mimeType, webrtc.MimeTypeVP8):
+		entry = appendEBML(entry, mkvCodecID, []byte("V_VP8"))
+	case strings.EqualFold(t.mimeType, webrtc.MimeTypeVP9):
+		entry = appendEBML(entry, mkvCodecID, []byte("V_VP9"))
+	case strings.EqualFold(t.mimeType, webrtc.MimeTypeH264):
+		entry = appendEBML(entry, mkvCodecID, []byte("V_MPEG4/ISO/AVC"))
+		entry = appendEBML(entry, mkvCodecPrivate, t.codecPrivate)
+	default:
+		entry = appendEBML(entry, mkvCodecID, []byte("A_OPUS"))
+		entry = appendEBML(entry, mkvCodecPrivate, opusHead(t.channels, t.clockRate))
+	}
+	if t.video() {
+		entry = appendEBMLUint(entry, mkvTrackType, 1)
+		video := appendEBMLUint(nil, mkvPixelWidth, uint64(t.width))
+		video = appendEBMLUint(video, mkvPixelHeight, uint64(t.height))
+		return appendEBML(entry, mkvVideo, video)
+	}
+	entry = appendEBMLUint(entry, mkvTrackType, 2)
+	entry = appendEBMLUint(entry, mkvCodecDelay, 0)
+	entry = appendEBMLUint(entry, mkvSeekPreRoll, uint64(opusSeekPreRoll))
+	audio := appendEBMLFloat(nil, mkvSamplingFrequency, float64(t.clockRate))
+	audio = appendEBMLUint(audio, mkvChannels, uint64(t.channels))
+	return appendEBML(entry, mkvAudio, audio)
+}
+
+// webmWriter writes the frames of its tracks to a Matroska file or stream
+// as they come, with a timecode scale of a millisecond. The segment and
+// clusters have an unknown size, only the duration of the files is written
+// on Close.
+type webmWriter struct {
+	out io.Writer
+	// file is set when out is a file, durationOffset is where the
+	// duration is in it
+	file           *os.File
+	durationOffset int64
+	clusterOpen    bool
+	cluster        time.Duration
+	last           time.Duration
+}
+
+// newWebMWriter writes the header of the file, docType is webm or matroska
+func newWebMWriter(fileName string, docType string, tracks []mediaTrack, date time.Time) (*webmWriter, error) {
+	header, durationOffset := webmHeader(docType, tracks, date, true)
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &webmWriter{out: file, file: file, durationOffset: durationOffset}, nil
+}
+
+// webmHeader is the start of a Matroska file up to its first cluster,
+// durationOffset where its duration is when it has one
+func webmHeader(docType string, tracks []mediaTrack, date time.Time, duration bool) ([]byte, int64) {
+	header := appendEBMLUint(nil, mkvEBMLVersion, 1)
+	header = appendEBMLUint(header, mkvEBMLReadVersion, 1)
+	header = appendEBMLUint(header, mkvEBMLMaxIDLength, 4)
+	header = appendEBMLUint(header, mkvEBMLMaxSizeLength, 8)
+	header = appendEBML(header, mkvDocType, []byte(docType))
+	header = appendEBMLUint(header, mkvDocTypeVersion, 4)
+	header = appendEBMLUint(header, mkvDocTypeReadVersion, 2)
+	buf := appendEBML(nil, mkvEBML, header)
+	buf = appendEBMLID(buf, mkvSegment)
+	buf = append(buf, mkvUnknownSize...)
+
+	info := appendEBMLUint(nil, mkvTimecodeScale, uint64(time.Millisecond))
+	info = appendEBML(info, mkvMuxingApp, []byte("webrtc-hub"))
+	info = appendEBML(info, mkvWritingApp, []byte("webrtc-hub"))
+	info = appendEBMLUint(info, mkvDateUTC, uint64(date.Sub(mkvEpoch)))
+	durationStart := len(info)
+	if duration {
+		info = appendEBMLFloat(info, mkvDuration, 0)
+	}
+	buf = appendEBMLID(buf, mkvInfo)
+	buf = appendEBMLSize(buf, uint64(len(info)))
+	// The float follows the 2 bytes of the ID and the byte of the size
+	durationOffset := int64(len(buf) + durationStart + 3)
+	buf = append(buf, info...)
+
+	entries := []byte{}
+	for _, track := range tracks {
+		entries = appendEBML(entries, mkvTrackEntry, webmTrackEntry(track))
+	}
+	return appendEBML(buf, mkvTracks, entries), durationOffset
+}
+
+// writeFrame writes a frame of track at, from the start of the file.
+// Clusters start on video keyframes.
+func (w *webmWriter) writeFrame(track mediaTrack, at time.Duration, keyframe bool, frame []byte) error {
+	if at < 0 {
+		at = 0
+	}
+	buf := []byte{}
+	if !w.clusterOpen || (track.video() && keyframe && at > w.cluster) || at-w.cluster >= mkvClusterDuration {
+		w.clusterOpen, w.cluster = true, at
+		buf = appendEBMLID(buf, mkvCluster)
+		buf = append(buf, mkvUnknownSize...)
+		buf = appendEBMLUint(buf, mkvTimecode, uint64(at/time.Millisecond))
+	}
+	relative := int64((at - w.cluster) / time.Millisecond)
+	if relative < math.MinInt16 {
+		relative = math.MinInt16
+	}
+	block := make([]byte, 4, 4+len(frame))
+	block[0] = 0x80 | track.number
+	binary.BigEndian.PutUint16(block[1:3], uint16(int16(relative)))
+	if keyframe {
+		block[3] = 0x80
+	}
+	buf = appendEBML(buf, mkvSimpleBlock, append(block, frame...))
+	if _, err := w.out.Write(buf); err != nil {
+		return err
+	}
+	if at > w.last {
+		w.last = at
+	}
+	return nil
+}
+
+// Close writes the duration and closes the file, or closes the stream
+func (w *webmWriter) Close() error {
+	if w.file == nil {
+		if closer, ok := w.out.(io.Closer); ok {
+			return closer.Close()
+		}
+		return nil
+	}
+	duration := binary.BigEndian.AppendUint64(nil, math.Float64bits(float64(w.last)/float64(time.Millisecond)))
+	if _, err := w.file.WriteAt(duration, w.durationOffset); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// vp8FrameSize reads the size of a VP8 keyframe
+func vp8FrameSize(frame []byte) (int, int, bool) {
+	// Frame tag, start code then the 14 bit width and height
+	if len(frame) < 10 || frame[0]&0x01 != 0 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 0, 0, false
+	}
+	width := int(binary.LittleEndian.Uint16(frame[6:]) & 0x3FFF)
+	height := int(binary.LittleEndian.Uint16(frame[8:]) & 0x3FFF)
+	return width, height, width > 0 && height > 0
+}
+
+// vp9FrameSize reads the size from the uncompressed header of a VP9
+// keyframe
+func vp9FrameSize(frame []byte) (int, int, bool) {
+	r := &bitReader{data: frame}
+	if r.bits(2) != 2 {
+		return 0, 0, false
+	}
+	profile := r.bits(1) | r.bits(1)<<1
+	if profile == 3 {
+		r.bits(1)
+	}
+	// show_existing_frame then frame_type, 0 for keyframes
+	if r.bits(1) != 0 || r.bits(1) != 0 {
+		return 0, 0, false
+	}
+	// show_frame, error_resilient_mode and the sync code
+	r.bits(2)
+	if r.bits(24) != 0x498342 {
+		return 0, 0, false
+	}
+	if profile >= 2 {
+		r.bits(1)
+	}
+	// Every color space but sRGB has a range and maybe a subsampling
+	if colorSpace := r.bits(3); colorSpace != 7 {
+		r.bits(1)
+		if profile == 1 || profile == 3 {
+			r.bits(3)
+		}
+	} else if profile == 1 || profile == 3 {
+		r.bits(1)
+	}
+	width, height := int(r.bits(16))+1, int(r.bits(16))+1
+	return width, height, !r.failed
+}
+
+// avcDecoderConfiguration builds the avcC of an H264 access unit in AVC
+// format holding its SPS and PPS, along with the frame size
+func avcDecoderConfiguration(frame []byte) ([]byte, int, int, bool) {
+	var sps, pps []byte
+	for offset := 0; offset+4 <= len(frame); {
+		size := int(binary.BigEndian.Uint32(frame[offset:]))
+		offset += 4
+		if size == 0 || offset+size > len(frame) {
+			break
+		}
+		switch nal := frame[offset : offset+size]; nal[0] & 0x1F {
+		case 7:
+			sps = nal
+		case 8:
+			pps = nal
+		}
+		offset += size
+	}
+	if len(sps) < 4 || len(pps) == 0 {
+		return nil, 0, 0, false
+	}
+	width, height, ok := parseH264SPS(sps)
+	if !ok {
+		return nil, 0, 0, false
+	}
+	// Version, profile, compatibility and level, 4 byte lengths, one SPS
+	avcC := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(sps)))
+	avcC = append(avcC, sps...)
+	avcC = append(avcC, 1)
+	avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(pps)))
+	avcC = append(avcC, pps...)
+	return avcC, width, height, true
+}
+
+// opusHead is the codec private data of an Opus track
+func opusHead(channels uint16, sampleRate uint32) []byte {
+	head := []byte("OpusHead")
+	head = append(head, 1, byte(channels))
+	// No pre-skip nor gain, channel mapping family 0
+	head = binary.LittleEndian.AppendUint16(head, 0)
+	head = binary.LittleEndian.AppendUint32(head, sampleRate)
+	head = binary.LittleEndian.AppendUint16(head, 0)
+	return append(head, 0)
+}
@@ -0,0 +1,54 @@
+package hub
+
+import (
+	"encoding/json"
+
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// WHEPSession is a WHEP player, its tracks are swapped as publishers come and go
+type WHEPSession struct {
+	PeerConn *webrtc.PeerConnection
+	// StreamID is the stream requested by the player, empty means any
+	StreamID string
+	Events   *EventStream
+}
+
+type whepTrackEvent struct {
+	Kind     string `json:"kind"`
+	TrackID  string `json:"trackID"`
+	StreamID string `json:"streamID"`
+}
+
+const whepPlaceholderStream = "whep-placeholder"
+
+func whepPlaceholderTrack(kind webrtc.RTPCodecType) (webrtc.TrackLocal, error) {
+	capability := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}
+	if kind == webrtc.RTPCodecTypeAudio {
+		capability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}
+	}
+	return webrtc.NewTrackLocalStaticRTP(capability, kind.String(), whepPlaceholderStream)
+}
+
+func whepTransceiver(peer *webrtc.PeerConnection, sender *webrtc.RTPSender) *webrtc.RTPTransceiver {
+	for _, transceiver := range peer.GetTransceivers() {
+		if transceiver.Sender() == sender {
+			return transceiver
+		}
+	}
+	return nil
+}
+
+func publishWHEPTrackEvent(session *WHEPSession, event string, track webrtc.TrackLocal) {
+	data, err := json.Marshal(whepTrackEvent{
+		Kind:     track.Kind().String(),
+		TrackID:  track.ID(),
+		StreamID: track.StreamID(),
+	})
+	if err != nil {
+		zap.S().Error(err)
+		return
+	}
+	session.Events.Publish(event, string(data))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"go.uber.org/zap"
+)
+
+// PlacementPolicy picks the hub a new WHIP publisher should go to, so that
+// a fleet of hubs can be fronted by a single ingest URL. An empty URL keeps
+// the publisher on this hub.
+type PlacementPolicy interface {
+	Place(r *http.Request) (string, error)
+}
+
+func loadHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, rooms.Load())
+	}
+}
+
+// StaticShardPlacement spreads publishers over a fixed list of hubs by
+// hashing their stream query parameter, or their address without one
+type StaticShardPlacement struct {
+	Self   string
+	Shards []string
+}
+
+func (p StaticShardPlacement) Place(r *http.Request) (string, error) {
+	if len(p.Shards) == 0 {
+		return "", nil
+	}
+	key := r.URL.Query().Get("stream")
+	if key == "" {
+		key = clientIP(r)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	shard := p.Shards[h.Sum32()%uint32(len(p.Shards))]
+	if shard == p.Self {
+		return "", nil
+	}
+	return shard, nil
+}
+
+// LeastPublishersPlacement sends publishers to the hub with the fewest of
+// them, peer loads are polled in the background
+type LeastPublishersPlacement struct {
+	Peers []string
+
+	rooms  *Rooms
+	client *http.Client
+	lock   sync.Mutex
+	loads  map[string]hub.Load
+}
+
+func NewLeastPublishersPlacement(rooms *Rooms, peers []string) *LeastPublishersPlacement {
+	return &LeastPublishersPlacement{
+		Peers:  peers,
+		rooms:  rooms,
+		client: &http.Client{Timeout: 5 * time.Second},
+		loads:  make(map[string]hub.Load),
+	}
+}
+
+// Run polls the peers load until ctx is done
+func (p *LeastPublishersPlacement) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, peer := range p.Peers {
+			load, err := p.fetchLoad(ctx, peer)
+			p.lock.Lock()
+			if err != nil {
+				// Unreachable peers get no publishers
+				zap.S().Warnw("Unable to fetch hub load", "peer", peer, "error", err)
+				delete(p.loads, peer)
+			} else {
+				p.loads[peer] = load
+			}
+			p.lock.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *LeastPublishersPlacement) fetchLoad(ctx context.Context, peer string) (hub.Load, error) {
+	load := hub.Load{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(peer, "/")+"/api/load", nil)
+	if err != nil {
+		return load, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return load, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return load, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&load)
+	return load, err
+}
+
+func (p *LeastPublishersPlacement) Place(r *http.Request) (string, error) {
+	best := ""
+	bestPublishers := p.rooms.Load().Publishers
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, peer := range p.Peers {
+		load, ok := p.loads[peer]
+		if ok && load.Publishers < bestPublishers {
+			best, bestPublishers = peer, load.Publishers
+		}
+	}
+	return best, nil
+}
+
+// PlacementMiddleware redirects WHIP offers to the hub picked by policy
+func PlacementMiddleware(policy PlacementPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				next.ServeHTTP(w, r)
+				return
+			}
+			target, err := policy.Place(r)
+			if err != nil {
+				logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+				logger.Warnw("Placement failed, keeping the publisher", "error", err)
+			}
+			if target == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			location := strings.TrimSuffix(target, "/") + r.URL.Path
+			if r.URL.RawQuery != "" {
+				location += "?" + r.URL.RawQuery
+			}
+			// 307 makes the client replay the POST with its offer
+			w.Header().Set("Location", location)
+			w.WriteHeader(http.StatusTemporaryRedirect)
+		})
+	}
+}
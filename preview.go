@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// previewQuality is the JPEG quality of the preview frames
+const previewQuality = 70
+
+// previewBoundary separates the frames of the MJPEG previews
+const previewBoundary = "preview-frame"
+
+// previewHandler streams the video of a stream of the room as MJPEG at
+// frameRate, for the dashboards and the devices which can neither take
+// WebRTC nor HLS. Every preview decodes its stream, slots bounds them.
+func previewHandler(rooms *Rooms, width, height, frameRate int, slots chan struct{}) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		file := chi.URLParam(r, "file")
+		streamID := strings.TrimSuffix(file, ".mjpeg")
+		if streamID == file || streamID == "" {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown preview file")
+			return
+		}
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			writeProblem(w, r, http.StatusServiceUnavailable, ProblemCapacity, "Too many previews")
+			return
+		}
+		preview, err := b.Preview(streamID, width, height)
+		switch {
+		case errors.Is(err, hub.ErrUnknownStream):
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Stream has no published track")
+			return
+		case errors.Is(err, hub.ErrNoVideo):
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Stream has no VP8, VP9 or H264 video track")
+			return
+		case err != nil:
+			logger.Errorw("Unable to preview the stream", "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, err.Error())
+			return
+		}
+		defer preview.Close()
+
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+previewBoundary)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		logger.Infow("Preview started", "streamID", streamID)
+		defer logger.Infow("Preview ended", "streamID", streamID)
+
+		ticker := time.NewTicker(time.Second / time.Duration(frameRate))
+		defer ticker.Stop()
+		var last image.Image
+		frame := &bytes.Buffer{}
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-preview.Done():
+				return
+			case <-ticker.C:
+			}
+			// The pictures are never written again once returned, the
+			// same one is the stream not moving on
+			picture := preview.Picture()
+			if picture == nil || picture == last {
+				continue
+			}
+			last = picture
+			frame.Reset()
+			if err := jpeg.Encode(frame, picture, &jpeg.Options{Quality: previewQuality}); err != nil {
+				logger.Errorw("Unable to encode a preview frame", "error", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", previewBoundary, frame.Len()); err != nil {
+				return
+			}
+			if _, err := w.Write(append(frame.Bytes(), "\r\n"...)); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Problem codes let API clients tell error causes apart without parsing messages
+const (
+	ProblemUnsupportedContentType = "unsupported-content-type"
+	ProblemBadSDP                 = "bad-sdp"
+	ProblemUnsupportedCodec       = "unsupported-codec"
+	ProblemUnauthorized           = "unauthorized"
+	ProblemForbidden              = "forbidden"
+	ProblemCapacity               = "capacity"
+	ProblemDraining               = "draining"
+	ProblemRateLimited            = "rate-limited"
+	ProblemNotFound               = "not-found"
+	ProblemBadRequest             = "bad-request"
+	ProblemConflict               = "conflict"
+	ProblemUpstream               = "upstream"
+	ProblemInternal               = "internal"
+)
+
+// Problem is an RFC 7807 problem details body
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// writeProblem replies with an application/problem+json body, headers such
+// as Retry-After must be set before calling it
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+	problem := Problem{
+		Type:      "urn:webrtc-hub:problem:" + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Code:      code,
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+	w.Header().Set("content-type", "application/problem+json")
+	w.Header().Set("x-content-type-options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// offerHasSupportedCodec checks that at least one rtpmap of the offer is
+// one of the codecs the hub is configured with
+func offerHasSupportedCodec(offer string, supportedCodecs []string) bool {
+	for _, line := range strings.Split(offer, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=rtpmap:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "a=rtpmap:"))
+		if len(fields) < 2 {
+			continue
+		}
+		name, _, _ := strings.Cut(fields[1], "/")
+		for _, codec := range supportedCodecs {
+			if _, supported, _ := strings.Cut(codec, "/"); strings.EqualFold(supported, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type ctxProxy string
+
+// PROXY holds whether the direct peer is a trusted reverse proxy
+var PROXY ctxProxy = "proxy"
+
+// ProxyMiddleware records whether the request comes from a trusted reverse
+// proxy, the remote address is then the client it forwards with
+// X-Forwarded-For. Other peers cannot set it.
+func ProxyMiddleware(proxies trustedProxiesFlag) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			trusted := proxies.trusts(r.RemoteAddr)
+			r = r.WithContext(context.WithValue(r.Context(), PROXY, trusted))
+			if trusted {
+				if ip := proxies.forwardedFor(r); ip != "" {
+					r.RemoteAddr = ip
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedFor is the client a trusted proxy forwards the request for, the
+// last address of X-Forwarded-For that is not one of the proxies. The
+// addresses before it were sent by the client, and True-Client-IP and
+// X-Real-IP are left alone as the proxies may pass them through. It is
+// empty when the header holds no address.
+func (t trustedProxiesFlag) forwardedFor(r *http.Request) string {
+	hops := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseForwardedIP(hops[i])
+		if ip == nil {
+			// The hops behind a garbled one cannot be told apart from the
+			// addresses the client made up
+			break
+		}
+		client = ip.String()
+		if !t.contains(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// parseForwardedIP parses an address of X-Forwarded-For, which proxies may
+// write with a port
+func parseForwardedIP(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+// clientIP is the IP of the client, forwarded by trusted reverse proxies
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// ProxyMiddleware rewrites RemoteAddr without a port
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// trustedProxiesFlag parses a list of IPs or CIDRs allowed to set X-Forwarded-* headers
+type trustedProxiesFlag []*net.IPNet
+
+func (t *trustedProxiesFlag) String() string {
+	nets := make([]string, 0, len(*t))
+	for _, n := range *t {
+		nets = append(nets, n.String())
+	}
+	return strings.Join(nets, ",")
+}
+
+func (t *trustedProxiesFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return err
+		}
+		*t = append(*t, n)
+	}
+	return nil
+}
+
+func (t trustedProxiesFlag) trusts(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return t.contains(ip)
+}
+
+func (t trustedProxiesFlag) contains(ip net.IP) bool {
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// externalURL returns the scheme and host clients used to reach the hub,
+// honoring forwarding headers set by trusted reverse proxies
+func externalURL(r *http.Request) (string, string) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if trusted, _ := r.Context().Value(PROXY).(bool); !trusted {
+		return scheme, host
+	}
+	if forwarded := r.Header.Get("Forwarded"); forwarded != "" {
+		// Only the first hop matters, it is the one closest to the client
+		first, _, _ := strings.Cut(forwarded, ",")
+		for _, pair := range strings.Split(first, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			value = strings.Trim(value, "\"")
+			switch strings.ToLower(key) {
+			case "proto":
+				scheme = strings.ToLower(value)
+			case "host":
+				host = value
+			}
+		}
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		first, _, _ := strings.Cut(proto, ",")
+		scheme = strings.ToLower(strings.TrimSpace(first))
+	}
+	if fwdHost := r.Header.Get("X-Forwarded-Host"); fwdHost != "" {
+		first, _, _ := strings.Cut(fwdHost, ",")
+		host = strings.TrimSpace(first)
+	}
+	return scheme, host
+}
+
+// absoluteURL builds an absolute http(s) URL for path as seen by the client
+func absoluteURL(r *http.Request, path string) string {
+	scheme, host := externalURL(r)
+	return scheme + "://" + host + path
+}
+
+// webSocketURL builds the ws(s) URL for path as seen by the client
+func webSocketURL(r *http.Request, path string) string {
+	scheme, host := externalURL(r)
+	if scheme == "https" {
+		return "wss://" + host + path
+	}
+	return "ws://" + host + path
+}
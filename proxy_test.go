@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyMiddlewareClientIP(t *testing.T) {
+	proxies := trustedProxiesFlag{}
+	if err := proxies.Set("10.0.0.0/8,2001:db8::1"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "203.0.113.7:4000",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "untrusted peer spoofing X-Forwarded-For",
+			remoteAddr: "203.0.113.7:4000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "untrusted peer spoofing True-Client-IP and X-Real-IP",
+			remoteAddr: "203.0.113.7:4000",
+			header:     http.Header{"True-Client-Ip": {"198.51.100.1"}, "X-Real-Ip": {"198.51.100.2"}},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.2:4000",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.7"}},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "trusted proxy without X-Forwarded-For",
+			remoteAddr: "10.0.0.2:4000",
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "trusted proxy passing True-Client-IP and X-Real-IP through",
+			remoteAddr: "10.0.0.2:4000",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.7"}, "True-Client-Ip": {"198.51.100.1"}, "X-Real-Ip": {"198.51.100.2"}},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "client prepending to X-Forwarded-For",
+			remoteAddr: "10.0.0.2:4000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7"}},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "client prepending a trusted address",
+			remoteAddr: "10.0.0.2:4000",
+			header:     http.Header{"X-Forwarded-For": {"10.0.0.9, 203.0.113.7"}},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "chained trusted proxies",
+			remoteAddr: "10.0.0.2:4000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7, 10.0.0.3"}},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "repeated X-Forwarded-For headers",
+			remoteAddr: "10.0.0.2:4000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1", "203.0.113.7, [2001:db8::1]:443"}},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "only trusted hops",
+			remoteAddr: "10.0.0.2:4000",
+			header:     http.Header{"X-Forwarded-For": {"10.0.0.4, 10.0.0.3"}},
+			want:       "10.0.0.4",
+		},
+		{
+			name:       "garbled hop",
+			remoteAddr: "10.0.0.2:4000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1, unknown, 10.0.0.3"}},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "garbled last hop",
+			remoteAddr: "10.0.0.2:4000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1, unknown"}},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "trusted IPv6 proxy",
+			remoteAddr: "[2001:db8::1]:4000",
+			header:     http.Header{"X-Forwarded-For": {"2001:db8::7"}},
+			want:       "2001:db8::7",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ""
+			handler := ProxyMiddleware(proxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIP(r)
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for name, values := range test.header {
+				r.Header[name] = values
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if got != test.want {
+				t.Errorf("client IP %q, want %q", got, test.want)
+			}
+		})
+	}
+}
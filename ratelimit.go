@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// ipRateLimiter is a token bucket per source IP
+type ipRateLimiter struct {
+	rate    float64
+	burst   float64
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newIPRateLimiter(rate float64, burst int) *ipRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &ipRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+	go l.cleanup(time.Minute)
+	return l
+}
+
+// allow consumes a token for ip, otherwise it returns how long until one is available
+func (l *ipRateLimiter) allow(ip string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[ip] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*l.rate)
+	bucket.lastSeen = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+// cleanup forgets the sources whose bucket has been full for a while
+func (l *ipRateLimiter) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		l.lock.Lock()
+		for ip, bucket := range l.buckets {
+			if now.Sub(bucket.lastSeen).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, ip)
+			}
+		}
+		l.lock.Unlock()
+	}
+}
+
+func RateLimitMiddleware(rate float64, burst int) func(http.Handler) http.Handler {
+	limiter := newIPRateLimiter(rate, burst)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+			ip := clientIP(r)
+			if ok, wait := limiter.allow(ip); !ok {
+				logger.Warnw("Rate limit exceeded", "ip", ip)
+				w.Header().Add("Retry-After", retryAfterSeconds(wait))
+				writeProblem(w, r, http.StatusTooManyRequests, ProblemRateLimited, "Too many requests from this address")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	return fmt.Sprintf("%d", int(math.Ceil(d.Seconds())))
+}
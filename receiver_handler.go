@@ -2,135 +2,407 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 
-	"github.com/pion/webrtc/v3"
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
 	"go.uber.org/zap"
 	"nhooyr.io/websocket"
 )
 
-func webSocketHandler(b *Broadcaster) func(w http.ResponseWriter, r *http.Request) {
+// websocketCompressionMode parses the websocket-compression flag
+func websocketCompressionMode(mode string) (websocket.CompressionMode, error) {
+	switch mode {
+	case "disabled":
+		return websocket.CompressionDisabled, nil
+	case "no-context-takeover":
+		return websocket.CompressionNoContextTakeover, nil
+	case "context-takeover":
+		return websocket.CompressionContextTakeover, nil
+	}
+	return websocket.CompressionDisabled, fmt.Errorf("unknown websocket compression %q", mode)
+}
+
+// websocketAcceptOptions are the options the receiver websocket is accepted
+// with, config was validated by LoadConfig
+func websocketAcceptOptions(config Config) websocket.AcceptOptions {
+	mode, _ := websocketCompressionMode(config.WebSocketCompression)
+	return websocket.AcceptOptions{
+		Subprotocols:         hub.Subprotocols,
+		OriginPatterns:       config.WebSocketOrigins,
+		InsecureSkipVerify:   config.WebSocketSkipOriginCheck,
+		CompressionMode:      mode,
+		CompressionThreshold: config.WebSocketCompressionThreshold,
+	}
+}
+
+func webSocketHandler(rooms *Rooms, options receiverOptions, accept websocket.AcceptOptions) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
-		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-			Subprotocols: []string{"webRTCBroadcast"},
-		})
+		b, ok := requestRoom(w, r, rooms, true)
+		if !ok {
+			return
+		}
+		options := options
+		if options.Preferences, ok = receiverPreferences(w, r); !ok {
+			return
+		}
+		options.ResumeToken = r.URL.Query().Get("resume")
+		c, err := websocket.Accept(w, r, &accept)
 		if err != nil {
 			logger.Errorw("Failed to upgrade", "error", err)
 			return
 		}
+		c.SetReadLimit(maxSignalingMessageSize)
+		signaler := hub.NewWebSocketSignaler(c)
+		if b.Draining() {
+			hub.SendReconnectHint(signaler, b.ReconnectPolicy(), "draining")
+			c.Close(websocket.StatusTryAgainLater, "Hub is draining")
+			return
+		}
 		defer c.Close(websocket.StatusInternalError, "the sky is falling")
 
-		peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
-		if err != nil {
-			logger.Errorw("Failed to create PeerConnection", "error", err)
+		err = serveReceiver(r.Context(), b, signaler, options, logger)
+		if websocket.CloseStatus(err) != websocket.StatusGoingAway {
+			logger.Error(err)
+		}
+	}
+}
+
+// receiverPreferences reads the preferences a receiver can pass in the query
+// string, it writes a problem and returns false when they are invalid
+func receiverPreferences(w http.ResponseWriter, r *http.Request) (hub.ReceiverPreferences, bool) {
+	preferences, err := parseReceiverPreferences(r.URL.Query().Get("maxTracks"), r.URL.Query().Get("capacity"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, err.Error())
+		return preferences, false
+	}
+	return preferences, true
+}
+
+// parseReceiverPreferences parses the maxTracks and capacity preferences,
+// empty values are left out
+func parseReceiverPreferences(maxTracks string, capacity string) (hub.ReceiverPreferences, error) {
+	preferences := hub.ReceiverPreferences{}
+	if maxTracks != "" {
+		value, err := strconv.Atoi(maxTracks)
+		if err != nil || value < 0 {
+			return preferences, errors.New("maxTracks must be a non-negative integer")
+		}
+		preferences.MaxTracks = value
+	}
+	if capacity != "" {
+		value, err := strconv.Atoi(capacity)
+		if err != nil || value < 0 {
+			return preferences, errors.New("capacity must be a non-negative integer")
+		}
+		preferences.Capacity = value
+	}
+	return preferences, nil
+}
+
+// keepalive pings receivers over their signaling, those that send nothing,
+// not even a pong, for Timeout are dropped. A zero Timeout disables it.
+type keepalive struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+var errSignalingTimeout = errors.New("receiver stopped answering pings")
+
+const (
+	// signalingQueueSize is how many messages can wait for a slow receiver
+	signalingQueueSize = 32
+	// signalingWriteTimeout closes the signaling of receivers that stall
+	signalingWriteTimeout = 5 * time.Second
+)
+
+// run pings until ctx is done, it cancels the session once the receiver
+// stayed silent too long
+func (k keepalive) run(ctx context.Context, signaler hub.Signaler, lastSeen *atomic.Int64, timedOut *atomic.Bool, cancel context.CancelFunc) {
+	ticker := time.NewTicker(k.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
 		}
+		if time.Since(time.Unix(0, lastSeen.Load())) > k.Timeout {
+			timedOut.Store(true)
+			cancel()
+			// Not every signaler honors ctx in Receive
+			signaler.Close(websocket.StatusPolicyViolation, "ping timeout")
+			return
+		}
+		pingCtx, cancelPing := context.WithTimeout(ctx, k.Interval)
+		// A failed send surfaces as a read error
+		_ = signaler.Send(pingCtx, hub.Message{Event: "ping"})
+		cancelPing()
+	}
+}
+
+// receiverOptions configure the receiver sessions
+type receiverOptions struct {
+	Preferences hub.ReceiverPreferences
+	Keepalive   keepalive
+	Sessions    *receiverSessions
+	// ICERestarts is how many ICE restarts a failed connection gets before
+	// the receiver is removed
+	ICERestarts int
+	// MaxBitrate paces the packets sent to each receiver under this many
+	// bits per second, 0 disables
+	MaxBitrate uint64
+	Chat       chatOptions
+	// ResumeToken names the parked session to take back, if any
+	ResumeToken string
+}
 
-		// When this frame returns close the PeerConnection
-		defer peerConnection.Close()
-		state := ReceiverState{
-			Connection:   peerConnection,
-			SignalSocket: c,
+// serveReceiver runs a receiver session over signaler until the signaling
+// ends, the session is then parked so that the receiver can resume it
+func serveReceiver(ctx context.Context, b *hub.Broadcaster, signaler hub.Signaler, options receiverOptions, logger *zap.SugaredLogger) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	signaler = hub.NewQueuedSignaler(signaler, signalingQueueSize, signalingWriteTimeout)
+	defer signaler.Close(websocket.StatusNormalClosure, "")
+	lastSeen := &atomic.Int64{}
+	lastSeen.Store(time.Now().UnixNano())
+	timedOut := &atomic.Bool{}
+	if options.Keepalive.Timeout > 0 && options.Keepalive.Interval > 0 {
+		go options.Keepalive.run(ctx, signaler, lastSeen, timedOut, cancel)
+	}
+
+	session, ok := options.Sessions.resume(options.ResumeToken, b)
+	if ok {
+		session.setSignaler(signaler)
+		if err := b.ResumeReceiver(session.receiverID, session.outbound()); err != nil {
+			session.peer.Close()
+			return err
+		}
+		logger.Infow("Receiver resumed", "receiverID", session.receiverID)
+	} else {
+		var err error
+		if session, err = newReceiverSession(b, signaler, options, logger); err != nil {
+			return err
 		}
+	}
+	defer func() {
+		if !options.Sessions.park(session) {
+			session.peer.Close()
+		}
+	}()
+	if err := hub.SendEvent(ctx, signaler, "session", sessionEvent{ResumeToken: session.token}); err != nil {
+		return err
+	}
+	peerConnection, receiverID := session.peer, session.receiverID
 
-		dc, err := peerConnection.CreateDataChannel("ping", nil)
+	invalid := 0
+	for {
+		message, err := signaler.Receive(ctx)
 		if err != nil {
-			logger.Error(err)
-		}
-		defer dc.Close()
-		go func() {
-			ticker := time.NewTicker(3 * time.Second)
-			for range ticker.C {
-				if err := dc.SendText("ping"); err != nil {
-					return
-				}
+			if timedOut.Load() {
+				return errSignalingTimeout
 			}
-		}()
+			return err
+		}
+		lastSeen.Store(time.Now().UnixNano())
 
-		// Trickle ICE. Emit server candidate to client
-		peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
-			if i == nil {
-				return
-			}
+		logger.Debugw("Received message", "message", message)
 
-			candidateString, err := json.Marshal(i.ToJSON())
-			if err != nil {
-				logger.Errorw("Unable to marshal to json", "error", err, "candidate", i)
-				return
-			}
+		err = handleReceiverMessage(b, receiverID, peerConnection, message, options.Chat, logger)
+		if err == nil {
+			invalid = 0
+			continue
+		}
+		problem := &signalingError{}
+		if !errors.As(err, &problem) {
+			return err
+		}
+		logger.Infow("Rejected receiver message", "event", message.Event, "code", problem.Code, "detail", problem.Detail)
+		if invalid++; invalid > maxInvalidMessages {
+			return errTooManyInvalidMessages
+		}
+		if err := hub.SendEvent(ctx, signaler, "error", problem); err != nil {
+			return err
+		}
+	}
+}
+
+// handleReceiverMessage applies a receiver message once validated, the
+// problems the receiver can recover from are returned as *signalingError
+func handleReceiverMessage(b *hub.Broadcaster, receiverID uuid.UUID, peerConnection *webrtc.PeerConnection, message hub.Message, chat chatOptions, logger *zap.SugaredLogger) error {
+	if err := validateMessageSize(message); err != nil {
+		return err
+	}
+	switch message.Event {
+	case "candidate":
+		candidate := webrtc.ICECandidateInit{}
+		if err := decodeData(message, &candidate); err != nil {
+			return err
+		}
+		if err := validateCandidate(message.Event, candidate); err != nil {
+			return err
+		}
+
+		if err := peerConnection.AddICECandidate(candidate); err != nil {
+			return negotiationFailed(message.Event, err)
+		}
+	case "answer", "offer":
+		description := webrtc.SessionDescription{}
+		if err := decodeData(message, &description); err != nil {
+			return err
+		}
+		if err := validateDescription(message.Event, description); err != nil {
+			return err
+		}
+
+		var err error
+		if message.Event == "answer" {
+			err = b.HandleAnswer(receiverID, description)
+		} else {
+			err = b.HandleOffer(receiverID, description)
+		}
+		if errors.Is(err, hub.ErrUnknownReceiver) {
+			return err
+		}
+		if err != nil {
+			return negotiationFailed(message.Event, err)
+		}
+	case "replay":
+		request := replayRequest{}
+		if err := decodeData(message, &request); err != nil {
+			return err
+		}
+		if err := validateID(message.Event, "streamID", request.StreamID); err != nil {
+			return err
+		}
+		if math.IsNaN(request.Delay) || math.IsInf(request.Delay, 0) || request.Delay <= 0 {
+			return invalidMessage(message.Event, "delay must be a positive number of seconds")
+		}
 
-			message := websocketMessage{
-				Event: "candidate",
-				Data:  string(candidateString),
+		delay := time.Duration(request.Delay * float64(time.Second))
+		if err := b.StartReplay(receiverID, request.StreamID, delay); err != nil {
+			logger.Warnw("Unable to start replay", "error", err, "streamID", request.StreamID)
+		}
+	case "live":
+		if err := validateID(message.Event, "stream ID", message.Data); err != nil {
+			return err
+		}
+		b.StopReplay(receiverID, message.Data)
+	case "capabilities":
+		capabilities := receiverCapabilities{}
+		if err := decodeData(message, &capabilities); err != nil {
+			return err
+		}
+		if (capabilities.MaxTracks != nil && *capabilities.MaxTracks < 0) || (capabilities.Capacity != nil && *capabilities.Capacity < 0) {
+			return invalidMessage(message.Event, "maxTracks and capacity must not be negative")
+		}
+		if capabilities.MaxResolution != nil && (capabilities.MaxResolution.Width < 0 || capabilities.MaxResolution.Height < 0) {
+			return invalidMessage(message.Event, "maxResolution must not be negative")
+		}
+		if capabilities.Codecs != nil {
+			if len(*capabilities.Codecs) > maxDeclaredCodecs {
+				return invalidMessage(message.Event, "too many codecs")
 			}
-			messageString, err := json.Marshal(message)
-			if err != nil {
-				logger.Error(err)
-				return
+			for _, codec := range *capabilities.Codecs {
+				if err := validateID(message.Event, "codec", codec); err != nil {
+					return err
+				}
 			}
+		}
 
-			ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-			defer cancel()
-			if writeErr := c.Write(ctx, websocket.MessageText, messageString); writeErr != nil {
-				logger.Errorw("Unable to write to ws", "error", writeErr)
+		if capabilities.MaxTracks != nil {
+			if err := b.SetMaxTracks(receiverID, *capabilities.MaxTracks); err != nil {
+				logger.Warnw("Unable to apply capabilities", "error", err)
 			}
-		})
-		receiverID := b.AddReceiver(state)
-
-		// If PeerConnection is closed remove it from global list
-		peerConnection.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
-			switch p {
-			case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
-				if err := peerConnection.Close(); err != nil {
-					logger.Errorw("Unable to close connection", "error", err)
-				}
-				b.RemoveReceiver(receiverID)
+		}
+		if capabilities.Capacity != nil {
+			if err := b.SetCapacity(receiverID, *capabilities.Capacity); err != nil {
+				logger.Warnw("Unable to apply capabilities", "error", err)
 			}
-		})
-
-		message := &websocketMessage{}
-		for {
-			_, raw, err := c.Read(r.Context())
-			if err != nil {
-				if websocket.CloseStatus(err) == websocket.StatusGoingAway {
-					return
-				}
-				logger.Error(err)
-				return
-			} else if err := json.Unmarshal(raw, &message); err != nil {
-				logger.Error(err)
-				return
+		}
+		if capabilities.Codecs != nil {
+			if err := b.SetCodecs(receiverID, *capabilities.Codecs); err != nil {
+				logger.Warnw("Unable to apply capabilities", "error", err)
 			}
-
-			logger.Debugw("Received message", "message", message)
-
-			switch message.Event {
-			case "candidate":
-				candidate := webrtc.ICECandidateInit{}
-				if err := json.Unmarshal([]byte(message.Data), &candidate); err != nil {
-					logger.Error(err)
-					return
-				}
-
-				if err := peerConnection.AddICECandidate(candidate); err != nil {
-					logger.Error(err)
-					return
-				}
-			case "answer":
-				answer := webrtc.SessionDescription{}
-				if err := json.Unmarshal([]byte(message.Data), &answer); err != nil {
-					logger.Error(err)
-					return
-				}
-
-				if err := peerConnection.SetRemoteDescription(answer); err != nil && err != webrtc.ErrSessionDescriptionMissingIceUfrag {
-					logger.Error(err)
-					return
-				}
+		}
+		if resolution := capabilities.MaxResolution; resolution != nil {
+			if err := b.SetMaxResolution(receiverID, resolution.Width, resolution.Height); err != nil {
+				logger.Warnw("Unable to apply capabilities", "error", err)
 			}
 		}
+	case "pause", "resume":
+		if err := validateID(message.Event, "track", message.Data); err != nil {
+			return err
+		}
+		if message.Event == "pause" {
+			if err := b.PauseTrack(receiverID, message.Data); err != nil {
+				logger.Warnw("Unable to pause track", "error", err, "track", message.Data)
+			}
+		} else if err := b.ResumeTrack(receiverID, message.Data); err != nil {
+			logger.Warnw("Unable to resume track", "error", err, "track", message.Data)
+		}
+	case "subscribe":
+		request, err := parseSubscription(message)
+		if err != nil {
+			return err
+		}
+		if err := b.Subscribe(receiverID, request.StreamID); err != nil {
+			logger.Warnw("Unable to subscribe", "error", err, "streamID", request.StreamID)
+		}
+		if request.RID != nil {
+			if err := b.SelectLayer(receiverID, request.StreamID, *request.RID); err != nil {
+				logger.Warnw("Unable to select layer", "error", err, "streamID", request.StreamID, "rid", *request.RID)
+			}
+		}
+	case "unsubscribe":
+		if err := validateID(message.Event, "stream ID", message.Data); err != nil {
+			return err
+		}
+		if err := b.Unsubscribe(receiverID, message.Data); err != nil {
+			logger.Warnw("Unable to unsubscribe", "error", err, "streamID", message.Data)
+		}
+	case "chat":
+		chatMessage, err := chat.message(receiverID, []byte(message.Data))
+		if err != nil {
+			return err
+		}
+		b.Chat(chatMessage)
+	case "pong":
+		// Only keeps the signaling alive
+	default:
+		return &signalingError{Event: message.Event, Code: signalingErrorUnknownEvent, Detail: "unknown event"}
 	}
+	return nil
+}
+
+// receiverCapabilities are the limits a receiver declares once connected,
+// the fields left out keep their value
+type receiverCapabilities struct {
+	// MaxTracks is the number of tracks the receiver can handle, 0 for no limit
+	MaxTracks *int `json:"maxTracks"`
+	// Capacity weighs the receiver in the weighted distribution
+	Capacity *int `json:"capacity"`
+	// Codecs are the MIME types the receiver decodes, empty for any
+	Codecs *[]string `json:"codecs"`
+	// MaxResolution bounds the video tracks, 0 leaves a dimension unbounded
+	MaxResolution *resolution `json:"maxResolution"`
+}
+
+type resolution struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type replayRequest struct {
+	StreamID string `json:"streamID"`
+	// Delay in seconds behind live
+	Delay float64 `json:"delay"`
 }
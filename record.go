@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/client"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// runRecord implements the record subcommand: join a hub as a receiver and
+// write every track it gets to disk, reconnecting when the hub asks to.
+func runRecord(args []string) error {
+	fs := flag.NewFlagSet("webrtc-hub record", flag.ContinueOnError)
+	url := fs.String("url", "ws://localhost:8080/websocket", "websocket signaling URL of the hub")
+	dir := fs.String("out", ".", "directory the tracks are written to")
+	token := fs.String("token", "", "bearer token sent with the websocket handshake")
+	duration := fs.Duration("duration", 0, "stop recording after this duration, 0 records until interrupted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	header := http.Header{}
+	if *token != "" {
+		header.Set("Authorization", "Bearer "+*token)
+	}
+	recorder := client.NewRecorder(*dir)
+	defer recorder.Close()
+	recorder.OnError = func(track *webrtc.TrackRemote, err error) {
+		zap.S().Errorw("Track recording stopped", "streamID", track.StreamID(), "trackID", track.ID(), "error", err)
+	}
+
+	for {
+		c, err := client.Dial(ctx, *url, client.Options{
+			Header: header,
+			OnTrack: func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+				zap.S().Infow("Recording track", "streamID", track.StreamID(), "trackID", track.ID(), "codec", track.Codec().MimeType)
+				recorder.OnTrack(track, receiver)
+			},
+		})
+		if err != nil {
+			return err
+		}
+		err = c.Run(ctx)
+		c.Close()
+
+		var reconnect *client.ReconnectError
+		if !errors.As(err, &reconnect) {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		zap.S().Infow("Hub asked to reconnect", "reason", reconnect.Hint.Reason, "retryAfter", reconnect.RetryAfter(), "alternates", reconnect.Hint.Alternates)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(reconnect.RetryAfter()):
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// archiveInterval is how often the completed recordings are looked for to
+// upload or offload
+const archiveInterval = 30 * time.Second
+
+// recordingsHandler lists the streams being recorded
+func recordingsHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, rooms.Recordings())
+	}
+}
+
+// startRecordingHandler records the tracks of a stream of the room in the
+// configured format until it is stopped or the stream goes away
+func startRecordingHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		streamID := chi.URLParam(r, "streamID")
+		info, err := b.StartRecording(streamID)
+		if err != nil {
+			writeRecordingProblem(w, r, err)
+			return
+		}
+		logger.Infow("Recording started", "streamID", streamID, "dir", info.Dir)
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, r, info)
+	}
+}
+
+// stopRecordingHandler stops recording a stream of the room and finalizes
+// its files
+func stopRecordingHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		streamID := chi.URLParam(r, "streamID")
+		info, err := b.StopRecording(streamID)
+		if err != nil {
+			writeRecordingProblem(w, r, err)
+			return
+		}
+		logger.Infow("Recording stopped", "streamID", streamID, "dir", info.Dir)
+		writeJSON(w, r, info)
+	}
+}
+
+// completedRecordingsHandler lists the recordings of every room whose files
+// are finalized, with their duration and size
+func completedRecordingsHandler(recordDir string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recordings, err := completedRecordings(recordDir)
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, err.Error())
+			return
+		}
+		writeJSON(w, r, recordings)
+	}
+}
+
+// deleteRecordingHandler removes the files of a completed recording, and
+// their uploaded objects when store is set
+func deleteRecordingHandler(recordDir string, store *s3Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		recording, ok := requestCompletedRecording(w, r, recordDir)
+		if !ok {
+			return
+		}
+		if recording.Uploaded != nil && store != nil {
+			for _, file := range recording.Files {
+				if err := store.deleteObject(r.Context(), recordingObjectKey(recordDir, recording, file.Name)); err != nil {
+					writeProblem(w, r, http.StatusBadGateway, ProblemUpstream, err.Error())
+					return
+				}
+			}
+		}
+		room := recording.Room
+		recording, err := hub.DeleteRecording(filepath.Join(recordDir, room), recording.ID)
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, err.Error())
+			return
+		}
+		recording.Room = room
+		logger.Infow("Recording deleted", "id", recording.ID, "streamID", recording.StreamID, "dir", recording.Dir)
+		writeJSON(w, r, recording)
+	}
+}
+
+// completedRecordings lists the completed recordings of every room, the
+// rooms torn down included
+func completedRecordings(recordDir string) ([]hub.CompletedRecording, error) {
+	recordings := []hub.CompletedRecording{}
+	for _, room := range recordingRooms(recordDir) {
+		completed, err := hub.CompletedRecordings(filepath.Join(recordDir, room))
+		if err != nil {
+			return nil, err
+		}
+		for _, recording := range completed {
+			recording.Room = room
+			recordings = append(recordings, recording)
+		}
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Started.Before(recordings[j].Started)
+	})
+	return recordings, nil
+}
+
+// findCompletedRecording finds a completed recording in every room, the
+// rooms torn down included
+func findCompletedRecording(recordDir string, id string) (hub.CompletedRecording, error) {
+	for _, room := range recordingRooms(recordDir) {
+		recording, err := hub.FindCompletedRecording(filepath.Join(recordDir, room), id)
+		if errors.Is(err, hub.ErrUnknownRecording) {
+			continue
+		}
+		recording.Room = room
+		return recording, err
+	}
+	return hub.CompletedRecording{}, hub.ErrUnknownRecording
+}
+
+// archiveRecordings uploads the completed recordings of every room to
+// store, and removes the local files of those that ended longer than
+// retention ago once uploaded, until ctx is done. Zero retention keeps
+// them.
+func archiveRecordings(ctx context.Context, recordDir string, store *s3Client, retention time.Duration, logger *zap.SugaredLogger) {
+	ticker := time.NewTicker(archiveInterval)
+	defer ticker.Stop()
+	for {
+		recordings, err := completedRecordings(recordDir)
+		if err != nil {
+			logger.Warnw("Unable to list the completed recordings", "error", err)
+		}
+		for _, recording := range recordings {
+			if ctx.Err() != nil {
+				return
+			}
+			if recording.Uploaded == nil {
+				// Retried at the next interval on failure
+				if recording, err = uploadRecording(ctx, recordDir, store, recording); err != nil {
+					logger.Warnw("Unable to upload the recording", "id", recording.ID, "streamID", recording.StreamID, "error", err)
+					continue
+				}
+				logger.Infow("Recording uploaded", "id", recording.ID, "streamID", recording.StreamID, "size", recording.Size)
+			}
+			if retention > 0 && !recording.Offloaded && time.Since(recording.Ended) > retention {
+				if _, err := hub.OffloadRecording(recording); err != nil {
+					logger.Warnw("Unable to remove the local files of the recording", "id", recording.ID, "error", err)
+					continue
+				}
+				// Its HLS packaging goes along
+				os.RemoveAll(filepath.Join(recording.Dir, vodHLSDir))
+				logger.Infow("Recording offloaded", "id", recording.ID, "streamID", recording.StreamID)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// uploadRecording uploads the files of a completed recording and records
+// their URL in its description
+func uploadRecording(ctx context.Context, recordDir string, store *s3Client, recording hub.CompletedRecording) (hub.CompletedRecording, error) {
+	for i, file := range recording.Files {
+		objectURL, err := store.putFile(ctx, recordingObjectKey(recordDir, recording, file.Name), filepath.Join(recording.Dir, file.Name))
+		if err != nil {
+			return recording, err
+		}
+		recording.Files[i].URL = objectURL
+	}
+	uploaded := time.Now().UTC()
+	recording.Uploaded = &uploaded
+	return recording, hub.SaveCompletedRecording(recording)
+}
+
+// recordingObjectKey lays the objects out in the bucket like the files
+// are under recordDir, by room, stream and session
+func recordingObjectKey(recordDir string, recording hub.CompletedRecording, name string) string {
+	dir, err := filepath.Rel(recordDir, recording.Dir)
+	if err != nil {
+		dir = filepath.Join(recording.Room, recording.ID)
+	}
+	return filepath.ToSlash(filepath.Join(dir, name))
+}
+
+// recordingRooms are the rooms with a recording directory
+func recordingRooms(recordDir string) []string {
+	rooms := []string{}
+	entries, err := os.ReadDir(recordDir)
+	if err != nil {
+		return rooms
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && roomNamePattern.MatchString(entry.Name()) {
+			rooms = append(rooms, entry.Name())
+		}
+	}
+	return rooms
+}
+
+func writeRecordingProblem(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, hub.ErrUnknownStream):
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Stream has no published track")
+	case errors.Is(err, hub.ErrNotRecording):
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Stream is not being recorded")
+	case errors.Is(err, hub.ErrRecording):
+		writeProblem(w, r, http.StatusConflict, ProblemConflict, "Stream is already being recorded")
+	case errors.Is(err, hub.ErrRecordingDisabled):
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Recording is not enabled, set -record-dir")
+	default:
+		writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, err.Error())
+	}
+}
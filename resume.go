@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+// sessionEvent tells a receiver how to resume its session
+type sessionEvent struct {
+	ResumeToken string `json:"resumeToken"`
+}
+
+// receiverSession is the part of a receiver outliving its signaling
+type receiverSession struct {
+	token       string
+	broadcaster *hub.Broadcaster
+	receiverID  uuid.UUID
+	peer        *webrtc.PeerConnection
+
+	lock     sync.Mutex
+	signaler hub.Signaler
+	expiry   *time.Timer
+
+	// channel carries the signaling once the connection is up, so that
+	// renegotiations do not depend on the websocket
+	channel         *webrtc.DataChannel
+	channelSignaler hub.Signaler
+}
+
+// sessionSignaler sends over the signaling data channel of its session when
+// it is open and over the current signaling otherwise
+type sessionSignaler struct {
+	session *receiverSession
+}
+
+func (s sessionSignaler) Send(ctx context.Context, message hub.Message) error {
+	if s.session.channel != nil && s.session.channel.ReadyState() == webrtc.DataChannelStateOpen {
+		return s.session.channelSignaler.Send(ctx, message)
+	}
+	return s.session.currentSignaler().Send(ctx, message)
+}
+
+// Pending counts the messages waiting for the current signaling
+func (s sessionSignaler) Pending() int {
+	if pending, ok := s.session.currentSignaler().(interface{ Pending() int }); ok {
+		return pending.Pending()
+	}
+	return 0
+}
+
+func (s sessionSignaler) Receive(ctx context.Context) (hub.Message, error) {
+	return s.session.currentSignaler().Receive(ctx)
+}
+
+func (s sessionSignaler) Close(code websocket.StatusCode, reason string) error {
+	return s.session.currentSignaler().Close(code, reason)
+}
+
+// newReceiverSession creates the receiver connection and registers it, it
+// gets offered its tracks through signaler
+func newReceiverSession(b *hub.Broadcaster, signaler hub.Signaler, options receiverOptions, logger *zap.SugaredLogger) (*receiverSession, error) {
+	repair := hub.NewRepairMonitor()
+	retransmitter := hub.NewRetransmitter()
+	bandwidth := hub.NewBandwidthMonitor()
+	// End-to-end encrypted streams cannot be read for their keyframes
+	var keyframes *hub.KeyframeGate
+	if !b.CodecSet().E2EE {
+		keyframes = hub.NewKeyframeGate()
+	}
+	reports := hub.NewSenderReports()
+	stats := hub.NewConnectionStats()
+	pacer := hub.NewPacer(options.MaxBitrate)
+	api, err := hub.NewReceiverAPI(b.CodecSet(), hub.ReceiverAPIOptions{
+		Repair:        repair,
+		Retransmitter: retransmitter,
+		Bandwidth:     bandwidth,
+		Keyframes:     keyframes,
+		Reports:       reports,
+		Stats:         stats,
+		Pacer:         pacer,
+	})
+	if err != nil {
+		return nil, err
+	}
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	session := &receiverSession{
+		token:       uuid.NewString(),
+		broadcaster: b,
+		peer:        peerConnection,
+		signaler:    signaler,
+	}
+
+	// The ping data channel carries the telemetry of the receiver
+	telemetry := hub.NewTelemetry()
+	dc, err := peerConnection.CreateDataChannel("ping", nil)
+	if err != nil {
+		logger.Error(err)
+	} else {
+		telemetry.Serve(dc)
+	}
+
+	// The control data channel changes the quality with sub-second effect
+	control, err := peerConnection.CreateDataChannel(hub.ControlChannelLabel, nil)
+	if err != nil {
+		logger.Errorw("Unable to create the control data channel", "error", err)
+	}
+
+	if session.channel, err = peerConnection.CreateDataChannel("signaling", nil); err != nil {
+		logger.Errorw("Unable to create the signaling data channel", "error", err)
+	} else {
+		session.channelSignaler = hub.NewDataChannelSignaler(session.channel)
+	}
+
+	// Trickle ICE. Emit server candidate to client
+	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
+		if i == nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := hub.SendEvent(ctx, session.outbound(), "candidate", i.ToJSON()); err != nil {
+			logger.Errorw("Unable to send candidate", "error", err)
+		}
+	})
+	session.receiverID = b.AddReceiver(hub.ReceiverState{
+		Connection:    peerConnection,
+		Signaler:      session.outbound(),
+		Repair:        repair,
+		Retransmitter: retransmitter,
+		Bandwidth:     bandwidth,
+		Keyframes:     keyframes,
+		Reports:       reports,
+		Stats:         stats,
+		Pacer:         pacer,
+		Telemetry:     telemetry,
+		Preferences:   options.Preferences,
+	})
+	if control != nil {
+		b.ServeControl(session.receiverID, control)
+	}
+	if session.channelSignaler != nil {
+		go session.serveChannel(b, options.Chat, logger)
+	}
+
+	// A failed connection gets ICE restarts before it is removed from the
+	// global list along with closed ones
+	restarts := &atomic.Int32{}
+	peerConnection.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
+		switch p {
+		case webrtc.PeerConnectionStateConnected:
+			restarts.Store(0)
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			if p == webrtc.PeerConnectionStateFailed && int(restarts.Add(1)) <= options.ICERestarts {
+				err := b.RestartICE(session.receiverID)
+				if err == nil {
+					logger.Infow("Restarting ICE of failed receiver", "receiverID", session.receiverID, "attempt", restarts.Load())
+					return
+				}
+				logger.Warnw("Unable to restart ICE", "receiverID", session.receiverID, "error", err)
+			}
+			if err := peerConnection.Close(); err != nil {
+				logger.Errorw("Unable to close connection", "error", err)
+			}
+			b.RemoveReceiver(session.receiverID)
+		}
+	})
+	return session, nil
+}
+
+// serveChannel handles the messages of the signaling data channel until it
+// closes, rejected ones are reported over it
+func (s *receiverSession) serveChannel(b *hub.Broadcaster, chat chatOptions, logger *zap.SugaredLogger) {
+	for {
+		message, err := s.channelSignaler.Receive(context.Background())
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err == nil {
+			err = handleReceiverMessage(b, s.receiverID, s.peer, message, chat, logger)
+		}
+		problem := &signalingError{}
+		if errors.As(err, &problem) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err = hub.SendEvent(ctx, s.channelSignaler, "error", problem)
+			cancel()
+		}
+		if err != nil {
+			logger.Warnw("Signaling data channel failed", "receiverID", s.receiverID, "error", err)
+		}
+	}
+}
+
+// outbound is the signaling the session sends over
+func (s *receiverSession) outbound() hub.Signaler {
+	return sessionSignaler{session: s}
+}
+
+func (s *receiverSession) currentSignaler() hub.Signaler {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.signaler
+}
+
+func (s *receiverSession) setSignaler(signaler hub.Signaler) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.signaler = signaler
+}
+
+// receiverSessions keeps the sessions whose signaling dropped for a grace
+// period, a receiver reconnecting with the resume token takes its session
+// back instead of negotiating a new connection
+type receiverSessions struct {
+	grace  time.Duration
+	lock   sync.Mutex
+	parked map[string]*receiverSession
+}
+
+func newReceiverSessions(grace time.Duration) *receiverSessions {
+	return &receiverSessions{grace: grace, parked: make(map[string]*receiverSession)}
+}
+
+// park keeps session resumable, its connection is closed once the grace
+// period ends without signaling over its data channel. It returns false when sessions cannot be resumed.
+func (r *receiverSessions) park(session *receiverSession) bool {
+	if r.grace <= 0 || session.peer.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.parked[session.token] = session
+	session.expiry = time.AfterFunc(r.grace, func() {
+		r.expire(session)
+	})
+	return true
+}
+
+// expire closes the connection of a session still parked, unless it keeps
+// signaling over its data channel
+func (r *receiverSessions) expire(session *receiverSession) {
+	r.lock.Lock()
+	expired := r.parked[session.token] == session
+	if expired && session.channel != nil && session.channel.ReadyState() == webrtc.DataChannelStateOpen {
+		session.expiry.Reset(r.grace)
+		expired = false
+	} else if expired {
+		delete(r.parked, session.token)
+	}
+	r.lock.Unlock()
+	if expired {
+		session.peer.Close()
+	}
+}
+
+// resume takes back the session parked under token in the room of b
+func (r *receiverSessions) resume(token string, b *hub.Broadcaster) (*receiverSession, bool) {
+	if token == "" {
+		return nil, false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	session, ok := r.parked[token]
+	if !ok || session.broadcaster != b || !session.expiry.Stop() {
+		return nil, false
+	}
+	delete(r.parked, token)
+	if session.peer.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return nil, false
+	}
+	return session, true
+}
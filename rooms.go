@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+)
+
+// DefaultRoom is used by requests without a room, it is never torn down
+const DefaultRoom = "default"
+
+var roomNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Room is a named Broadcaster with its own senders, receivers and distribution
+type Room struct {
+	Name        string
+	Broadcaster *hub.Broadcaster
+
+	lastUsed time.Time
+	cancel   context.CancelFunc
+}
+
+// Rooms creates rooms on first use and tears them down once idle
+type Rooms struct {
+	lock  sync.Mutex
+	rooms map[string]*Room
+	// setup configures the Broadcaster of a new room, ctx is done on teardown
+	setup       func(ctx context.Context, name string, b *hub.Broadcaster)
+	idleTimeout time.Duration
+	draining    bool
+}
+
+func NewRooms(idleTimeout time.Duration, setup func(ctx context.Context, name string, b *hub.Broadcaster)) *Rooms {
+	return &Rooms{
+		rooms:       make(map[string]*Room),
+		setup:       setup,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Get returns the room, creating it when needed
+func (r *Rooms) Get(name string) *hub.Broadcaster {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	room, ok := r.rooms[name]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		room = &Room{Name: name, Broadcaster: hub.NewBroadcaster(nil), cancel: cancel}
+		if r.setup != nil {
+			r.setup(ctx, name, room.Broadcaster)
+		}
+		if r.draining {
+			room.Broadcaster.Drain("draining")
+		}
+		r.rooms[name] = room
+	}
+	room.lastUsed = time.Now()
+	return room.Broadcaster
+}
+
+// Lookup returns an existing room
+func (r *Rooms) Lookup(name string) (*hub.Broadcaster, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	room, ok := r.rooms[name]
+	if !ok {
+		return nil, false
+	}
+	room.lastUsed = time.Now()
+	return room.Broadcaster, true
+}
+
+// All returns the current rooms keyed by name
+func (r *Rooms) All() map[string]*hub.Broadcaster {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	all := make(map[string]*hub.Broadcaster, len(r.rooms))
+	for name, room := range r.rooms {
+		all[name] = room.Broadcaster
+	}
+	return all
+}
+
+// ReapIdle tears down the rooms left without any session for longer than
+// the idle timeout, until ctx is done
+func (r *Rooms) ReapIdle(ctx context.Context) {
+	ticker := time.NewTicker(r.idleTimeout/2 + time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, room := range r.idleRooms() {
+			room.cancel()
+			room.Broadcaster.Close()
+		}
+	}
+}
+
+func (r *Rooms) idleRooms() []*Room {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	idle := []*Room{}
+	for name, room := range r.rooms {
+		if name == DefaultRoom || time.Since(room.lastUsed) < r.idleTimeout || !room.Broadcaster.Idle() {
+			continue
+		}
+		delete(r.rooms, name)
+		idle = append(idle, room)
+	}
+	return idle
+}
+
+// Drain drains every room
+func (r *Rooms) Drain(reason string) {
+	r.lock.Lock()
+	r.draining = true
+	r.lock.Unlock()
+	for _, b := range r.All() {
+		b.Drain(reason)
+	}
+}
+
+// Close tears down every room
+func (r *Rooms) Close() {
+	r.lock.Lock()
+	rooms := r.rooms
+	r.rooms = make(map[string]*Room)
+	r.lock.Unlock()
+	for _, room := range rooms {
+		room.cancel()
+		room.Broadcaster.Close()
+	}
+}
+
+// WaitIdle returns once every room is idle or when ctx is done
+func (r *Rooms) WaitIdle(ctx context.Context) {
+	for _, b := range r.All() {
+		b.WaitIdle(ctx)
+	}
+}
+
+func (r *Rooms) ActivePeerSenders() int {
+	count := 0
+	for _, b := range r.All() {
+		count += b.ActivePeerSenders()
+	}
+	return count
+}
+
+func (r *Rooms) Load() hub.Load {
+	total := hub.Load{}
+	for _, b := range r.All() {
+		load := b.Load()
+		total.Publishers += load.Publishers
+		total.Receivers += load.Receivers
+	}
+	return total
+}
+
+func (r *Rooms) Receivers() []hub.ReceiverInfo {
+	infos := []hub.ReceiverInfo{}
+	for name, b := range r.All() {
+		for _, info := range b.Receivers() {
+			info.Room = name
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// Stats merges the track and receiver statistics of every room
+func (r *Rooms) Stats() hub.Stats {
+	merged := hub.Stats{Tracks: []hub.TrackStats{}, Receivers: []hub.ReceiverStats{}}
+	for name, b := range r.All() {
+		stats := b.Stats()
+		for _, track := range stats.Tracks {
+			track.Room = name
+			merged.Tracks = append(merged.Tracks, track)
+		}
+		for _, receiver := range stats.Receivers {
+			receiver.Room = name
+			merged.Receivers = append(merged.Receivers, receiver)
+		}
+	}
+	return merged
+}
+
+// Recordings lists the streams being recorded in every room
+func (r *Rooms) Recordings() []hub.RecordingInfo {
+	recordings := []hub.RecordingInfo{}
+	for name, b := range r.All() {
+		for _, info := range b.Recordings() {
+			info.Room = name
+			recordings = append(recordings, info)
+		}
+	}
+	return recordings
+}
+
+// Egresses lists the streams pushed out of every room
+func (r *Rooms) Egresses() []hub.EgressInfo {
+	egresses := []hub.EgressInfo{}
+	for name, b := range r.All() {
+		for _, info := range b.Egresses() {
+			info.Room = name
+			egresses = append(egresses, info)
+		}
+	}
+	return egresses
+}
+
+// StopEgress stops the egress id of whichever room runs it
+func (r *Rooms) StopEgress(id string) (hub.EgressInfo, error) {
+	for name, b := range r.All() {
+		info, err := b.StopEgress(id)
+		if err == nil {
+			info.Room = name
+			return info, nil
+		}
+		if !errors.Is(err, hub.ErrUnknownEgress) {
+			return info, err
+		}
+	}
+	return hub.EgressInfo{}, hub.ErrUnknownEgress
+}
+
+func (r *Rooms) RebalanceStats() map[string]hub.RebalanceStats {
+	stats := make(map[string]hub.RebalanceStats)
+	for name, b := range r.All() {
+		stats[name] = b.RebalanceStats()
+	}
+	return stats
+}
+
+func (r *Rooms) SessionDescriptors() []hub.SessionDescriptor {
+	descriptors := []hub.SessionDescriptor{}
+	for name, b := range r.All() {
+		for _, descriptor := range b.SessionDescriptors() {
+			descriptor.Room = name
+			descriptors = append(descriptors, descriptor)
+		}
+	}
+	return descriptors
+}
+
+// requestRoom resolves the room named by the room query parameter, creating
+// it when create is set, and writes the problem response when it cannot
+func requestRoom(w http.ResponseWriter, r *http.Request, rooms *Rooms, create bool) (*hub.Broadcaster, bool) {
+	name := r.URL.Query().Get("room")
+	if name == "" {
+		name = DefaultRoom
+	}
+	if !roomNamePattern.MatchString(name) {
+		writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Invalid room name")
+		return nil, false
+	}
+	if create {
+		return rooms.Get(name), true
+	}
+	b, ok := rooms.Lookup(name)
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown room")
+	}
+	return b, ok
+}
+
+// roomPath adds the room of the request to a resource path
+func roomPath(r *http.Request, path string, query url.Values) string {
+	if room := r.URL.Query().Get("room"); room != "" {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("room", room)
+	}
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"go.uber.org/zap"
+)
+
+// serveRTMP takes the streams of the RTMP encoders until ctx is done,
+// published with the stream key {streamID} to the default room and
+// {room}/{streamID} to the others, followed by ?token= and an API token
+// granting the publish scope
+func serveRTMP(ctx context.Context, config Config, rooms *Rooms, logger *zap.SugaredLogger) error {
+	server := hub.NewRTMPServer(ingestStream(rooms), authorizeScope(config.APITokens, ScopePublish), ffmpegAudioCodec{path: config.FFmpeg})
+	ln, err := net.Listen("tcp", config.RTMPAddr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Infow("Listening for RTMP", "addr", config.RTMPAddr)
+	return server.Serve(ln)
+}
+
+// ingestStream finds the stream published with the key {streamID} in the
+// default room or {room}/{streamID} in the others, creating the room
+func ingestStream(rooms *Rooms) func(key string) (*hub.Broadcaster, string, bool) {
+	return func(key string) (*hub.Broadcaster, string, bool) {
+		name, streamID, ok := splitStreamKey(key)
+		if !ok {
+			return nil, "", false
+		}
+		return rooms.Get(name), streamID, true
+	}
+}
+
+// splitStreamKey reads the room and stream of the key {streamID} or
+// {room}/{streamID}, false when it is invalid
+func splitStreamKey(key string) (string, string, bool) {
+	name, streamID := DefaultRoom, key
+	if slash := strings.Index(key, "/"); slash >= 0 {
+		name, streamID = key[:slash], key[slash+1:]
+	}
+	return name, streamID, streamID != "" && roomNamePattern.MatchString(name)
+}
+
+// ffmpegAudioCodec transcodes the audio of the ingests to Opus with an
+// ffmpeg process each, reading it back as Ogg
+type ffmpegAudioCodec struct {
+	path string
+}
+
+func (c ffmpegAudioCodec) NewAACTranscoder(output func(packet []byte)) (io.WriteCloser, error) {
+	t := &ffmpegAudioTranscoder{}
+	t.process = exec.Command(c.path, "-hide_banner", "-loglevel", "error", "-fflags", "nobuffer",
+		"-f", "aac", "-i", "pipe:0",
+		"-c:a", "libopus", "-b:a", "128k", "-ar", "48000", "-ac", "2", "-frame_duration", "20", "-application", "audio",
+		// A page per packet, written as soon as encoded
+		"-f", "ogg", "-page_duration", "20000", "-flush_packets", "1", "pipe:1")
+	if err := t.startProcess(func(stdout io.Reader) { readOggPackets(stdout, output) }); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ffmpegAudioTranscoder writes the input of the process
+type ffmpegAudioTranscoder struct {
+	ffmpegProcess
+}
+
+func (t *ffmpegAudioTranscoder) Write(p []byte) (int, error) {
+	return t.stdin.Write(p)
+}
+
+// readOggPackets calls output with the packets of an Ogg Opus stream, but
+// for its headers
+func readOggPackets(stream io.Reader, output func(packet []byte)) {
+	reader := bufio.NewReader(stream)
+	header := make([]byte, 27)
+	packet, packets := []byte{}, 0
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil || string(header[:4]) != "OggS" {
+			return
+		}
+		lacing := make([]byte, header[26])
+		if _, err := io.ReadFull(reader, lacing); err != nil {
+			return
+		}
+		for _, size := range lacing {
+			segment := make([]byte, size)
+			if _, err := io.ReadFull(reader, segment); err != nil {
+				return
+			}
+			// Segments of 255 bytes go on, possibly on the next page
+			if packet = append(packet, segment...); size == 255 {
+				continue
+			}
+			// OpusHead and OpusTags come first
+			if packets++; packets > 2 {
+				output(packet)
+			}
+			packet = []byte{}
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"go.uber.org/zap"
+)
+
+// serveRTPIngest takes the RTP streams described by description until ctx
+// is done, forwarded with the stream key {streamID} to the default room
+// and {room}/{streamID} to the others
+func serveRTPIngest(ctx context.Context, config Config, rooms *Rooms, key string, description []byte, logger *zap.SugaredLogger) error {
+	ingest, err := hub.NewRTPIngest(description, key, ingestStream(rooms), ffmpegAudioCodec{path: config.FFmpeg})
+	if err != nil {
+		return err
+	}
+	logger.Infow("Listening for RTP", "key", key, "addrs", ingest.Addresses())
+	return ingest.Serve(ctx)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"go.uber.org/zap"
+)
+
+// serveRTSP serves the streams to RTSP clients until ctx is done, at
+// rtsp://host:port/{streamID} for the default room and
+// rtsp://host:port/{room}/{streamID} for the others
+func serveRTSP(ctx context.Context, config Config, rooms *Rooms, logger *zap.SugaredLogger) error {
+	server := hub.NewRTSPServer(func(path string) (*hub.Broadcaster, string, bool) {
+		name, streamID := DefaultRoom, path
+		if slash := strings.Index(path, "/"); slash >= 0 {
+			name, streamID = path[:slash], path[slash+1:]
+		}
+		if streamID == "" || !roomNamePattern.MatchString(name) {
+			return nil, "", false
+		}
+		b, ok := rooms.Lookup(name)
+		return b, streamID, ok
+	})
+	ln, err := net.Listen("tcp", config.RTSPAddr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Infow("Listening for RTSP", "addr", config.RTSPAddr)
+	return server.Serve(ln)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"go.uber.org/zap"
+)
+
+// RTSPPuller plays an RTSP camera and forwards it with its stream key,
+// {streamID} in the default room or {room}/{streamID} in the others
+type RTSPPuller struct {
+	Key string
+	URL string
+
+	lookup     func(key string) (*hub.Broadcaster, string, bool)
+	transcoder hub.AudioTranscoder
+}
+
+func NewRTSPPuller(rooms *Rooms, key string, cameraURL string, transcoder hub.AudioTranscoder) *RTSPPuller {
+	return &RTSPPuller{
+		Key:        key,
+		URL:        cameraURL,
+		lookup:     ingestStream(rooms),
+		transcoder: transcoder,
+	}
+}
+
+// Run keeps pulling the camera, reconnecting with backoff, until ctx is done
+func (p *RTSPPuller) Run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := p.pull(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		zap.S().Warnw("RTSP pull ended", "key", p.Key, "url", hub.RedactRTSPURL(p.URL), "error", err, "retryIn", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// pull runs one RTSP session, it returns once the camera is lost
+func (p *RTSPPuller) pull(ctx context.Context) error {
+	// The room is looked up again on every attempt as it is reaped while
+	// the camera is away
+	broadcaster, streamID, ok := p.lookup(p.Key)
+	if !ok {
+		return errors.New("invalid stream key")
+	}
+	zap.S().Infow("Pulling RTSP camera", "key", p.Key, "url", hub.RedactRTSPURL(p.URL))
+	return broadcaster.PullRTSP(ctx, p.URL, streamID, p.transcoder)
+}
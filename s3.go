@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// unsignedPayload has the files streamed without hashing them first, the
+// request itself is still signed
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3Options locate a bucket of an S3 compatible object storage
+type s3Options struct {
+	// Endpoint is the base URL of the storage, e.g.
+	// https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Endpoint string
+	Bucket   string
+	Region   string
+	// Prefix is prepended to the key of every object
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket in the path rather than the host name
+	PathStyle bool
+}
+
+// s3Client uploads and deletes objects with requests signed with AWS
+// Signature Version 4
+type s3Client struct {
+	options  s3Options
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func newS3Client(options s3Options) (*s3Client, error) {
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("expected an http or https URL, got %q", options.Endpoint)
+	}
+	return &s3Client{options: options, endpoint: endpoint, client: &http.Client{}}, nil
+}
+
+// objectURL is the URL of the object of key
+func (c *s3Client) objectURL(key string) *url.URL {
+	u := *c.endpoint
+	base := u.Path
+	if c.options.PathStyle {
+		base = path.Join(base, c.options.Bucket)
+	} else {
+		u.Host = c.options.Bucket + "." + u.Host
+	}
+	objectPath := path.Join("/", base, c.options.Prefix+key)
+	u.Path, u.RawPath = objectPath, s3Escape(objectPath)
+	u.RawQuery, u.Fragment = "", ""
+	return &u
+}
+
+// putFile uploads the file at filePath as the object of key and returns
+// its URL
+func (c *s3Client) putFile(ctx context.Context, key string, filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	objectURL := c.objectURL(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL.String(), file)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = info.Size()
+	contentType := mime.TypeByExtension(filepath.Ext(filePath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("content-type", contentType)
+	if err := c.do(req); err != nil {
+		return "", err
+	}
+	return objectURL.String(), nil
+}
+
+// deleteObject removes the object of key, deleting a missing object
+// succeeds
+func (c *s3Client) deleteObject(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req)
+}
+
+func (c *s3Client) do(req *http.Request) error {
+	c.sign(req, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		// The error document names the cause, e.g. NoSuchBucket
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// sign adds the Signature Version 4 authorization of req, made at now
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", unsignedPayload)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + unsignedPayload,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	scope := day + "/" + c.options.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.options.SecretKey), day)
+	for _, part := range []string{c.options.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.options.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes a path the way the signature expects, every
+// byte but the unreserved characters and the slashes
+func s3Escape(p string) string {
+	var b strings.Builder
+	for _, c := range []byte(p) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
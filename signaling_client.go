@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"go.uber.org/zap"
+)
+
+// postOffer performs the WHIP/WHEP offer/answer exchange, it returns the
+// answer and the absolute URL of the created resource
+func postOffer(client *http.Client, endpoint string, token string, offer string) (string, string, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBufferString(offer))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("content-type", "application/sdp")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	answer, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", "", fmt.Errorf("unexpected response %s from %s", resp.Status, endpoint)
+	}
+	resource, err := resolveLocation(endpoint, resp.Header.Get("Location"))
+	if err != nil {
+		return "", "", err
+	}
+	return string(answer), resource, nil
+}
+
+// deleteResource ends a WHIP/WHEP session on the remote side
+func deleteResource(client *http.Client, resource string, token string) {
+	if resource == "" {
+		return
+	}
+	req, err := http.NewRequest(http.MethodDelete, resource, nil)
+	if err != nil {
+		zap.S().Error(err)
+		return
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		zap.S().Warnw("Unable to delete remote resource", "resource", resource, "error", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// resolveLocation makes a possibly relative Location header absolute
+func resolveLocation(base string, location string) (string, error) {
+	if location == "" {
+		return "", nil
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	locationURL, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return baseURL.ResolveReference(locationURL).String(), nil
+}
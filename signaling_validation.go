@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// maxSignalingMessageSize bounds the websocket messages of receivers,
+	// offers of a few dozen tracks fit
+	maxSignalingMessageSize = 64 * 1024
+	// maxCandidateLength bounds ICE candidate lines
+	maxCandidateLength = 1024
+	// maxSignalingIDLength bounds the stream and track IDs of the messages
+	maxSignalingIDLength = 256
+	// maxDeclaredCodecs bounds the codecs a receiver lists in its capabilities
+	maxDeclaredCodecs = 32
+	// maxInvalidMessages is how many rejected messages in a row end the session
+	maxInvalidMessages = 10
+)
+
+// The codes of the error events
+const (
+	signalingErrorInvalidMessage    = "invalid-message"
+	signalingErrorUnknownEvent      = "unknown-event"
+	signalingErrorNegotiationFailed = "negotiation-failed"
+)
+
+var errTooManyInvalidMessages = errors.New("too many invalid signaling messages")
+
+// signalingError is a receiver message that was rejected, it is reported
+// back in an error event and the session goes on
+type signalingError struct {
+	Event  string `json:"event"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+func (e *signalingError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Event, e.Code, e.Detail)
+}
+
+func invalidMessage(event string, detail string) error {
+	return &signalingError{Event: event, Code: signalingErrorInvalidMessage, Detail: detail}
+}
+
+func negotiationFailed(event string, err error) error {
+	return &signalingError{Event: event, Code: signalingErrorNegotiationFailed, Detail: err.Error()}
+}
+
+// validateMessageSize rejects the messages of signalers without a read limit
+func validateMessageSize(message hub.Message) error {
+	if len(message.Data) > maxSignalingMessageSize {
+		return invalidMessage(message.Event, "data too large")
+	}
+	return nil
+}
+
+// decodeData decodes the JSON document of message into v
+func decodeData(message hub.Message, v interface{}) error {
+	if err := json.Unmarshal([]byte(message.Data), v); err != nil {
+		return invalidMessage(message.Event, "data is not a valid JSON document for the event")
+	}
+	return nil
+}
+
+func validateCandidate(event string, candidate webrtc.ICECandidateInit) error {
+	if len(candidate.Candidate) > maxCandidateLength {
+		return invalidMessage(event, "candidate too long")
+	}
+	if candidate.SDPMid != nil && len(*candidate.SDPMid) > maxSignalingIDLength {
+		return invalidMessage(event, "sdpMid too long")
+	}
+	return nil
+}
+
+// validateDescription checks that description is an event of its type with
+// a parsable SDP
+func validateDescription(event string, description webrtc.SessionDescription) error {
+	if description.Type != webrtc.NewSDPType(event) {
+		return invalidMessage(event, fmt.Sprintf("type must be %s", event))
+	}
+	if description.SDP == "" {
+		return invalidMessage(event, "sdp is missing")
+	}
+	if _, err := description.Unmarshal(); err != nil {
+		return invalidMessage(event, "sdp is invalid")
+	}
+	return nil
+}
+
+// subscription is the data of subscribe events, a bare stream ID or a JSON
+// object also choosing the simulcast layer
+type subscription struct {
+	StreamID string `json:"streamID"`
+	// RID pins the simulcast layer, an empty one goes back to automatic
+	RID *string `json:"rid"`
+}
+
+func parseSubscription(message hub.Message) (subscription, error) {
+	request := subscription{StreamID: message.Data}
+	if strings.HasPrefix(message.Data, "{") {
+		request = subscription{}
+		if err := decodeData(message, &request); err != nil {
+			return request, err
+		}
+	}
+	if err := validateID(message.Event, "stream ID", request.StreamID); err != nil {
+		return request, err
+	}
+	if request.RID != nil && *request.RID != "" {
+		if err := validateID(message.Event, "rid", *request.RID); err != nil {
+			return request, err
+		}
+	}
+	return request, nil
+}
+
+// validateID checks the stream or track ID named name
+func validateID(event string, name string, id string) error {
+	if id == "" {
+		return invalidMessage(event, name+" is missing")
+	}
+	if len(id) > maxSignalingIDLength {
+		return invalidMessage(event, name+" too long")
+	}
+	for _, r := range id {
+		if !unicode.IsPrint(r) {
+			return invalidMessage(event, name+" contains unprintable characters")
+		}
+	}
+	return nil
+}
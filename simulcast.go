@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// simulcastRIDs returns the RIDs sent on each media section of the offer,
+// keyed by MID and in the order of the simulcast attribute
+func simulcastRIDs(offer string) map[string][]string {
+	rids := make(map[string][]string)
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer)); err != nil {
+		return rids
+	}
+	for _, media := range parsed.MediaDescriptions {
+		mid, _ := media.Attribute(sdp.AttrKeyMID)
+		value, ok := media.Attribute("simulcast")
+		if !ok {
+			continue
+		}
+		direction, streams, _ := strings.Cut(value, " ")
+		if direction != "send" {
+			continue
+		}
+		// Alternatives are separated by commas, paused streams start with ~
+		for _, stream := range strings.Split(streams, ";") {
+			for _, rid := range strings.Split(stream, ",") {
+				rids[mid] = append(rids[mid], strings.TrimPrefix(rid, "~"))
+			}
+		}
+	}
+	return rids
+}
+
+// simulcastLayer builds the layer metadata of a track received on the given
+// transceiver, ok is false when the track is not part of a simulcast
+func simulcastLayer(rids map[string][]string, transceiver *webrtc.RTPTransceiver, track *webrtc.TrackRemote) (hub.SimulcastLayer, bool) {
+	if track.RID() == "" {
+		return hub.SimulcastLayer{}, false
+	}
+	layer := hub.SimulcastLayer{TrackID: track.ID(), RID: track.RID()}
+	if transceiver != nil {
+		for i, rid := range rids[transceiver.Mid()] {
+			if rid == track.RID() {
+				layer.Index = i
+			}
+		}
+	}
+	return layer, true
+}
+
+// receiverTransceiver finds the transceiver owning receiver
+func receiverTransceiver(peer *webrtc.PeerConnection, receiver *webrtc.RTPReceiver) *webrtc.RTPTransceiver {
+	for _, transceiver := range peer.GetTransceivers() {
+		if transceiver.Receiver() == receiver {
+			return transceiver
+		}
+	}
+	return nil
+}
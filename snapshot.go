@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/go-chi/chi/v5"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// snapshotDecodeTimeout bounds the decoding of a keyframe by ffmpeg
+const snapshotDecodeTimeout = 5 * time.Second
+
+// snapshotQuality is the JPEG quality of the snapshots
+const snapshotQuality = 85
+
+// ffmpegDecoder decodes the keyframes with an ffmpeg process each, which
+// spares linking the video codec libraries
+type ffmpegDecoder struct {
+	path string
+}
+
+func (d ffmpegDecoder) DecodeKeyframe(mimeType string, frame []byte) (image.Image, error) {
+	format, input := "", frame
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		format = "h264"
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		format, input = "ivf", ivfFrame("VP80", frame)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		format, input = "ivf", ivfFrame("VP90", frame)
+	default:
+		return nil, fmt.Errorf("%s cannot be decoded", mimeType)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotDecodeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, d.path, "-hide_banner", "-loglevel", "error",
+		"-f", format, "-i", "pipe:0", "-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "pipe:1")
+	cmd.Stdin = bytes.NewReader(input)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return png.Decode(bytes.NewReader(output))
+}
+
+// ivfFrame wraps a single frame in an IVF file
+func ivfFrame(fourCC string, frame []byte) []byte {
+	return append(ivfFrameHeader(ivfHeader(fourCC), frame, 0), frame...)
+}
+
+// ivfHeader starts an IVF file of frames at 30 per second
+func ivfHeader(fourCC string) []byte {
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourCC)
+	// The size is read from the frames
+	binary.LittleEndian.PutUint32(header[16:], 30)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	binary.LittleEndian.PutUint32(header[24:], 1)
+	return header
+}
+
+// ivfFrameHeader appends the header of frame at pts to buf
+func ivfFrameHeader(buf []byte, frame []byte, pts uint64) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(frame)))
+	return binary.LittleEndian.AppendUint64(buf, pts)
+}
+
+// snapshotHandler serves the last keyframe of a stream of the room as a
+// JPEG, for the thumbnails of stream directories and dashboards
+func snapshotHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		snapshot, err := b.Snapshot(chi.URLParam(r, "streamID"))
+		switch {
+		case errors.Is(err, hub.ErrUnknownStream):
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Stream has no published track")
+			return
+		case errors.Is(err, hub.ErrNoKeyframe):
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Stream has no video keyframe yet")
+			return
+		case err != nil:
+			logger.Errorw("Unable to take a snapshot", "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, err.Error())
+			return
+		}
+		picture := &bytes.Buffer{}
+		if err := jpeg.Encode(picture, snapshot.Image, &jpeg.Options{Quality: snapshotQuality}); err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Last-Modified", snapshot.Received.UTC().Format(http.TimeFormat))
+		w.Write(picture.Bytes())
+	}
+}
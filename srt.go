@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"go.uber.org/zap"
+)
+
+// serveSRT takes the MPEG-TS streams of the SRT callers until ctx is done,
+// published with the streamid {streamID} to the default room and
+// {room}/{streamID} to the others, followed by ?token= and an API token
+// granting the publish scope
+func serveSRT(ctx context.Context, config Config, rooms *Rooms, logger *zap.SugaredLogger) error {
+	server := hub.NewSRTServer(ingestStream(rooms), authorizeScope(config.APITokens, ScopePublish), ffmpegAudioCodec{path: config.FFmpeg})
+	address, err := net.ResolveUDPAddr("udp", config.SRTAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", address)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Infow("Listening for SRT", "addr", config.SRTAddr)
+	return server.Serve(conn)
+}
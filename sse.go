@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+)
+
+// serveEventStream writes events as text/event-stream until the client goes
+// away, only events in filter are sent unless filter is empty.
+func serveEventStream(w http.ResponseWriter, r *http.Request, stream *hub.EventStream, filter map[string]bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Streaming unsupported")
+		return
+	}
+	events, unsubscribe := stream.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Add("content-type", "text/event-stream")
+	w.Header().Add("cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if len(filter) > 0 && !filter[ev.Event] {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\n", ev.Event)
+			for _, line := range strings.Split(ev.Data, "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprint(w, "\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+const (
+	// sseStreamTimeout is how long a signaling created with POST /events
+	// waits for its event stream to be opened
+	sseStreamTimeout = 30 * time.Second
+	// sseIncomingQueueSize is how many POSTed messages wait for the signaling
+	sseIncomingQueueSize = 16
+)
+
+// sseSignaler is a receiver signaling made of a server-sent events downlink
+// and of the messages the receiver POSTs, for the networks where websockets
+// do not get through. Every event is an unnamed one holding a JSON message,
+// as sent over the websocket.
+type sseSignaler struct {
+	id       string
+	room     *hub.Broadcaster
+	options  receiverOptions
+	incoming chan hub.Message
+	done     chan struct{}
+	closing  sync.Once
+
+	lock sync.Mutex
+	// w is the event stream, nil until it is opened and once it ended
+	w         io.Writer
+	flush     func()
+	streaming bool
+}
+
+func (s *sseSignaler) Send(ctx context.Context, message hub.Message) error {
+	raw, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.w == nil {
+		return hub.ErrSignalingClosed
+	}
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", raw); err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+func (s *sseSignaler) Receive(ctx context.Context) (hub.Message, error) {
+	select {
+	case message := <-s.incoming:
+		return message, nil
+	case <-s.done:
+		return hub.Message{}, io.EOF
+	case <-ctx.Done():
+		return hub.Message{}, ctx.Err()
+	}
+}
+
+func (s *sseSignaler) Close(code websocket.StatusCode, reason string) error {
+	s.closing.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+// deliver hands a POSTed message to the signaling
+func (s *sseSignaler) deliver(ctx context.Context, message hub.Message) error {
+	select {
+	case s.incoming <- message:
+		return nil
+	case <-s.done:
+		return hub.ErrSignalingClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// attach makes w the event stream, a signaling only streams once
+func (s *sseSignaler) attach(w io.Writer, flush func()) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.streaming {
+		return false
+	}
+	s.w, s.flush, s.streaming = w, flush, true
+	return true
+}
+
+// detach stops writing to the event stream, before its handler returns
+func (s *sseSignaler) detach() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.w = nil
+}
+
+// sseSignalers are the signalings created with POST /events, by ID
+type sseSignalers struct {
+	lock      sync.Mutex
+	signalers map[string]*sseSignaler
+}
+
+func newSSESignalers() *sseSignalers {
+	return &sseSignalers{signalers: make(map[string]*sseSignaler)}
+}
+
+// add registers a new signaling, it is dropped if its event stream is not
+// opened within sseStreamTimeout
+func (r *sseSignalers) add(b *hub.Broadcaster, options receiverOptions) *sseSignaler {
+	signaler := &sseSignaler{
+		id:       uuid.NewString(),
+		room:     b,
+		options:  options,
+		incoming: make(chan hub.Message, sseIncomingQueueSize),
+		done:     make(chan struct{}),
+	}
+	r.lock.Lock()
+	r.signalers[signaler.id] = signaler
+	r.lock.Unlock()
+	time.AfterFunc(sseStreamTimeout, func() {
+		signaler.lock.Lock()
+		streaming := signaler.streaming
+		signaler.lock.Unlock()
+		if !streaming {
+			r.remove(signaler)
+		}
+	})
+	return signaler
+}
+
+func (r *sseSignalers) get(id string) (*sseSignaler, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	signaler, ok := r.signalers[id]
+	return signaler, ok
+}
+
+// remove closes the signaling and forgets it
+func (r *sseSignalers) remove(signaler *sseSignaler) {
+	signaler.Close(websocket.StatusNormalClosure, "")
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.signalers[signaler.id] == signaler {
+		delete(r.signalers, signaler.id)
+	}
+}
+
+// sseCreateHandler creates a receiver signaling over server-sent events. It
+// takes the query parameters of the websocket and answers with the
+// Location of the event stream, where the messages are POSTed as well.
+func sseCreateHandler(rooms *Rooms, receivers receiverOptions, signalers *sseSignalers) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := requestRoom(w, r, rooms, true)
+		if !ok {
+			return
+		}
+		if b.Draining() {
+			b.ReconnectPolicy().WriteHeaders(w)
+			writeProblem(w, r, http.StatusServiceUnavailable, ProblemDraining, "Hub is draining")
+			return
+		}
+		options := receivers
+		if options.Preferences, ok = receiverPreferences(w, r); !ok {
+			return
+		}
+		options.ResumeToken = r.URL.Query().Get("resume")
+		signaler := signalers.add(b, options)
+		w.Header().Add("Location", absoluteURL(r, fmt.Sprintf("/events/%s", signaler.id)))
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// sseStreamHandler streams the signaling to the receiver until it ends
+func sseStreamHandler(signalers *sseSignalers) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		signaler, ok := signalers.get(chi.URLParam(r, "receiverID"))
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown signaling")
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Streaming unsupported")
+			return
+		}
+		w.Header().Add("content-type", "text/event-stream")
+		w.Header().Add("cache-control", "no-cache")
+		if !signaler.attach(w, flusher.Flush) {
+			writeProblem(w, r, http.StatusConflict, ProblemBadRequest, "The signaling is already streaming, create a new one to resume")
+			return
+		}
+		defer signalers.remove(signaler)
+		defer signaler.detach()
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		err := serveReceiver(r.Context(), signaler.room, signaler, signaler.options, logger)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
+			logger.Infow("SSE signaling ended", "error", err)
+		}
+	}
+}
+
+// ssePostHandler hands a message POSTed by the receiver to its signaling
+func ssePostHandler(signalers *sseSignalers) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		signaler, ok := signalers.get(chi.URLParam(r, "receiverID"))
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown signaling")
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			writeProblem(w, r, http.StatusUnsupportedMediaType, ProblemUnsupportedContentType, "Expected an application/json message")
+			return
+		}
+		message := hub.Message{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxSignalingMessageSize)).Decode(&message); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Expected a JSON signaling message")
+			return
+		}
+		if err := signaler.deliver(r.Context(), message); err != nil {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "The signaling ended")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// sseDeleteHandler ends the signaling, the receiver session stays
+// resumable like after a websocket drop
+func sseDeleteHandler(signalers *sseSignalers) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		signaler, ok := signalers.get(chi.URLParam(r, "receiverID"))
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown signaling")
+			return
+		}
+		signalers.remove(signaler)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// The test pattern loops every testPatternSeconds with a keyframe a second
+const (
+	testPatternSeconds   = 10
+	testPatternFrameRate = 30
+)
+
+// errTestSourceRunning is returned when a stream already plays the pattern
+var errTestSourceRunning = errors.New("test source already running")
+
+// TestSources publishes the test pattern, moving color bars with a counter
+// burnt in and a tone, as streams of the rooms. It is encoded with ffmpeg
+// on first use and looped.
+type TestSources struct {
+	ctx    context.Context
+	ffmpeg string
+
+	lock    sync.Mutex
+	pattern *hub.TestPattern
+	running map[testSourceKey]*testSource
+}
+
+// testSourceKey is a stream of a room
+type testSourceKey struct {
+	room     *hub.Broadcaster
+	streamID string
+}
+
+// testSource is a pattern being published
+type testSource struct {
+	cancel context.CancelFunc
+}
+
+// NewTestSources makes the test sources, they stop when ctx is done
+func NewTestSources(ctx context.Context, ffmpeg string) *TestSources {
+	return &TestSources{ctx: ctx, ffmpeg: ffmpeg, running: map[testSourceKey]*testSource{}}
+}
+
+// Start publishes the pattern as streamID of the room until it is stopped
+func (t *TestSources) Start(room *hub.Broadcaster, streamID string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := testSourceKey{room: room, streamID: streamID}
+	if _, ok := t.running[key]; ok {
+		return errTestSourceRunning
+	}
+	if t.pattern == nil {
+		pattern, err := encodeTestPattern(t.ffmpeg)
+		if err != nil {
+			return err
+		}
+		t.pattern = pattern
+	}
+	ctx, cancel := context.WithCancel(t.ctx)
+	source := &testSource{cancel: cancel}
+	t.running[key] = source
+	go func() {
+		defer cancel()
+		if err := room.PublishTestPattern(ctx, streamID, t.pattern); err != nil {
+			zap.S().Warnw("Test source failed", "streamID", streamID, "error", err)
+		}
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		// Unless stopped and started again meanwhile
+		if t.running[key] == source {
+			delete(t.running, key)
+		}
+	}()
+	return nil
+}
+
+// Stop ends the pattern published as streamID of the room, false when it
+// was not
+func (t *TestSources) Stop(room *hub.Broadcaster, streamID string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := testSourceKey{room: room, streamID: streamID}
+	source, ok := t.running[key]
+	if ok {
+		source.cancel()
+		delete(t.running, key)
+	}
+	return ok
+}
+
+// encodeTestPattern encodes the frames and the tone of the pattern
+func encodeTestPattern(ffmpeg string) (*hub.TestPattern, error) {
+	pattern := &hub.TestPattern{FrameRate: testPatternFrameRate}
+	video, err := runFFmpeg(ffmpeg, "-f", "lavfi", "-i", fmt.Sprintf("testsrc=size=640x360:rate=%d:duration=%d", testPatternFrameRate, testPatternSeconds),
+		"-c:v", "libvpx", "-b:v", "1M", "-deadline", "realtime", "-cpu-used", "8",
+		"-g", fmt.Sprint(testPatternFrameRate), "-keyint_min", fmt.Sprint(testPatternFrameRate), "-auto-alt-ref", "0",
+		"-f", "ivf", "pipe:1")
+	if err != nil {
+		return nil, err
+	}
+	// A header of 32 bytes, then the frames behind their size and pts
+	if len(video) < 32 || string(video[:4]) != "DKIF" {
+		return nil, errors.New("ffmpeg: invalid IVF output")
+	}
+	for video = video[32:]; len(video) >= 12; {
+		size := int(binary.LittleEndian.Uint32(video))
+		if 12+size > len(video) {
+			break
+		}
+		if size > 0 {
+			pattern.Frames = append(pattern.Frames, video[12:12+size])
+		}
+		video = video[12+size:]
+	}
+	// A whole number of periods a second, for the loop to be seamless
+	audio, err := runFFmpeg(ffmpeg, "-f", "lavfi", "-i", "sine=frequency=440:sample_rate=48000:duration=1",
+		"-c:a", "libopus", "-b:a", "64k", "-ac", "2", "-frame_duration", "20", "-application", "audio",
+		"-f", "ogg", "pipe:1")
+	if err != nil {
+		return nil, err
+	}
+	readOggPackets(bytes.NewReader(audio), func(packet []byte) {
+		pattern.Tone = append(pattern.Tone, packet)
+	})
+	if len(pattern.Frames) == 0 || len(pattern.Tone) == 0 {
+		return nil, errors.New("ffmpeg: empty test pattern")
+	}
+	return pattern, nil
+}
+
+// runFFmpeg runs ffmpeg with args and returns its output
+func runFFmpeg(ffmpeg string, args ...string) ([]byte, error) {
+	command := exec.Command(ffmpeg, append([]string{"-hide_banner", "-loglevel", "error"}, args...)...)
+	stderr := &bytes.Buffer{}
+	command.Stderr = stderr
+	output, err := command.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// startTestSourceHandler publishes the test pattern as a stream of the room
+func startTestSourceHandler(rooms *Rooms, sources *TestSources) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, true)
+		if !ok {
+			return
+		}
+		streamID := chi.URLParam(r, "streamID")
+		if err := sources.Start(b, streamID); err != nil {
+			if errors.Is(err, errTestSourceRunning) {
+				writeProblem(w, r, http.StatusConflict, ProblemConflict, "The stream already plays the test pattern")
+				return
+			}
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, err.Error())
+			return
+		}
+		logger.Infow("Test source started", "streamID", streamID)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// stopTestSourceHandler stops publishing the test pattern as a stream of
+// the room
+func stopTestSourceHandler(rooms *Rooms, sources *TestSources) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		streamID := chi.URLParam(r, "streamID")
+		if !sources.Stop(b, streamID) {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "The stream does not play the test pattern")
+			return
+		}
+		logger.Infow("Test source stopped", "streamID", streamID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/go-chi/chi/v5"
+)
+
+// thumbnailsHandler lists the thumbnails of the live streams of the room,
+// each served at /thumbnails/{streamID}/{sequence}.jpg. The pages of any
+// origin may load them.
+func thumbnailsHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		writeJSON(w, r, b.Thumbnails())
+	}
+}
+
+// thumbnailHandler serves a thumbnail of a stream of the room, latest.jpg
+// being the last one taken, renewed every interval
+func thumbnailHandler(rooms *Rooms, interval time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		file := chi.URLParam(r, "file")
+		if !strings.HasSuffix(file, ".jpg") {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Thumbnail not found")
+			return
+		}
+		sequence, latest := uint64(0), strings.TrimSuffix(file, ".jpg") == "latest"
+		if !latest {
+			var err error
+			if sequence, err = strconv.ParseUint(strings.TrimSuffix(file, ".jpg"), 10, 64); err != nil || sequence == 0 {
+				writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Thumbnail not found")
+				return
+			}
+		}
+		thumbnail, data, err := b.ThumbnailImage(chi.URLParam(r, "streamID"), sequence)
+		if errors.Is(err, hub.ErrThumbnailNotFound) {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Thumbnail not found")
+			return
+		} else if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		if latest {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(interval.Seconds())))
+		} else {
+			// The sequences start over when a stream is published again
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Header().Set("Last-Modified", thumbnail.Taken.Format(http.TimeFormat))
+		w.Write(data)
+	}
+}
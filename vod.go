@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// vodPackageTimeout bounds the repackaging of a recording by ffmpeg
+const vodPackageTimeout = 10 * time.Minute
+
+// vodSegmentDuration is the target duration of the HLS segments of the
+// recordings, cut on their keyframes
+const vodSegmentDuration = 6 * time.Second
+
+// vodHLSDir is the directory of a recording its HLS packaging is kept in,
+// removed along with the recording
+const vodHLSDir = "hls"
+
+// vodContentTypes are those of the recorded files and the HLS packaging,
+// the others are sniffed
+var vodContentTypes = map[string]string{
+	".ivf":  "video/x-ivf",
+	".ogg":  "audio/ogg",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mp4":  "video/mp4",
+	".m4s":  "video/iso.segment",
+}
+
+// vodFileHandler serves a file of a completed recording with range
+// requests, or redirects to its uploaded URL once offloaded. The players of
+// any origin may load it.
+func vodFileHandler(recordDir string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		recording, ok := requestCompletedRecording(w, r, recordDir)
+		if !ok {
+			return
+		}
+		name := chi.URLParam(r, "file")
+		for _, file := range recording.Files {
+			if file.Name != name {
+				continue
+			}
+			if recording.Offloaded {
+				http.Redirect(w, r, file.URL, http.StatusFound)
+				return
+			}
+			serveVODFile(w, r, filepath.Join(recording.Dir, name))
+			return
+		}
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown recording file")
+	}
+}
+
+// vodHLSHandler serves the HLS packaging of a completed recording, made by
+// packager on the first request for it
+func vodHLSHandler(recordDir string, packager *vodPackager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		recording, ok := requestCompletedRecording(w, r, recordDir)
+		if !ok {
+			return
+		}
+		if recording.Offloaded {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Recording files were offloaded to object storage")
+			return
+		}
+		name := chi.URLParam(r, "file")
+		if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown HLS file")
+			return
+		}
+		dir, err := packager.packageHLS(r.Context(), recording)
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		if err != nil {
+			logger.Warnw("Unable to package the recording as HLS", "id", recording.ID, "error", err)
+			writeProblem(w, r, http.StatusUnprocessableEntity, ProblemBadRequest, "Recording cannot be packaged as HLS, only H264, VP9 and Opus can: "+err.Error())
+			return
+		}
+		serveVODFile(w, r, filepath.Join(dir, name))
+	}
+}
+
+// requestCompletedRecording looks the recording of the request up in every
+// room, writing the problem when it fails
+func requestCompletedRecording(w http.ResponseWriter, r *http.Request, recordDir string) (hub.CompletedRecording, bool) {
+	recording, err := findCompletedRecording(recordDir, chi.URLParam(r, "recordingID"))
+	if errors.Is(err, hub.ErrUnknownRecording) {
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown recording")
+		return recording, false
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, err.Error())
+		return recording, false
+	}
+	return recording, true
+}
+
+func serveVODFile(w http.ResponseWriter, r *http.Request, fileName string) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown recording file")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown recording file")
+		return
+	}
+	if contentType, ok := vodContentTypes[filepath.Ext(fileName)]; ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// The recordings never change once completed
+	w.Header().Set("Cache-Control", "max-age=3600")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// vodPackager repackages the completed recordings as HLS with fMP4
+// segments with an ffmpeg process, copying the media, once per recording
+type vodPackager struct {
+	path            string
+	segmentDuration time.Duration
+
+	lock sync.Mutex
+	// packaging are the recordings being packaged by ID
+	packaging map[string]*vodPackaging
+}
+
+type vodPackaging struct {
+	done chan struct{}
+	err  error
+}
+
+func newVODPackager(path string, segmentDuration time.Duration) *vodPackager {
+	return &vodPackager{path: path, segmentDuration: segmentDuration, packaging: make(map[string]*vodPackaging)}
+}
+
+// packageHLS returns the directory of the HLS packaging of recording,
+// packaging it first unless it was before. The requests for a recording
+// being packaged wait for it until ctx is done.
+func (p *vodPackager) packageHLS(ctx context.Context, recording hub.CompletedRecording) (string, error) {
+	dir := filepath.Join(recording.Dir, vodHLSDir)
+	p.lock.Lock()
+	if _, err := os.Stat(filepath.Join(dir, "index.m3u8")); err == nil {
+		p.lock.Unlock()
+		return dir, nil
+	}
+	packaging, ok := p.packaging[recording.ID]
+	if !ok {
+		packaging = &vodPackaging{done: make(chan struct{})}
+		p.packaging[recording.ID] = packaging
+		go func() {
+			packaging.err = p.run(recording, dir)
+			p.lock.Lock()
+			delete(p.packaging, recording.ID)
+			p.lock.Unlock()
+			close(packaging.done)
+		}()
+	}
+	p.lock.Unlock()
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-packaging.done:
+		return dir, packaging.err
+	}
+}
+
+// run packages the files of recording into a temporary directory renamed
+// to dir once complete, for the players never to see half of it
+func (p *vodPackager) run(recording hub.CompletedRecording, dir string) error {
+	temporary := filepath.Join(recording.Dir, "."+vodHLSDir)
+	os.RemoveAll(temporary)
+	if err := os.Mkdir(temporary, 0o755); err != nil {
+		return err
+	}
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+	inputs := 0
+	for _, file := range recording.Files {
+		if _, ok := vodContentTypes[filepath.Ext(file.Name)]; !ok {
+			continue
+		}
+		args = append(args, "-i", filepath.Join(recording.Dir, file.Name))
+		inputs++
+	}
+	if inputs == 0 {
+		os.RemoveAll(temporary)
+		return errors.New("no media file")
+	}
+	for i := 0; i < inputs; i++ {
+		args = append(args, "-map", strconv.Itoa(i))
+	}
+	args = append(args, "-c", "copy", "-strict", "experimental",
+		"-f", "hls", "-hls_playlist_type", "vod",
+		"-hls_time", strconv.FormatFloat(p.segmentDuration.Seconds(), 'f', -1, 64),
+		"-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", "init.mp4",
+		"-hls_segment_filename", filepath.Join(temporary, "%d.m4s"),
+		filepath.Join(temporary, "index.m3u8"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), vodPackageTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, p.path, args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(temporary)
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.Rename(temporary, dir)
+}
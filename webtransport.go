@@ -0,0 +1,70 @@
+//go:build webtransport
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+// serveWebTransport serves the receiver signaling over HTTP/3 WebTransport
+// until ctx is done. Clients open one bidirectional stream on
+// /webtransport and exchange the websocket messages as newline delimited
+// JSON, free of TCP head-of-line blocking on lossy networks.
+func serveWebTransport(ctx context.Context, config Config, rooms *Rooms, receivers receiverOptions, logger *zap.SugaredLogger) error {
+	mux := http.NewServeMux()
+	server := &webtransport.Server{
+		H3: http3.Server{Addr: config.WebTransportAddr, Handler: mux},
+	}
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.With("remoteAddr", r.RemoteAddr, "transport", "webtransport")
+		r = r.WithContext(context.WithValue(r.Context(), LOGGER, logger))
+		b, ok := requestRoom(w, r, rooms, true)
+		if !ok {
+			return
+		}
+		options := receivers
+		if options.Preferences, ok = receiverPreferences(w, r); !ok {
+			return
+		}
+		options.ResumeToken = r.URL.Query().Get("resume")
+		session, err := server.Upgrade(w, r)
+		if err != nil {
+			logger.Errorw("Failed to upgrade", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		stream, err := session.AcceptStream(session.Context())
+		if err != nil {
+			logger.Errorw("No signaling stream opened", "error", err)
+			session.CloseWithError(0, "no signaling stream")
+			return
+		}
+		signaler := hub.NewStreamSignaler(stream, maxSignalingMessageSize)
+		if b.Draining() {
+			hub.SendReconnectHint(signaler, b.ReconnectPolicy(), "draining")
+			session.CloseWithError(webtransport.SessionErrorCode(websocket.StatusTryAgainLater), "Hub is draining")
+			return
+		}
+		err = serveReceiver(session.Context(), b, signaler, options, logger)
+		logger.Infow("WebTransport signaling ended", "error", err)
+		session.CloseWithError(0, "")
+	})
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Infow("Listening for WebTransport", "addr", config.WebTransportAddr)
+	err := server.ListenAndServeTLS(config.WebTransportCert, config.WebTransportKey)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !webtransport
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+)
+
+func serveWebTransport(ctx context.Context, config Config, rooms *Rooms, receivers receiverOptions, logger *zap.SugaredLogger) error {
+	return errors.New("built without WebTransport support, rebuild with -tags webtransport")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+const whepSSERel = "urn:ietf:params:whep:ext:core:server-sent-events"
+
+// whepEvents are the events a WHEP player can subscribe to through the
+// server-sent events extension
+var whepEvents = []string{"active", "inactive", "candidate", "end-of-candidates"}
+
+func whepHandler(rooms *Rooms, capabilities Capabilities) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		if r.Header.Get("content-type") != "application/sdp" {
+			writeProblem(w, r, http.StatusUnsupportedMediaType, ProblemUnsupportedContentType, "Offer must be sent as application/sdp")
+			return
+		}
+		b, ok := requestRoom(w, r, rooms, true)
+		if !ok {
+			return
+		}
+		if b.Draining() {
+			b.ReconnectPolicy().WriteHeaders(w)
+			writeProblem(w, r, http.StatusServiceUnavailable, ProblemDraining, "Hub is draining")
+			return
+		}
+		boffer, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Error(err)
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadSDP, "Unable to read offer")
+			return
+		}
+		if !offerHasSupportedCodec(string(boffer), capabilities.Codecs) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, ProblemUnsupportedCodec, "Offer contains no supported codec")
+			return
+		}
+		offer := webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  string(boffer),
+		}
+
+		api, err := hub.NewEgressAPI(b.CodecSet())
+		if err != nil {
+			logger.Error(err)
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Unable to create peer connection")
+			return
+		}
+		peer, err := api.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			logger.Error(err)
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Unable to create peer connection")
+			return
+		}
+		session := &hub.WHEPSession{
+			PeerConn: peer,
+			StreamID: r.URL.Query().Get("stream"),
+			Events:   hub.NewEventStream(64),
+		}
+
+		peer.OnICECandidate(func(i *webrtc.ICECandidate) {
+			if i == nil {
+				session.Events.Publish("end-of-candidates", "")
+				return
+			}
+			candidateString, err := json.Marshal(i.ToJSON())
+			if err != nil {
+				logger.Errorw("Unable to marshal to json", "error", err, "candidate", i)
+				return
+			}
+			session.Events.Publish("candidate", string(candidateString))
+		})
+
+		if err := peer.SetRemoteDescription(offer); err != nil {
+			logger.Error(err)
+			peer.Close()
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadSDP, err.Error())
+			return
+		}
+		if err := b.AttachWHEPTracks(session); err != nil {
+			logger.Error(err)
+			peer.Close()
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Unable to attach tracks")
+			return
+		}
+
+		gatherComplete := webrtc.GatheringCompletePromise(peer)
+		answer, err := peer.CreateAnswer(nil)
+		if err != nil {
+			logger.Error(err)
+			peer.Close()
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Unable to create answer")
+			return
+		}
+		if err := peer.SetLocalDescription(answer); err != nil {
+			logger.Error(err)
+			peer.Close()
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Unable to create answer")
+			return
+		}
+		// With server side trickle the candidates are pushed through the
+		// event stream, otherwise the answer must hold all of them
+		if !capabilities.ServerTrickle {
+			<-gatherComplete
+		}
+
+		peerID := b.AddWHEPSession(session)
+		peer.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
+			switch p {
+			case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+				if err := peer.Close(); err != nil {
+					logger.Errorw("Unable to close connection", "error", err)
+				}
+				b.DeleteWHEPSession(peerID)
+			}
+		})
+
+		w.Header().Add("content-type", "application/sdp")
+		w.Header().Add("Location", absoluteURL(r, roomPath(r, fmt.Sprintf("/whep/%s", peerID.String()), nil)))
+		w.Header().Add("Link", fmt.Sprintf(
+			"<%s>; rel=\"%s\"; events=\"%s\"",
+			absoluteURL(r, roomPath(r, fmt.Sprintf("/whep/%s/sse", peerID.String()), nil)), whepSSERel, strings.Join(whepEvents, ","),
+		))
+		capabilities.WriteHeaders(w)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(peer.LocalDescription().SDP))
+	}
+}
+
+func whepDeleteHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		peerID, err := uuid.Parse(chi.URLParam(r, "peerID"))
+		if err != nil {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown WHEP session")
+			return
+		}
+		session, ok := b.GetWHEPSession(peerID)
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown WHEP session")
+			return
+		}
+		if session.PeerConn.Close() != nil {
+			logger.Error("Unable to close peer connection")
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Error closing peer connection")
+			return
+		}
+		b.DeleteWHEPSession(peerID)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// whepSSESubscribeHandler handles the event list POSTed by the player, the
+// events are then streamed from the returned Location
+func whepSSESubscribeHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		peerID, err := uuid.Parse(chi.URLParam(r, "peerID"))
+		if err != nil {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown WHEP session")
+			return
+		}
+		if _, ok := b.GetWHEPSession(peerID); !ok {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown WHEP session")
+			return
+		}
+		events := []string{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&events); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, "Expected a JSON array of event names")
+			return
+		}
+		query := url.Values{}
+		for _, event := range events {
+			if !containsString(whepEvents, event) {
+				writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, fmt.Sprintf("Unsupported event %q", event))
+				return
+			}
+			query.Add("event", event)
+		}
+		w.Header().Add("Location", absoluteURL(r, roomPath(r, fmt.Sprintf("/whep/%s/sse", peerID.String()), query)))
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func whepSSEHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		peerID, err := uuid.Parse(chi.URLParam(r, "peerID"))
+		if err != nil {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown WHEP session")
+			return
+		}
+		session, ok := b.GetWHEPSession(peerID)
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown WHEP session")
+			return
+		}
+		filter := make(map[string]bool)
+		for _, event := range r.URL.Query()["event"] {
+			filter[event] = true
+		}
+		serveEventStream(w, r, session.Events, filter)
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
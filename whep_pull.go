@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// WHEPPuller subscribes to an upstream WHEP endpoint and publishes the
+// received tracks as local senders, for origin to edge fanout.
+type WHEPPuller struct {
+	URL   string
+	Token string
+
+	broadcaster *hub.Broadcaster
+	client      *http.Client
+}
+
+func NewWHEPPuller(b *hub.Broadcaster, whepURL string, token string) *WHEPPuller {
+	return &WHEPPuller{
+		URL:         whepURL,
+		Token:       token,
+		broadcaster: b,
+		client:      &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// Run keeps pulling the upstream stream, reconnecting with backoff, until ctx is done
+func (p *WHEPPuller) Run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := p.pull(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		zap.S().Warnw("WHEP pull ended", "url", p.URL, "error", err, "retryIn", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// pull runs one WHEP session, it returns once the connection is lost
+func (p *WHEPPuller) pull(ctx context.Context) error {
+	api, err := hub.NewIngestAPI(p.broadcaster.ReadBufferSize(), p.broadcaster.CodecSet())
+	if err != nil {
+		return err
+	}
+	peer, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := peer.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			return err
+		}
+	}
+
+	logger := zap.S().With("upstream", p.URL)
+	peer.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		logger.Infow("Pulling upstream track", "trackID", remoteTrack.ID(), "streamID", remoteTrack.StreamID())
+		// Keyframes are requested upstream when the receivers need them
+		p.broadcaster.AddRelayedSender(peer, remoteTrack)
+	})
+
+	ended := make(chan struct{})
+	peer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			select {
+			case <-ended:
+			default:
+				close(ended)
+			}
+		}
+	})
+
+	offer, err := peer.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(peer)
+	if err := peer.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gatherComplete
+
+	answer, resource, err := postOffer(p.client, p.URL, p.Token, peer.LocalDescription().SDP)
+	if err != nil {
+		return err
+	}
+	defer deleteResource(p.client, resource, p.Token)
+
+	if err := peer.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answer,
+	}); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ended:
+		return errors.New("upstream connection lost")
+	}
+}
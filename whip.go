@@ -1,28 +1,64 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"time"
 
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
-	"github.com/pion/rtcp"
-	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v4"
 	"go.uber.org/zap"
 )
 
-func whipHandler(b *Broadcaster) func(w http.ResponseWriter, r *http.Request) {
+// viewersRel links publishers to the endpoint counting their viewers
+const viewersRel = "urn:webrtc-hub:ext:viewers"
+
+// maxLabelLength bounds the label publishers pass in the query string
+const maxLabelLength = 128
+
+func whipHandler(rooms *Rooms, maxPublishers int, capabilities Capabilities, chat chatOptions) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
 		if r.Header.Get("content-type") != "application/sdp" {
-			http.Error(w, "Unsupported content type", http.StatusNotAcceptable)
+			writeProblem(w, r, http.StatusUnsupportedMediaType, ProblemUnsupportedContentType, "Offer must be sent as application/sdp")
+			return
+		}
+		b, ok := requestRoom(w, r, rooms, true)
+		if !ok {
+			return
+		}
+		if b.Draining() {
+			b.ReconnectPolicy().WriteHeaders(w)
+			writeProblem(w, r, http.StatusServiceUnavailable, ProblemDraining, "Hub is draining")
+			return
+		}
+		if maxPublishers > 0 && rooms.ActivePeerSenders() >= maxPublishers {
+			logger.Warnw("Maximum number of publishers reached", "max", maxPublishers)
+			b.ReconnectPolicy().WriteHeaders(w)
+			writeProblem(w, r, http.StatusServiceUnavailable, ProblemCapacity, "Too many publishers")
+			return
+		}
+		label := r.URL.Query().Get("label")
+		if len(label) > maxLabelLength {
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadRequest, fmt.Sprintf("label must be at most %d bytes", maxLabelLength))
+			return
+		}
+		boffer, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSignalingMessageSize))
+		if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, ProblemBadSDP, fmt.Sprintf("Offer must be at most %d bytes", maxSignalingMessageSize))
 			return
 		}
-		boffer, err := io.ReadAll(r.Body)
 		if err != nil {
 			logger.Error(err)
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadSDP, "Unable to read offer")
+			return
+		}
+		if !offerHasSupportedCodec(string(boffer), capabilities.Codecs) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, ProblemUnsupportedCodec, "Offer contains no supported codec")
 			return
 		}
 		offer := webrtc.SessionDescription{
@@ -30,84 +66,134 @@ func whipHandler(b *Broadcaster) func(w http.ResponseWriter, r *http.Request) {
 			SDP:  string(boffer),
 		}
 
-		peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		api, err := hub.NewIngestAPI(b.ReadBufferSize(), b.CodecSet())
 		if err != nil {
 			logger.Error(err)
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Unable to create peer connection")
+			return
+		}
+		peer, err := api.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			logger.Error(err)
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Unable to create peer connection")
+			return
 		}
 
 		if _, err = peer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
 			logger.Error(err)
 		}
 
+		// Registered first so that the publisher owns its tracks from the start
+		senderState := hub.PeerSenderState{
+			PeerConn: peer,
+			ETag:     uuid.NewString(),
+			Created:  time.Now(),
+			Label:    label,
+		}
+		peerID := b.AddPeerSender(senderState)
+
+		// Publishers opening a chat data channel take part in the room chat
+		peer.OnDataChannel(func(channel *webrtc.DataChannel) {
+			if channel.Label() == "chat" {
+				chat.onPublisherChat(b, peerID, channel, logger)
+			}
+		})
+
+		rids := simulcastRIDs(offer.SDP)
+		// Keyframes are requested when the receivers ask for them
 		peer.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-			// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-			// This can be less wasteful by processing incoming RTCP events, then we would emit a NACK/PLI when a viewer requests it
-			go func() {
-				ticker := time.NewTicker(3 * time.Second)
-				for range ticker.C {
-					if rtcpSendErr := peer.WriteRTCP(
-						[]rtcp.Packet{
-							&rtcp.PictureLossIndication{
-								MediaSSRC: uint32(remoteTrack.SSRC()),
-							}},
-					); rtcpSendErr != nil {
-						logger.Info(rtcpSendErr)
-						return
-					}
-				}
-			}()
-
-			b.AddSender(remoteTrack)
+			if layer, ok := simulcastLayer(rids, receiverTransceiver(peer, receiver), remoteTrack); ok {
+				logger.Infow("Simulcast layer received", "trackID", remoteTrack.ID(), "rid", layer.RID, "index", layer.Index)
+				b.AddSimulcastSender(peerID, remoteTrack, layer)
+				return
+			}
+			b.AddSender(peerID, remoteTrack)
 		})
 		// Set the remote SessionDescription
 		err = peer.SetRemoteDescription(offer)
 		if err != nil {
-			panic(err)
+			logger.Error(err)
+			peer.Close()
+			b.DeletePeerSender(peerID)
+			writeProblem(w, r, http.StatusBadRequest, ProblemBadSDP, err.Error())
+			return
 		}
 		gatherComplete := webrtc.GatheringCompletePromise(peer)
 
 		// Create answer
 		answer, err := peer.CreateAnswer(nil)
 		if err != nil {
-			panic(err)
+			logger.Error(err)
+			peer.Close()
+			b.DeletePeerSender(peerID)
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Unable to create answer")
+			return
 		}
 
 		if err := peer.SetLocalDescription(answer); err != nil {
-			panic(err)
+			logger.Error(err)
+			peer.Close()
+			b.DeletePeerSender(peerID)
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Unable to set local description")
+			return
 		}
 
 		<-gatherComplete
 
-		senderState := PeerSenderState{
-			PeerConn: peer,
-			ETag:     uuid.NewString(),
-		}
-		peerID := b.AddPeerSender(senderState)
 		w.Header().Add("content-type", "application/sdp")
-		w.Header().Add("Location", fmt.Sprintf("/whip/%s", peerID.String()))
+		w.Header().Add("Location", absoluteURL(r, roomPath(r, fmt.Sprintf("/whip/%s", peerID.String()), nil)))
+		viewersURL := absoluteURL(r, roomPath(r, fmt.Sprintf("/whip/%s/viewers", peerID.String()), nil))
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"%s\"", viewersURL, viewersRel))
 		w.Header().Add("ETag", fmt.Sprintf("\"%s\"", senderState.ETag))
 		w.Header().Add("Accept-Patch", "application/trickle-ice-sdpfrag")
+		capabilities.WriteHeaders(w)
 		w.WriteHeader(http.StatusCreated)
 		w.Write([]byte(peer.LocalDescription().SDP))
 	}
 }
 
-func whipDeleteHandler(b *Broadcaster) func(w http.ResponseWriter, r *http.Request) {
+// whipViewersHandler lets a publisher poll how many receivers get its tracks
+func whipViewersHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
+		peerID, err := uuid.Parse(chi.URLParam(r, "peerID"))
+		if err != nil {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown WHIP session")
+			return
+		}
+		viewers, ok := b.PublisherViewers(peerID)
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown WHIP session")
+			return
+		}
+		w.Header().Set("cache-control", "no-cache")
+		writeJSON(w, r, viewers)
+	}
+}
+
+func whipDeleteHandler(rooms *Rooms) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := r.Context().Value(LOGGER).(*zap.SugaredLogger)
+		b, ok := requestRoom(w, r, rooms, false)
+		if !ok {
+			return
+		}
 		peerID, err := uuid.Parse(chi.URLParam(r, "peerID"))
 		if err != nil {
-			http.Error(w, "Not Found", http.StatusNotFound)
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown WHIP session")
 			return
 		}
 		peer, ok := b.GetPeerSender(peerID)
 		if !ok {
-			http.Error(w, "Not Found", http.StatusNotFound)
+			writeProblem(w, r, http.StatusNotFound, ProblemNotFound, "Unknown WHIP session")
 			return
 		}
 		if peer.PeerConn.Close() != nil {
 			logger.Error("Unable to close peer connection")
-			http.Error(w, "Error closing peer connection", http.StatusInternalServerError)
+			writeProblem(w, r, http.StatusInternalServerError, ProblemInternal, "Error closing peer connection")
 			return
 		}
 		b.DeletePeerSender(peerID)
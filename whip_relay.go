@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/diconico07/webrtc-hub-example/pkg/hub"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// WHIPRelay publishes local streams to a remote WHIP endpoint, turning the
+// hub into an aggregator in front of a cloud SFU or CDN ingest. Each stream
+// gets its own WHIP session, republished whenever its track set changes.
+type WHIPRelay struct {
+	URL   string
+	Token string
+	// Streams to relay, every stream is relayed when empty
+	Streams stringListFlag
+
+	broadcaster *hub.Broadcaster
+	client      *http.Client
+	sessions    map[string]*whipRelaySession
+}
+
+type whipRelaySession struct {
+	peer     *webrtc.PeerConnection
+	resource string
+	tracks   map[webrtc.TrackLocal]bool
+}
+
+func NewWHIPRelay(b *hub.Broadcaster, whipURL string, token string, streams stringListFlag) *WHIPRelay {
+	return &WHIPRelay{
+		URL:         whipURL,
+		Token:       token,
+		Streams:     streams,
+		broadcaster: b,
+		client:      &http.Client{Timeout: 15 * time.Second},
+		sessions:    make(map[string]*whipRelaySession),
+	}
+}
+
+// Run keeps the remote sessions in sync with the local streams until ctx is done
+func (p *WHIPRelay) Run(ctx context.Context) {
+	changes := p.broadcaster.WatchTracks()
+	// Periodic pass to retry failed publications
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		p.reconcile()
+		select {
+		case <-ctx.Done():
+			for streamID := range p.sessions {
+				p.stop(streamID)
+			}
+			return
+		case <-changes:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *WHIPRelay) reconcile() {
+	streams := p.broadcaster.Streams()
+	for streamID, session := range p.sessions {
+		tracks, ok := streams[streamID]
+		if !ok || !sameTracks(session.tracks, tracks) || session.failed() {
+			p.stop(streamID)
+		}
+	}
+	for streamID, tracks := range streams {
+		if len(p.Streams) > 0 && !p.Streams.Contains(streamID) {
+			continue
+		}
+		if _, ok := p.sessions[streamID]; ok {
+			continue
+		}
+		session, err := p.publish(tracks)
+		if err != nil {
+			zap.S().Warnw("Unable to relay stream over WHIP", "streamID", streamID, "url", p.URL, "error", err)
+			continue
+		}
+		zap.S().Infow("Relaying stream over WHIP", "streamID", streamID, "resource", session.resource)
+		p.sessions[streamID] = session
+	}
+}
+
+func (p *WHIPRelay) publish(tracks []webrtc.TrackLocal) (*whipRelaySession, error) {
+	api, err := hub.NewEgressAPI(p.broadcaster.CodecSet())
+	if err != nil {
+		return nil, err
+	}
+	peer, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	session := &whipRelaySession{
+		peer:   peer,
+		tracks: make(map[webrtc.TrackLocal]bool),
+	}
+	for _, track := range tracks {
+		sender, err := peer.AddTrack(track)
+		if err != nil {
+			peer.Close()
+			return nil, err
+		}
+		session.tracks[track] = true
+		go hub.DrainRTCP(sender)
+	}
+
+	offer, err := peer.CreateOffer(nil)
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(peer)
+	if err := peer.SetLocalDescription(offer); err != nil {
+		peer.Close()
+		return nil, err
+	}
+	<-gatherComplete
+
+	answer, resource, err := postOffer(p.client, p.URL, p.Token, peer.LocalDescription().SDP)
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+	session.resource = resource
+
+	if err := peer.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answer,
+	}); err != nil {
+		session.close(p.client, p.Token)
+		return nil, err
+	}
+	return session, nil
+}
+
+func (p *WHIPRelay) stop(streamID string) {
+	session, ok := p.sessions[streamID]
+	if !ok {
+		return
+	}
+	zap.S().Infow("Stopping WHIP relay", "streamID", streamID, "resource", session.resource)
+	session.close(p.client, p.Token)
+	delete(p.sessions, streamID)
+}
+
+func (s *whipRelaySession) failed() bool {
+	switch s.peer.ConnectionState() {
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		return true
+	}
+	return false
+}
+
+// close tears down the connection and releases the remote WHIP resource
+func (s *whipRelaySession) close(client *http.Client, token string) {
+	if err := s.peer.Close(); err != nil {
+		zap.S().Errorw("Unable to close relay connection", "error", err)
+	}
+	deleteResource(client, s.resource, token)
+}
+
+func sameTracks(current map[webrtc.TrackLocal]bool, tracks []webrtc.TrackLocal) bool {
+	if len(current) != len(tracks) {
+		return false
+	}
+	for _, track := range tracks {
+		if !current[track] {
+			return false
+		}
+	}
+	return true
+}